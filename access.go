@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+)
+
+// accessRule is a requirement attached to a route with protect, so that
+// handlers don't each repeat their own sign-in, ownership or admin checks.
+type accessRule int
+
+const (
+	// loginRequired sends signed-out visitors back to the top page.
+	loginRequired accessRule = iota + 1
+	// ownerRequired answers 404 unless the signed-in user owns the memo
+	// named by the route's {memo_id}, so other users' memos don't leak.
+	ownerRequired
+	// adminRequired checks the admin token; see requireAdmin.
+	adminRequired
+	// adminForm answers 404 while no admin token is configured, like the
+	// admin endpoints, but needs no token: it is for the pages with the
+	// forms that ask for it, which a browser can't send in a header.
+	adminForm
+)
+
+// csrfPolicy says which requests to a route antiCSRF checks for the
+// session's token.
+type csrfPolicy int
+
+const (
+	// csrfStrict checks every request. It is the policy of the routes
+	// that don't set one, which are all the browser forms.
+	csrfStrict csrfPolicy = iota
+	// csrfBearerExempt skips requests authenticated by a bearer token.
+	// Browsers attach the session cookie to cross-site requests but never
+	// an Authorization header, which a cross-site page can only send
+	// after a CORS preflight this app doesn't answer, so such a request
+	// can't be forged. Requests to the route that carry the cookie are
+	// still checked.
+	csrfBearerExempt
+)
+
+// withCSRFPolicy sets the CSRF policy of the route h serves.
+func withCSRFPolicy(policy csrfPolicy, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, info := ensureRequestInfo(r)
+		info.csrf = policy
+		h(w, r)
+	}
+}
+
+// csrfExempt reports whether the route's policy lets r through without
+// the session's token.
+func csrfExempt(r *http.Request) bool {
+	info := requestInfoFrom(r.Context())
+	return info != nil && info.csrf == csrfBearerExempt && info.bearer
+}
+
+// protect wraps h so that it only runs when rule is satisfied.
+func protect(rule accessRule, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rule == adminRequired {
+			if requireAdmin(w, r) {
+				h(w, r)
+			}
+			return
+		}
+		if rule == adminForm {
+			if config.AdminToken == "" {
+				handleError(w, r, notFoundError(""))
+				return
+			}
+			h(w, r)
+			return
+		}
+
+		session, err := loadSession(w, r)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		user := getUser(w, r, session)
+		switch rule {
+		case loginRequired:
+			if user == nil {
+				http.Redirect(w, r, "/", http.StatusFound)
+				return
+			}
+		case ownerRequired:
+			if _, err := ownMemo(r, user); err != nil {
+				handleError(w, r, err)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"./sessions"
+	"github.com/gorilla/mux"
+)
+
+func TestProtect(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{AdminToken: "secret"}
+	userCache.Put(&User{Id: 1, Username: "owner"})
+	userCache.Put(&User{Id: 2, Username: "other"})
+	memoCache.Put(&Memo{Id: 10, User: 1})
+	defer func() {
+		userCache.Remove(1)
+		userCache.Remove(2)
+		memoCache.Delete(10)
+	}()
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/mypage", protect(loginRequired, ok))
+	router.HandleFunc("/memo/{memo_id:[0-9]+}/edit", protect(ownerRequired, ok))
+	router.HandleFunc("/admin/jobs", protect(adminRequired, ok))
+
+	tests := []struct {
+		name   string
+		path   string
+		userId int
+		token  string
+		want   int
+	}{
+		{"login/anonymous", "/mypage", 0, "", http.StatusFound},
+		{"login/signed in", "/mypage", 2, "", http.StatusOK},
+		{"owner/anonymous", "/memo/10/edit", 0, "", http.StatusNotFound},
+		{"owner/other user", "/memo/10/edit", 2, "", http.StatusNotFound},
+		{"owner/owner", "/memo/10/edit", 1, "", http.StatusOK},
+		{"owner/missing memo", "/memo/11/edit", 1, "", http.StatusNotFound},
+		{"admin/no token", "/admin/jobs", 1, "", http.StatusForbidden},
+		{"admin/wrong token", "/admin/jobs", 0, "guess", http.StatusForbidden},
+		{"admin/token", "/admin/jobs", 0, "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		session := sessions.NewSession(nil, sessionName)
+		if tt.userId != 0 {
+			session.Values["user_id"] = tt.userId
+		}
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("X-Admin-Token", tt.token)
+		}
+		r = withRequestInfo(r, &requestInfo{session: session})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	config.AdminToken = ""
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/jobs", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("admin without a configured token: status = %d, want 404", w.Code)
+	}
+}
+
+// TestAdminTokenSources checks that the admin token is taken from the
+// headers and POST bodies but never from the query string.
+func TestAdminTokenSources(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{AdminToken: "secret"}
+	h := protect(adminRequired, func(w http.ResponseWriter, r *http.Request) {})
+
+	post := func(target, body string) *http.Request {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+	bearer := httptest.NewRequest("GET", "/metrics", nil)
+	bearer.Header.Set("Authorization", "Bearer secret")
+	for name, c := range map[string]struct {
+		r    *http.Request
+		want int
+	}{
+		"query":      {httptest.NewRequest("GET", "/admin/stats?admin_token=secret", nil), http.StatusForbidden},
+		"post query": {post("/admin/banner?admin_token=secret", "message=hi"), http.StatusForbidden},
+		"post body":  {post("/admin/banner", "admin_token=secret&message=hi"), http.StatusOK},
+		"bearer":     {bearer, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		h(w, c.r)
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, c.want)
+		}
+	}
+}
+
+// TestAdminForms checks that the admin form pages ask for the token
+// instead of needing it, never echo it, and are hidden without one.
+func TestAdminForms(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 2, Users: 2, Memos: 1})
+	get := func(path string) (int, string) {
+		res, err := http.Get(app.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	for _, path := range []string{"/admin/banner", "/admin/impersonate?username=user2"} {
+		config.AdminToken = ""
+		if code, _ := get(path); code != http.StatusNotFound {
+			t.Errorf("%s without a token configured: %d, want 404", path, code)
+		}
+		config.AdminToken = "form-secret"
+		code, body := get(path)
+		if code != http.StatusOK || !strings.Contains(body, `<input type="password" name="admin_token"`) {
+			t.Errorf("%s: %d without a token field", path, code)
+		}
+		if strings.Contains(body, "form-secret") {
+			t.Errorf("%s echoes the admin token", path)
+		}
+	}
+
+	res, err := http.PostForm(app.URL+"/admin/banner", url.Values{"admin_token": {"form-secret"}, "message": {"maintenance"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), `value="maintenance"`) || strings.Contains(string(body), "form-secret") {
+		t.Errorf("banner post: %d\n%s", res.StatusCode, body)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ConsistencyReport struct {
+	CheckedAt   string `json:"checked_at"`
+	Users       int    `json:"users"`
+	Memos       int    `json:"memos"`
+	OrphanMemos []int  `json:"orphan_memos"`
+}
+
+type ResetStatus struct {
+	State      string `json:"state"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	Users      int    `json:"users"`
+	Memos      int    `json:"memos"`
+	Error      string `json:"error,omitempty"`
+}
+
+var (
+	resetMutex  sync.Mutex
+	resetStatus = ResetStatus{State: "idle"}
+)
+
+// requireAdmin reports whether the request carries the configured admin
+// token. Admin endpoints are hidden entirely when no token is configured.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if config.AdminToken == "" {
+		handleError(w, r, notFoundError(""))
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(adminToken(r)), []byte(config.AdminToken)) != 1 {
+		handleError(w, r, forbiddenError(""))
+		return false
+	}
+	return true
+}
+
+// adminToken takes the token from the X-Admin-Token header, an
+// Authorization bearer header, as Prometheus sends it, or the form body
+// of a POST. Never from the query string, which ends up in access logs,
+// browser history and Referer headers.
+func adminToken(r *http.Request) string {
+	if token := r.Header.Get("X-Admin-Token"); token != "" {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.PostFormValue("admin_token")
+}
+
+func checkConsistency() *ConsistencyReport {
+	report := &ConsistencyReport{
+		CheckedAt:   time.Now().Format(time.RFC3339),
+		Users:       userCache.Len(),
+		OrphanMemos: make([]int, 0),
+	}
+	memoCache.Each(func(memo *Memo) {
+		report.Memos++
+		if _, ok := userCache.Get(memo.User); !ok {
+			report.OrphanMemos = append(report.OrphanMemos, memo.Id)
+		}
+	})
+	sort.Ints(report.OrphanMemos)
+	return report
+}
+
+func consistencyHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, checkConsistency())
+}
+
+func currentResetStatus() ResetStatus {
+	resetMutex.Lock()
+	defer resetMutex.Unlock()
+	return resetStatus
+}
+
+// startReset reloads the caches in the background. The new data is built
+// off to the side and swapped in, so requests keep being served from the
+// old caches meanwhile. It returns false if a reset is already running.
+func startReset() bool {
+	resetMutex.Lock()
+	defer resetMutex.Unlock()
+	if resetStatus.State == "running" {
+		return false
+	}
+	resetStatus = ResetStatus{
+		State:     "running",
+		StartedAt: time.Now().Format(time.RFC3339),
+	}
+	go func() {
+		dbConn := <-dbConnPool
+		err := initialize(dbConn)
+		dbConnPool <- dbConn
+
+		resetMutex.Lock()
+		defer resetMutex.Unlock()
+		resetStatus.FinishedAt = time.Now().Format(time.RFC3339)
+		resetStatus.Users = userCache.Len()
+		resetStatus.Memos = memoCache.Len()
+		if err != nil {
+			resetStatus.State = "failed"
+			resetStatus.Error = err.Error()
+		} else {
+			resetStatus.State = "done"
+		}
+	}()
+	return true
+}
+
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusAccepted
+	if !startReset() {
+		code = http.StatusConflict
+	}
+	writeJSON(w, code, currentResetStatus())
+}
+
+func resetStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentResetStatus())
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentRuntimeConfig())
+}
+
+func configReloadHandler(w http.ResponseWriter, r *http.Request) {
+	changes, err := reloadConfig("admin " + r.RemoteAddr)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"changes": changes})
+}
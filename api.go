@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiMemo adds the memo's view count, which changes too often to live in
+// the cached Memo.
+type apiMemo struct {
+	*Memo
+	Visitors int `json:"unique_visitors"`
+	// Hidden and ModerationNote are only filled in for the author.
+	Hidden         bool   `json:"hidden,omitempty"`
+	ModerationNote string `json:"moderation_note,omitempty"`
+}
+
+type apiMemoList struct {
+	Page       int    `json:"page,omitempty"`
+	Total      int    `json:"total"`
+	Memos      Memos  `json:"memos"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// encodeCursor makes the opaque token for resuming a list after memo.
+// Lists are ordered by (created_at, id), so the pair pins the position
+// even while newer memos are being inserted at the head.
+func encodeCursor(memo *Memo) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(memo.CreatedAt.Format(time.RFC3339) + "|" + strconv.Itoa(memo.Id)))
+}
+
+// decodeCursor also accepts cursors holding the DATETIME string, as they
+// were issued before created_at was parsed.
+func decodeCursor(cursor string) (createdAt time.Time, id int, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, &AppError{Kind: KindValidation, Message: "invalid cursor", Err: err}
+	}
+	i := strings.LastIndex(string(b), "|")
+	if i < 0 {
+		return time.Time{}, 0, validationError("invalid cursor")
+	}
+	if id, err = strconv.Atoi(string(b[i+1:])); err != nil {
+		return time.Time{}, 0, &AppError{Kind: KindValidation, Message: "invalid cursor", Err: err}
+	}
+	if createdAt, err = time.Parse(time.RFC3339, string(b[:i])); err != nil {
+		if createdAt, err = parseDBTime(string(b[:i])); err != nil {
+			return time.Time{}, 0, &AppError{Kind: KindValidation, Message: "invalid cursor", Err: err}
+		}
+	}
+	return createdAt, id, nil
+}
+
+// nextCursor returns the cursor after the last of memos, or "" when the
+// page was not full and so there is nothing after it.
+func nextCursor(memos Memos) string {
+	if len(memos) < memosPerPage {
+		return ""
+	}
+	return encodeCursor(memos[len(memos)-1])
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("error: %s", err)
+		b = []byte(`{"error": "Internal Server Error"}`)
+		code = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func apiMemoHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	memoId, _ := strconv.Atoi(mux.Vars(r)["memo_id"])
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+
+	memo, err := findMemo(user, memoId)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	visitors := memoVisitors.Count(memo.Id)
+	if checkETag(w, r, versionETag("memo", memo.Id, memo.UpdatedAt, memo.Version, visitors)) {
+		return
+	}
+	v := &apiMemo{Memo: memo, Visitors: visitors}
+	if user != nil && user.Id == memo.User {
+		v.Hidden, v.ModerationNote = memo.Hidden, memo.ModerationNote
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// apiNeighbor is enough of a memo to link to it.
+type apiNeighbor struct {
+	Id    int    `json:"id"`
+	Title string `json:"title"`
+	Path  string `json:"path"`
+}
+
+type apiNeighbors struct {
+	Older *apiNeighbor `json:"older"`
+	Newer *apiNeighbor `json:"newer"`
+}
+
+func newAPINeighbor(memo *Memo) *apiNeighbor {
+	if memo == nil {
+		return nil
+	}
+	return &apiNeighbor{Id: memo.Id, Title: memo.Title, Path: memo.Path()}
+}
+
+// apiNeighborsHandler returns the memos the memo page links to as older
+// and newer, for moving between them without loading whole pages.
+func apiNeighborsHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	memoId, _ := strconv.Atoi(mux.Vars(r)["memo_id"])
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+
+	memo, err := findMemo(user, memoId)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	older, newer := findNeighbors(user, memo)
+	v := &apiNeighbors{Older: newAPINeighbor(older), Newer: newAPINeighbor(newer)}
+	if checkETag(w, r, versionETag("neighbors", v.Older, v.Newer)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func apiRecentHandler(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(mux.Vars(r)["page"])
+	if !validPage(page) {
+		handleError(w, r, notFoundError(""))
+		return
+	}
+	if checkETag(w, r, versionETag("recent", etagSeed, listFragments.Generation(), page)) {
+		return
+	}
+	memos, totalCount := listedPage(page)
+	shadowListedPage(page)
+	writeJSON(w, http.StatusOK, &apiMemoList{Page: page, Total: totalCount, Memos: nonNil(memos), NextCursor: nextCursor(memos)})
+}
+
+// apiMemosHandler lists public memos newest first, resuming after the
+// optional cursor from a previous response's next_cursor.
+func apiMemosHandler(w http.ResponseWriter, r *http.Request) {
+	if checkETag(w, r, versionETag("memos", etagSeed, listFragments.Generation(), r.FormValue("cursor"))) {
+		return
+	}
+	memos, totalCount := listedPage(0)
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		createdAt, id, err := decodeCursor(cursor)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		memos = listedBefore(createdAt, id)
+		shadowListedBefore(createdAt, id)
+	} else {
+		shadowListedPage(0)
+	}
+	writeJSON(w, http.StatusOK, &apiMemoList{Total: totalCount, Memos: nonNil(memos), NextCursor: nextCursor(memos)})
+}
+
+// nonNil keeps empty lists encoding as [] rather than null.
+func nonNil(memos Memos) Memos {
+	if memos == nil {
+		return Memos{}
+	}
+	return memos
+}
+
+// apiSummary is what the top page polls to tell how many public memos
+// were posted since it was loaded.
+type apiSummary struct {
+	Total  int `json:"total"`
+	Newest int `json:"newest_id"`
+}
+
+func listedSummary() *apiSummary {
+	listed := memoCache.Listed()
+	s := &apiSummary{Total: len(listed)}
+	if len(listed) > 0 {
+		s.Newest = listed[0].Id
+	}
+	return s
+}
+
+// apiSummaryHandler answers from the memo cache without a session, the
+// same for everyone, so that shared caches can serve the polls for a few
+// seconds and browsers can revalidate them with If-None-Match.
+func apiSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	s := listedSummary()
+	w.Header().Set("Cache-Control", "public, max-age=5, stale-while-revalidate=30")
+	if checkETag(w, r, versionETag("summary", s.Total, s.Newest)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursor(t *testing.T) {
+	created, _ := parseDBTime("2013-10-05 10:30:15")
+	memo := &Memo{Id: 42, CreatedAt: created}
+	createdAt, id, err := decodeCursor(encodeCursor(memo))
+	if err != nil || !createdAt.Equal(memo.CreatedAt) || id != memo.Id {
+		t.Fatalf("decodeCursor(encodeCursor(memo)) = %s, %d, %v", createdAt, id, err)
+	}
+	legacy := base64.RawURLEncoding.EncodeToString([]byte("2013-10-05 10:30:15|42"))
+	if createdAt, id, err := decodeCursor(legacy); err != nil || !createdAt.Equal(created) || id != 42 {
+		t.Errorf("decodeCursor(legacy) = %s, %d, %v", createdAt, id, err)
+	}
+	for _, cursor := range []string{"!!!", "bm8tc2VwYXJhdG9y", "MjAxMy0xMC0wNXxhYmM"} {
+		if _, _, err := decodeCursor(cursor); err == nil {
+			t.Errorf("decodeCursor(%q) succeeded, want error", cursor)
+		}
+	}
+}
+
+func TestMemoTimesInJSON(t *testing.T) {
+	defer func(loc *time.Location) { dbLocation = loc }(dbLocation)
+	dbLocation = time.FixedZone("JST", 9*60*60)
+
+	memo, err := scanMemo(func(dest ...interface{}) error {
+		*dest[4].(*string) = "2013-10-05 10:30:15"
+		*dest[5].(*string) = "2013-10-05 11:00:00"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(memo)
+	if !strings.Contains(string(b), `"created_at":"2013-10-05T10:30:15+09:00"`) {
+		t.Errorf("JSON = %s", b)
+	}
+	if got := formatDBTime(memo.UpdatedAt.UTC()); got != "2013-10-05 11:00:00" {
+		t.Errorf("formatDBTime = %q", got)
+	}
+}
+
+func TestNeighborsAPI(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 6, Users: 2, Memos: 0})
+	var ids []string
+	for i, visibility := range []string{"public", "private", "public"} {
+		res := app.postMemo(t, url.Values{"content": {fmt.Sprintf("%s memo %d", visibility, i)}, "visibility": {visibility}})
+		ids = append(ids, strings.SplitN(strings.TrimPrefix(res.Request.URL.Path, "/memo/"), "-", 2)[0])
+	}
+	neighbors := func(body string) (older, newer string) {
+		var v struct{ Older, Newer *apiNeighbor }
+		if err := json.Unmarshal([]byte(body), &v); err != nil {
+			t.Fatal(err)
+		}
+		if v.Older != nil {
+			older = strconv.Itoa(v.Older.Id)
+		}
+		if v.Newer != nil {
+			newer = strconv.Itoa(v.Newer.Id)
+		}
+		return older, newer
+	}
+
+	if older, newer := neighbors(app.get(t, "/api/memo/"+ids[1]+"/neighbors")); older != ids[0] || newer != ids[2] {
+		t.Errorf("author's neighbors of %s = %q, %q; want %s, %s", ids[1], older, newer, ids[0], ids[2])
+	}
+	res, err := http.Get(app.URL + "/api/memo/" + ids[2] + "/neighbors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if older, newer := neighbors(string(body)); older != ids[0] || newer != "" {
+		t.Errorf("anonymous neighbors of %s = %q, %q; want %s and none", ids[2], older, newer, ids[0])
+	}
+	if res, err := http.Get(app.URL + "/api/memo/" + ids[1] + "/neighbors"); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Errorf("anonymous neighbors of a private memo: %v %v, want 404", res.StatusCode, err)
+	}
+}
+
+func TestSummaryAPI(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 8, Users: 2, Memos: 10})
+	summary := func() (apiSummary, string) {
+		res, err := http.Get(app.URL + "/api/stats/summary")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if cc := res.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "public, max-age=") {
+			t.Errorf("Cache-Control = %q", cc)
+		}
+		var s apiSummary
+		if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s, res.Header.Get("ETag")
+	}
+	before, etag := summary()
+	if before.Total != len(memoCache.Listed()) || before.Newest != memoCache.Listed()[0].Id {
+		t.Errorf("summary = %+v", before)
+	}
+	if top := app.get(t, "/"); !strings.Contains(top, `data-newest="`+strconv.Itoa(before.Newest)+`"`) {
+		t.Errorf("top page has no new memo badge")
+	}
+
+	req, _ := http.NewRequest("GET", app.URL+"/api/stats/summary", nil)
+	req.Header.Set("If-None-Match", etag)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation: status = %d, want 304", res.StatusCode)
+	}
+
+	app.postMemo(t, url.Values{"content": {"a new public memo"}, "visibility": {"public"}})
+	app.postMemo(t, url.Values{"content": {"a new private memo"}, "visibility": {"private"}})
+	after, _ := summary()
+	if after.Total != before.Total+1 || after.Newest <= before.Newest {
+		t.Errorf("after posting: %+v, before %+v", after, before)
+	}
+}
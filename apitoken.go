@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"./sessions"
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	defaultAccessTokenTTL  = 5 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	refreshTokenBytes      = 32
+)
+
+// APITokenConfig turns on bearer tokens for API clients, as an
+// alternative to the session cookie. Access tokens are JWTs that the API
+// checks without touching the session store; refresh tokens are kept in
+// the database so they can be revoked.
+type APITokenConfig struct {
+	Enabled         bool `json:"enabled"`
+	AccessTTLSec    int  `json:"access_ttl_sec"`
+	RefreshTTLHours int  `json:"refresh_ttl_hours"`
+}
+
+func (c APITokenConfig) accessTTL() time.Duration {
+	if c.AccessTTLSec <= 0 {
+		return defaultAccessTokenTTL
+	}
+	return time.Duration(c.AccessTTLSec) * time.Second
+}
+
+func (c APITokenConfig) refreshTTL() time.Duration {
+	if c.RefreshTTLHours <= 0 {
+		return defaultRefreshTokenTTL
+	}
+	return time.Duration(c.RefreshTTLHours) * time.Hour
+}
+
+const (
+	insertRefreshTokenSQL = "INSERT INTO api_refresh_tokens (token_hash, user_id, expires_at, created_at) VALUES (?, ?, ?, now())"
+	selectRefreshTokenSQL = "SELECT user_id, expires_at FROM api_refresh_tokens WHERE token_hash=?"
+	deleteRefreshTokenSQL = "DELETE FROM api_refresh_tokens WHERE token_hash=?"
+	sweepRefreshTokensSQL = "DELETE FROM api_refresh_tokens WHERE expires_at < ?"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+)
+
+// jwtHeader is the only header issued or accepted: HS256, so that a token
+// naming another algorithm, "none" included, is rejected.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type jwtClaims struct {
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+func jwtSignature(signed string) string {
+	mac := hmac.New(sha256.New, sessionKey("jwt"))
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signJWT(claims jwtClaims) string {
+	payload, _ := json.Marshal(claims)
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + jwtSignature(signed)
+}
+
+// parseJWT checks token's signature and expiry and returns the user id
+// it was issued to.
+func parseJWT(token string, now time.Time) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return 0, errInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(jwtSignature(parts[0]+"."+parts[1]))) {
+		return 0, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, errInvalidToken
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return 0, errInvalidToken
+	}
+	if now.Unix() >= claims.Expires {
+		return 0, errExpiredToken
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, errInvalidToken
+	}
+	return userId, nil
+}
+
+// withBearerAuth lets h see the user of a valid "Authorization: Bearer"
+// access token as if they were signed in, as long as the user still
+// exists. The session it gets is made up for the request and never
+// saved, and has no CSRF token: routes that take bearer tokens for writes
+// say so with csrfBearerExempt.
+func withBearerAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !config.APITokens.Enabled || !strings.HasPrefix(auth, "Bearer ") {
+			h(w, r)
+			return
+		}
+		userId, err := parseJWT(strings.TrimPrefix(auth, "Bearer "), time.Now())
+		if err == nil {
+			if _, ok := userCache.Get(userId); !ok {
+				err = errInvalidToken
+			}
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, r, http.StatusUnauthorized, err.Error(), nil)
+			return
+		}
+		session := sessions.NewSession(nil, sessionName)
+		session.Values["user_id"] = userId
+		r, info := ensureRequestInfo(r)
+		info.session = session
+		info.bearer = true
+		h(w, r)
+	}
+}
+
+type apiTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func refreshTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens makes a new access and refresh token pair for userId.
+func issueTokens(ctx context.Context, q querier, userId int, now time.Time) (*apiTokenResponse, error) {
+	c := config.APITokens
+	refresh := fmt.Sprintf("%x", securecookie.GenerateRandomKey(refreshTokenBytes))
+	_, err := execSQL(ctx, q, insertRefreshTokenSQL, refreshTokenHash(refresh), userId, formatDBTime(now.Add(c.refreshTTL())))
+	if err != nil {
+		return nil, err
+	}
+	access := signJWT(jwtClaims{
+		Subject:  strconv.Itoa(userId),
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(c.accessTTL()).Unix(),
+	})
+	return &apiTokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(c.accessTTL() / time.Second),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// useRefreshToken deletes token and returns the user it was issued to.
+// The delete decides between two clients racing with the same token.
+func useRefreshToken(ctx context.Context, tx *sql.Tx, token string, now time.Time) (int, error) {
+	hash := refreshTokenHash(token)
+	var userId int
+	var expiresAt string
+	err := tx.QueryRowContext(ctx, selectRefreshTokenSQL, hash).Scan(&userId, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	res, err := execSQL(ctx, tx, deleteRefreshTokenSQL, hash)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, errInvalidToken
+	}
+	expires, err := parseDBTime(expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	if !now.Before(expires) {
+		return 0, errExpiredToken
+	}
+	return userId, nil
+}
+
+func writeTokenError(w http.ResponseWriter, r *http.Request, message string) {
+	writeError(w, r, http.StatusUnauthorized, message, nil)
+}
+
+// apiTokenHandler exchanges a username and password for a token pair.
+func apiTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.APITokens.Enabled {
+		writeError(w, r, http.StatusNotFound, "", nil)
+		return
+	}
+	user, ok := authenticate(r.FormValue("username"), r.FormValue("password"))
+	if !ok {
+		writeTokenError(w, r, "invalid username or password")
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	tokens, err := issueTokens(r.Context(), dbConn, user.Id, time.Now())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// apiTokenRefreshHandler trades a refresh token for a new pair; the old
+// refresh token stops working.
+func apiTokenRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.APITokens.Enabled {
+		writeError(w, r, http.StatusNotFound, "", nil)
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	now := time.Now()
+	var tokens *apiTokenResponse
+	err := withTx(r.Context(), dbConn, func(tx *sql.Tx) error {
+		userId, err := useRefreshToken(r.Context(), tx, r.FormValue("refresh_token"), now)
+		if err != nil {
+			return err
+		}
+		if _, ok := userCache.Get(userId); !ok {
+			return errInvalidToken
+		}
+		tokens, err = issueTokens(r.Context(), tx, userId, now)
+		return err
+	})
+	switch err {
+	case nil:
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, tokens)
+	case errInvalidToken, errExpiredToken:
+		writeTokenError(w, r, err.Error())
+	default:
+		handleError(w, r, err)
+	}
+}
+
+// apiTokenRevokeHandler deletes a refresh token, as a client does when it
+// signs out. Access tokens already issued stay valid until they expire.
+func apiTokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if !config.APITokens.Enabled {
+		writeError(w, r, http.StatusNotFound, "", nil)
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	if _, err := execSQL(r.Context(), dbConn, deleteRefreshTokenSQL, refreshTokenHash(r.FormValue("refresh_token"))); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sweepRefreshTokensTask deletes refresh tokens that have expired unused.
+func sweepRefreshTokensTask() error {
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	res, err := execSQL(context.Background(), dbConn, sweepRefreshTokensSQL, formatDBTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	debugf("swept %d expired refresh tokens", n)
+	return nil
+}
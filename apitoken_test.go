@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1381000000, 0)
+	token := signJWT(jwtClaims{Subject: "42", IssuedAt: now.Unix(), Expires: now.Add(time.Minute).Unix()})
+	if userId, err := parseJWT(token, now); err != nil || userId != 42 {
+		t.Fatalf("parseJWT = %d, %v", userId, err)
+	}
+	if _, err := parseJWT(token, now.Add(time.Minute)); err != errExpiredToken {
+		t.Errorf("expired token: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"1","iat":1381000000,"exp":1381000060}`))
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	for name, bad := range map[string]string{
+		"payload":   parts[0] + "." + forged + "." + parts[2],
+		"signature": parts[0] + "." + parts[1] + "." + parts[2][1:],
+		"alg none":  none + "." + parts[1] + ".",
+		"garbage":   "not-a-token",
+	} {
+		if _, err := parseJWT(bad, now); err != errInvalidToken {
+			t.Errorf("%s: %v, want %v", name, err, errInvalidToken)
+		}
+	}
+}
+
+func postTokenForm(t *testing.T, app *memoryApp, path string, form url.Values) (*apiTokenResponse, int) {
+	res, err := http.PostForm(app.URL+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, res.StatusCode
+	}
+	var tokens apiTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	return &tokens, res.StatusCode
+}
+
+func getWithBearer(t *testing.T, app *memoryApp, path, token string) int {
+	req, _ := http.NewRequest("GET", app.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestAPITokens(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 3, Users: 3, Memos: 5})
+	signin := url.Values{"username": {"user1"}, "password": {"user1"}}
+	if _, code := postTokenForm(t, app, "/api/token", signin); code != http.StatusNotFound {
+		t.Fatalf("tokens disabled: %d, want 404", code)
+	}
+	config.APITokens.Enabled = true
+
+	res := app.postMemo(t, url.Values{"content": {"# for the api client"}, "visibility": {"private"}})
+	memoPath := "/api/memo/" + strings.SplitN(strings.TrimPrefix(res.Request.URL.Path, "/memo/"), "-", 2)[0]
+	sessionFiles, _ := ioutil.ReadDir(sessionFile)
+
+	if _, code := postTokenForm(t, app, "/api/token", url.Values{"username": {"user1"}, "password": {"wrong"}}); code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d, want 401", code)
+	}
+	tokens, code := postTokenForm(t, app, "/api/token", signin)
+	if code != http.StatusOK || tokens.TokenType != "Bearer" || tokens.ExpiresIn != int(defaultAccessTokenTTL/time.Second) {
+		t.Fatalf("token: %d %+v", code, tokens)
+	}
+	if code := getWithBearer(t, app, memoPath, ""); code != http.StatusNotFound {
+		t.Errorf("private memo without a token: %d, want 404", code)
+	}
+	if code := getWithBearer(t, app, memoPath, tokens.AccessToken); code != http.StatusOK {
+		t.Errorf("private memo with a token: %d, want 200", code)
+	}
+	if code := getWithBearer(t, app, memoPath, tokens.AccessToken+"x"); code != http.StatusUnauthorized {
+		t.Errorf("bad token: %d, want 401", code)
+	}
+	gone := signJWT(jwtClaims{Subject: "9999", IssuedAt: time.Now().Unix(), Expires: time.Now().Add(time.Minute).Unix()})
+	if code := getWithBearer(t, app, memoPath, gone); code != http.StatusUnauthorized {
+		t.Errorf("token of a user who doesn't exist: %d, want 401", code)
+	}
+	if files, _ := ioutil.ReadDir(sessionFile); len(files) != len(sessionFiles) {
+		t.Errorf("bearer requests made %d session files", len(files)-len(sessionFiles))
+	}
+
+	refreshed, code := postTokenForm(t, app, "/api/token/refresh", url.Values{"refresh_token": {tokens.RefreshToken}})
+	if code != http.StatusOK || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("refresh: %d %+v", code, refreshed)
+	}
+	if _, code := postTokenForm(t, app, "/api/token/refresh", url.Values{"refresh_token": {tokens.RefreshToken}}); code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token: %d, want 401", code)
+	}
+	res, err := http.PostForm(app.URL+"/api/token/revoke", url.Values{"refresh_token": {refreshed.RefreshToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("revoke: %d, want 204", res.StatusCode)
+	}
+	if _, code := postTokenForm(t, app, "/api/token/refresh", url.Values{"refresh_token": {refreshed.RefreshToken}}); code != http.StatusUnauthorized {
+		t.Errorf("revoked refresh token: %d, want 401", code)
+	}
+}
+
+func TestCSRFPolicy(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 1})
+	defer func(enabled bool) { config.APITokens.Enabled = enabled }(config.APITokens.Enabled)
+	config.APITokens.Enabled = true
+	tokens, code := postTokenForm(t, app, "/api/token", url.Values{"username": {"user1"}, "password": {"user1"}})
+	if code != http.StatusOK {
+		t.Fatalf("token: %d", code)
+	}
+	post := func(client *http.Client, token string, form url.Values) int {
+		req, _ := http.NewRequest("POST", app.URL+"/api/markdown/render", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	content := url.Values{"content": {"*hi*"}}
+	if code := post(http.DefaultClient, tokens.AccessToken, content); code != http.StatusOK {
+		t.Errorf("bearer without sid: %d, want 200", code)
+	}
+	if code := post(app.client, "", content); code != http.StatusBadRequest {
+		t.Errorf("cookie without sid: %d, want 400", code)
+	}
+	if code := post(app.client, "", url.Values{"content": {"*hi*"}, "sid": {app.sid}}); code != http.StatusOK {
+		t.Errorf("cookie with sid: %d, want 200", code)
+	}
+
+	// Routes that keep the strict policy check bearer requests too.
+	h := withBearerAuth(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := loadSession(w, r)
+		if !antiCSRF(w, r, session) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	r := httptest.NewRequest("POST", "/strict", nil)
+	r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bearer on a strict route: %d, want 400", w.Code)
+	}
+}
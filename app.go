@@ -3,65 +3,68 @@ package main
 import (
 	"./sessions"
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"database/sql"
-	"encoding/json"
+	"flag"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/knieriem/markdown"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
-	"runtime"
 	"strconv"
-	"strings"
+	"time"
 )
 
 const (
-	maxConnectionCount = 256
-	memosPerPage       = 100
-	listenAddr         = ":5000"
-	sessionName        = "isucon_session"
-	tmpDir             = "/tmp/"
-	markdownCommand    = "../bin/markdown"
-	dbConnPoolSize     = 10
-	memcachedServer    = "localhost:11211"
-	sessionFile        = "/dev/shm/gorilla"
-	sessionSecret      = "kH<{11qpic*gf0e21YK7YtwyUvE9l<1r>yX8R-Op"
+	maxConnectionCount   = 256
+	listenAddr           = ":5000"
+	defaultSessionName   = "isucon_session"
+	tmpDir               = "/tmp/"
+	markdownCommand      = "../bin/markdown"
+	dbConnPoolSize       = 10
+	memcachedServer      = "localhost:11211"
+	defaultSessionFile   = "/dev/shm/gorilla"
+	defaultSessionSecret = "kH<{11qpic*gf0e21YK7YtwyUvE9l<1r>yX8R-Op"
+	sessionMaxAge        = 30 * 24 * time.Hour
+	initRetryCount       = 6
+	initRetryBackoff     = 500 * time.Millisecond
 )
 
-type Config struct {
-	Database struct {
-		Dbname   string `json:"dbname"`
-		Host     string `json:"host"`
-		Port     int    `json:"port"`
-		Username string `json:"username"`
-		Password string `json:"password"`
-	} `json:"database"`
-}
-
 type User struct {
 	Id         int
 	Username   string
 	Password   string
 	Salt       string
 	LastAccess string
+	Prefs      Preferences
 }
 
 type Memo struct {
-	Id        int
-	User      int
-	Content   string
-	IsPrivate int
-	CreatedAt string
-	UpdatedAt string
-	Username  string
+	Id         int        `json:"id"`
+	User       int        `json:"user"`
+	Content    string     `json:"content"`
+	Visibility Visibility `json:"visibility"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Username   string     `json:"username"`
+	Title      string     `json:"title"`
+	Chars      int        `json:"chars"`
+	Words      int        `json:"words"`
+	ReadMins   int        `json:"reading_minutes"`
+	Version    int        `json:"version"`
+	Slug       string     `json:"slug"`
+	Team       int        `json:"team,omitempty"`
+	Hidden     bool       `json:"-"`
+	Locked     bool       `json:"locked"`
+	// ModerationNote is the moderator's reason for a lock or hide, shown
+	// only to the author.
+	ModerationNote string `json:"-"`
 }
 
 type Memos []*Memo
@@ -69,274 +72,480 @@ type Memos []*Memo
 type View struct {
 	User      *User
 	Memo      *Memo
-	Memos     *Memos
+	Memos     Memos
 	Page      int
 	PageStart int
 	PageEnd   int
 	Total     int
 	Older     *Memo
 	Newer     *Memo
-	Session   *sessions.Session
+	Content   template.HTML
+	List      template.HTML
+	Themes    []string
+	PageSizes []int
+	Languages []string
+	Draft     *Memo
+	Diff      *MemoDiff
+	Similar   *Memo
+	Following bool
+	Window    string
+	Visitors  int
+	Summary   *apiSummary
+	Error     *ErrorPage
+	Notices   []Notice
+	Previews  []*LinkPreview
+	Archive   *ArchivePage
+	Team      *Team
+	Teams     []*Team
+	Reports   []*MemoReport
+	MorePath  string
+	// MemoTemplates are the user's saved templates, for the picker on
+	// mypage and the list on /settings/templates.
+	MemoTemplates []*MemoTemplate
+	// Attachments are the files uploaded to Memo.
+	Attachments []*Attachment
+	Session     *sessions.Session
+	// locale is set by renderTemplate; see Locale.
+	locale *Locale
 }
 
 var (
-	users      = make(map[int]*User)
-	dbConnPool chan *sql.DB
-	baseUrl    *url.URL
-	fmap       = template.FuncMap{
+	config      *Config
+	sessionName = defaultSessionName
+	sessionFile = defaultSessionFile
+	userCache   = NewUserCache()
+	memoCache   = NewMemoCache()
+	dbConnPool  chan *sql.DB
+	baseUrl     *url.URL
+	fmap        = template.FuncMap{
 		"url_for": func(path string) string {
 			return baseUrl.String() + path
 		},
-		"first_line": func(s string) string {
-			sl := strings.Split(s, "\n")
-			return sl[0]
-		},
 		"get_token": func(session *sessions.Session) interface{} {
 			return session.Values["token"]
 		},
-		"gen_markdown": func(s string) template.HTML {
-			var buf bytes.Buffer
-			p := markdown.NewParser(nil)
-			p.Markdown(bytes.NewBufferString(s), markdown.ToHTML(&buf))
-
-			return template.HTML(buf.String())
-		},
+		"gen_markdown": genMarkdown,
+		"datetime":     formatDBTime,
+		"archive_path": archivePath,
+		"user_archive": userArchivePath,
+		"captcha":      captchaWidget,
+		"form_guard":   formGuardFields,
+		"banner":       siteBanner.Message,
+		"excerpt":      memoExcerpt,
 	}
-	tmpl = template.Must(template.New("tmpl").Funcs(fmap).ParseGlob("templates/*.html"))
 )
 
-func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
+func genMarkdown(s string) template.HTML {
+	var buf bytes.Buffer
+	p := markdown.NewParser(nil)
+	p.Markdown(bytes.NewBufferString(s), markdown.ToHTML(&buf))
 
-	env := os.Getenv("ISUCON_ENV")
-	if env == "" {
-		env = "local"
+	return template.HTML(renderEmoji(autolink(buf.String())))
+}
+
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var db databaseFlags
+	db.register(fs)
+	fs.BoolVar(&createMissingIndexes, "create-indexes", false, "add the indexes the self-check finds missing")
+	fs.Parse(args)
+
+	loadEnvConfig()
+	go reloadConfigOnSIGHUP()
+	if err := setupHandlers(); err != nil {
+		return err
+	}
+	if err := startRecording(config.Record); err != nil {
+		return err
+	}
+	if err := startErrorReporting(config.ErrorReport); err != nil {
+		return err
 	}
-	config := loadConfig("../config/" + env + ".json")
-	db := config.Database
-	connectionString := fmt.Sprintf(
-		"%s:%s@tcp(%s:%d)/%s?charset=utf8",
-		db.Username, db.Password, db.Host, db.Port, db.Dbname,
-	)
-	log.Printf("db: %s", connectionString)
+	driverName, connectionString := db.open()
+	selfCheck(driverName, connectionString).log()
 
 	dbConnPool = make(chan *sql.DB, dbConnPoolSize)
 	for i := 0; i < dbConnPoolSize; i++ {
-		conn, err := sql.Open("mysql", connectionString)
+		conn, err := sql.Open(driverName, connectionString)
 		if err != nil {
 			log.Panicf("Error opening database: %v", err)
 		}
 		dbConnPool <- conn
 		defer conn.Close()
 	}
+	if err := openReplicas(config.Replicas); err != nil {
+		log.Panicf("Error opening replica: %v", err)
+	}
 
-	r := mux.NewRouter()
-
-	conn, err := sql.Open("mysql", connectionString)
+	conn, err := sql.Open(driverName, connectionString)
 	defer conn.Close()
 	if err != nil {
 		log.Panicf("Error opening database: %v", err)
 	}
-	rows, _ := conn.Query("SELECT * FROM users")
-	defer rows.Close()
+	if err := initializeWithRetry(conn, config.Snapshot); err != nil {
+		log.Fatalf("Error initializing cache: %v", err)
+	}
+	setupSnapshot(config.Snapshot)
+	startCacheSync(config.CacheSync)
+	jobs.Register("user.last_access", updateLastAccessJob)
+	jobs.Register("link.preview", fetchLinkPreviewJob)
+	jobs.Register("attachment.resize", resizeAttachmentJob)
+	jobs.Start(config.Jobs)
+	err = startScheduler(config.Schedule, time.Duration(config.ScheduleJitterMs)*time.Millisecond, map[string]func() error{
+		"user_reconcile": reconcileUsersTask,
+		"session_sweep":  sweepSessionsTask,
+		"view_flush":     flushViewsTask,
+		"popular_rank":   rankPopularTask,
+		"related_rank":   rankRelatedTask,
+		"visitor_flush":  flushVisitorsTask,
+		"banner_refresh": refreshBannerTask,
+		"token_sweep":    sweepRefreshTokensTask,
+		"cache_audit":    auditCacheTask,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, task := range []func() error{flushViewsTask, flushVisitorsTask} {
+		task := task
+		onShutdown(func() {
+			if err := task(); err != nil {
+				log.Printf("shutdown: %s", err)
+			}
+		})
+	}
 
-	for rows.Next() {
-		user := &User{}
-		rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt, &user.LastAccess)
-		users[user.Id] = user
+	r := newRouter()
+	http.Handle("/", newTenantRouter(config.Tenant, config.Tenants, r))
+	if err := serve(withIPFilter(clientFilter, http.DefaultServeMux), config.Server); err != nil && err != http.ErrServerClosed {
+		return err
 	}
+	return nil
+}
 
-	r.HandleFunc("/", topHandler)
-	r.HandleFunc("/signin", signinHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/signin", signinPostHandler).Methods("POST")
-	r.HandleFunc("/signout", signoutHandler)
-	r.HandleFunc("/mypage", mypageHandler)
-	r.HandleFunc("/memo/{memo_id}", memoHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/memo", memoPostHandler).Methods("POST")
-	r.HandleFunc("/recent/{page:[0-9]+}", recentHandler)
+// newRouter builds the application's routes behind its middleware.
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(statsMiddleware)
+	r.Use(loadSheddingMiddleware)
+	r.Use(requestInfoMiddleware)
+	r.Use(errorReportMiddleware)
+	r.Use(impersonationMiddleware)
+	r.Use(tracingMiddleware)
+	r.Use(slowRequestMiddleware)
+	r.Use(latencyBudgetMiddleware)
+	r.Use(recordMiddleware)
+
+	r.HandleFunc("/", withETag(withSLO(topHandler)))
+	r.HandleFunc("/signin", withETag(signinHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/signin", limitBody(config.BodyLimits.Signin, guardForm(requireCaptcha(signinPostHandler)))).Methods("POST")
+	r.HandleFunc("/signout", limitBody(config.BodyLimits.Default, signoutHandler))
+	r.HandleFunc("/mypage", withETag(protect(loginRequired, mypageHandler)))
+	r.HandleFunc("/mypage/visibility", limitBody(config.BodyLimits.Default, protect(loginRequired, limitWrites(bulkVisibilityHandler)))).Methods("POST")
+	r.HandleFunc("/memo/{memo_id:[0-9]+}.txt", withETag(memoTextHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/memo/{memo_id}", withETag(memoHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/memo/{memo_id:[0-9]+}/edit", protect(ownerRequired, memoEditHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/memo/{memo_id:[0-9]+}/edit", limitBody(config.BodyLimits.Memo, protect(ownerRequired, memoEditPostHandler))).Methods("POST")
+	r.HandleFunc("/memo", limitBody(config.BodyLimits.Memo, guardForm(protect(loginRequired, limitWrites(memoPostHandler))))).Methods("POST")
+	r.HandleFunc("/memo/{memo_id:[0-9]+}/attachments", limitBody(config.BodyLimits.Upload, protect(ownerRequired, limitWrites(attachmentPostHandler)))).Methods("POST")
+	r.HandleFunc("/attachments/{attachment_id:[0-9]+}", attachmentHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/attachments/{attachment_id:[0-9]+}/delete", limitBody(config.BodyLimits.Default, protect(loginRequired, attachmentDeleteHandler))).Methods("POST")
+	r.HandleFunc("/memo/{memo_id:[0-9]+}/report", limitBody(config.BodyLimits.Default, protect(loginRequired, limitWrites(reportHandler)))).Methods("POST")
+	r.HandleFunc("/theme", limitBody(config.BodyLimits.Default, themeHandler)).Methods("POST")
+	r.HandleFunc("/settings", withETag(protect(loginRequired, settingsHandler))).Methods("GET", "HEAD")
+	r.HandleFunc("/settings", limitBody(config.BodyLimits.Default, protect(loginRequired, settingsPostHandler))).Methods("POST")
+	r.HandleFunc("/settings/templates", withETag(protect(loginRequired, memoTemplatesHandler))).Methods("GET", "HEAD")
+	r.HandleFunc("/settings/templates", limitBody(config.BodyLimits.Memo, protect(loginRequired, memoTemplatePostHandler))).Methods("POST")
+	r.HandleFunc("/settings/templates/{template_id:[0-9]+}", limitBody(config.BodyLimits.Memo, protect(loginRequired, memoTemplateUpdateHandler))).Methods("POST")
+	r.HandleFunc("/recent/{page:[0-9]+}", withETag(withSLO(recentHandler)))
+	r.HandleFunc("/popular", withETag(withSLO(popularHandler))).Methods("GET", "HEAD")
+	r.HandleFunc("/archive/{year:[0-9]{4}}/{month:[0-9]{2}}", withETag(archiveHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/user/{user_id:[0-9]+}/archive/{year:[0-9]{4}}/{month:[0-9]{2}}", withETag(archiveHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/timeline", withETag(protect(loginRequired, withSLO(timelineHandler)))).Methods("GET", "HEAD")
+	r.HandleFunc("/team/{name}", withETag(protect(loginRequired, teamHandler))).Methods("GET", "HEAD")
+	r.HandleFunc("/follow/{user_id:[0-9]+}", limitBody(config.BodyLimits.Default, protect(loginRequired, followHandler(false)))).Methods("POST")
+	r.HandleFunc("/unfollow/{user_id:[0-9]+}", limitBody(config.BodyLimits.Default, protect(loginRequired, followHandler(true)))).Methods("POST")
+	r.HandleFunc("/api/memo/{memo_id:[0-9]+}", withBearerAuth(apiMemoHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/api/memo/{memo_id:[0-9]+}/neighbors", withBearerAuth(apiNeighborsHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/api/memo/{memo_id:[0-9]+}/related", withBearerAuth(apiRelatedHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/api/recent/{page:[0-9]+}", withBearerAuth(apiRecentHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/api/memos", withBearerAuth(apiMemosHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/api/stats/summary", apiSummaryHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/api/markdown/render", limitBody(config.BodyLimits.Memo, withCSRFPolicy(csrfBearerExempt, withBearerAuth(protect(loginRequired, apiMarkdownHandler))))).Methods("POST")
+	r.HandleFunc("/api/token", limitBody(config.BodyLimits.Signin, apiTokenHandler)).Methods("POST")
+	r.HandleFunc("/api/token/refresh", limitBody(config.BodyLimits.Signin, apiTokenRefreshHandler)).Methods("POST")
+	r.HandleFunc("/api/token/revoke", limitBody(config.BodyLimits.Signin, apiTokenRevokeHandler)).Methods("POST")
+	r.HandleFunc("/reset", protect(adminRequired, resetStatusHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/reset", limitBody(config.BodyLimits.Default, protect(adminRequired, resetHandler))).Methods("POST")
+	r.HandleFunc("/admin/config", protect(adminRequired, configHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/config/reload", limitBody(config.BodyLimits.Default, protect(adminRequired, configReloadHandler))).Methods("POST")
+	r.HandleFunc("/admin/slow", protect(adminRequired, slowEventsHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/jobs", protect(adminRequired, jobsHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/tasks", protect(adminRequired, tasksHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/flags", protect(adminRequired, flagsHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/duplicates", protect(adminRequired, duplicatesHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/reports", protect(adminRequired, reportsHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/reports/{memo_id:[0-9]+}", limitBody(config.BodyLimits.Default, protect(adminRequired, reportReviewHandler))).Methods("POST")
+	r.HandleFunc("/admin/memos/{memo_id:[0-9]+}/moderate", limitBody(config.BodyLimits.Default, protect(adminRequired, moderateHandler))).Methods("POST")
+	r.HandleFunc("/admin/flags/{memo_id:[0-9]+}", limitBody(config.BodyLimits.Default, protect(adminRequired, flagReviewHandler))).Methods("POST")
+	r.HandleFunc("/admin/impersonate", protect(adminForm, impersonateFormHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/impersonate", limitBody(config.BodyLimits.Default, protect(adminRequired, impersonateHandler))).Methods("POST")
+	r.HandleFunc("/impersonate/stop", limitBody(config.BodyLimits.Default, impersonateStopHandler)).Methods("POST")
+	r.HandleFunc("/admin/banner", protect(adminForm, bannerHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/banner", limitBody(config.BodyLimits.Default, protect(adminRequired, bannerPostHandler))).Methods("POST")
+	r.HandleFunc("/admin/teams", protect(adminRequired, teamsHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/teams", limitBody(config.BodyLimits.Default, protect(adminRequired, teamPostHandler))).Methods("POST")
+	r.HandleFunc("/admin/teams/{name}/members", limitBody(config.BodyLimits.Default, protect(adminRequired, teamMemberPostHandler))).Methods("POST")
+	r.HandleFunc("/metrics", protect(adminRequired, metricsHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/cache", protect(adminRequired, cacheHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/stats", protect(adminRequired, statsHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/caches", protect(adminRequired, cachesHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/consistency", protect(adminRequired, consistencyHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/cache/audit", protect(adminRequired, cacheAuditHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/admin/cache/audit", limitBody(config.BodyLimits.Default, protect(adminRequired, cacheAuditHandler))).Methods("POST")
+	r.HandleFunc("/admin/shadow", protect(adminRequired, shadowHandler)).Methods("GET", "HEAD")
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
-	http.Handle("/", r)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	return r
 }
 
-func loadConfig(filename string) *Config {
-	log.Printf("loading config file: %s", filename)
-	f, err := ioutil.ReadFile(filename)
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+func initialize(conn *sql.DB) error {
+	if err := loadCaches(conn); err != nil {
+		return err
+	}
+	return loadIndexes(conn)
+}
+
+// loadCaches fills the user and memo caches from their tables.
+func loadCaches(conn *sql.DB) error {
+	if err := userCache.Reload(conn); err != nil {
+		return fmt.Errorf("loading users: %s", err)
 	}
-	var config Config
-	err = json.Unmarshal(f, &config)
+	log.Printf("cached %d users", userCache.Len())
+
+	memos, err := queryMemos(context.Background(), conn, "SELECT "+memoColumns+" FROM memos")
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return fmt.Errorf("loading memos: %s", err)
+	}
+	for _, memo := range memos {
+		if _, ok := userCache.Get(memo.User); !ok {
+			log.Printf("memo %d references missing user %d", memo.Id, memo.User)
+		}
 	}
-	return &config
+	memoCache.Replace(newMemoCacheOf(memos))
+	memoWatermark.observe(memos)
+	log.Printf("cached %d memos", memoCache.Len())
+	return nil
 }
 
-func prepareHandler(w http.ResponseWriter, r *http.Request) {
-	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
-		baseUrl, _ = url.Parse("http://" + h)
-	} else {
-		baseUrl, _ = url.Parse("http://" + r.Host)
+// loadIndexes builds what is derived from the memo cache or kept in
+// smaller tables: feeds, teams, visitor counts and the banner.
+func loadIndexes(conn *sql.DB) error {
+	listFragments.Purge()
+	if err := rebuildFeeds(conn); err != nil {
+		return fmt.Errorf("loading follows: %s", err)
+	}
+	if err := rebuildTeams(conn); err != nil {
+		return fmt.Errorf("loading teams: %s", err)
+	}
+	if err := memoVisitors.Load(conn); err != nil {
+		return fmt.Errorf("loading visitor counts: %s", err)
+	}
+	if err := siteBanner.Load(conn); err != nil {
+		return fmt.Errorf("loading banner: %s", err)
+	}
+	return nil
+}
+
+// startup is initialize for a new process, which can start from the
+// cache snapshot instead of reading the user and memo tables.
+func startup(conn *sql.DB, c SnapshotConfig) error {
+	if !c.Disabled {
+		err := restoreSnapshot(conn, c.path(), c.maxAge())
+		if err == nil {
+			return loadIndexes(conn)
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("snapshot not used: %s", err)
+		}
 	}
+	return initialize(conn)
 }
 
+// initializeWithRetry keeps retrying the initial load with exponential
+// backoff so that the app can start while MySQL is still coming up.
+func initializeWithRetry(conn *sql.DB, c SnapshotConfig) error {
+	backoff := initRetryBackoff
+	var err error
+	for attempt := 1; attempt <= initRetryCount; attempt++ {
+		if err = startup(conn, c); err == nil {
+			return nil
+		}
+		log.Printf("initialize failed (attempt %d/%d): %s", attempt, initRetryCount, err)
+		if attempt < initRetryCount {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+func prepareHandler(w http.ResponseWriter, r *http.Request) {
+	baseUrl, _ = url.Parse(requestBase(r))
+}
+
+// requestBase is the URL the site is reached by in r, which url_for
+// prefixes paths with.
+func requestBase(r *http.Request) string {
+	return requestScheme(r) + "://" + requestHost(r) + urlPrefix(r)
+}
+
+// loadSession reads the request's session once and keeps it on the
+// request info for middleware and handlers that ask again.
 func loadSession(w http.ResponseWriter, r *http.Request) (session *sessions.Session, err error) {
-	store := sessions.NewFilesystemStore(sessionFile, []byte(sessionSecret))
-	return store.Get(r, sessionName)
+	info := requestInfoFrom(r.Context())
+	if info != nil && info.session != nil {
+		return info.session, nil
+	}
+	if _, err := r.Cookie(sessionName); err == http.ErrNoCookie {
+		session = anonymousSession()
+		if info != nil {
+			info.session = session
+		}
+		return session, nil
+	}
+	_, span := startSpan(r.Context(), "session.load")
+	defer func() { endSpan(span, err) }()
+	session, err = newSessionStore().Get(r, sessionName)
+	if err == nil {
+		countSessionLoad(session.IsNew)
+		if migrateSession(session) && !session.IsNew {
+			if err := session.Save(r, w); err != nil {
+				log.Printf("session: saving migrated session: %s", err)
+			}
+		}
+	}
+	if err == nil && info != nil {
+		info.session = session
+	}
+	return session, err
 }
 
-func getUser(w http.ResponseWriter, r *http.Request, dbConn *sql.DB, session *sessions.Session) *User {
-	userId := session.Values["user_id"]
-	if userId == nil {
+func getUser(w http.ResponseWriter, r *http.Request, session *sessions.Session) *User {
+	userId, ok := sessionUserId(session)
+	if !ok {
 		return nil
 	}
-	user, ok := users[userId.(int)]
+	_, span := startSpan(r.Context(), "cache.user")
+	user, ok := userCache.Get(userId)
+	span.End()
+	if info := requestInfoFrom(r.Context()); info != nil && ok {
+		info.UserId = user.Id
+	}
 	if ok {
-		w.Header().Add("Cache-Control", "private")
+		w.Header().Set("Cache-Control", "private")
 	}
 	return user
 }
 
+// antiCSRF answers 400 and returns true unless r carries the session's
+// token in sid or is exempt under its route's csrfPolicy.
 func antiCSRF(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	if csrfExempt(r) {
+		return false
+	}
 	if r.FormValue("sid") != session.Values["token"] {
-		code := http.StatusBadRequest
-		http.Error(w, http.StatusText(code), code)
+		writeError(w, r, http.StatusBadRequest, "", session)
 		return true
 	}
 	return false
 }
 
-func serverError(w http.ResponseWriter, err error) {
-	log.Printf("error: %s", err)
-	code := http.StatusInternalServerError
-	http.Error(w, http.StatusText(code), code)
-}
-
-func notFound(w http.ResponseWriter) {
-	code := http.StatusNotFound
-	http.Error(w, http.StatusText(code), code)
+func renderTemplate(w http.ResponseWriter, r *http.Request, name string, v *View) error {
+	_, span := startSpan(r.Context(), "template."+name)
+	v.locale = resolveLocale(v.User, r)
+	v.Notices = append(takeNotices(w, r, v.Session), v.Notices...)
+	w.Header().Add("Vary", "Accept-Language")
+	err := themeTemplates(themeFor(v.Session)).ExecuteTemplate(w, name, v)
+	endSpan(span, err)
+	return err
 }
 
 func topHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	prepareHandler(w, r)
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
-	user := getUser(w, r, dbConn, session)
+	user := getUser(w, r, session)
 
-	var totalCount int
-	rows, err := dbConn.Query("SELECT count(*) AS c FROM memos WHERE is_private=0")
+	// Taken before the list, so a memo posted in between is counted as
+	// new rather than missed.
+	summary := listedSummary()
+	shadowListedPage(0)
+	list, err := memoListFragment(r.Context(), requestBase(r), themeFor(session), 0)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
-	if rows.Next() {
-		rows.Scan(&totalCount)
-	}
-	rows.Close()
-
-	rows, err = dbConn.Query("SELECT * FROM memos WHERE is_private=0 ORDER BY created_at DESC, id DESC LIMIT ?", memosPerPage)
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-	memos := make(Memos, 0)
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-	for rows.Next() {
-		memo := Memo{}
-		rows.Scan(&memo.Id, &memo.User, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
-		memo.Username = users[memo.User].Username
-		memos = append(memos, &memo)
-	}
-	rows.Close()
 
 	v := &View{
-		Total:     totalCount,
-		Page:      0,
-		PageStart: 1,
-		PageEnd:   memosPerPage,
-		Memos:     &memos,
-		User:      user,
-		Session:   session,
+		List:    list.HTML,
+		Summary: summary,
+		User:    user,
+		Session: session,
 	}
-	if err = tmpl.ExecuteTemplate(w, "index", v); err != nil {
-		serverError(w, err)
+	if err = renderTemplate(w, r, "index", v); err != nil {
+		handleError(w, r, err)
 	}
 }
 
 func recentHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	prepareHandler(w, r)
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
-	user := getUser(w, r, dbConn, session)
+	user := getUser(w, r, session)
 	vars := mux.Vars(r)
 	page, _ := strconv.Atoi(vars["page"])
-
-	rows, err := dbConn.Query("SELECT count(*) AS c FROM memos WHERE is_private=0")
-	if err != nil {
-		serverError(w, err)
+	if !validPage(page) {
+		handleError(w, r, notFoundError(""))
 		return
 	}
-	var totalCount int
-	if rows.Next() {
-		rows.Scan(&totalCount)
-	}
-	rows.Close()
 
-	rows, err = dbConn.Query("SELECT * FROM memos WHERE is_private=0 ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?", memosPerPage, memosPerPage*page)
+	shadowListedPage(page)
+	list, err := memoListFragment(r.Context(), requestBase(r), themeFor(session), page)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
-	memos := make(Memos, 0)
-	for rows.Next() {
-		memo := Memo{}
-		rows.Scan(&memo.Id, &memo.User, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
-		memo.Username = users[memo.User].Username
-		memos = append(memos, &memo)
-	}
-	if len(memos) == 0 {
-		notFound(w)
+	if list.Count == 0 {
+		handleError(w, r, notFoundError(""))
 		return
 	}
 
 	v := &View{
-		Total:     totalCount,
-		Page:      page,
-		PageStart: memosPerPage*page + 1,
-		PageEnd:   memosPerPage * (page + 1),
-		Memos:     &memos,
-		User:      user,
-		Session:   session,
+		List:    list.HTML,
+		User:    user,
+		Session: session,
 	}
-	if err = tmpl.ExecuteTemplate(w, "index", v); err != nil {
-		serverError(w, err)
+	if err = renderTemplate(w, r, "index", v); err != nil {
+		handleError(w, r, err)
 	}
 }
 
+// findNeighbors finds the author's memos either side of memo that user
+// may follow links to: all of them for the author, the listed ones for
+// everyone else.
+func findNeighbors(user *User, memo *Memo) (older, newer *Memo) {
+	return userNeighbors(memo, user != nil && user.Id == memo.User)
+}
+
 func signinHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	prepareHandler(w, r)
@@ -344,14 +553,14 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		dbConnPool <- dbConn
 	}()
-	user := getUser(w, r, dbConn, session)
+	user := getUser(w, r, session)
 
 	v := &View{
 		User:    user,
 		Session: session,
 	}
-	if err := tmpl.ExecuteTemplate(w, "signin", v); err != nil {
-		serverError(w, err)
+	if err := renderTemplate(w, r, "signin", v); err != nil {
+		handleError(w, r, err)
 		return
 	}
 }
@@ -359,51 +568,36 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 func signinPostHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	prepareHandler(w, r)
-	dbConn := <-dbConnPool
-	defer func() {
-		dbConnPool <- dbConn
-	}()
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
-	user := &User{}
-	rows, err := dbConn.Query("SELECT id, username, password, salt FROM users WHERE username=?", username)
-	if err != nil {
-		serverError(w, err)
-		return
-	}
-	if rows.Next() {
-		rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt)
-	}
-	rows.Close()
-	if user.Id > 0 {
-		h := sha256.New()
-		h.Write([]byte(user.Salt + password))
-		if user.Password == fmt.Sprintf("%x", h.Sum(nil)) {
-			session.Values["user_id"] = user.Id
-			session.Values["token"] = fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
-			if err := session.Save(r, w); err != nil {
-				serverError(w, err)
-				return
-			}
-			if _, err := dbConn.Exec("UPDATE users SET last_access=now() WHERE id=?", user.Id); err != nil {
-				serverError(w, err)
-				return
-			} else {
-				http.Redirect(w, r, "/mypage", http.StatusFound)
-			}
+	if user, ok := authenticate(username, password); ok {
+		session.Values["user_id"] = user.Id
+		session.Values["token"] = fmt.Sprintf("%x", securecookie.GenerateRandomKey(32))
+		if err := regenerateSession(w, r, session); err != nil {
+			handleError(w, r, err)
+			return
+		}
+		if err := jobs.Enqueue("user.last_access", &lastAccessJob{UserId: user.Id}); err != nil {
+			handleError(w, r, err)
 			return
+		} else {
+			http.Redirect(w, r, "/mypage", http.StatusFound)
 		}
+		return
 	}
 	v := &View{
 		Session: session,
 	}
-	if err := tmpl.ExecuteTemplate(w, "signin", v); err != nil {
-		serverError(w, err)
+	if username != "" || password != "" {
+		v.Notices = []Notice{{Level: noticeError, Message: "The username or password is incorrect."}}
+	}
+	if err := renderTemplate(w, r, "signin", v); err != nil {
+		handleError(w, r, err)
 		return
 	}
 }
@@ -411,7 +605,7 @@ func signinPostHandler(w http.ResponseWriter, r *http.Request) {
 func signoutHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	prepareHandler(w, r)
@@ -419,14 +613,18 @@ func signoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.SetCookie(w, sessions.NewCookie(sessionName, "", &sessions.Options{MaxAge: -1}))
+	endImpersonation(session, "signed out")
+	if err := destroySession(w, session); err != nil {
+		handleError(w, r, err)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func mypageHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	prepareHandler(w, r)
@@ -435,123 +633,134 @@ func mypageHandler(w http.ResponseWriter, r *http.Request) {
 		dbConnPool <- dbConn
 	}()
 
-	user := getUser(w, r, dbConn, session)
-	if user == nil {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+	user := getUser(w, r, session)
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 {
+		page = 0
 	}
-	rows, err := dbConn.Query("SELECT id, content, is_private, created_at, updated_at FROM memos WHERE user=? ORDER BY created_at DESC", user.Id)
+	perPage := perPageFor(user, mypagePerPage)
+	memos, more := userPage(user.Id, page, perPage)
+	reports, err := myReports(r.Context(), readDB(r, dbConn), user.Id)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
-	memos := make(Memos, 0)
-	for rows.Next() {
-		memo := Memo{}
-		rows.Scan(&memo.Id, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
-		memos = append(memos, &memo)
+	templates, err := listMemoTemplates(r.Context(), readDB(r, dbConn), user.Id)
+	if err != nil {
+		handleError(w, r, err)
+		return
 	}
 	v := &View{
-		Memos:   &memos,
-		User:    user,
-		Session: session,
+		User:          user,
+		Page:          page,
+		Teams:         teams.Of(user.Id),
+		Reports:       reports,
+		MemoTemplates: templates,
+		Session:       session,
+	}
+	// ?template=ID starts the new memo from one of the user's templates.
+	if id, err := strconv.Atoi(r.FormValue("template")); err == nil {
+		for _, t := range templates {
+			if t.Id == id {
+				v.Draft = &Memo{Content: t.Content}
+			}
+		}
+	}
+	if more {
+		v.MorePath = "/mypage?page=" + strconv.Itoa(page+1)
 	}
-	if err = tmpl.ExecuteTemplate(w, "mypage", v); err != nil {
-		serverError(w, err)
+	v.Memos = memos
+	if err = renderTemplate(w, r, "mypage", v); err != nil {
+		handleError(w, r, err)
 	}
 }
 
 func memoHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	prepareHandler(w, r)
 	vars := mux.Vars(r)
-	memoId := vars["memo_id"]
+	memoId, err := parseMemoRef(vars["memo_id"])
+	if err != nil {
+		handleError(w, r, notFoundError(""))
+		return
+	}
 	dbConn := <-dbConnPool
 	defer func() {
 		dbConnPool <- dbConn
 	}()
-	user := getUser(w, r, dbConn, session)
+	user := getUser(w, r, session)
 
-	rows, err := dbConn.Query("SELECT id, user, content, is_private, created_at, updated_at FROM memos WHERE id=?", memoId)
+	_, span := startSpan(r.Context(), "cache.memo")
+	memo, err := findMemo(user, memoId)
+	span.End()
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
-	memo := &Memo{}
-	if rows.Next() {
-		rows.Scan(&memo.Id, &memo.User, &memo.Content, &memo.IsPrivate, &memo.CreatedAt, &memo.UpdatedAt)
-		rows.Close()
-	} else {
-		notFound(w)
+	if path := memo.Path(); r.URL.EscapedPath() != path {
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, path, http.StatusMovedPermanently)
 		return
 	}
-	if memo.IsPrivate == 1 {
-		if user == nil || user.Id != memo.User {
-			notFound(w)
-			return
+
+	if r.FormValue("print") == "1" {
+		if impersonation(session) == nil {
+			memoViews.Add(memo.Id)
+			memoVisitors.Add(memo.Id, visitorKey(r, user, session))
+		}
+		v := &View{User: user, Memo: memo, Content: renderedHTMLFor(memo, user), Session: session}
+		if err = renderMemoPrint(w, r, v); err != nil {
+			handleError(w, r, err)
 		}
-	}
-	rows, err = dbConn.Query("SELECT username FROM users WHERE id=?", memo.User)
-	if err != nil {
-		serverError(w, err)
 		return
 	}
-	if rows.Next() {
-		rows.Scan(users[memo.User].Username)
-		rows.Close()
-	}
 
-	var cond string
-	if user != nil && user.Id == memo.User {
-		cond = ""
-	} else {
-		cond = "AND is_private=0"
+	older, newer := findNeighbors(user, memo)
+
+	v := &View{
+		User:     user,
+		Memo:     memo,
+		Older:    older,
+		Newer:    newer,
+		Content:  renderedHTMLFor(memo, user),
+		Previews: linkPreviews.For(memo),
+		Session:  session,
+	}
+	if user != nil {
+		v.Following = follows.Following(user.Id, memo.User)
+	}
+	// ?similar=ID is added after a post that nearly repeats the author's
+	// memo ID.
+	if similar, err := strconv.Atoi(r.FormValue("similar")); err == nil && user != nil && user.Id == memo.User {
+		if other, ok := memoCache.Get(similar); ok && other.User == user.Id && other.Id != memo.Id {
+			v.Similar = other
+		}
 	}
-	rows, err = dbConn.Query("SELECT id, content, is_private, created_at, updated_at FROM memos WHERE user=? "+cond+" ORDER BY created_at", memo.User)
-	if err != nil {
-		serverError(w, err)
+	if v.Attachments, err = listAttachments(r.Context(), readDB(r, dbConn), memo.Id); err != nil {
+		handleError(w, r, err)
 		return
 	}
-	memos := make(Memos, 0)
-	for rows.Next() {
-		m := Memo{}
-		rows.Scan(&m.Id, &m.Content, &m.IsPrivate, &m.CreatedAt, &m.UpdatedAt)
-		memos = append(memos, &m)
-	}
-	rows.Close()
-	var older *Memo
-	var newer *Memo
-	for i, m := range memos {
-		if m.Id == memo.Id {
-			if i > 0 {
-				older = memos[i-1]
-			}
-			if i < len(memos)-1 {
-				newer = memos[i+1]
-			}
-		}
+	// An admin viewing as the user is not counted as a view.
+	if impersonation(session) == nil {
+		memoViews.Add(memo.Id)
+		memoVisitors.Add(memo.Id, visitorKey(r, user, session))
 	}
-
-	v := &View{
-		User:    user,
-		Memo:    memo,
-		Older:   older,
-		Newer:   newer,
-		Session: session,
-	}
-	if err = tmpl.ExecuteTemplate(w, "memo", v); err != nil {
-		serverError(w, err)
+	v.Visitors = memoVisitors.Count(memo.Id)
+	if err = renderTemplate(w, r, "memo", v); err != nil {
+		handleError(w, r, err)
 	}
 }
 
 func memoPostHandler(w http.ResponseWriter, r *http.Request) {
 	session, err := loadSession(w, r)
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	prepareHandler(w, r)
@@ -563,25 +772,76 @@ func memoPostHandler(w http.ResponseWriter, r *http.Request) {
 		dbConnPool <- dbConn
 	}()
 
-	user := getUser(w, r, dbConn, session)
-	if user == nil {
-		http.Redirect(w, r, "/", http.StatusFound)
+	user := getUser(w, r, session)
+	visibility, err := visibilityFromForm(r)
+	if err != nil {
+		handleError(w, r, err)
 		return
 	}
-	var isPrivate int
-	if r.FormValue("is_private") == "1" {
-		isPrivate = 1
-	} else {
-		isPrivate = 0
+	teamId, err := teamFromForm(r, user, visibility)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	content := r.FormValue("content")
+	key := postKey(user.Id, visibility, content)
+	post, owner := recentPosts.begin(key)
+	if !owner {
+		if id := post.wait(); id > 0 {
+			http.Redirect(w, r, memoPath(int(id)), http.StatusFound)
+			return
+		}
 	}
-	result, err := dbConn.Exec(
-		"INSERT INTO memos (user, content, is_private, created_at) VALUES (?, ?, ?, now())",
-		user.Id, r.FormValue("content"), isPrivate,
-	)
+	var newId int64
+	if owner {
+		defer func() { recentPosts.finish(key, post, newId) }()
+	}
+	action, reason := checkContent(r.Context(), user, content)
+	if action == spamReject {
+		renderError(w, r, http.StatusUnprocessableEntity, "your memo was not posted ("+reason+")")
+		return
+	}
+
+	var memo *Memo
+	err = withTx(r.Context(), dbConn, func(tx *sql.Tx) error {
+		result, err := execSQL(r.Context(), tx,
+			"INSERT INTO memos (user, content, visibility, team_id, hidden, created_at) VALUES (?, ?, ?, ?, ?, now())",
+			user.Id, content, visibility, teamIdArg(teamId), action == spamHide,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if action == spamFlag {
+			_, err = execSQL(r.Context(), tx, "INSERT INTO memo_flags (memo_id, reason, created_at) VALUES (?, ?, now())", id, reason)
+			if err != nil {
+				return err
+			}
+		}
+		if err = assignSlug(r.Context(), tx, id, content); err != nil {
+			return err
+		}
+		memo, err = loadMemo(r.Context(), tx, id)
+		return err
+	})
 	if err != nil {
-		serverError(w, err)
+		handleError(w, r, err)
 		return
 	}
-	newId, _ := result.LastInsertId()
-	http.Redirect(w, r, fmt.Sprintf("/memo/%d", newId), http.StatusFound)
+	newId = int64(memo.Id)
+	memoCache.Put(memo)
+	fanOut(memo)
+	indexTeamMemo(nil, memo)
+	if memo.Listed() {
+		listFragments.Purge()
+	}
+	path := memo.Path()
+	if similar := findNearDuplicate(memo); similar != nil {
+		path += "?similar=" + strconv.Itoa(similar.Id)
+	}
+	markWrite(w)
+	http.Redirect(w, r, path, http.StatusFound)
 }
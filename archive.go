@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ArchivePage is what the "archive" template renders besides the memos.
+type ArchivePage struct {
+	Month    time.Time
+	Author   *User
+	PrevPath string
+	NextPath string
+	MorePath string
+}
+
+// archivePath is the archive page for the month t falls in, in dbLocation.
+func archivePath(t time.Time) string {
+	t = t.In(dbLocation)
+	return fmt.Sprintf("/archive/%04d/%02d", t.Year(), t.Month())
+}
+
+func userArchivePath(userId int, t time.Time) string {
+	return "/user/" + strconv.Itoa(userId) + archivePath(t)
+}
+
+// listedBetween returns the listed memos created in [from, to), newest
+// first. The slice is shared with the index.
+func listedBetween(from, to time.Time) Memos {
+	memos := memoCache.Listed()
+	start := sort.Search(len(memos), func(i int) bool {
+		return memos[i].CreatedAt.Before(to)
+	})
+	end := start + sort.Search(len(memos)-start, func(i int) bool {
+		return memos[start+i].CreatedAt.Before(from)
+	})
+	return memos[start:end:end]
+}
+
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	vars := mux.Vars(r)
+	year, _ := strconv.Atoi(vars["year"])
+	month, _ := strconv.Atoi(vars["month"])
+	if month < 1 || month > 12 {
+		handleError(w, r, notFoundError(""))
+		return
+	}
+	var author *User
+	if id, ok := vars["user_id"]; ok {
+		userId, _ := strconv.Atoi(id)
+		if author, ok = userCache.Get(userId); !ok {
+			handleError(w, r, notFoundError(""))
+			return
+		}
+	}
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 {
+		page = 0
+	}
+	user := getUser(w, r, session)
+
+	from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, dbLocation)
+	to := from.AddDate(0, 1, 0)
+	memos := listedBetween(from, to)
+	if author != nil {
+		mine := getMemoSlice()
+		defer putMemoSlice(mine)
+		for _, memo := range memos {
+			if memo.User == author.Id {
+				*mine = append(*mine, memo)
+			}
+		}
+		memos = *mine
+	}
+	total := len(memos)
+	start, end := pageBounds(page, memosPerPage, total)
+
+	archive := &ArchivePage{Month: from, Author: author}
+	if author != nil {
+		archive.PrevPath = userArchivePath(author.Id, from.AddDate(0, -1, 0))
+		archive.NextPath = userArchivePath(author.Id, to)
+	} else {
+		archive.PrevPath = archivePath(from.AddDate(0, -1, 0))
+		archive.NextPath = archivePath(to)
+	}
+	if end < total {
+		archive.MorePath = r.URL.Path + "?page=" + strconv.Itoa(page+1)
+	}
+	v := &View{
+		User:      user,
+		Memos:     memos[start:end],
+		Total:     total,
+		Page:      page,
+		PageStart: start + 1,
+		PageEnd:   end,
+		Archive:   archive,
+		Session:   session,
+	}
+	if err = renderTemplate(w, r, "archive", v); err != nil {
+		handleError(w, r, err)
+	}
+}
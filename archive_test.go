@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListedBetween(t *testing.T) {
+	putListedMemos(t, 250)
+	from := listTestEpoch.Add(100 * time.Second)
+	memos := listedBetween(from, from.Add(50*time.Second))
+	if len(memos) != 50 || memos[0].Id != 149 || memos[49].Id != 100 {
+		t.Fatalf("listedBetween = %d memos, %d to %d", len(memos), memos[0].Id, memos[len(memos)-1].Id)
+	}
+	if memos := listedBetween(from.AddDate(1, 0, 0), from.AddDate(1, 1, 0)); len(memos) != 0 {
+		t.Errorf("listedBetween a later month = %d memos", len(memos))
+	}
+
+	if got := archivePath(listTestEpoch); got != "/archive/2013/10" {
+		t.Errorf("archivePath = %q", got)
+	}
+	if got := userArchivePath(3, listTestEpoch.AddDate(0, 3, 0)); got != "/user/3/archive/2014/01" {
+		t.Errorf("userArchivePath = %q", got)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	maxAttachmentsPerMemo = 20
+	maxAttachmentNameLen  = 128
+	// multipartMemory is how much of a multipart body is kept in memory;
+	// file parts beyond it are spooled to temporary files.
+	multipartMemory = 1 << 20
+)
+
+const (
+	listAttachmentsSQL  = "SELECT id, memo_id, user_id, blob_key, filename, content_type, size, variants FROM memo_attachments WHERE memo_id=? ORDER BY id"
+	getAttachmentSQL    = "SELECT id, memo_id, user_id, blob_key, filename, content_type, size, variants FROM memo_attachments WHERE id=?"
+	insertAttachmentSQL = "INSERT INTO memo_attachments (memo_id, user_id, blob_key, filename, content_type, size, created_at) VALUES (?, ?, ?, ?, ?, ?, now())"
+	deleteAttachmentSQL = "DELETE FROM memo_attachments WHERE id=? AND user_id=?"
+	// deleteMemoAttachmentsSQL goes with the memo, in deleteMemo.
+	deleteMemoAttachmentsSQL = "DELETE FROM memo_attachments WHERE memo_id=?"
+)
+
+// Attachment is a file uploaded to a memo. The file itself is in blobs
+// under Key.
+type Attachment struct {
+	Id          int
+	Memo        int
+	User        int
+	Key         string
+	Filename    string
+	ContentType string
+	Size        int
+	// Variants lists the sizes stored of an image, empty until they are
+	// made; see thumbnails.go.
+	Variants string
+}
+
+func (a *Attachment) Path() string {
+	return "/attachments/" + strconv.Itoa(a.Id)
+}
+
+// Inline reports whether browsers may show the file rather than download
+// it. Only images are, so an uploaded page cannot run as the site.
+func (a *Attachment) Inline() bool {
+	switch a.ContentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return a.Variants != variantsNone
+	case "image/webp":
+		return true
+	}
+	return false
+}
+
+func scanAttachment(row interface{ Scan(...interface{}) error }) (*Attachment, error) {
+	a := &Attachment{}
+	err := row.Scan(&a.Id, &a.Memo, &a.User, &a.Key, &a.Filename, &a.ContentType, &a.Size, &a.Variants)
+	return a, err
+}
+
+func listAttachments(ctx context.Context, q querier, memoId int) ([]*Attachment, error) {
+	rows, err := q.QueryContext(ctx, listAttachmentsSQL, memoId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var attachments []*Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// findAttachment returns attachment id if user may see its memo, or a
+// not-found error.
+func findAttachment(ctx context.Context, q querier, user *User, id int) (*Attachment, error) {
+	a, err := scanAttachment(q.QueryRowContext(ctx, getAttachmentSQL, id))
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := findMemo(user, a.Memo); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// attachmentName keeps the base of an uploaded file's name without
+// control characters, for Content-Disposition.
+func attachmentName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	for utf8.RuneCountInString(name) > maxAttachmentNameLen {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+func newBlobKey(memoId int) string {
+	return "memos/" + strconv.Itoa(memoId) + "/" + hex.EncodeToString(securecookie.GenerateRandomKey(16))
+}
+
+// attachmentPostHandler stores the file of an upload form and attaches it
+// to the memo.
+func attachmentPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	if antiCSRF(w, r, session) {
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+	memo, err := editableMemo(r, user)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		handleError(w, r, validationError("choose a file to attach"))
+		return
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer file.Close()
+	existing, err := listAttachments(r.Context(), dbConn, memo.Id)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if len(existing) >= maxAttachmentsPerMemo {
+		handleError(w, r, validationError("a memo can have up to 20 attachments"))
+		return
+	}
+
+	// The type is sniffed rather than taken from the browser.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		handleError(w, r, err)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	a := &Attachment{
+		Memo:        memo.Id,
+		User:        user.Id,
+		Key:         newBlobKey(memo.Id),
+		Filename:    attachmentName(header.Filename),
+		ContentType: http.DetectContentType(head[:n]),
+		Size:        int(header.Size),
+	}
+	if err := blobs.Put(r.Context(), a.Key, file, header.Size, a.ContentType); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	result, err := execSQL(r.Context(), dbConn, insertAttachmentSQL, a.Memo, a.User, a.Key, a.Filename, a.ContentType, a.Size)
+	if err != nil {
+		if derr := blobs.Delete(context.Background(), a.Key); derr != nil {
+			log.Printf("attachment: leaving blob %s: %s", a.Key, derr)
+		}
+		handleError(w, r, err)
+		return
+	}
+	if resizable(a.ContentType) {
+		id, _ := result.LastInsertId()
+		if err := jobs.Enqueue("attachment.resize", &resizeJob{AttachmentId: int(id)}); err != nil {
+			log.Printf("attachment %d: %s", id, err)
+		}
+	}
+	markWrite(w)
+	flash(w, r, session, noticeSuccess, a.Filename+" was attached.")
+	http.Redirect(w, r, memo.Path(), http.StatusFound)
+}
+
+// attachmentHandler serves an attachment to those who can see its memo.
+// Stores with signed URLs are read directly by the browser; the local one
+// is streamed through the app.
+func attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+	id, _ := strconv.Atoi(mux.Vars(r)["attachment_id"])
+	a, err := findAttachment(r.Context(), readDB(r, dbConn), user, id)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	key, contentType, length, err := a.blob(r.FormValue("size"), user)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "private")
+	if u := blobs.SignedURL(key, time.Now().Add(config.Blobs.urlTTL())); u != "" {
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+	body, err := blobs.Get(r.Context(), key)
+	if err == errBlobAbsent {
+		err = notFoundError("")
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer body.Close()
+	disposition := "attachment"
+	if a.Inline() {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if length >= 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(length))
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("attachment %d: %s", a.Id, err)
+	}
+}
+
+// attachmentDeleteHandler removes an attachment and its files. Only the
+// uploader can, and not while the memo is locked.
+func attachmentDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	if antiCSRF(w, r, session) {
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+	id, _ := strconv.Atoi(mux.Vars(r)["attachment_id"])
+	a, err := findAttachment(r.Context(), dbConn, user, id)
+	if err == nil && a.User != user.Id {
+		err = notFoundError("")
+	}
+	if err == nil {
+		if memo, _ := memoCache.Get(a.Memo); memo != nil && memo.Locked {
+			err = forbiddenError("this memo was locked by a moderator")
+		}
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if _, err := execSQL(r.Context(), dbConn, deleteAttachmentSQL, a.Id, user.Id); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	for _, key := range a.blobKeys() {
+		if err := blobs.Delete(r.Context(), key); err != nil {
+			log.Printf("attachment: leaving blob %s: %s", key, err)
+		}
+	}
+	markWrite(w)
+	flash(w, r, session, noticeSuccess, a.Filename+" was deleted.")
+	http.Redirect(w, r, memoPath(a.Memo), http.StatusFound)
+}
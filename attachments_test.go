@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentName(t *testing.T) {
+	for in, want := range map[string]string{
+		"notes.txt":              "notes.txt",
+		`C:\Users\me\photo.png`:  "photo.png",
+		"../../etc/passwd":       "passwd",
+		"a\"b\r\nc.txt":          "abc.txt",
+		"":                       "file",
+		strings.Repeat("あ", 200): strings.Repeat("あ", maxAttachmentNameLen),
+	} {
+		if got := attachmentName(in); got != want {
+			t.Errorf("attachmentName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func (app *memoryApp) upload(tb testing.TB, path, name string, content []byte) *http.Response {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("sid", app.sid)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write(content)
+	mw.Close()
+	res, err := app.client.Post(app.URL+path, mw.FormDataContentType(), &body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestAttachments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(b BlobStore) { blobs = b }(blobs)
+	blobs = &localBlobStore{dir: dir}
+
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 5})
+	res := app.postMemo(t, url.Values{"content": {"# with a file\nsee the attachment"}, "visibility": {"private"}})
+	memoPage := res.Request.URL.Path
+	id := strings.SplitN(strings.TrimPrefix(memoPage, "/memo/"), "-", 2)[0]
+
+	content := []byte("<html><script>alert(1)</script></html>")
+	res = app.upload(t, "/memo/"+id+"/attachments", "page.html", content)
+	if res.StatusCode != http.StatusOK || res.Request.URL.Path != memoPage {
+		t.Fatalf("upload ended at %s with %d", res.Request.URL, res.StatusCode)
+	}
+	link := regexp.MustCompile(`href="[^"]*(/attachments/[0-9]+)">page.html</a>`).FindStringSubmatch(app.get(t, memoPage))
+	if link == nil {
+		t.Fatalf("memo page does not list the attachment")
+	}
+
+	res, err = app.client.Get(app.URL + link[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !bytes.Equal(got, content) {
+		t.Errorf("download = %q", got)
+	}
+	if cd := res.Header.Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") {
+		t.Errorf("html served with Content-Disposition %q", cd)
+	}
+	if nosniff := res.Header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q", nosniff)
+	}
+
+	// The memo is private, so the file is too.
+	res, err = http.Get(app.URL + link[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("signed out download: %d, want 404", res.StatusCode)
+	}
+
+	// Nor can a file be taken off a memo a moderator locked.
+	memoId, _ := strconv.Atoi(id)
+	moderate := func(action string, args ...interface{}) {
+		conn := <-dbConnPool
+		defer func() { dbConnPool <- conn }()
+		if _, err := moderateMemo(context.Background(), conn, memoId, moderationActions[action], args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	moderate("lock", "under review")
+	if res := app.post(t, link[1]+"/delete", url.Values{}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("delete from a locked memo: %d, want 403", res.StatusCode)
+	}
+	moderate("unlock")
+
+	res = app.post(t, link[1]+"/delete", url.Values{})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %d", res.StatusCode)
+	}
+	if strings.Contains(app.get(t, memoPage), link[1]) {
+		t.Errorf("deleted attachment is still listed")
+	}
+	if files, _ := ioutil.ReadDir(dir + "/memos/" + id); len(files) != 0 {
+		t.Errorf("deleted attachment left %d files", len(files))
+	}
+}
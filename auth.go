@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gorilla/securecookie"
+)
+
+// dummyUser stands in for unknown usernames so that a failed signin costs
+// the same whether or not the account exists.
+var dummyUser = &User{
+	Salt:     fmt.Sprintf("%x", securecookie.GenerateRandomKey(16)),
+	Password: fmt.Sprintf("%x", securecookie.GenerateRandomKey(sha256.Size)),
+}
+
+func passwordHash(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate returns the user if password is theirs. Users are looked
+// up in the cache only: querying the table for names it doesn't hold
+// would make unknown names measurably slower. Accounts created outside
+// this process appear once user_reconcile has run.
+func authenticate(username, password string) (*User, bool) {
+	user, ok := userCache.GetByName(username)
+	candidate := user
+	if !ok {
+		candidate = dummyUser
+	}
+	hash := passwordHash(candidate.Salt, password)
+	match := subtle.ConstantTimeCompare([]byte(hash), []byte(candidate.Password)) == 1
+	if !ok || !match {
+		return nil, false
+	}
+	return user, true
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	// The stored format is the lowercase hex sha256 of salt+password.
+	want := fmt.Sprintf("%x", sha256.Sum256([]byte("saltsecret")))
+	if got := passwordHash("salt", "secret"); got != want {
+		t.Fatalf("passwordHash = %s, want %s", got, want)
+	}
+
+	userCache.Put(&User{Id: 903, Username: "auth_user", Salt: "salt", Password: want})
+	defer userCache.Remove(903)
+
+	if user, ok := authenticate("auth_user", "secret"); !ok || user.Id != 903 {
+		t.Errorf("authenticate with the right password = %v, %v", user, ok)
+	}
+	if _, ok := authenticate("auth_user", "wrong"); ok {
+		t.Errorf("authenticate accepted a wrong password")
+	}
+	if _, ok := authenticate("no_such_user", ""); ok {
+		t.Errorf("authenticate accepted an unknown user")
+	}
+}
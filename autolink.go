@@ -0,0 +1,72 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// bareURLRe matches http(s) URLs in escaped HTML text. Trailing
+// punctuation is left out since it usually ends the sentence instead.
+var bareURLRe = regexp.MustCompile(`https?://[^\s<>"']*[^\s<>"'.,;:!?)]`)
+
+// mapHTMLText applies f to the text between the tags of rendered HTML,
+// skipping text inside any of the skip elements.
+func mapHTMLText(s string, skip []string, f func(string) string) string {
+	var b strings.Builder
+	depth := 0
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			i = len(s)
+		}
+		if depth > 0 {
+			b.WriteString(s[:i])
+		} else {
+			b.WriteString(f(s[:i]))
+		}
+		s = s[i:]
+		if len(s) == 0 {
+			break
+		}
+		j := strings.IndexByte(s, '>')
+		if j < 0 {
+			j = len(s) - 1
+		}
+		tag := strings.ToLower(s[:j+1])
+		for _, name := range skip {
+			if tagIs(tag, "<"+name) {
+				depth++
+			} else if tagIs(tag, "</"+name) && depth > 0 {
+				depth--
+			}
+		}
+		b.WriteString(s[:j+1])
+		s = s[j+1:]
+	}
+	return b.String()
+}
+
+// tagIs reports whether tag starts with prefix followed by the end of the
+// tag name, so "<a" matches "<a href=..." but not "<abbr>".
+func tagIs(tag, prefix string) bool {
+	if !strings.HasPrefix(tag, prefix) || len(tag) == len(prefix) {
+		return false
+	}
+	switch tag[len(prefix)] {
+	case ' ', '>', '/', '\t', '\n':
+		return true
+	}
+	return false
+}
+
+// autolink turns bare URLs in rendered HTML into links, leaving existing
+// links and code alone.
+func autolink(s string) string {
+	return mapHTMLText(s, []string{"a", "code", "pre"}, func(text string) string {
+		return bareURLRe.ReplaceAllStringFunc(text, func(u string) string {
+			href := html.EscapeString(html.UnescapeString(u))
+			return `<a href="` + href + `" rel="nofollow">` + u + `</a>`
+		})
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+)
+
+// siteBanner is the message shown at the top of every page, such as a
+// maintenance notice. It lives in the site_banner table so that every
+// instance shows the same one; the banner_refresh task picks up changes
+// made through other instances.
+var siteBanner = &bannerCache{}
+
+type bannerCache struct {
+	sync.RWMutex
+	message string
+}
+
+func (c *bannerCache) Message() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.message
+}
+
+func (c *bannerCache) set(message string) {
+	c.Lock()
+	c.message = message
+	c.Unlock()
+}
+
+func (c *bannerCache) Load(dbConn *sql.DB) error {
+	var message string
+	err := dbConn.QueryRow("SELECT message FROM site_banner WHERE id=1").Scan(&message)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	c.set(message)
+	return nil
+}
+
+func refreshBannerTask() error {
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	return siteBanner.Load(dbConn)
+}
+
+// bannerHandler shows the form, which asks for the admin token each time
+// rather than echoing it back into the page.
+func bannerHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+	v := struct {
+		Message string
+	}{siteBanner.Message()}
+	if err := themeTemplates(defaultTheme).ExecuteTemplate(w, "admin_banner", v); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+// bannerPostHandler replaces the banner; an empty message removes it.
+func bannerPostHandler(w http.ResponseWriter, r *http.Request) {
+	message := r.FormValue("message")
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	_, err := execSQL(r.Context(), dbConn,
+		"INSERT INTO site_banner (id, message, updated_at) VALUES (1, ?, now()) ON DUPLICATE KEY UPDATE message=VALUES(message), updated_at=now()",
+		message,
+	)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	siteBanner.set(message)
+	audit("admin "+r.RemoteAddr, "banner.set", []string{message})
+	if r.Header.Get("X-Admin-Token") != "" {
+		writeJSON(w, http.StatusOK, map[string]string{"message": message})
+		return
+	}
+	bannerHandler(w, r)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// benchRoutes are what each bench-local client requests in turn; path
+// gets the client's random source and the data set.
+var benchRoutes = []struct {
+	route string
+	path  func(rng *rand.Rand, seed memorySeed) string
+}{
+	{"/", func(*rand.Rand, memorySeed) string { return "/" }},
+	{"/recent/{page}", func(rng *rand.Rand, seed memorySeed) string {
+		return "/recent/" + strconv.Itoa(1+rng.Intn(seed.Memos/memosPerPage+1))
+	}},
+	{"/memo/{memo_id}", func(rng *rand.Rand, seed memorySeed) string {
+		return "/memo/" + strconv.Itoa(1+rng.Intn(seed.Memos))
+	}},
+	{"/mypage", func(*rand.Rand, memorySeed) string { return "/mypage" }},
+	{"/timeline", func(*rand.Rand, memorySeed) string { return "/timeline" }},
+	{"/popular", func(*rand.Rand, memorySeed) string { return "/popular" }},
+	{"/api/memos", func(*rand.Rand, memorySeed) string { return "/api/memos" }},
+}
+
+type benchSample struct {
+	route    string
+	status   int
+	duration time.Duration
+}
+
+// benchRoute is what bench-local found for one route.
+type benchRoute struct {
+	Route              string
+	Count, Errors      int
+	P50, P95, P99, Max time.Duration
+}
+
+// runBench has clients signed in as user1, user2, ... request benchRoutes
+// from base until d has passed. Requests that fail or return a 5xx count
+// as errors; 404s for memos the user may not see do not.
+func runBench(base string, seed memorySeed, d time.Duration, clients int) ([]benchRoute, error) {
+	deadline := time.Now().Add(d)
+	samples := make(chan []benchSample, clients)
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			jar, _ := cookiejar.New(nil)
+			client := &http.Client{Jar: jar}
+			name := "user" + strconv.Itoa(1+i%seed.Users)
+			res, err := client.PostForm(base+"/signin", url.Values{"username": {name}, "password": {name}})
+			if err != nil {
+				errs <- err
+				return
+			}
+			res.Body.Close()
+			rng := rand.New(rand.NewSource(seed.Seed + int64(i)))
+			var mine []benchSample
+			for n := i; time.Now().Before(deadline); n++ {
+				r := benchRoutes[n%len(benchRoutes)]
+				start := time.Now()
+				res, err := client.Get(base + r.path(rng, seed))
+				s := benchSample{route: r.route, duration: time.Since(start)}
+				if err == nil {
+					io.Copy(ioutil.Discard, res.Body)
+					res.Body.Close()
+					s.status = res.StatusCode
+				}
+				mine = append(mine, s)
+			}
+			samples <- mine
+		}(i)
+	}
+	wg.Wait()
+	close(samples)
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	byRoute := make(map[string][]benchSample)
+	for mine := range samples {
+		for _, s := range mine {
+			byRoute[s.route] = append(byRoute[s.route], s)
+		}
+	}
+	var routes []benchRoute
+	for route, ss := range byRoute {
+		sort.Slice(ss, func(i, j int) bool { return ss[i].duration < ss[j].duration })
+		r := benchRoute{Route: route, Count: len(ss), Max: ss[len(ss)-1].duration}
+		r.P50, r.P95, r.P99 = ss[(len(ss)-1)*50/100].duration, ss[(len(ss)-1)*95/100].duration, ss[(len(ss)-1)*99/100].duration
+		for _, s := range ss {
+			if s.status == 0 || s.status >= 500 {
+				r.Errors++
+			}
+		}
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Route < routes[j].Route })
+	return routes, nil
+}
+
+func printBench(w io.Writer, routes []benchRoute, d time.Duration) {
+	fmt.Fprintf(w, "%-20s %7s %8s %10s %10s %10s %10s %6s\n", "route", "count", "req/s", "p50", "p95", "p99", "max", "errors")
+	for _, r := range routes {
+		fmt.Fprintf(w, "%-20s %7d %8.1f %10s %10s %10s %10s %6d\n", r.Route, r.Count, float64(r.Count)/d.Seconds(),
+			r.P50.Round(time.Microsecond), r.P95.Round(time.Microsecond), r.P99.Round(time.Microsecond), r.Max.Round(time.Microsecond), r.Errors)
+	}
+}
+
+// benchLocalCommand serves the router on the memory database inside the
+// process and loads it, for comparing changes without MySQL or a
+// benchmarker. The configuration's rate limits and captcha still apply.
+func benchLocalCommand(args []string) error {
+	fs := flag.NewFlagSet("bench-local", flag.ExitOnError)
+	seed := defaultMemorySeed
+	registerSeedFlags(fs, &seed, "memory data set")
+	d := fs.Duration("duration", 10*time.Second, "how long to keep loading the server")
+	clients := fs.Int("clients", 8, "concurrent clients, each signed in as its own user")
+	fs.Parse(args)
+	if seed.Users < 1 || seed.Memos < 1 || *clients < 1 {
+		return fmt.Errorf("need at least one user, memo and client")
+	}
+
+	loadEnvConfig()
+	if err := setupHandlers(); err != nil {
+		return err
+	}
+	driverName, dsn := useMemoryDatabase(config, seed)
+	dbConnPool = make(chan *sql.DB, dbConnPoolSize)
+	for i := 0; i < dbConnPoolSize; i++ {
+		conn, err := sql.Open(driverName, dsn)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		dbConnPool <- conn
+	}
+	conn := <-dbConnPool
+	dbConnPool <- conn
+	if err := initialize(conn); err != nil {
+		return err
+	}
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	routes, err := runBench(srv.URL, seed, *d, *clients)
+	if err != nil {
+		return err
+	}
+	printBench(os.Stdout, routes, *d)
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunBench(t *testing.T) {
+	seed := memorySeed{Seed: 2, Users: 3, Memos: 30}
+	app := startMemoryApp(t, seed)
+	routes, err := runBench(app.URL, seed, 200*time.Millisecond, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != len(benchRoutes) {
+		t.Fatalf("%d routes in the report, want %d", len(routes), len(benchRoutes))
+	}
+	for _, r := range routes {
+		if r.Count == 0 || r.Errors > 0 || r.P50 > r.P99 || r.P99 > r.Max {
+			t.Errorf("%+v", r)
+		}
+	}
+}
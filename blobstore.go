@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBlobDir    = tmpDir + "isucon_blobs"
+	defaultBlobURLTTL = 15 * time.Minute
+	blobTimeout       = 30 * time.Second
+)
+
+// BlobConfig selects where uploaded files are kept. Driver is "local"
+// (the default), "s3" for S3 or a store speaking its API, or "gcs" for
+// Google Cloud Storage through its XML API with HMAC keys.
+type BlobConfig struct {
+	Driver string `json:"driver"`
+	// Dir is where the local driver writes.
+	Dir    string `json:"dir"`
+	Bucket string `json:"bucket"`
+	// Endpoint overrides the service URL, e.g. for MinIO; PathStyle puts
+	// the bucket in the path rather than the host name.
+	Endpoint  string `json:"endpoint"`
+	PathStyle bool   `json:"path_style"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	// URLTTLSec is how long signed download URLs work, 15 minutes unless
+	// set.
+	URLTTLSec int `json:"url_ttl_sec"`
+}
+
+func (c BlobConfig) urlTTL() time.Duration {
+	if c.URLTTLSec <= 0 {
+		return defaultBlobURLTTL
+	}
+	return time.Duration(c.URLTTLSec) * time.Second
+}
+
+// BlobStore keeps uploaded files by key. Bodies are streamed in both
+// directions, so a file never has to fit in memory.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL that reads key without credentials until
+	// expires, or "" if the store can only be read through the app.
+	SignedURL(key string, expires time.Time) string
+}
+
+var (
+	blobs         BlobStore = &localBlobStore{dir: defaultBlobDir}
+	errBlobAbsent           = errors.New("blob: not found")
+	blobKeyRe               = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*(/[a-z0-9._-]+)*$`)
+)
+
+func newBlobStore(c BlobConfig) (BlobStore, error) {
+	switch c.Driver {
+	case "", "local":
+		dir := c.Dir
+		if dir == "" {
+			dir = defaultBlobDir
+		}
+		return &localBlobStore{dir: dir}, nil
+	case "s3", "gcs":
+		if c.Bucket == "" || c.AccessKey == "" || c.SecretKey == "" {
+			return nil, fmt.Errorf("config: the %s blob store needs bucket, access_key and secret_key", c.Driver)
+		}
+		s := &s3BlobStore{
+			bucket:    c.Bucket,
+			region:    c.Region,
+			accessKey: c.AccessKey,
+			secretKey: c.SecretKey,
+			pathStyle: c.PathStyle,
+			client:    &http.Client{Timeout: blobTimeout},
+			now:       time.Now,
+		}
+		endpoint := c.Endpoint
+		if c.Driver == "gcs" {
+			if endpoint == "" {
+				endpoint = "https://storage.googleapis.com"
+			}
+			if s.region == "" {
+				s.region = "auto"
+			}
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if endpoint == "" {
+			endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("config: invalid blob endpoint %q", endpoint)
+		}
+		s.endpoint = u
+		return s, nil
+	}
+	return nil, fmt.Errorf("config: unknown blob driver %q", c.Driver)
+}
+
+func checkBlobKey(key string) error {
+	if !blobKeyRe.MatchString(key) || strings.Contains(key, "..") {
+		return fmt.Errorf("blob: invalid key %q", key)
+	}
+	return nil
+}
+
+// localBlobStore keeps blobs as files under dir.
+type localBlobStore struct {
+	dir string
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if err := checkBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file and renames it, so that readers never
+// see part of a blob.
+func (s *localBlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("blob: wrote %d bytes of %d", n, size)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errBlobAbsent
+	}
+	return f, err
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) SignedURL(key string, expires time.Time) string {
+	return ""
+}
+
+// s3BlobStore talks to S3, or to any store taking its requests signed
+// with AWS Signature Version 4, such as GCS's XML API and MinIO.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+	now       func() time.Time
+}
+
+const (
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3TimeFormat     = "20060102T150405Z"
+	s3UnsignedBody   = "UNSIGNED-PAYLOAD"
+	maxSignedURLSecs = 7 * 24 * 60 * 60
+)
+
+func (s *s3BlobStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return &u
+}
+
+// s3Escape encodes a path or query value the way Signature Version 4
+// wants: everything but unreserved characters, and "/" in paths.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signature signs the canonical request made of method, u, the given
+// headers (lowercase names) and payload hash, at t.
+func (s *s3BlobStore) signature(method string, u *url.URL, headers map[string]string, payload string, t time.Time) (signed, sig string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signed = strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		method, s3Escape(u.Path, true), s3Query(u.Query()), canonicalHeaders.String(), signed, payload,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	day := t.Format("20060102")
+	toSign := strings.Join([]string{s3Algorithm, t.Format(s3TimeFormat), s.scope(day), hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return signed, hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func (s *s3BlobStore) scope(day string) string {
+	return day + "/" + s.region + "/s3/aws4_request"
+}
+
+// do sends a request for key signed in the Authorization header. The
+// body is not hashed, so it can be streamed.
+func (s *s3BlobStore) do(ctx context.Context, method, key string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	if err := checkBlobKey(key); err != nil {
+		return nil, err
+	}
+	u := s.objectURL(key)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	t := s.now().UTC()
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": s3UnsignedBody,
+		"x-amz-date":           t.Format(s3TimeFormat),
+	}
+	if body != nil {
+		req.ContentLength = size
+		headers["content-type"] = contentType
+	}
+	signed, sig := s.signature(method, u, headers, s3UnsignedBody, t)
+	for name, value := range headers {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, s.scope(t.Format("20060102")), signed, sig))
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errBlobAbsent
+	}
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		res.Body.Close()
+		return nil, fmt.Errorf("blob: %s %s: %s %s", method, key, res.Status, msg)
+	}
+	return res, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	res, err := s.do(ctx, "PUT", key, body, size, contentType)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, "GET", key, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, "DELETE", key, nil, 0, "")
+	if err == errBlobAbsent {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// SignedURL presigns a GET in the query string. Signature Version 4 caps
+// the lifetime at a week.
+func (s *s3BlobStore) SignedURL(key string, expires time.Time) string {
+	if checkBlobKey(key) != nil {
+		return ""
+	}
+	t := s.now().UTC()
+	secs := int(expires.Sub(t) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	if secs > maxSignedURLSecs {
+		secs = maxSignedURLSecs
+	}
+	u := s.objectURL(key)
+	q := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.accessKey + "/" + s.scope(t.Format("20060102"))},
+		"X-Amz-Date":          {t.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(secs)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u.RawQuery = s3Query(q)
+	_, sig := s.signature("GET", u, map[string]string{"host": u.Host}, s3UnsignedBody, t)
+	u.RawQuery += "&X-Amz-Signature=" + sig
+	return u.String()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSQLStatements(t *testing.T) {
+	stmts := sqlStatements(schemaSQL + alterSQL)
+	if n := strings.Count(schemaSQL+alterSQL, ";\n"); len(stmts) != n {
+		t.Fatalf("%d statements, want %d", len(stmts), n)
+	}
+	if !strings.HasPrefix(stmts[0], "CREATE TABLE `users`") {
+		t.Errorf("first statement is %q", stmts[0])
+	}
+	for _, stmt := range stmts {
+		if strings.HasSuffix(stmt, ";") || strings.Contains(stmt, ";\n") {
+			t.Errorf("statement %q was not split", stmt)
+		}
+	}
+	if got := sqlStatements("SELECT 1;\n\n  SELECT 2;"); len(got) != 2 || got[1] != "SELECT 2" {
+		t.Errorf("sqlStatements = %q", got)
+	}
+}
+
+// TestSchemaSteps checks that each step ends on the statement that
+// creates what its probe looks for.
+func TestSchemaSteps(t *testing.T) {
+	stmts := sqlStatements(alterSQL)
+	if last := schemaSteps[len(schemaSteps)-1].last; last != len(stmts)-1 {
+		t.Errorf("the last step ends at statement %d of %d", last, len(stmts))
+	}
+	for i, step := range schemaSteps {
+		name := step.name
+		if dot := strings.Index(name, "."); dot >= 0 {
+			name = name[dot+1:]
+		}
+		if !strings.Contains(step.probe, name) {
+			t.Errorf("step %s probes %q", step.name, step.probe)
+		}
+		// The step's last statement must create what its probe looks for,
+		// or a step cut short would pass for done.
+		created := false
+		for _, verb := range []string{"CREATE TABLE", "ADD COLUMN", "ADD INDEX", "ADD UNIQUE INDEX"} {
+			if strings.Contains(stmts[step.last], verb+" `"+name+"`") {
+				created = true
+			}
+		}
+		if !created {
+			t.Errorf("step %s ends at %q", step.name, stmts[step.last])
+		}
+		if i > 0 && step.last <= schemaSteps[i-1].last {
+			t.Errorf("step %s does not come after %s", step.name, schemaSteps[i-1].name)
+		}
+	}
+}
+
+func TestMigrateSchemaUpToDate(t *testing.T) {
+	db := openTestMemoryDB(t, memorySeed{Seed: 1, Users: 1})
+	if n, err := migrateSchema(context.Background(), db); n != 0 || err != nil {
+		t.Errorf("migrateSchema = %d, %v; want nothing to run", n, err)
+	}
+}
+
+func TestCreateInitialUser(t *testing.T) {
+	db := openTestMemoryDB(t, memorySeed{Seed: 1, Users: 2})
+	password, err := createInitialUser(db, "operator7")
+	if err != nil || len(password) != 2*initPasswordBytes {
+		t.Fatalf("createInitialUser = %q, %v", password, err)
+	}
+	if _, err := createInitialUser(db, "operator7"); err == nil {
+		t.Errorf("the same user was created twice")
+	}
+}
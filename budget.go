@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases a request's time is broken down into when it overruns its
+// latency budget.
+const (
+	phaseSession = iota
+	phaseCache
+	phaseDB
+	phaseRender
+	phaseCount
+)
+
+var phaseNames = [phaseCount]string{"session", "cache", "db", "render"}
+
+// spanPhase maps a span name to the phase it is counted in, or -1. The
+// sql.tx span is left out since the statements inside it are counted
+// one by one.
+func spanPhase(name string) int {
+	switch {
+	case strings.HasPrefix(name, "session."):
+		return phaseSession
+	case strings.HasPrefix(name, "cache."):
+		return phaseCache
+	case strings.HasPrefix(name, "template."):
+		return phaseRender
+	}
+	return -1
+}
+
+// phaseTimings adds up the time spent per phase during one request. A
+// coalesced render can still be running in another goroutine, hence the
+// lock.
+type phaseTimings struct {
+	sync.Mutex
+	total [phaseCount]time.Duration
+	count [phaseCount]int
+}
+
+func (t *phaseTimings) add(phase int, d time.Duration) {
+	t.Lock()
+	t.total[phase] += d
+	t.count[phase]++
+	t.Unlock()
+}
+
+// latencyBudget returns the budget for route, falling back to the "*"
+// entry.
+func latencyBudget(c RuntimeConfig, route string) time.Duration {
+	ms, ok := c.LatencyBudgetMs[route]
+	if !ok {
+		ms = c.LatencyBudgetMs["*"]
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// latencyBudgetMiddleware logs a warning with the per-phase breakdown
+// for every request that takes longer than its route's budget.
+func latencyBudgetMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget := latencyBudget(currentRuntimeConfig(), routeName(r))
+		info := requestInfoFrom(r.Context())
+		if budget == 0 || info == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info.timings = &phaseTimings{}
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		d := time.Since(start)
+		if d <= budget {
+			return
+		}
+		log.Print(budgetWarning(info, budget, d, sw.Status()))
+	})
+}
+
+func budgetWarning(info *requestInfo, budget, d time.Duration, status int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "latency budget exceeded: route=%q budget_ms=%.1f duration_ms=%.1f", info.Route, ms(budget), ms(d))
+	other := d
+	info.timings.Lock()
+	for phase, name := range phaseNames {
+		fmt.Fprintf(&b, " %s_ms=%.1f %s_spans=%d", name, ms(info.timings.total[phase]), name, info.timings.count[phase])
+		other -= info.timings.total[phase]
+	}
+	info.timings.Unlock()
+	if other < 0 {
+		other = 0
+	}
+	fmt.Fprintf(&b, " other_ms=%.1f status=%d user=%d ip=%s", ms(other), status, info.UserId, info.ClientIP)
+	return b.String()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
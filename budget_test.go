@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLatencyBudget(t *testing.T) {
+	defer setRuntimeConfig(currentRuntimeConfig())
+	setRuntimeConfig(RuntimeConfig{LatencyBudgetMs: map[string]int{"/slow": 5}})
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	router := mux.NewRouter()
+	router.Use(requestInfoMiddleware)
+	router.Use(latencyBudgetMiddleware)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		_, span := startSpan(r.Context(), "cache.memo")
+		time.Sleep(10 * time.Millisecond)
+		span.End()
+		_, span = startSpan(r.Context(), "template.memo")
+		endSpan(span, nil)
+	}
+	router.HandleFunc("/slow", handler)
+	router.HandleFunc("/fast", handler)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	if buf.Len() != 0 {
+		t.Errorf("route without a budget logged %q", buf.String())
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	line := buf.String()
+	for _, want := range []string{`route="GET /slow"`, "budget_ms=5.0", "cache_spans=1", "render_spans=1", "db_spans=0", "status=200"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("warning lacks %q: %s", want, line)
+		}
+	}
+}
+
+func TestLatencyBudgetFallback(t *testing.T) {
+	c := RuntimeConfig{LatencyBudgetMs: map[string]int{"*": 100, "/api/memos": 0}}
+	if got := latencyBudget(c, "/memo/{memo_id}"); got != 100*time.Millisecond {
+		t.Errorf("fallback budget = %s", got)
+	}
+	if got := latencyBudget(c, "/api/memos"); got != 0 {
+		t.Errorf("budget turned off per route = %s", got)
+	}
+}
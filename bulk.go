@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// maxBulkMemos caps how many memos one bulk action may change.
+const maxBulkMemos = 1000
+
+// setVisibilitySQL changes one of the user's memos to public or private,
+// leaving it alone if it already is, or is locked.
+const setVisibilitySQL = "UPDATE memos SET visibility=?, team_id=NULL, version=version+1, updated_at=now() WHERE id=? AND user=? AND locked=0 AND visibility<>?"
+
+// bulkMemoIds parses the checked memo ids, dropping repeats.
+func bulkMemoIds(values []string) ([]int, error) {
+	if len(values) == 0 {
+		return nil, validationError("no memos selected")
+	}
+	if len(values) > maxBulkMemos {
+		return nil, validationError("too many memos selected")
+	}
+	seen := make(map[int]bool, len(values))
+	ids := make([]int, 0, len(values))
+	for _, v := range values {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, validationError("invalid memo id")
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// bulkVisibilityHandler makes the memos checked on mypage public or
+// private in one transaction. Memos that are not the user's, or are
+// locked, are skipped.
+func bulkVisibilityHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	if antiCSRF(w, r, session) {
+		return
+	}
+	user := getUser(w, r, session)
+	visibility := Visibility(r.FormValue("visibility"))
+	if visibility != visibilityPublic && visibility != visibilityPrivate {
+		handleError(w, r, validationError("choose public or private"))
+		return
+	}
+	ids, err := bulkMemoIds(r.Form["memo_id"])
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+
+	var changed Memos
+	err = withTx(r.Context(), dbConn, func(tx *sql.Tx) error {
+		for _, id := range ids {
+			result, err := execSQL(r.Context(), tx, setVisibilitySQL, visibility, id, user.Id, visibility)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				continue
+			}
+			memo, err := loadMemo(r.Context(), tx, int64(id))
+			if err != nil {
+				return err
+			}
+			changed = append(changed, memo)
+		}
+		return nil
+	})
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	// Update the caches only once the transaction has committed, and purge
+	// the list fragments once for all the memos.
+	purge := false
+	for _, memo := range changed {
+		old, _ := memoCache.Get(memo.Id)
+		memoCache.Put(memo)
+		fanOut(memo)
+		indexTeamMemo(old, memo)
+		if memo.Listed() || (old != nil && old.Listed()) {
+			purge = true
+		}
+	}
+	if purge {
+		listFragments.Purge()
+	}
+	markWrite(w)
+	flash(w, r, session, noticeSuccess, "Changed the visibility of "+strconv.Itoa(len(changed))+" of "+strconv.Itoa(len(ids))+" memos.")
+	http.Redirect(w, r, "/mypage", http.StatusFound)
+}
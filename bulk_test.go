@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBulkVisibility(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 9, Users: 2, Memos: 6})
+	var mine []string
+	for i := 0; i < 3; i++ {
+		res := app.postMemo(t, url.Values{"content": {fmt.Sprintf("bulk memo %d", i)}, "visibility": {"public"}})
+		mine = append(mine, strings.SplitN(strings.TrimPrefix(res.Request.URL.Path, "/memo/"), "-", 2)[0])
+	}
+	var theirs *Memo
+	memoCache.Each(func(m *Memo) {
+		if m.User != 1 && m.Listed() {
+			theirs = m
+		}
+	})
+	if theirs == nil {
+		t.Fatal("no listed memo by another user")
+	}
+	_, before := listedPage(0)
+
+	res := app.post(t, "/mypage/visibility", url.Values{
+		"visibility": {"private"},
+		"memo_id":    {mine[0], mine[1], mine[1], strconv.Itoa(theirs.Id)},
+	})
+	if res.StatusCode != http.StatusOK || res.Request.URL.Path != "/mypage" {
+		t.Fatalf("bulk: %d at %s", res.StatusCode, res.Request.URL.Path)
+	}
+	for i, id := range mine {
+		n, _ := strconv.Atoi(id)
+		memo, _ := memoCache.Get(n)
+		want := visibilityPrivate
+		if i == 2 {
+			want = visibilityPublic
+		}
+		if memo.Visibility != want {
+			t.Errorf("memo %s is %s, want %s", id, memo.Visibility, want)
+		}
+	}
+	if memo, _ := memoCache.Get(theirs.Id); memo.Visibility != theirs.Visibility || memo.Version != theirs.Version {
+		t.Errorf("another user's memo was changed: %+v", memo)
+	}
+	if _, after := listedPage(0); after != before-2 {
+		t.Errorf("listed memos = %d, want %d", after, before-2)
+	}
+	if top := app.get(t, "/"); strings.Contains(top, "bulk memo 0") || !strings.Contains(top, "bulk memo 2") {
+		t.Errorf("top page does not reflect the change")
+	}
+
+	res = app.post(t, "/mypage/visibility", url.Values{"visibility": {"team"}, "memo_id": {mine[2]}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("team visibility: %d, want 400", res.StatusCode)
+	}
+	form := url.Values{"visibility": {"public"}, "memo_id": {mine[0]}}
+	res, err := app.client.PostForm(app.URL+"/mypage/visibility", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("without the CSRF token: %d, want 400", res.StatusCode)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	cacheAuditCountsSQL = "SELECT (SELECT count(*) FROM users), (SELECT count(*) FROM memos), (SELECT count(*) FROM memos WHERE " + listedCond + ")"
+
+	defaultAuditSample = 100
+	maxAuditSample     = 10000
+)
+
+// AuditDiscrepancy is one place where the caches and the database
+// disagree. Cache and DB hold the two sides as text.
+type AuditDiscrepancy struct {
+	Kind   string `json:"kind"`
+	MemoId int    `json:"memo_id,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Cache  string `json:"cache"`
+	DB     string `json:"db"`
+	Healed bool   `json:"healed"`
+}
+
+type CacheAuditReport struct {
+	CheckedAt     string              `json:"checked_at"`
+	Sampled       int                 `json:"sampled"`
+	Heal          bool                `json:"heal"`
+	Discrepancies []*AuditDiscrepancy `json:"discrepancies"`
+}
+
+// auditCache compares the cached counts of users, memos and listed memos
+// with the database, and sample memos picked at random from the cache
+// with their rows. Writes made while it runs can show up as drift that
+// is gone on the next run.
+//
+// With heal, memos that differ are reloaded or dropped from the cache,
+// users are reloaded when their count is off, and memos written since
+// the last cache sync are read in for the memo counts; what is still off
+// after that needs a /reset.
+func auditCache(ctx context.Context, dbConn *sql.DB, sample int, heal bool) (*CacheAuditReport, error) {
+	report := &CacheAuditReport{
+		CheckedAt:     time.Now().Format(time.RFC3339),
+		Heal:          heal,
+		Discrepancies: make([]*AuditDiscrepancy, 0),
+	}
+
+	ids := make([]int, 0, memoCache.Len())
+	memoCache.Each(func(memo *Memo) {
+		ids = append(ids, memo.Id)
+	})
+	if sample > len(ids) {
+		sample = len(ids)
+	}
+	for i := 0; i < sample; i++ {
+		j := i + rand.Intn(len(ids)-i)
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	purge := false
+	for _, id := range ids[:sample] {
+		cached, ok := memoCache.Get(id)
+		if !ok {
+			continue
+		}
+		report.Sampled++
+		memo, err := loadMemo(ctx, dbConn, int64(id))
+		if appErr, ok := err.(*AppError); ok && appErr.Kind == KindNotFound {
+			d := &AuditDiscrepancy{Kind: "memo", MemoId: id, Cache: "cached", DB: "deleted", Healed: heal}
+			report.Discrepancies = append(report.Discrepancies, d)
+			if heal {
+				memoCache.Delete(id)
+				purge = purge || cached.Listed()
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		field, c, db := memoDrift(cached, memo)
+		if field == "" {
+			continue
+		}
+		report.Discrepancies = append(report.Discrepancies, &AuditDiscrepancy{Kind: "memo", MemoId: id, Field: field, Cache: c, DB: db, Healed: heal})
+		if heal {
+			memoCache.Put(memo)
+			fanOut(memo)
+			indexTeamMemo(cached, memo)
+			purge = purge || cached.Listed() || memo.Listed()
+		}
+	}
+	if purge {
+		listFragments.Purge()
+	}
+
+	counts, err := auditCounts(ctx, dbConn)
+	if err != nil {
+		return nil, err
+	}
+	if heal && counts[0].cache != counts[0].db {
+		if err := userCache.Reload(dbConn); err != nil {
+			return nil, err
+		}
+	}
+	if heal && (counts[1].cache != counts[1].db || counts[2].cache != counts[2].db) {
+		if err := applyMemoChanges(ctx, dbConn); err != nil {
+			return nil, err
+		}
+	}
+	healed := counts
+	if heal {
+		if healed, err = auditCounts(ctx, dbConn); err != nil {
+			return nil, err
+		}
+	}
+	for i, c := range counts {
+		if c.cache != c.db {
+			report.Discrepancies = append(report.Discrepancies, &AuditDiscrepancy{
+				Kind: c.name, Cache: strconv.Itoa(c.cache), DB: strconv.Itoa(c.db),
+				Healed: heal && healed[i].cache == healed[i].db,
+			})
+		}
+	}
+	return report, nil
+}
+
+type auditCount struct {
+	name      string
+	cache, db int
+}
+
+func auditCounts(ctx context.Context, dbConn *sql.DB) ([]auditCount, error) {
+	counts := []auditCount{
+		{name: "users.count", cache: userCache.Len()},
+		{name: "memos.count", cache: memoCache.Len()},
+		{name: "listed.count", cache: len(memoCache.Listed())},
+	}
+	err := dbConn.QueryRowContext(ctx, cacheAuditCountsSQL).Scan(&counts[0].db, &counts[1].db, &counts[2].db)
+	return counts, err
+}
+
+// memoDrift names the first field in which the cached memo differs from
+// the row, with both values.
+func memoDrift(cached, memo *Memo) (field, c, db string) {
+	switch {
+	case cached.Version != memo.Version:
+		return "version", strconv.Itoa(cached.Version), strconv.Itoa(memo.Version)
+	case !cached.UpdatedAt.Equal(memo.UpdatedAt):
+		return "updated_at", formatDBTime(cached.UpdatedAt), formatDBTime(memo.UpdatedAt)
+	case cached.Visibility != memo.Visibility:
+		return "visibility", string(cached.Visibility), string(memo.Visibility)
+	case cached.Hidden != memo.Hidden:
+		return "hidden", strconv.FormatBool(cached.Hidden), strconv.FormatBool(memo.Hidden)
+	case cached.Locked != memo.Locked:
+		return "locked", strconv.FormatBool(cached.Locked), strconv.FormatBool(memo.Locked)
+	case cached.User != memo.User:
+		return "user", strconv.Itoa(cached.User), strconv.Itoa(memo.User)
+	case cached.Team != memo.Team:
+		return "team_id", strconv.Itoa(cached.Team), strconv.Itoa(memo.Team)
+	case cached.Content != memo.Content:
+		return "content", strconv.Itoa(len(cached.Content)) + " bytes", strconv.Itoa(len(memo.Content)) + " bytes"
+	}
+	return "", "", ""
+}
+
+func auditSample() int {
+	if n := currentRuntimeConfig().AuditSample; n > 0 {
+		return n
+	}
+	return defaultAuditSample
+}
+
+// auditCacheTask runs the audit on schedule, healing if audit_heal is set,
+// and logs what it found.
+func auditCacheTask() error {
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	report, err := auditCache(context.Background(), dbConn, auditSample(), currentRuntimeConfig().AuditHeal)
+	if err != nil {
+		return err
+	}
+	for _, d := range report.Discrepancies {
+		log.Printf("cache audit: %s %d %s: cache %s, db %s, healed %t", d.Kind, d.MemoId, d.Field, d.Cache, d.DB, d.Healed)
+	}
+	debugf("cache audit: %d memos sampled, %d discrepancies", report.Sampled, len(report.Discrepancies))
+	return nil
+}
+
+// cacheAuditHandler runs an audit of ?sample= memos. GET only reports;
+// POST with heal=1 also repairs what it can.
+func cacheAuditHandler(w http.ResponseWriter, r *http.Request) {
+	sample := auditSample()
+	if s := r.FormValue("sample"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxAuditSample {
+			handleError(w, r, validationError("sample must be a number from 0 to "+strconv.Itoa(maxAuditSample)))
+			return
+		}
+		sample = n
+	}
+	heal := r.Method == "POST" && r.FormValue("heal") == "1"
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	report, err := auditCache(r.Context(), dbConn, sample, heal)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if heal {
+		audit("admin "+r.RemoteAddr, "cache.heal", []string{strconv.Itoa(len(report.Discrepancies)) + " discrepancies"})
+	}
+	writeJSON(w, http.StatusOK, report)
+}
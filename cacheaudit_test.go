@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestCacheAudit(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 6, Users: 3, Memos: 20})
+	db := <-dbConnPool
+	dbConnPool <- db
+	ctx := context.Background()
+
+	report, err := auditCache(ctx, db, maxAuditSample, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sampled != 20 || len(report.Discrepancies) != 0 {
+		t.Fatalf("fresh cache: %d sampled, %+v", report.Sampled, report.Discrepancies)
+	}
+
+	// Change the tables behind the cache's back.
+	first, _ := listedPage(0)
+	gone, hidden := first[0].Id, first[1].Id
+	if _, err := db.Exec("DELETE FROM memos WHERE id=?", gone); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE memos SET hidden=1, version=version+1, updated_at=now() WHERE id=?", hidden); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = auditCache(ctx, db, maxAuditSample, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]*AuditDiscrepancy)
+	for _, d := range report.Discrepancies {
+		key := d.Kind
+		if d.MemoId != 0 {
+			key += " " + strconv.Itoa(d.MemoId)
+		}
+		found[key] = d
+	}
+	if d := found["memo "+strconv.Itoa(gone)]; d == nil || d.DB != "deleted" || d.Healed {
+		t.Errorf("deleted memo: %+v", d)
+	}
+	if d := found["memo "+strconv.Itoa(hidden)]; d == nil || d.Field != "version" {
+		t.Errorf("hidden memo: %+v", d)
+	}
+	if d := found["memos.count"]; d == nil || d.Cache != "20" || d.DB != "19" {
+		t.Errorf("memo count: %+v", d)
+	}
+	if d := found["listed.count"]; d == nil {
+		t.Errorf("listed count not reported: %+v", report.Discrepancies)
+	}
+	if _, ok := memoCache.Get(gone); !ok {
+		t.Fatalf("an audit without heal changed the cache")
+	}
+
+	report, err = auditCache(ctx, db, maxAuditSample, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range report.Discrepancies {
+		if !d.Healed {
+			t.Errorf("not healed: %+v", d)
+		}
+	}
+	if memo, ok := memoCache.Get(hidden); !ok || !memo.Hidden {
+		t.Errorf("hidden memo was not reloaded")
+	}
+	for _, memo := range memoCache.Listed() {
+		if memo.Id == hidden || memo.Id == gone {
+			t.Errorf("memo %d is still listed", memo.Id)
+		}
+	}
+
+	config.AdminToken = "audit-token"
+	req, _ := http.NewRequest("GET", app.URL+"/admin/cache/audit?"+url.Values{"sample": {"5"}}.Encode(), nil)
+	req.Header.Set("X-Admin-Token", config.AdminToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var served CacheAuditReport
+	if err := json.NewDecoder(res.Body).Decode(&served); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /admin/cache/audit: %d, %v", res.StatusCode, err)
+	}
+	if served.Sampled != 5 || served.Heal || len(served.Discrepancies) != 0 {
+		t.Errorf("after healing: %+v", served)
+	}
+}
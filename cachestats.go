@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// CacheStats describes one cache layer for /metrics and /admin/cache.
+// Bytes and Budget are zero for the layers that don't track their size.
+type CacheStats struct {
+	Name      string `json:"name"`
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	Evictions int64  `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Budget    int64  `json:"budget"`
+}
+
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (s CacheStats) HitPercent() float64 {
+	return s.HitRatio() * 100
+}
+
+// Session loads that found a stored session count as hits; the ones that
+// had to start a new session as misses.
+var sessionHits, sessionMisses int64
+
+func countSessionLoad(isNew bool) {
+	if isNew {
+		atomic.AddInt64(&sessionMisses, 1)
+	} else {
+		atomic.AddInt64(&sessionHits, 1)
+	}
+}
+
+func sessionStats() CacheStats {
+	st := CacheStats{
+		Name:   "session",
+		Hits:   atomic.LoadInt64(&sessionHits),
+		Misses: atomic.LoadInt64(&sessionMisses),
+	}
+	files, _ := ioutil.ReadDir(sessionFile)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "session_") {
+			st.Entries++
+			st.Bytes += f.Size()
+		}
+	}
+	return st
+}
+
+func allCacheStats() []CacheStats {
+	return []CacheStats{
+		memoCache.Stats(),
+		userCache.Stats(),
+		memoHTMLCache.cacheStats("memo_html"),
+		pageCache.cacheStats("page"),
+		staleCache.cacheStats("stale"),
+		sessionStats(),
+	}
+}
+
+type metric struct {
+	name, kind, help string
+	value            func(CacheStats) float64
+}
+
+var cacheMetrics = []metric{
+	{"isucon_cache_hits_total", "counter", "Cache lookups that found an entry.", func(s CacheStats) float64 { return float64(s.Hits) }},
+	{"isucon_cache_misses_total", "counter", "Cache lookups that found nothing.", func(s CacheStats) float64 { return float64(s.Misses) }},
+	{"isucon_cache_evictions_total", "counter", "Entries dropped to stay within the budget.", func(s CacheStats) float64 { return float64(s.Evictions) }},
+	{"isucon_cache_entries", "gauge", "Entries currently cached.", func(s CacheStats) float64 { return float64(s.Entries) }},
+	{"isucon_cache_bytes", "gauge", "Bytes currently cached, where tracked.", func(s CacheStats) float64 { return float64(s.Bytes) }},
+	{"isucon_cache_budget_bytes", "gauge", "Byte budget, where the cache has one.", func(s CacheStats) float64 { return float64(s.Budget) }},
+	{"isucon_cache_hit_ratio", "gauge", "Hits over lookups since the process started.", CacheStats.HitRatio},
+}
+
+// metricsHandler serves the cache statistics and the SLO counters in
+// the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := allCacheStats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range cacheMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{cache=%q} %g\n", m.name, s.Name, m.value(s))
+		}
+	}
+	writeSLOMetrics(w)
+}
+
+// cacheHandler shows the same statistics as a table.
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+	if err := themeTemplates(defaultTheme).ExecuteTemplate(w, "admin_cache", allCacheStats()); err != nil {
+		handleError(w, r, err)
+	}
+}
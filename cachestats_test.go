@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMemoCacheStats(t *testing.T) {
+	c := NewMemoCache()
+	c.Put(&Memo{Id: 1})
+	c.Put(&Memo{Id: 2})
+	c.Get(1)
+	c.Get(2)
+	c.Get(2)
+	c.Get(3)
+	st := c.Stats()
+	if st.Hits != 3 || st.Misses != 1 || st.Entries != 2 {
+		t.Errorf("Stats() = %+v, want 3 hits, 1 miss, 2 entries", st)
+	}
+	if st.HitRatio() != 0.75 {
+		t.Errorf("HitRatio() = %g, want 0.75", st.HitRatio())
+	}
+	if (CacheStats{}).HitRatio() != 0 {
+		t.Error("HitRatio() of an unused cache is not 0")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE isucon_cache_hits_total counter\n",
+		`isucon_cache_entries{cache="memo"} `,
+		`isucon_cache_budget_bytes{cache="page"} `,
+		`isucon_cache_misses_total{cache="session"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := themeTemplates(defaultTheme).ExecuteTemplate(&buf, "admin_cache", allCacheStats()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "<td>memo_html</td>") {
+		t.Errorf("admin_cache = %s", buf.String())
+	}
+}
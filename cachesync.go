@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultCacheSyncInterval = time.Second
+
+// CacheSyncConfig enables keeping the memo cache in step with writes that
+// bypass this process. Only the "poll" mode is implemented: it re-reads
+// rows that are new or changed since the last poll. Deleted rows are not
+// noticed until the next /reset.
+type CacheSyncConfig struct {
+	Mode       string `json:"mode"`
+	IntervalMs int    `json:"interval_ms"`
+}
+
+func (c CacheSyncConfig) validate() error {
+	switch c.Mode {
+	case "", "poll":
+		return nil
+	}
+	return fmt.Errorf("config: unknown cache_sync mode %q", c.Mode)
+}
+
+// watermark is the newest id and updated_at the cache is known to hold.
+type watermark struct {
+	sync.Mutex
+	maxId     int
+	updatedAt time.Time
+}
+
+var memoWatermark = &watermark{}
+
+func (m *watermark) observe(memos Memos) {
+	m.Lock()
+	for _, memo := range memos {
+		if memo.Id > m.maxId {
+			m.maxId = memo.Id
+		}
+		if memo.UpdatedAt.After(m.updatedAt) {
+			m.updatedAt = memo.UpdatedAt
+		}
+	}
+	m.Unlock()
+}
+
+func (m *watermark) get() (int, time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	return m.maxId, m.updatedAt
+}
+
+func startCacheSync(c CacheSyncConfig) {
+	if c.Mode != "poll" {
+		return
+	}
+	interval := time.Duration(c.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultCacheSyncInterval
+	}
+	go func() {
+		for _ = range time.Tick(interval) {
+			if err := pollMemoChanges(); err != nil {
+				log.Printf("error polling memo changes: %s", err)
+			}
+		}
+	}()
+}
+
+// pollMemoChanges loads memos written since the watermark. updated_at is
+// compared with >= because it only has one-second resolution; re-applying
+// a row that is already cached is harmless. Both halves of the condition
+// are served by an index, the primary key and memos(updated_at).
+func pollMemoChanges() error {
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	return applyMemoChanges(context.Background(), dbConn)
+}
+
+func applyMemoChanges(ctx context.Context, dbConn querier) error {
+	maxId, updatedAt := memoWatermark.get()
+	memos, err := queryMemos(ctx, dbConn,
+		"SELECT "+memoColumns+" FROM memos WHERE id > ? OR updated_at >= ?", maxId, formatDBTime(updatedAt))
+	if err != nil {
+		return err
+	}
+	purge := false
+	for _, memo := range memos {
+		old, ok := memoCache.Get(memo.Id)
+		if ok && old.Version == memo.Version && old.UpdatedAt.Equal(memo.UpdatedAt) {
+			continue
+		}
+		if memo.Listed() || (ok && old.Listed()) {
+			purge = true
+		}
+		memoCache.Put(memo)
+		fanOut(memo)
+		indexTeamMemo(old, memo)
+	}
+	if purge {
+		listFragments.Purge()
+	}
+	memoWatermark.observe(memos)
+	debugf("cache sync: %d rows at or after id %d / %s", len(memos), maxId, formatDBTime(updatedAt))
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CaptchaConfig turns on CAPTCHA checks for the forms anonymous visitors
+// submit. Provider is "hcaptcha", "recaptcha" or empty for none.
+type CaptchaConfig struct {
+	Provider string `json:"provider"`
+	SiteKey  string `json:"site_key"`
+	Secret   string `json:"secret"`
+}
+
+// CaptchaProvider renders the widget for a form and verifies the token it
+// submits.
+type CaptchaProvider interface {
+	Widget() template.HTML
+	Verify(ctx context.Context, r *http.Request) (bool, error)
+}
+
+var captcha CaptchaProvider
+
+func newCaptchaProvider(c CaptchaConfig) (CaptchaProvider, error) {
+	var p *siteVerifyCaptcha
+	switch c.Provider {
+	case "":
+		return nil, nil
+	case "hcaptcha":
+		p = &siteVerifyCaptcha{
+			verifyURL: "https://hcaptcha.com/siteverify",
+			script:    "https://js.hcaptcha.com/1/api.js",
+			class:     "h-captcha",
+			field:     "h-captcha-response",
+		}
+	case "recaptcha":
+		p = &siteVerifyCaptcha{
+			verifyURL: "https://www.google.com/recaptcha/api/siteverify",
+			script:    "https://www.google.com/recaptcha/api.js",
+			class:     "g-recaptcha",
+			field:     "g-recaptcha-response",
+		}
+	default:
+		return nil, fmt.Errorf("config: unknown captcha provider %q", c.Provider)
+	}
+	if c.SiteKey == "" || c.Secret == "" {
+		return nil, fmt.Errorf("config: captcha provider %s needs site_key and secret", c.Provider)
+	}
+	p.siteKey, p.secret = c.SiteKey, c.Secret
+	p.client = &http.Client{Timeout: 5 * time.Second}
+	return p, nil
+}
+
+// siteVerifyCaptcha covers hCaptcha and reCAPTCHA, which share the same
+// siteverify protocol and differ only in URLs and field names.
+type siteVerifyCaptcha struct {
+	verifyURL string
+	script    string
+	class     string
+	field     string
+	siteKey   string
+	secret    string
+	client    *http.Client
+}
+
+func (p *siteVerifyCaptcha) Widget() template.HTML {
+	return template.HTML(fmt.Sprintf(`<script src="%s" async defer></script>
+<div class="%s" data-sitekey="%s"></div>`,
+		template.HTMLEscapeString(p.script), p.class, template.HTMLEscapeString(p.siteKey)))
+}
+
+func (p *siteVerifyCaptcha) Verify(ctx context.Context, r *http.Request) (bool, error) {
+	token := r.FormValue(p.field)
+	if token == "" {
+		return false, nil
+	}
+	form := url.Values{"secret": {p.secret}, "response": {token}, "remoteip": {clientIP(r)}}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// captchaWidget is the template function for forms that requireCaptcha
+// protects; it renders nothing when CAPTCHA is off.
+func captchaWidget() template.HTML {
+	if captcha == nil {
+		return ""
+	}
+	return captcha.Widget()
+}
+
+// requireCaptcha rejects the form unless its CAPTCHA was solved. It fails
+// closed: if the provider can't be reached, the form is refused.
+func requireCaptcha(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if captcha == nil {
+			h(w, r)
+			return
+		}
+		ok, err := captcha.Verify(r.Context(), r)
+		if err != nil {
+			log.Printf("captcha: %s", err)
+			renderError(w, r, http.StatusServiceUnavailable, "The CAPTCHA could not be checked. Please try again.")
+			return
+		}
+		if !ok {
+			renderError(w, r, http.StatusBadRequest, "Please solve the CAPTCHA and try again.")
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequireCaptcha(t *testing.T) {
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"success": %v}`, r.FormValue("secret") == "s3cret" && r.FormValue("response") == "solved")
+	}))
+	defer verifier.Close()
+
+	defer func(p CaptchaProvider) { captcha = p }(captcha)
+	p, err := newCaptchaProvider(CaptchaConfig{Provider: "hcaptcha", SiteKey: "site", Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.(*siteVerifyCaptcha).verifyURL = verifier.URL
+	captcha = p
+
+	h := requireCaptcha(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	for token, want := range map[string]int{"": http.StatusBadRequest, "wrong": http.StatusBadRequest, "solved": http.StatusOK} {
+		form := url.Values{"h-captcha-response": {token}}
+		r := httptest.NewRequest("POST", "/signin", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != want {
+			t.Errorf("token %q: status = %d, want %d", token, w.Code, want)
+		}
+	}
+
+	if _, err := newCaptchaProvider(CaptchaConfig{Provider: "recaptcha"}); err == nil {
+		t.Error("provider without keys accepted")
+	}
+}
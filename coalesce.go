@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var errFlightPanicked = errors.New("coalesced call panicked")
+
+// flight is one call in progress; waiters block on done.
+type flight struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// flightGroup coalesces concurrent calls with the same key: the first
+// caller does the work and everyone who arrives before it finishes gets
+// the same result. Nothing is kept once the call returns, so callers
+// still need their own cache.
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flight)}
+}
+
+// renders coalesces page renders and the queries behind them.
+var renders = newFlightGroup()
+
+// Do runs fn once for all concurrent callers using key. Results are
+// shared, so fn must return something callers will not modify.
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.Unlock()
+		<-f.done
+		return f.val, f.err
+	}
+	f := &flight{done: make(chan struct{}), err: errFlightPanicked}
+	g.calls[key] = f
+	g.Unlock()
+
+	defer func() {
+		g.Lock()
+		delete(g.calls, key)
+		g.Unlock()
+		close(f.done)
+	}()
+	f.val, f.err = fn()
+	return f.val, f.err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	g := newFlightGroup()
+	var runs int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return "page", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.Do("recent#0", fn)
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("fn ran %d times, want 1", n)
+	}
+	for i, v := range results {
+		if v != "page" {
+			t.Errorf("result %d = %v", i, v)
+		}
+	}
+
+	// Once the call has returned nothing is remembered.
+	g.Do("recent#0", fn)
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("fn ran %d times after the first call returned, want 2", n)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("%d calls left in flight", len(g.calls))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// command is one of the app's subcommands. run gets the arguments after
+// the command's name and parses its own flags from them.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the web server (the default)", serveCommand},
+	{"migrate", "create the schema, or apply the init/alter.sql changes it lacks", migrateCommand},
+	{"seed", "fill an empty database with the data set of -memory", seedCommand},
+	{"export", "write the database to stdout as JSON lines", exportCommand},
+	{"import", "read an export from stdin into an empty database", importCommand},
+	{"check", "run the self-check and print its report as JSON", checkCommand},
+	{"bench-local", "load an in-process server on the memory database", benchLocalCommand},
+}
+
+// parseCommand picks the command named by the first argument. Without
+// one, as in "app -memory", the command is serve.
+func parseCommand(args []string) (command, []string, bool) {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name == name {
+			return c, args, true
+		}
+	}
+	return command{name: name}, args, false
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags]\n\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the command's flags.\n", os.Args[0])
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	cmd, args, ok := parseCommand(os.Args[1:])
+	if cmd.name == "help" {
+		usage()
+		return
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd.name)
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		log.Fatalf("%s: %s", cmd.name, err)
+	}
+}
+
+// loadEnvConfig reads config/<ISUCON_ENV>.json and applies the settings
+// every command depends on.
+func loadEnvConfig() {
+	env := os.Getenv("ISUCON_ENV")
+	if env == "" {
+		env = "local"
+	}
+	configFile = "../config/" + env + ".json"
+	config = loadConfig(configFile)
+	setRuntimeConfig(config.Runtime)
+	if config.Timezone != "" {
+		loc, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dbLocation = loc
+	}
+	setupTenant(config)
+	setupSessions(config.Session)
+}
+
+// setupHandlers prepares what the router's handlers and middleware use.
+func setupHandlers() error {
+	contentFilters = buildContentFilters(config.Spam)
+	setupRateLimits(config.RateLimits)
+	setupRenderCaches(config.RenderCache)
+	setupPaging(config.Paging)
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies = proxies
+	if clientFilter, err = newIPFilter(config.IPFilter); err != nil {
+		return err
+	}
+	if captcha, err = newCaptchaProvider(config.Captcha); err != nil {
+		return err
+	}
+	formGuard = config.FormGuard
+	if blobs, err = newBlobStore(config.Blobs); err != nil {
+		return err
+	}
+	if err := initTracing(config.Tracing); err != nil {
+		log.Printf("tracing disabled: %s", err)
+	}
+	return nil
+}
+
+// databaseFlags selects the configured MySQL database or, with -memory,
+// a generated one.
+type databaseFlags struct {
+	memory bool
+	seed   memorySeed
+}
+
+func (d *databaseFlags) register(fs *flag.FlagSet) {
+	d.seed = defaultMemorySeed
+	fs.BoolVar(&d.memory, "memory", false, "run on an in-memory database filled from -seed instead of MySQL")
+	registerSeedFlags(fs, &d.seed, "-memory data set")
+}
+
+func registerSeedFlags(fs *flag.FlagSet, seed *memorySeed, what string) {
+	fs.Int64Var(&seed.Seed, "seed", seed.Seed, "seed for the "+what)
+	fs.IntVar(&seed.Users, "seed-users", seed.Users, "users in the "+what)
+	fs.IntVar(&seed.Memos, "seed-memos", seed.Memos, "memos in the "+what)
+}
+
+// open returns the driver name and DSN to open the database with.
+func (d *databaseFlags) open() (string, string) {
+	if d.memory {
+		return useMemoryDatabase(config, d.seed)
+	}
+	dsn := config.Database.dsn()
+	log.Printf("db: %s", dsn)
+	return mysqlDriverName, dsn
+}
+
+// openMySQL opens the configured database, for the commands that only
+// make sense on MySQL.
+func openMySQL() (*sql.DB, error) {
+	dsn := config.Database.dsn()
+	log.Printf("db: %s", dsn)
+	return sql.Open(mysqlDriverName, dsn)
+}
+
+func checkCommand(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	var db databaseFlags
+	db.register(fs)
+	fs.BoolVar(&createMissingIndexes, "create-indexes", false, "add the indexes the check finds missing")
+	fs.Parse(args)
+
+	loadEnvConfig()
+	report := selfCheck(db.open())
+	if err := report.write(os.Stdout); err != nil {
+		return err
+	}
+	if !report.OK {
+		os.Exit(1)
+	}
+	return nil
+}
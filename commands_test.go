@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestParseCommand(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		name string
+		rest int
+		ok   bool
+	}{
+		{nil, "serve", 0, true},
+		{[]string{"-memory", "-seed", "2"}, "serve", 3, true},
+		{[]string{"check", "-memory"}, "check", 1, true},
+		{[]string{"bench-local"}, "bench-local", 0, true},
+		{[]string{"frobnicate", "-x"}, "frobnicate", 1, false},
+	} {
+		cmd, rest, ok := parseCommand(c.args)
+		if cmd.name != c.name || len(rest) != c.rest || ok != c.ok {
+			t.Errorf("parseCommand(%q) = %s, %q, %t", c.args, cmd.name, rest, ok)
+		}
+	}
+}
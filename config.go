@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+type DatabaseConfig struct {
+	Dbname   string `json:"dbname"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c DatabaseConfig) dsn() string {
+	return fmt.Sprintf(
+		"%s:%s@tcp(%s:%d)/%s?charset=utf8",
+		c.Username, c.Password, c.Host, c.Port, c.Dbname,
+	)
+}
+
+type Config struct {
+	Database       DatabaseConfig   `json:"database"`
+	Replicas       []DatabaseConfig `json:"replicas"`
+	AdminToken     string           `json:"admin_token"`
+	TrustedProxies []string         `json:"trusted_proxies"`
+	Theme          string           `json:"theme"`
+	// Timezone is the IANA zone DATETIME columns are stored in; the
+	// server's local zone when empty.
+	Timezone   string          `json:"timezone"`
+	BodyLimits BodyLimitConfig `json:"body_limits"`
+	CacheSync  CacheSyncConfig `json:"cache_sync"`
+	Jobs       JobsConfig      `json:"jobs"`
+	// Schedule maps a task name to a cron expression or "@every <duration>";
+	// "off" disables the task.
+	Schedule         map[string]string `json:"schedule"`
+	ScheduleJitterMs int               `json:"schedule_jitter_ms"`
+	// Emoji maps custom shortcodes to image files in public/emoji/.
+	Emoji       map[string]string `json:"emoji"`
+	Spam        SpamConfig        `json:"spam"`
+	RateLimits  RateLimitConfig   `json:"rate_limits"`
+	Captcha     CaptchaConfig     `json:"captcha"`
+	FormGuard   FormGuardConfig   `json:"form_guard"`
+	IPFilter    IPFilterConfig    `json:"ip_filter"`
+	Blobs       BlobConfig        `json:"blobs"`
+	Tracing     TracingConfig     `json:"tracing"`
+	ErrorReport ErrorReportConfig `json:"error_report"`
+	Runtime     RuntimeConfig     `json:"runtime"`
+	Server      ServerConfig      `json:"server"`
+	Session     SessionConfig     `json:"session"`
+	APITokens   APITokenConfig    `json:"api_tokens"`
+	Snapshot    SnapshotConfig    `json:"snapshot"`
+	Paging      PagingConfig      `json:"paging"`
+	Record      RecordConfig      `json:"record"`
+	RenderCache RenderCacheConfig `json:"render_cache"`
+	// Tenant is the name of the tenant this process serves, and Tenants
+	// the ones requests may be routed to.
+	Tenant  string         `json:"tenant"`
+	Tenants []TenantConfig `json:"tenants"`
+}
+
+// BodyLimitConfig sets the maximum request body size in bytes per kind of
+// form. Zero values fall back to the defaults below.
+type BodyLimitConfig struct {
+	Signin  int64 `json:"signin"`
+	Memo    int64 `json:"memo"`
+	Upload  int64 `json:"upload"`
+	Default int64 `json:"default"`
+}
+
+const (
+	defaultSigninBodyLimit = 4 << 10
+	defaultMemoBodyLimit   = 1 << 20
+	defaultUploadBodyLimit = 10 << 20
+	defaultBodyLimit       = 64 << 10
+)
+
+func (c *BodyLimitConfig) setDefaults() {
+	if c.Signin <= 0 {
+		c.Signin = defaultSigninBodyLimit
+	}
+	if c.Memo <= 0 {
+		c.Memo = defaultMemoBodyLimit
+	}
+	if c.Upload <= 0 {
+		c.Upload = defaultUploadBodyLimit
+	}
+	if c.Default <= 0 {
+		c.Default = defaultBodyLimit
+	}
+}
+
+// RuntimeConfig holds the settings that can be changed without a restart,
+// either by sending SIGHUP or through /admin/config/reload.
+type RuntimeConfig struct {
+	LogLevel      string          `json:"log_level"`
+	Features      map[string]bool `json:"features"`
+	SlowRequestMs int             `json:"slow_request_ms"`
+	SlowQueryMs   int             `json:"slow_query_ms"`
+	// QueryLog logs every MySQL statement with its arguments and time,
+	// and ExplainMs logs the plan of those taking at least that long,
+	// with EXPLAIN ANALYZE if ExplainAnalyze is set. Both are for
+	// development; see sqllog.go.
+	QueryLog       bool `json:"query_log"`
+	ExplainMs      int  `json:"explain_ms"`
+	ExplainAnalyze bool `json:"explain_analyze"`
+	// MaxInFlight caps concurrent requests overall and RouteMaxInFlight per
+	// route template (e.g. "/memo/{memo_id}"). Zero means unlimited.
+	MaxInFlight      int            `json:"max_in_flight"`
+	RouteMaxInFlight map[string]int `json:"route_max_in_flight"`
+	// LatencyBudgetMs maps a route template to the time after which a
+	// request is logged with its breakdown; "*" applies to the others.
+	LatencyBudgetMs map[string]int `json:"latency_budget_ms"`
+	// AuditSample is how many cached memos the cache_audit task compares
+	// with their rows, and AuditHeal makes it repair what differs.
+	AuditSample int  `json:"audit_sample"`
+	AuditHeal   bool `json:"audit_heal"`
+	// ShadowReads is the fraction, from 0 to 1, of public list reads
+	// that are repeated against MySQL and compared; see shadow.go.
+	ShadowReads float64 `json:"shadow_reads"`
+	// SLOMs maps a list page's route template to the time after which it
+	// is answered from a stale copy; "*" applies to the others. See slo.go.
+	SLOMs map[string]int `json:"slo_ms"`
+}
+
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+}
+
+var (
+	configFile    string
+	runtimeMutex  sync.RWMutex
+	runtimeConfig RuntimeConfig
+)
+
+func readConfig(filename string) (*Config, error) {
+	f, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err = json.Unmarshal(f, &config); err != nil {
+		return nil, err
+	}
+	if err = config.Runtime.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.RateLimits.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.Spam.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.FormGuard.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.IPFilter.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.ErrorReport.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.CacheSync.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.Server.validate(); err != nil {
+		return nil, err
+	}
+	if err = config.Session.validate(); err != nil {
+		return nil, err
+	}
+	// Access tokens are signed with a key derived from the session secret.
+	if config.APITokens.Enabled && !config.Session.ownSecret() {
+		return nil, fmt.Errorf("config: api_tokens need session.secret or $%s", sessionSecretEnv)
+	}
+	if err = validateTenants(config.Tenant, config.Tenants); err != nil {
+		return nil, err
+	}
+	config.BodyLimits.setDefaults()
+	return &config, nil
+}
+
+func loadConfig(filename string) *Config {
+	log.Printf("loading config file: %s", filename)
+	config, err := readConfig(filename)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	return config
+}
+
+func (c *RuntimeConfig) validate() error {
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("config: unknown log_level %q", c.LogLevel)
+	}
+	if c.Features == nil {
+		c.Features = make(map[string]bool)
+	}
+	if c.SlowRequestMs < 0 || c.SlowQueryMs < 0 || c.ExplainMs < 0 {
+		return fmt.Errorf("config: slow thresholds must not be negative")
+	}
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("config: max_in_flight must not be negative")
+	}
+	if c.AuditSample < 0 || c.AuditSample > maxAuditSample {
+		return fmt.Errorf("config: audit_sample must be from 0 to %d", maxAuditSample)
+	}
+	if c.ShadowReads < 0 || c.ShadowReads > 1 {
+		return fmt.Errorf("config: shadow_reads must be from 0 to 1")
+	}
+	for route, n := range c.RouteMaxInFlight {
+		if n < 0 {
+			return fmt.Errorf("config: route_max_in_flight[%q] must not be negative", route)
+		}
+	}
+	for route, ms := range c.LatencyBudgetMs {
+		if ms < 0 {
+			return fmt.Errorf("config: latency_budget_ms[%q] must not be negative", route)
+		}
+	}
+	for route, ms := range c.SLOMs {
+		if ms < 0 {
+			return fmt.Errorf("config: slo_ms[%q] must not be negative", route)
+		}
+	}
+	return nil
+}
+
+// diff describes every field of c that differs from old.
+func (c RuntimeConfig) diff(old RuntimeConfig) []string {
+	changes := make([]string, 0)
+	if c.LogLevel != old.LogLevel {
+		changes = append(changes, fmt.Sprintf("log_level: %s -> %s", old.LogLevel, c.LogLevel))
+	}
+	if c.SlowRequestMs != old.SlowRequestMs {
+		changes = append(changes, fmt.Sprintf("slow_request_ms: %d -> %d", old.SlowRequestMs, c.SlowRequestMs))
+	}
+	if c.SlowQueryMs != old.SlowQueryMs {
+		changes = append(changes, fmt.Sprintf("slow_query_ms: %d -> %d", old.SlowQueryMs, c.SlowQueryMs))
+	}
+	if c.QueryLog != old.QueryLog {
+		changes = append(changes, fmt.Sprintf("query_log: %t -> %t", old.QueryLog, c.QueryLog))
+	}
+	if c.ExplainMs != old.ExplainMs {
+		changes = append(changes, fmt.Sprintf("explain_ms: %d -> %d", old.ExplainMs, c.ExplainMs))
+	}
+	if c.ExplainAnalyze != old.ExplainAnalyze {
+		changes = append(changes, fmt.Sprintf("explain_analyze: %t -> %t", old.ExplainAnalyze, c.ExplainAnalyze))
+	}
+	if c.MaxInFlight != old.MaxInFlight {
+		changes = append(changes, fmt.Sprintf("max_in_flight: %d -> %d", old.MaxInFlight, c.MaxInFlight))
+	}
+	if !reflect.DeepEqual(c.RouteMaxInFlight, old.RouteMaxInFlight) {
+		changes = append(changes, fmt.Sprintf("route_max_in_flight: %v -> %v", old.RouteMaxInFlight, c.RouteMaxInFlight))
+	}
+	if !reflect.DeepEqual(c.LatencyBudgetMs, old.LatencyBudgetMs) {
+		changes = append(changes, fmt.Sprintf("latency_budget_ms: %v -> %v", old.LatencyBudgetMs, c.LatencyBudgetMs))
+	}
+	if c.AuditSample != old.AuditSample {
+		changes = append(changes, fmt.Sprintf("audit_sample: %d -> %d", old.AuditSample, c.AuditSample))
+	}
+	if c.AuditHeal != old.AuditHeal {
+		changes = append(changes, fmt.Sprintf("audit_heal: %t -> %t", old.AuditHeal, c.AuditHeal))
+	}
+	if !reflect.DeepEqual(c.SLOMs, old.SLOMs) {
+		changes = append(changes, fmt.Sprintf("slo_ms: %v -> %v", old.SLOMs, c.SLOMs))
+	}
+	if c.ShadowReads != old.ShadowReads {
+		changes = append(changes, fmt.Sprintf("shadow_reads: %g -> %g", old.ShadowReads, c.ShadowReads))
+	}
+	if !reflect.DeepEqual(c.Features, old.Features) {
+		names := make([]string, 0)
+		for name := range c.Features {
+			names = append(names, name)
+		}
+		for name := range old.Features {
+			if _, ok := c.Features[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			before, after := old.Features[name], c.Features[name]
+			if before != after {
+				changes = append(changes, fmt.Sprintf("features.%s: %t -> %t", name, before, after))
+			}
+		}
+	}
+	return changes
+}
+
+func currentRuntimeConfig() RuntimeConfig {
+	runtimeMutex.RLock()
+	defer runtimeMutex.RUnlock()
+	return runtimeConfig
+}
+
+func setRuntimeConfig(c RuntimeConfig) {
+	runtimeMutex.Lock()
+	runtimeConfig = c
+	runtimeMutex.Unlock()
+}
+
+func featureEnabled(name string) bool {
+	return currentRuntimeConfig().Features[name]
+}
+
+func debugf(format string, v ...interface{}) {
+	if logLevels[currentRuntimeConfig().LogLevel] <= logLevels["debug"] {
+		log.Printf("debug: "+format, v...)
+	}
+}
+
+// reloadMutex keeps reloads from SIGHUP and the admin endpoint apart.
+var reloadMutex sync.Mutex
+
+// reloadConfig re-reads the config file and applies its runtime section,
+// the render cache budgets and the rate limits. Database settings and
+// the admin token still require a restart.
+func reloadConfig(actor string) ([]string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	c, err := readConfig(configFile)
+	if err != nil {
+		log.Printf("config reload by %s rejected: %s", actor, err)
+		return nil, err
+	}
+	changes := c.Runtime.diff(currentRuntimeConfig())
+	changes = append(changes, c.RenderCache.diff(config.RenderCache)...)
+	changes = append(changes, c.RateLimits.diff(config.RateLimits)...)
+	setRuntimeConfig(c.Runtime)
+	setupRenderCaches(c.RenderCache)
+	applyRateLimits(c.RateLimits)
+	config.RenderCache = c.RenderCache
+	config.RateLimits.MemoPerUser, config.RateLimits.MemoPerIP = c.RateLimits.MemoPerUser, c.RateLimits.MemoPerIP
+	audit(actor, "config.reload", changes)
+	return changes, nil
+}
+
+func reloadConfigOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for _ = range ch {
+		reloadConfig("SIGHUP")
+	}
+}
+
+func audit(actor, action string, details []string) {
+	log.Printf("audit: %s by %s: %v", action, actor, details)
+}
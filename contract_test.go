@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The contract tests check that what the caches serve matches what the
+// queries they replaced would return from the same tables. These are
+// those queries, with the ones in shadow.go for the public list; the
+// memory database answers them, and MySQL does when ISUCON_TEST_DSN is
+// set.
+const (
+	contractBetweenSQL = "SELECT " + memoColumns + " FROM memos WHERE " + listedCond + " AND created_at >= ? AND created_at < ? ORDER BY created_at DESC, id DESC"
+	contractFeedSQL    = "SELECT " + memoColumns + " FROM memos WHERE user IN (SELECT followee FROM follows WHERE follower=?) AND visibility IN ('public', 'followers') AND hidden=0 ORDER BY id DESC LIMIT ?"
+	contractVisibleSQL = "SELECT count(*) FROM memos WHERE id=? AND (user=? OR hidden=0 AND (visibility IN ('public', 'unlisted')" +
+		" OR visibility='followers' AND user IN (SELECT followee FROM follows WHERE follower=?)" +
+		" OR visibility='team' AND team_id IN (SELECT team_id FROM team_members WHERE user_id=?)))"
+)
+
+func init() {
+	listed := func(m *Memo) bool { return m.Visibility == visibilityPublic && !m.Hidden }
+	memoryStatements[contractBetweenSQL] = memStatement{args: 2, query: func(s *memStore, args []driver.Value) *memRows {
+		from, _ := parseDBTime(argString(args[0]))
+		to, _ := parseDBTime(argString(args[1]))
+		return memoRows(s.selectMemos(func(m *Memo) bool {
+			return listed(m) && !m.CreatedAt.Before(from) && m.CreatedAt.Before(to)
+		}, memoNewer))
+	}}
+	memoryStatements[contractFeedSQL] = memStatement{args: 2, query: func(s *memStore, args []driver.Value) *memRows {
+		follower, limit := argInt(args[0]), argInt(args[1])
+		memos := s.selectMemos(func(m *Memo) bool {
+			return s.follows[[2]int{follower, m.User}] && !m.Hidden &&
+				(m.Visibility == visibilityPublic || m.Visibility == visibilityFollowers)
+		}, func(a, b *Memo) bool { return a.Id > b.Id })
+		if len(memos) > limit {
+			memos = memos[:limit]
+		}
+		return memoRows(memos)
+	}}
+	memoryStatements[contractVisibleSQL] = memStatement{args: 4, query: func(s *memStore, args []driver.Value) *memRows {
+		id, viewer := argInt(args[0]), argInt(args[1])
+		n := 0
+		if m, ok := s.memos[id]; ok {
+			switch {
+			case m.User == viewer:
+				n = 1
+			case m.Hidden:
+			case m.Visibility == visibilityPublic, m.Visibility == visibilityUnlisted:
+				n = 1
+			case m.Visibility == visibilityFollowers && s.follows[[2]int{viewer, m.User}]:
+				n = 1
+			case m.Visibility == visibilityTeam && s.teamMembers[[2]int{m.Team, viewer}]:
+				n = 1
+			}
+		}
+		return &memRows{columns: 1, rows: [][]driver.Value{{int64(n)}}}
+	}}
+}
+
+func memoIds(memos Memos) string {
+	ids := make([]string, len(memos))
+	for i, m := range memos {
+		ids[i] = "-"
+		if m != nil {
+			ids[i] = strconv.Itoa(m.Id)
+		}
+	}
+	return "[" + strings.Join(ids, " ") + "]"
+}
+
+func contractMemos(t *testing.T, db *sql.DB, query string, args ...interface{}) Memos {
+	memos, err := queryMemos(context.Background(), db, query, args...)
+	if err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	return memos
+}
+
+// checkStoreContract compares the cache-backed reads with db after the
+// caches were loaded from it.
+func checkStoreContract(t *testing.T, db *sql.DB) {
+	var total int
+	if err := db.QueryRow(shadowCountSQL).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listing and pagination, by page number and by cursor.
+	for page := 0; validPage(page); page++ {
+		got, n := listedPage(page)
+		want := contractMemos(t, db, shadowListedSQL, memosPerPage, page*memosPerPage)
+		if n != total || memoIds(got) != memoIds(want) {
+			t.Errorf("page %d: cache has %s of %d, SQL %s of %d", page, memoIds(got), n, memoIds(want), total)
+		}
+		if len(want) == 0 {
+			break
+		}
+		last := want[len(want)-1]
+		got = listedBefore(last.CreatedAt, last.Id)
+		want = contractMemos(t, db, shadowBeforeSQL, formatDBTime(last.CreatedAt), formatDBTime(last.CreatedAt), last.Id, memosPerPage)
+		if memoIds(got) != memoIds(want) {
+			t.Errorf("after memo %d: cache has %s, SQL %s", last.Id, memoIds(got), memoIds(want))
+		}
+	}
+
+	// Archive months.
+	months := make(map[time.Time]bool)
+	memoCache.Each(func(memo *Memo) {
+		t := memo.CreatedAt.In(dbLocation)
+		months[time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, dbLocation)] = true
+	})
+	for from := range months {
+		to := from.AddDate(0, 1, 0)
+		got := listedBetween(from, to)
+		want := contractMemos(t, db, contractBetweenSQL, formatDBTime(from), formatDBTime(to))
+		if memoIds(got) != memoIds(want) {
+			t.Errorf("archive %s: cache has %s, SQL %s", archivePath(from), memoIds(got), memoIds(want))
+		}
+	}
+
+	viewers := []*User{nil}
+	for id := 1; len(viewers) <= 5; id++ {
+		if user, ok := userCache.Get(id); ok {
+			viewers = append(viewers, user)
+		} else if id > userCache.Len() {
+			break
+		}
+	}
+	all := contractMemos(t, db, "SELECT "+memoColumns+" FROM memos")
+	if len(all) != memoCache.Len() {
+		t.Errorf("cache has %d memos, SQL %d", memoCache.Len(), len(all))
+	}
+
+	// Visibility of every memo to each viewer.
+	for _, viewer := range viewers {
+		viewerId := 0
+		if viewer != nil {
+			viewerId = viewer.Id
+		}
+		for _, m := range all {
+			_, err := findMemo(viewer, m.Id)
+			var n int
+			if err := db.QueryRow(contractVisibleSQL, m.Id, viewerId, viewerId, viewerId).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if (err == nil) != (n == 1) {
+				t.Errorf("memo %d to user %d: cache says visible=%t, SQL %t", m.Id, viewerId, err == nil, n == 1)
+			}
+		}
+	}
+
+	// Timelines.
+	for _, viewer := range viewers[1:] {
+		var got Memos
+		for _, id := range feeds.Ids(viewer.Id) {
+			if memo, ok := memoCache.Get(id); ok && inFeeds(memo) && canView(viewer, memo) && len(got) < memosPerPage {
+				got = append(got, memo)
+			}
+		}
+		want := contractMemos(t, db, contractFeedSQL, viewer.Id, memosPerPage)
+		if memoIds(got) != memoIds(want) {
+			t.Errorf("timeline of user %d: cache has %s, SQL %s", viewer.Id, memoIds(got), memoIds(want))
+		}
+	}
+
+	// Neighbors on memo pages, for the author and for anyone else. The
+	// others see the author's listed memos, as the public list has them.
+	for _, m := range all {
+		if !m.Listed() {
+			continue
+		}
+		var own Memos
+		memoCache.Each(func(memo *Memo) {
+			if memo.User == m.User {
+				own = append(own, memo)
+			}
+		})
+		sort.Slice(own, func(i, j int) bool { return memoNewer(own[i], own[j]) })
+		if memoIds(memoCache.ByUser(m.User)) != memoIds(own) {
+			t.Errorf("memos of user %d: index has %s, cache %s", m.User, memoIds(memoCache.ByUser(m.User)), memoIds(own))
+		}
+		author, _ := userCache.Get(m.User)
+		for _, c := range []struct {
+			viewer *User
+			cond   string
+		}{{author, ""}, {nil, "AND " + listedCond}} {
+			want := contractMemos(t, db, "SELECT "+memoColumns+" FROM memos WHERE user=? "+c.cond+" ORDER BY created_at, id", m.User)
+			gotOlder, gotNewer := findNeighbors(c.viewer, m)
+			wantOlder, wantNewer := contractNeighbors(want, m.Id)
+			if memoIds(Memos{gotOlder, gotNewer}) != memoIds(Memos{wantOlder, wantNewer}) {
+				t.Errorf("neighbors of memo %d (%q): cache has %s, SQL %s", m.Id, c.cond, memoIds(Memos{gotOlder, gotNewer}), memoIds(Memos{wantOlder, wantNewer}))
+			}
+		}
+	}
+}
+
+// contractNeighbors finds the memos either side of id in memos, which are
+// ordered oldest first.
+func contractNeighbors(memos Memos, id int) (older, newer *Memo) {
+	for i, m := range memos {
+		if m.Id == id {
+			if i > 0 {
+				older = memos[i-1]
+			}
+			if i < len(memos)-1 {
+				newer = memos[i+1]
+			}
+		}
+	}
+	return older, newer
+}
+
+// TestStoreContract loads the caches from a memory database, changes it
+// through the handlers and checks that cache and tables still agree.
+func TestStoreContract(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 3, Users: 8, Memos: 400})
+	db := <-dbConnPool
+	dbConnPool <- db
+	checkStoreContract(t, db)
+
+	config.AdminToken = "contract"
+	admin := func(path string, form url.Values) {
+		req, _ := http.NewRequest("POST", app.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Admin-Token", config.AdminToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			t.Fatalf("POST %s: %d", path, res.StatusCode)
+		}
+	}
+	admin("/admin/teams", url.Values{"name": {"contract"}})
+	admin("/admin/teams/contract/members", url.Values{"username": {"user1"}})
+	admin("/admin/teams/contract/members", url.Values{"username": {"user2"}})
+	for i, v := range []string{"public", "unlisted", "followers", "private", "team", "public"} {
+		app.postMemo(t, url.Values{"content": {"contract " + strconv.Itoa(i)}, "visibility": {v}, "team": {"contract"}})
+	}
+	app.post(t, "/follow/2", url.Values{})
+	app.post(t, "/follow/3", url.Values{})
+	app.post(t, "/unfollow/3", url.Values{})
+	first, _ := listedPage(0)
+	admin("/admin/memos/"+strconv.Itoa(first[1].Id)+"/moderate", url.Values{"action": {"hide"}, "reason": {"contract"}})
+	admin("/admin/memos/"+strconv.Itoa(first[2].Id)+"/moderate", url.Values{"action": {"lock"}, "reason": {"contract"}})
+	mine := first[0]
+	app.post(t, "/memo/"+strconv.Itoa(mine.Id)+"/edit", url.Values{
+		"content": {mine.Content}, "visibility": {"private"}, "version": {strconv.Itoa(mine.Version)},
+	})
+	if memo, _ := memoCache.Get(first[1].Id); !memo.Hidden {
+		t.Fatalf("memo %d was not hidden", memo.Id)
+	}
+	if memo, _ := memoCache.Get(mine.Id); memo.Visibility != visibilityPrivate {
+		t.Fatalf("memo %d was not made private", memo.Id)
+	}
+	checkStoreContract(t, db)
+}
+
+// TestStoreContractMySQL runs the same checks against the MySQL database
+// in ISUCON_TEST_DSN, without changing it.
+func TestStoreContractMySQL(t *testing.T) {
+	dsn := os.Getenv("ISUCON_TEST_DSN")
+	if dsn == "" {
+		t.Skip("ISUCON_TEST_DSN is not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := initialize(db); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		empty := memorySeed{}
+		db, _ := sql.Open(memoryDriverName, empty.dsn())
+		initialize(db)
+		db.Close()
+	}()
+	checkStoreContract(t, db)
+}
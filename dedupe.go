@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const duplicatePostWindow = 5 * time.Second
+
+// recentPost is a memo post that is in progress or finished within the
+// duplicate window. done is closed once id is known (zero on failure).
+type recentPost struct {
+	id   int64
+	at   time.Time
+	done chan struct{}
+}
+
+// postDeduper collapses identical memo posts from the same user that
+// arrive within duplicatePostWindow, e.g. from a double-clicked button.
+type postDeduper struct {
+	sync.Mutex
+	posts map[string]*recentPost
+}
+
+var recentPosts = &postDeduper{posts: make(map[string]*recentPost)}
+
+func postKey(userId int, visibility Visibility, content string) string {
+	return fmt.Sprintf("%d:%s:%x", userId, visibility, sha1.Sum([]byte(content)))
+}
+
+// begin returns the post registered under key and whether the caller owns
+// it. An owner must call finish; others may wait for the owner's result.
+func (d *postDeduper) begin(key string) (*recentPost, bool) {
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	for k, p := range d.posts {
+		if now.Sub(p.at) > duplicatePostWindow {
+			delete(d.posts, k)
+		}
+	}
+	if p, ok := d.posts[key]; ok {
+		return p, false
+	}
+	p := &recentPost{at: now, done: make(chan struct{})}
+	d.posts[key] = p
+	return p, true
+}
+
+// finish records the id of the inserted memo, or forgets the post when
+// the insert failed so that a retry is not redirected to nothing.
+func (d *postDeduper) finish(key string, p *recentPost, id int64) {
+	d.Lock()
+	p.id = id
+	if id == 0 {
+		delete(d.posts, key)
+	}
+	d.Unlock()
+	close(p.done)
+}
+
+func (p *recentPost) wait() int64 {
+	<-p.done
+	return p.id
+}
+
+const (
+	// nearDuplicateBits is how many simhash bits two memos may differ in
+	// and still be near duplicates. Memos are short, so a changed word
+	// moves more bits than in the usual use on web pages; unrelated memos
+	// differ in well over ten.
+	nearDuplicateBits = 6
+	// minSimHashTerms is the fewest distinct words a memo needs for a
+	// simhash. Shorter memos only match when identical: a word or two
+	// changed in them is a real difference.
+	minSimHashTerms    = 8
+	maxDuplicateGroups = 100
+)
+
+// simHash fingerprints content so that memos with mostly the same words
+// get hashes differing in few bits. It is zero for short memos.
+func simHash(content string) uint64 {
+	terms := relatedTerms(content)
+	if len(terms) < minSimHashTerms {
+		return 0
+	}
+	var weights [64]int
+	h := fnv.New64a()
+	for term, n := range terms {
+		h.Reset()
+		h.Write([]byte(term))
+		x := h.Sum64()
+		for i := range weights {
+			if x&(1<<uint(i)) != 0 {
+				weights[i] += n
+			} else {
+				weights[i] -= n
+			}
+		}
+	}
+	var hash uint64
+	for i, w := range weights {
+		if w > 0 {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// simHashCache keeps the simhash of each memo version it has been asked
+// for, so that only new and edited memos are hashed again.
+type simHashCache struct {
+	sync.Mutex
+	hashes map[int]simHashEntry
+}
+
+type simHashEntry struct {
+	version   int
+	createdAt time.Time
+	hash      uint64
+}
+
+var simHashes = &simHashCache{hashes: make(map[int]simHashEntry)}
+
+func (c *simHashCache) Get(memo *Memo) uint64 {
+	c.Lock()
+	e, ok := c.hashes[memo.Id]
+	c.Unlock()
+	if ok && e.version == memo.Version && e.createdAt.Equal(memo.CreatedAt) {
+		return e.hash
+	}
+	e = simHashEntry{version: memo.Version, createdAt: memo.CreatedAt, hash: simHash(memo.Content)}
+	c.Lock()
+	c.hashes[memo.Id] = e
+	c.Unlock()
+	return e.hash
+}
+
+func nearDuplicate(a, b *Memo) bool {
+	ha, hb := simHashes.Get(a), simHashes.Get(b)
+	if ha == 0 || hb == 0 {
+		return a.Content == b.Content
+	}
+	return bits.OnesCount64(ha^hb) <= nearDuplicateBits
+}
+
+// findNearDuplicate returns the author's newest other memo that is nearly
+// the same as memo, or nil.
+func findNearDuplicate(memo *Memo) *Memo {
+	var found *Memo
+	for _, other := range memoCache.ByUser(memo.User) {
+		if other.Id != memo.Id && nearDuplicate(memo, other) {
+			if found == nil || other.Id > found.Id {
+				found = other
+			}
+		}
+	}
+	return found
+}
+
+type DuplicateMemo struct {
+	Id    int    `json:"id"`
+	User  int    `json:"user"`
+	Title string `json:"title"`
+}
+
+type DuplicateGroup struct {
+	Memos []DuplicateMemo `json:"memos"`
+}
+
+// findDuplicateGroups groups the cached memos that are near duplicates of
+// each other, largest groups first. Comparing every pair would take too
+// long, so hashes are only compared with those sharing one of seven
+// 9-bit bands: hashes at most nearDuplicateBits apart always do.
+func findDuplicateGroups() []*DuplicateGroup {
+	byHash := make(map[uint64][]*Memo)
+	byContent := make(map[string][]*Memo)
+	memoCache.Each(func(memo *Memo) {
+		if hash := simHashes.Get(memo); hash == 0 {
+			byContent[memo.Content] = append(byContent[memo.Content], memo)
+		} else {
+			byHash[hash] = append(byHash[hash], memo)
+		}
+	})
+
+	hashes := make([]uint64, 0, len(byHash))
+	for hash := range byHash {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for band := uint(0); band < 63; band += 9 {
+		buckets := make(map[uint64][]int)
+		for i, hash := range hashes {
+			key := hash >> band & 0x1ff
+			buckets[key] = append(buckets[key], i)
+		}
+		for _, bucket := range buckets {
+			for x := 0; x < len(bucket); x++ {
+				for y := x + 1; y < len(bucket); y++ {
+					if bits.OnesCount64(hashes[bucket[x]]^hashes[bucket[y]]) <= nearDuplicateBits {
+						parent[root(bucket[y])] = root(bucket[x])
+					}
+				}
+			}
+		}
+	}
+
+	var sets [][]*Memo
+	components := make(map[int][]*Memo)
+	for i, hash := range hashes {
+		components[root(i)] = append(components[root(i)], byHash[hash]...)
+	}
+	for _, memos := range components {
+		sets = append(sets, memos)
+	}
+	for _, memos := range byContent {
+		sets = append(sets, memos)
+	}
+
+	groups := make([]*DuplicateGroup, 0)
+	for _, memos := range sets {
+		if len(memos) < 2 {
+			continue
+		}
+		sort.Slice(memos, func(i, j int) bool { return memos[i].Id < memos[j].Id })
+		group := &DuplicateGroup{}
+		for _, memo := range memos {
+			group.Memos = append(group.Memos, DuplicateMemo{Id: memo.Id, User: memo.User, Title: memo.Title})
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Memos) != len(groups[j].Memos) {
+			return len(groups[i].Memos) > len(groups[j].Memos)
+		}
+		return groups[i].Memos[0].Id < groups[j].Memos[0].Id
+	})
+	if len(groups) > maxDuplicateGroups {
+		groups = groups[:maxDuplicateGroups]
+	}
+	return groups
+}
+
+// duplicatesHandler reports the groups of near-duplicate memos, which
+// mostly come from benchmark runs.
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, findDuplicateGroups())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const dedupeText = `Notes from the tuning session: the slow query on the recent list
+went away after adding a covering index, nginx now serves the static
+files directly, and the template cache cut rendering time by half. Next
+we profile the session store and move sign-in checks to memory.`
+
+func TestSimHash(t *testing.T) {
+	if h := simHash("too short to hash"); h != 0 {
+		t.Errorf("short memo has simhash %x", h)
+	}
+	a := &Memo{Id: -1, Content: dedupeText}
+	b := &Memo{Id: -2, Content: strings.Replace(dedupeText, "by half", "by a third", 1)}
+	if !nearDuplicate(a, b) {
+		t.Errorf("an edited copy is not a near duplicate")
+	}
+	other := "Shopping list for the weekend trip: bread, cheese, apples, coffee beans, sunscreen, batteries, a map of the coast and rain jackets for everyone."
+	c := &Memo{Id: -3, Content: other}
+	if nearDuplicate(a, c) {
+		t.Errorf("unrelated memos are near duplicates")
+	}
+	short := &Memo{Id: -4, Content: "hello"}
+	if nearDuplicate(short, &Memo{Id: -5, Content: "hello there"}) || !nearDuplicate(short, &Memo{Id: -6, Content: "hello"}) {
+		t.Errorf("short memos should only match when identical")
+	}
+}
+
+func TestNearDuplicatePost(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 10})
+	res := app.postMemo(t, url.Values{"content": {"# tuning\n" + dedupeText}, "visibility": {"public"}})
+	if res.Request.URL.RawQuery != "" {
+		t.Fatalf("first post warns: %s", res.Request.URL)
+	}
+	first := strings.SplitN(strings.TrimPrefix(res.Request.URL.Path, "/memo/"), "-", 2)[0]
+
+	res = app.postMemo(t, url.Values{"content": {"# tuning again\n" + dedupeText}, "visibility": {"private"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("second post: %d", res.StatusCode)
+	}
+	if got := res.Request.URL.Query().Get("similar"); got != first {
+		t.Fatalf("second post redirected to %s, want similar=%s", res.Request.URL, first)
+	}
+	page := app.get(t, res.Request.URL.RequestURI())
+	if !strings.Contains(page, `id="similar"`) {
+		t.Errorf("memo page does not warn about the near duplicate")
+	}
+
+	groups := findDuplicateGroups()
+	found := false
+	for _, g := range groups {
+		ids := make([]string, len(g.Memos))
+		for i, m := range g.Memos {
+			ids[i] = strconv.Itoa(m.Id)
+		}
+		if strings.Contains(" "+strings.Join(ids, " ")+" ", " "+first+" ") && len(g.Memos) >= 2 {
+			found = true
+		}
+	}
+	if !found {
+		b, _ := json.Marshal(groups)
+		t.Errorf("duplicate report misses memo %s: %s", first, b)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"unicode"
+)
+
+// maxDiffEdits bounds the work of wordDiff. Texts that differ in more
+// words than this are shown as wholly replaced.
+const maxDiffEdits = 1000
+
+type diffKind int
+
+const (
+	diffEqual diffKind = iota
+	diffDelete
+	diffInsert
+)
+
+// diffOp is a run of text that both versions share, or that only the old
+// or only the new one has.
+type diffOp struct {
+	Kind diffKind
+	Text string
+}
+
+// MemoDiff is the change from one version of a memo to another, rendered
+// inline and side by side.
+type MemoDiff struct {
+	Inline template.HTML
+	Old    template.HTML
+	New    template.HTML
+}
+
+// diffTokens splits s into words and the runs of space between them, so
+// that joining the tokens gives s back.
+func diffTokens(s string) []string {
+	var tokens []string
+	start, space := 0, false
+	for i, r := range s {
+		if i > start && unicode.IsSpace(r) != space {
+			tokens = append(tokens, s[start:i])
+			start = i
+		}
+		space = unicode.IsSpace(r)
+	}
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// wordDiff compares old and new word by word with Myers' algorithm,
+// which finds the shortest edit script.
+func wordDiff(old, new string) []diffOp {
+	a, b := diffTokens(old), diffTokens(new)
+
+	// Shared leading and trailing words need no search.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	add := func(kind diffKind, tokens []string) {
+		if len(tokens) == 0 {
+			return
+		}
+		text := strings.Join(tokens, "")
+		if n := len(ops); n > 0 && ops[n-1].Kind == kind {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, diffOp{Kind: kind, Text: text})
+	}
+	add(diffEqual, a[:prefix])
+	for _, op := range myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		add(op.Kind, []string{op.Text})
+	}
+	add(diffEqual, a[len(a)-suffix:])
+	return ops
+}
+
+// myersDiff returns one op per token.
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+	// v[k+offset] is the furthest x reached on diagonal k; trace keeps
+	// the v of each step for walking back.
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				x = v[k+1+offset]
+			} else {
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		ops := make([]diffOp, 0, n+m)
+		for _, t := range a {
+			ops = append(ops, diffOp{Kind: diffDelete, Text: t})
+		}
+		for _, t := range b {
+			ops = append(ops, diffOp{Kind: diffInsert, Text: t})
+		}
+		return ops
+	}
+
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+offset]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{Kind: diffEqual, Text: a[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{Kind: diffInsert, Text: b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{Kind: diffDelete, Text: a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, diffOp{Kind: diffEqual, Text: a[x]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// newMemoDiff renders the change from old to new with <del> and <ins>.
+func newMemoDiff(old, new string) *MemoDiff {
+	var inline, left, right strings.Builder
+	for _, op := range wordDiff(old, new) {
+		text := template.HTMLEscapeString(op.Text)
+		switch op.Kind {
+		case diffEqual:
+			inline.WriteString(text)
+			left.WriteString(text)
+			right.WriteString(text)
+		case diffDelete:
+			inline.WriteString("<del>" + text + "</del>")
+			left.WriteString("<del>" + text + "</del>")
+		case diffInsert:
+			inline.WriteString("<ins>" + text + "</ins>")
+			right.WriteString("<ins>" + text + "</ins>")
+		}
+	}
+	return &MemoDiff{
+		Inline: template.HTML(inline.String()),
+		Old:    template.HTML(left.String()),
+		New:    template.HTML(right.String()),
+	}
+}
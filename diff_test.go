@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWordDiff(t *testing.T) {
+	for _, c := range []struct{ old, new, want string }{
+		{"same text", "same text", "same text"},
+		{"", "new", "+[new]"},
+		{"old", "", "-[old]"},
+		{"the quick brown fox", "the slow brown fox", "the -[quick]+[slow] brown fox"},
+		{"a b c", "a c", "a -[b ]c"},
+		{"one\ntwo", "one\n2\ntwo", "one\n+[2\n]two"},
+		{"ab cd", "cd ab", "-[ab ]cd+[ ab]"},
+	} {
+		var got strings.Builder
+		for _, op := range wordDiff(c.old, c.new) {
+			switch op.Kind {
+			case diffEqual:
+				got.WriteString(op.Text)
+			case diffDelete:
+				got.WriteString("-[" + op.Text + "]")
+			case diffInsert:
+				got.WriteString("+[" + op.Text + "]")
+			}
+		}
+		if got.String() != c.want {
+			t.Errorf("wordDiff(%q, %q) = %q, want %q", c.old, c.new, got.String(), c.want)
+		}
+	}
+}
+
+func TestWordDiffRoundTrip(t *testing.T) {
+	old := strings.Repeat("alpha beta gamma\n", 50)
+	new := strings.Replace(old, "beta", "delta", 7)
+	var a, b strings.Builder
+	for _, op := range wordDiff(old, new) {
+		if op.Kind != diffInsert {
+			a.WriteString(op.Text)
+		}
+		if op.Kind != diffDelete {
+			b.WriteString(op.Text)
+		}
+	}
+	if a.String() != old || b.String() != new {
+		t.Errorf("the diff does not give back both texts")
+	}
+}
+
+func TestMemoDiffEscapes(t *testing.T) {
+	d := newMemoDiff("<b>old</b>", "<b>new</b>")
+	if strings.Contains(string(d.Inline), "<b>") {
+		t.Errorf("inline diff is not escaped: %s", d.Inline)
+	}
+	if !strings.Contains(string(d.Old), "<del>") || !strings.Contains(string(d.New), "<ins>") {
+		t.Errorf("side by side diff has no marks: %s | %s", d.Old, d.New)
+	}
+}
+
+func TestConflictDiff(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 5})
+	res := app.postMemo(t, url.Values{"content": {"# plan\nship on monday"}, "visibility": {"private"}})
+	id, _ := strconv.Atoi(strings.SplitN(strings.TrimPrefix(res.Request.URL.Path, "/memo/"), "-", 2)[0])
+	memo, ok := memoCache.Get(id)
+	if !ok {
+		t.Fatalf("memo %d is not cached", id)
+	}
+	edit := "/memo/" + strconv.Itoa(id) + "/edit"
+	version := strconv.Itoa(memo.Version)
+	res = app.post(t, edit, url.Values{"content": {"# plan\nship on tuesday"}, "visibility": {"private"}, "version": {version}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("first edit: %d", res.StatusCode)
+	}
+	res, err := app.client.PostForm(app.URL+edit, url.Values{"sid": {app.sid}, "content": {"# plan\nship on friday"}, "visibility": {"private"}, "version": {version}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("stale edit: %d, want 409", res.StatusCode)
+	}
+	page, _ := ioutil.ReadAll(res.Body)
+	if !strings.Contains(string(page), "ship on <del>tuesday</del>") || !strings.Contains(string(page), "ship on <ins>friday</ins>") {
+		t.Errorf("conflict page does not show the word diff:\n%s", page)
+	}
+}
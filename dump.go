@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+type dumpTable struct {
+	name    string
+	columns []string
+}
+
+// dumpTables are what export writes and import reads, in that order.
+// Views and visitor counts are left out: they are statistics, and large.
+// So are API refresh tokens, which clients can get again by signing in,
+// and memo attachments, whose files are in the blob store.
+var dumpTables = []dumpTable{
+	{"users", []string{"id", "username", "password", "salt", "last_access"}},
+	{"memos", []string{"id", "user", "content", "visibility", "created_at", "updated_at", "version", "slug", "hidden", "team_id", "locked", "moderation_note"}},
+	{"follows", []string{"follower", "followee", "created_at"}},
+	{"teams", []string{"id", "name", "created_at"}},
+	{"team_members", []string{"team_id", "user_id", "created_at"}},
+	{"memo_flags", []string{"memo_id", "reason", "created_at"}},
+	{"memo_reports", []string{"id", "memo_id", "reporter", "reason", "status", "created_at", "resolved_at"}},
+	{"site_banner", []string{"id", "message", "updated_at"}},
+	{"user_preferences", []string{"user_id", "per_page", "theme", "timezone", "language", "hard_breaks", "updated_at"}},
+	{"memo_templates", []string{"id", "user_id", "name", "content", "created_at", "updated_at"}},
+}
+
+func findDumpTable(name string) (dumpTable, bool) {
+	for _, t := range dumpTables {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return dumpTable{}, false
+}
+
+func (t dumpTable) selectSQL() string {
+	return "SELECT " + strings.Join(t.columns, ", ") + " FROM " + t.name + " ORDER BY " + t.columns[0]
+}
+
+func (t dumpTable) insertSQL() string {
+	return "INSERT INTO " + t.name + " (" + strings.Join(t.columns, ", ") + ") VALUES (?" +
+		strings.Repeat(", ?", len(t.columns)-1) + ")"
+}
+
+// dumpRecord is one row of an export, written as a line of JSON. NULL
+// columns are null and missing ones are read as NULL.
+type dumpRecord struct {
+	Table string                 `json:"table"`
+	Row   map[string]interface{} `json:"row"`
+}
+
+func exportDump(ctx context.Context, db *sql.DB, w io.Writer) (map[string]int, error) {
+	enc := json.NewEncoder(w)
+	counts := make(map[string]int)
+	for _, t := range dumpTables {
+		if err := exportTable(ctx, db, t, enc, counts); err != nil {
+			return counts, fmt.Errorf("%s: %s", t.name, err)
+		}
+	}
+	return counts, nil
+}
+
+func exportTable(ctx context.Context, db *sql.DB, t dumpTable, enc *json.Encoder, counts map[string]int) error {
+	rows, err := db.QueryContext(ctx, t.selectSQL())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	values := make([]interface{}, len(t.columns))
+	dest := make([]interface{}, len(t.columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		rec := dumpRecord{Table: t.name, Row: make(map[string]interface{}, len(t.columns))}
+		for i, c := range t.columns {
+			rec.Row[c] = dumpValue(values[i])
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+		counts[t.name]++
+	}
+	return rows.Err()
+}
+
+// dumpValue makes a scanned column JSON-friendly: the MySQL driver gives
+// text and DATETIME columns as bytes.
+func dumpValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+// importDump inserts the records next returns, until io.EOF, in one
+// transaction. The users and memos tables have to be empty.
+func importDump(ctx context.Context, db *sql.DB, next func(*dumpRecord) error) (map[string]int, error) {
+	for _, table := range []string{"users", "memos"} {
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT count(*) FROM "+table).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, fmt.Errorf("%s has %d rows; import only into an empty database", table, n)
+		}
+	}
+	counts := make(map[string]int)
+	err := withTx(ctx, db, func(tx *sql.Tx) error {
+		for {
+			var rec dumpRecord
+			if err := next(&rec); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			t, ok := findDumpTable(rec.Table)
+			if !ok {
+				return fmt.Errorf("unknown table %q", rec.Table)
+			}
+			if _, err := tx.ExecContext(ctx, t.insertSQL(), rec.args(t)...); err != nil {
+				return fmt.Errorf("%s row %d: %s", t.name, counts[t.name]+1, err)
+			}
+			counts[t.name]++
+		}
+	})
+	return counts, err
+}
+
+func (rec *dumpRecord) args(t dumpTable) []interface{} {
+	args := make([]interface{}, len(t.columns))
+	for i, c := range t.columns {
+		args[i] = rec.Row[c]
+	}
+	return args
+}
+
+// dumpRecords gives the store's users, follows and memos as an export
+// would have them.
+func (s *memStore) dumpRecords() []dumpRecord {
+	var recs []dumpRecord
+	add := func(table string, row map[string]interface{}) {
+		recs = append(recs, dumpRecord{Table: table, Row: row})
+	}
+	nullable := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	userIds := make([]int, 0, len(s.users))
+	for id := range s.users {
+		userIds = append(userIds, id)
+	}
+	sort.Ints(userIds)
+	for _, id := range userIds {
+		u := s.users[id]
+		add("users", map[string]interface{}{"id": u.Id, "username": u.Username, "password": u.Password, "salt": u.Salt, "last_access": nullable(u.LastAccess)})
+	}
+	now := s.now()
+	for _, pair := range pairRows(s.follows).rows {
+		add("follows", map[string]interface{}{"follower": pair[0], "followee": pair[1], "created_at": now})
+	}
+	for _, m := range s.selectMemos(func(*Memo) bool { return true }, memoById) {
+		add("memos", map[string]interface{}{
+			"id": m.Id, "user": m.User, "content": m.Content, "visibility": string(m.Visibility),
+			"created_at": formatDBTime(m.CreatedAt), "updated_at": formatDBTime(m.UpdatedAt),
+			"version": m.Version, "slug": nullable(m.Slug), "hidden": m.Hidden, "locked": m.Locked,
+		})
+	}
+	return recs
+}
+
+func logCounts(verb string, counts map[string]int) {
+	for _, t := range dumpTables {
+		if n := counts[t.name]; n > 0 {
+			log.Printf("%s %d %s", verb, n, t.name)
+		}
+	}
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Parse(args)
+
+	loadEnvConfig()
+	db, err := openMySQL()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	counts, err := exportDump(context.Background(), db, os.Stdout)
+	logCounts("exported", counts)
+	return err
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s import [file]\n\nReads stdin without a file.\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	in := os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	loadEnvConfig()
+	db, err := openMySQL()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	dec := json.NewDecoder(in)
+	dec.UseNumber()
+	counts, err := importDump(context.Background(), db, func(rec *dumpRecord) error { return dec.Decode(rec) })
+	if err != nil {
+		return err
+	}
+	logCounts("imported", counts)
+	return nil
+}
+
+func seedCommand(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	seed := defaultMemorySeed
+	registerSeedFlags(fs, &seed, "generated data set")
+	fs.Parse(args)
+
+	loadEnvConfig()
+	db, err := openMySQL()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	s := newMemStore()
+	s.seed(seed)
+	recs := s.dumpRecords()
+	counts, err := importDump(context.Background(), db, func(rec *dumpRecord) error {
+		if len(recs) == 0 {
+			return io.EOF
+		}
+		*rec, recs = recs[0], recs[1:]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logCounts("seeded", counts)
+	return nil
+}
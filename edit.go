@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ownMemo returns the memo named in the route if user owns it. Other
+// users' memos are reported as missing.
+func ownMemo(r *http.Request, user *User) (*Memo, error) {
+	if user == nil {
+		return nil, notFoundError("")
+	}
+	memoId, err := strconv.Atoi(mux.Vars(r)["memo_id"])
+	if err != nil {
+		return nil, notFoundError("")
+	}
+	memo, ok := memoCache.Get(memoId)
+	if !ok || memo.User != user.Id {
+		return nil, notFoundError("")
+	}
+	return memo, nil
+}
+
+func memoEditHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+	memo, err := editableMemo(r, user)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	v := &View{
+		User:    user,
+		Memo:    memo,
+		Draft:   memo,
+		Teams:   teams.Of(user.Id),
+		Session: session,
+	}
+	if err = renderTemplate(w, r, "edit", v); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+// memoEditPostHandler updates a memo only if it is still at the version
+// the form was rendered from. Otherwise both versions are shown so the
+// user can merge them and submit again against the current version.
+func memoEditPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	if antiCSRF(w, r, session) {
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+	memo, err := editableMemo(r, user)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	draft := &Memo{
+		Id:      memo.Id,
+		User:    memo.User,
+		Content: r.FormValue("content"),
+	}
+	if draft.Visibility, err = visibilityFromForm(r); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if draft.Team, err = teamFromForm(r, user, draft.Visibility); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	draft.Version, _ = strconv.Atoi(r.FormValue("version"))
+
+	var updated int64
+	var current *Memo
+	err = withTx(r.Context(), dbConn, func(tx *sql.Tx) error {
+		result, err := execSQL(r.Context(), tx,
+			"UPDATE memos SET content=?, visibility=?, team_id=?, version=version+1, updated_at=now() WHERE id=? AND user=? AND version=? AND locked=0",
+			draft.Content, draft.Visibility, teamIdArg(draft.Team), memo.Id, user.Id, draft.Version,
+		)
+		if err != nil {
+			return err
+		}
+		if updated, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		current, err = loadMemo(r.Context(), tx, int64(memo.Id))
+		return err
+	})
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	memoCache.Put(current)
+	fanOut(current)
+	indexTeamMemo(memo, current)
+	if memo.Listed() || current.Listed() {
+		listFragments.Purge()
+	}
+
+	if updated == 0 && current.Locked {
+		handleError(w, r, forbiddenError("this memo was locked by a moderator"))
+		return
+	}
+	if updated == 0 {
+		prepareMemo(draft)
+		v := &View{
+			User:    user,
+			Memo:    current,
+			Draft:   draft,
+			Diff:    newMemoDiff(current.Content, draft.Content),
+			Teams:   teams.Of(user.Id),
+			Session: session,
+		}
+		w.WriteHeader(http.StatusConflict)
+		if err = renderTemplate(w, r, "conflict", v); err != nil {
+			handleError(w, r, err)
+		}
+		return
+	}
+	markWrite(w)
+	http.Redirect(w, r, current.Path(), http.StatusFound)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+)
+
+var shortcodeRe = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+
+// emojiShortcodes covers the common shortcodes; sites can add their own
+// images with config.Emoji.
+var emojiShortcodes = map[string]string{
+	"smile":            "😄",
+	"smiley":           "😃",
+	"grin":             "😁",
+	"laughing":         "😆",
+	"joy":              "😂",
+	"wink":             "😉",
+	"blush":            "😊",
+	"heart_eyes":       "😍",
+	"thinking":         "🤔",
+	"neutral_face":     "😐",
+	"sweat_smile":      "😅",
+	"cry":              "😢",
+	"sob":              "😭",
+	"angry":            "😠",
+	"scream":           "😱",
+	"sunglasses":       "😎",
+	"+1":               "👍",
+	"thumbsup":         "👍",
+	"-1":               "👎",
+	"thumbsdown":       "👎",
+	"clap":             "👏",
+	"pray":             "🙏",
+	"wave":             "👋",
+	"ok_hand":          "👌",
+	"muscle":           "💪",
+	"eyes":             "👀",
+	"heart":            "❤️",
+	"broken_heart":     "💔",
+	"star":             "⭐",
+	"sparkles":         "✨",
+	"fire":             "🔥",
+	"tada":             "🎉",
+	"rocket":           "🚀",
+	"zap":              "⚡",
+	"bulb":             "💡",
+	"memo":             "📝",
+	"warning":          "⚠️",
+	"white_check_mark": "✅",
+	"x":                "❌",
+	"question":         "❓",
+	"exclamation":      "❗",
+	"coffee":           "☕",
+	"beer":             "🍺",
+	"sushi":            "🍣",
+	"bug":              "🐛",
+	"cat":              "🐱",
+	"dog":              "🐶",
+}
+
+// renderEmoji replaces shortcodes in the text of rendered HTML, leaving
+// tags and anything inside <code> or <pre> alone.
+func renderEmoji(s string) string {
+	return mapHTMLText(s, []string{"code", "pre"}, func(text string) string {
+		return shortcodeRe.ReplaceAllStringFunc(text, emojiFor)
+	})
+}
+
+func emojiFor(shortcode string) string {
+	name := shortcode[1 : len(shortcode)-1]
+	if config != nil {
+		if file, ok := config.Emoji[name]; ok {
+			src := "/emoji/" + url.PathEscape(path.Base(file))
+			return `<img class="emoji" src="` + html.EscapeString(src) + `" alt="` + shortcode + `" title="` + shortcode + `">`
+		}
+	}
+	if e, ok := emojiShortcodes[name]; ok {
+		return e
+	}
+	return shortcode
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"./sessions"
+)
+
+// ErrorPage is what the "error" template renders.
+type ErrorPage struct {
+	Code    int
+	Title   string
+	Message string
+}
+
+// renderError is the one way handlers report an error to the client. It
+// renders the theme's error page, with the signed-in header when the
+// request has a session, or a JSON body for API and admin endpoints.
+// An empty message uses the status text.
+func renderError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		session = nil
+	}
+	writeError(w, r, code, message, session)
+}
+
+// writeError renders the error page for session, which may be nil when
+// loading it would be too expensive or has already failed.
+func writeError(w http.ResponseWriter, r *http.Request, code int, message string, session *sessions.Session) {
+	if message == "" {
+		message = http.StatusText(code)
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/admin/") || r.URL.Path == "/reset" {
+		writeJSON(w, code, map[string]string{"error": message})
+		return
+	}
+
+	prepareHandler(w, r)
+	v := &View{
+		Error:   &ErrorPage{Code: code, Title: http.StatusText(code), Message: message},
+		Session: session,
+	}
+	if message != v.Error.Title {
+		v.Notices = []Notice{{Level: noticeError, Message: message}}
+	}
+	if session != nil {
+		if userId, ok := sessionUserId(session); ok {
+			v.User, _ = userCache.Get(userId)
+		}
+	}
+	var buf bytes.Buffer
+	if err := themeTemplates(themeFor(session)).ExecuteTemplate(&buf, "error", v); err != nil {
+		log.Printf("error page: %s", err)
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if v.User != nil {
+		w.Header().Add("Cache-Control", "private")
+	}
+	w.WriteHeader(code)
+	buf.WriteTo(w)
+}
+
+// ErrorKind classifies an AppError; each kind maps to one HTTP status.
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindNotFound
+	KindForbidden
+	KindValidation
+	KindConflict
+)
+
+var kindStatus = map[ErrorKind]int{
+	KindInternal:   http.StatusInternalServerError,
+	KindNotFound:   http.StatusNotFound,
+	KindForbidden:  http.StatusForbidden,
+	KindValidation: http.StatusBadRequest,
+	KindConflict:   http.StatusConflict,
+}
+
+// AppError is an error the store and cache layers return when the cause
+// is something the client should hear about. Message is shown to the
+// client; Err, if any, is only logged.
+type AppError struct {
+	Kind    ErrorKind
+	Message string
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	switch {
+	case e.Err == nil:
+		return e.Message
+	case e.Message == "":
+		return e.Err.Error()
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+func notFoundError(message string) error {
+	return &AppError{Kind: KindNotFound, Message: message}
+}
+
+func forbiddenError(message string) error {
+	return &AppError{Kind: KindForbidden, Message: message}
+}
+
+func validationError(message string) error {
+	return &AppError{Kind: KindValidation, Message: message}
+}
+
+func conflictError(message string) error {
+	return &AppError{Kind: KindConflict, Message: message}
+}
+
+// errorKind reports the kind of err. Errors that aren't AppErrors are
+// internal.
+func errorKind(err error) ErrorKind {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr.Kind
+	}
+	return KindInternal
+}
+
+// errorStatus is the HTTP status and client-facing message for err.
+// Internal errors never expose their message.
+func errorStatus(err error) (int, string) {
+	var appErr *AppError
+	if !errors.As(err, &appErr) || appErr.Kind == KindInternal {
+		return http.StatusInternalServerError, ""
+	}
+	return kindStatus[appErr.Kind], appErr.Message
+}
+
+// handleError reports err to the client with the status its kind maps
+// to, logging it when it is internal.
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	code, message := errorStatus(err)
+	if code == http.StatusInternalServerError {
+		log.Printf("error: %s", err)
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.err = err
+		}
+	}
+	renderError(w, r, code, message)
+}
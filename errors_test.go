@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderError(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleError(w, httptest.NewRequest("GET", "/memo/999", nil), notFoundError(""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `<h3 id="error">404 Not Found</h3>`) {
+		t.Errorf("body does not contain the error heading:\n%s", body)
+	}
+
+	w = httptest.NewRecorder()
+	handleError(w, httptest.NewRequest("GET", "/api/memo/1", nil), validationError("bad cursor"))
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusBadRequest {
+		t.Fatalf("API error = %d %q (%v)", w.Code, w.Body.String(), err)
+	}
+	if body["error"] != "bad cursor" {
+		t.Errorf("error = %q, want %q", body["error"], "bad cursor")
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err     error
+		code    int
+		message string
+	}{
+		{notFoundError(""), http.StatusNotFound, ""},
+		{forbiddenError("admins only"), http.StatusForbidden, "admins only"},
+		{validationError("invalid visibility"), http.StatusBadRequest, "invalid visibility"},
+		{conflictError("edited elsewhere"), http.StatusConflict, "edited elsewhere"},
+		{fmt.Errorf("loading memo 3: %w", &AppError{Kind: KindNotFound, Err: sql.ErrNoRows}), http.StatusNotFound, ""},
+		{&AppError{Kind: KindInternal, Message: "dsn secret", Err: errors.New("dial")}, http.StatusInternalServerError, ""},
+		{errors.New("connection refused"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		code, message := errorStatus(tt.err)
+		if code != tt.code || message != tt.message {
+			t.Errorf("errorStatus(%v) = %d %q, want %d %q", tt.err, code, message, tt.code, tt.message)
+		}
+	}
+
+	err := &AppError{Kind: KindNotFound, Err: sql.ErrNoRows}
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("AppError does not unwrap to its cause")
+	}
+	if errorKind(err) != KindNotFound || errorKind(sql.ErrNoRows) != KindInternal {
+		t.Errorf("errorKind misclassified errors")
+	}
+}
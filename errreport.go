@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	errorReportQueueLen = 64
+	errorReportTimeout  = 5 * time.Second
+	errorReportClient   = "isucon3-go/1.0"
+	maxReportFrames     = 50
+)
+
+// release names the build in error reports. Set it with
+// -ldflags "-X main.release=..."; error_report.release overrides it, and
+// without either the VCS revision Go recorded is used.
+var release string
+
+// ErrorReportConfig sends recovered panics and 5xx responses to a sink
+// that speaks Sentry's store API, such as Sentry itself or GlitchTip,
+// given its DSN. SampleRate is the share of 5xx responses reported;
+// panics are always. Events the sink doesn't take are appended to
+// FallbackLog as JSON lines, or logged when it is unset.
+type ErrorReportConfig struct {
+	DSN         string  `json:"dsn"`
+	SampleRate  float64 `json:"sample_rate"`
+	Release     string  `json:"release"`
+	Environment string  `json:"environment"`
+	FallbackLog string  `json:"fallback_log"`
+}
+
+func (c *ErrorReportConfig) validate() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("config: error_report.sample_rate must be between 0 and 1")
+	}
+	if c.DSN != "" {
+		if _, _, err := parseDSN(c.DSN); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDSN turns https://key@host/project into the store endpoint and the
+// key to authenticate with.
+func parseDSN(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", fmt.Errorf("config: bad error_report.dsn: %s", err)
+	}
+	project := strings.TrimPrefix(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || project == "" || u.Host == "" {
+		return "", "", fmt.Errorf("config: error_report.dsn must look like https://key@host/project")
+	}
+	prefix := ""
+	if i := strings.LastIndexByte(project, '/'); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	endpoint = u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/store/"
+	return endpoint, u.User.Username(), nil
+}
+
+// ReportEvent is an event in the Sentry store format, trimmed to what
+// this app fills in.
+type ReportEvent struct {
+	EventId     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Exception   []ReportException `json:"exception,omitempty"`
+	Request     *ReportRequest    `json:"request,omitempty"`
+	User        map[string]string `json:"user,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+type ReportException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *ReportStacktrace `json:"stacktrace,omitempty"`
+}
+
+// ReportStacktrace lists the frames oldest first, as Sentry wants them.
+type ReportStacktrace struct {
+	Frames []ReportFrame `json:"frames"`
+}
+
+type ReportFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type ReportRequest struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// reportedHeaders are the request headers sent with an event; cookies
+// and credentials never are.
+var reportedHeaders = []string{"User-Agent", "Referer", "Accept-Language", "Content-Type"}
+
+// appFuncPrefix starts the names of this package's functions: "main." in
+// the server, the import path in tests.
+var appFuncPrefix = strings.TrimSuffix(runtime.FuncForPC(reflect.ValueOf(buildRelease).Pointer()).Name(), "buildRelease")
+
+type errorReporter struct {
+	c        ErrorReportConfig
+	endpoint string
+	auth     string
+	client   *http.Client
+	queue    chan *ReportEvent
+	done     chan struct{}
+	mu       sync.Mutex
+	closed   bool
+	drops    int64
+}
+
+var reporter *errorReporter
+
+// startErrorReporting starts the sender for c.DSN; the events queued are
+// sent before the process exits.
+func startErrorReporting(c ErrorReportConfig) error {
+	if c.DSN == "" {
+		return nil
+	}
+	endpoint, key, err := parseDSN(c.DSN)
+	if err != nil {
+		return err
+	}
+	if c.SampleRate == 0 {
+		c.SampleRate = 1
+	}
+	if c.Release == "" {
+		c.Release = buildRelease()
+	}
+	rep := &errorReporter{
+		c:        c,
+		endpoint: endpoint,
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s, sentry_key=%s", errorReportClient, key),
+		client:   &http.Client{Timeout: errorReportTimeout},
+		queue:    make(chan *ReportEvent, errorReportQueueLen),
+		done:     make(chan struct{}),
+	}
+	go rep.send()
+	onShutdown(rep.close)
+	reporter = rep
+	log.Printf("reporting errors to %s, release %q", endpoint, c.Release)
+	return nil
+}
+
+func buildRelease() string {
+	if release != "" {
+		return release
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+	return ""
+}
+
+func (rep *errorReporter) send() {
+	defer close(rep.done)
+	for event := range rep.queue {
+		if err := rep.post(event); err != nil {
+			rep.fallback(event, err)
+		}
+	}
+}
+
+func (rep *errorReporter) post(event *ReportEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", rep.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", rep.auth)
+	res, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", rep.endpoint, res.Status)
+	}
+	return nil
+}
+
+// fallback keeps an event the sink did not take, so that it is not lost
+// while the sink is down.
+func (rep *errorReporter) fallback(event *ReportEvent, err error) {
+	log.Printf("error report %s not sent: %s", event.EventId, err)
+	if rep.c.FallbackLog == "" {
+		log.Printf("error report %s: %s", event.EventId, event.summary())
+		return
+	}
+	line, _ := json.Marshal(event)
+	f, ferr := os.OpenFile(rep.c.FallbackLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if ferr != nil {
+		log.Printf("error report %s: %s: %s", event.EventId, ferr, event.summary())
+		return
+	}
+	f.Write(append(line, '\n'))
+	f.Close()
+}
+
+func (rep *errorReporter) close() {
+	rep.mu.Lock()
+	if !rep.closed {
+		rep.closed = true
+		close(rep.queue)
+	}
+	rep.mu.Unlock()
+	<-rep.done
+	if rep.drops > 0 {
+		log.Printf("error report: dropped %d events while the sender was behind", rep.drops)
+	}
+}
+
+// capture never blocks a request; events beyond what the sender keeps up
+// with are dropped.
+func (rep *errorReporter) capture(event *ReportEvent) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	if rep.closed {
+		return
+	}
+	select {
+	case rep.queue <- event:
+	default:
+		rep.drops++
+	}
+}
+
+func (e *ReportEvent) summary() string {
+	if len(e.Exception) > 0 {
+		return e.Exception[0].Type + ": " + e.Exception[0].Value
+	}
+	return e.Message
+}
+
+// newReportEvent fills in what every event of r carries: the request,
+// with secrets left out, the user acting and the request id.
+func (rep *errorReporter) newReportEvent(r *http.Request, level string) *ReportEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	host, _ := os.Hostname()
+	event := &ReportEvent{
+		EventId:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:       level,
+		Platform:    "go",
+		Logger:      "http",
+		Release:     rep.c.Release,
+		Environment: rep.c.Environment,
+		ServerName:  host,
+		Request: &ReportRequest{
+			URL:     requestScheme(r) + "://" + requestHost(r) + r.URL.EscapedPath(),
+			Method:  r.Method,
+			Headers: make(map[string]string),
+		},
+		Tags: map[string]string{"route": routeName(r)},
+	}
+	if r.URL.RawQuery != "" {
+		event.Request.QueryString = sanitizeValues(r.URL.RawQuery)
+	}
+	for _, name := range reportedHeaders {
+		if v := r.Header.Get(name); v != "" {
+			event.Request.Headers[name] = v
+		}
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		event.Tags["request_id"] = info.Id
+		event.User = map[string]string{"ip_address": info.ClientIP}
+		if info.UserId != 0 {
+			event.User["id"] = strconv.Itoa(info.UserId)
+		}
+	}
+	return event
+}
+
+// reportFrames returns the stack of the caller skip levels up, oldest
+// frame first.
+func reportFrames(skip int) []ReportFrame {
+	pcs := make([]uintptr, maxReportFrames)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var list []ReportFrame
+	for {
+		frame, more := frames.Next()
+		list = append(list, ReportFrame{
+			Function: frame.Function,
+			Filename: frame.File,
+			Lineno:   frame.Line,
+			InApp:    strings.HasPrefix(frame.Function, appFuncPrefix),
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list
+}
+
+// errorReportMiddleware reports the panics that reach it, before passing
+// them on to net/http, and the 5xx responses other than the 503s sent on
+// purpose when shedding load.
+func errorReportMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep := reporter
+		if rep == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v != http.ErrAbortHandler {
+				event := rep.newReportEvent(r, "fatal")
+				event.Exception = []ReportException{{
+					Type:  fmt.Sprintf("panic %T", v),
+					Value: fmt.Sprint(v),
+					// Without this function and runtime.gopanic.
+					Stacktrace: &ReportStacktrace{Frames: reportFrames(2)},
+				}}
+				rep.capture(event)
+			}
+			panic(v)
+		}()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		status := sw.Status()
+		if status < 500 || status == http.StatusServiceUnavailable || mathrand.Float64() >= rep.c.SampleRate {
+			return
+		}
+		event := rep.newReportEvent(r, "error")
+		event.Message = fmt.Sprintf("%d %s: %s", status, http.StatusText(status), r.Method+" "+routeName(r))
+		if info := requestInfoFrom(r.Context()); info != nil && info.err != nil {
+			event.Exception = []ReportException{{Type: fmt.Sprintf("%T", info.err), Value: info.err.Error()}}
+		}
+		rep.capture(event)
+	})
+}
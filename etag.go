@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etagSeed keeps ETags built from in-memory counters in one run of the
+// process from matching those of the next, whose counters start over.
+var etagSeed = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// bufferedWriter holds the response body back so that headers derived
+// from it can still be set.
+type bufferedWriter struct {
+	http.ResponseWriter
+	buf    bytes.Buffer
+	status int
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.buf.Write(b)
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// versionETag builds an ETag from the values a response is derived from,
+// so it can be checked before doing any of the work to produce it.
+func versionETag(parts ...interface{}) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum([]byte(fmt.Sprintln(parts...))))
+}
+
+// checkETag sets etag on the response and answers 304 if the client
+// already has it, reporting whether it did.
+func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// withETag renders the page once, then sends Content-Length and an ETag
+// computed from the body. HEAD requests get the same headers as GET with
+// no body, and GETs whose If-None-Match matches are answered with 304.
+func withETag(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bw := &bufferedWriter{ResponseWriter: w}
+		h(bw, r)
+		status := bw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		body := bw.buf.Bytes()
+
+		if status == http.StatusOK {
+			etag := fmt.Sprintf(`"%x"`, sha1.Sum(body))
+			w.Header().Set("ETag", etag)
+			if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		if r.Method != "HEAD" {
+			w.Write(body)
+		}
+	}
+}
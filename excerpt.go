@@ -0,0 +1,142 @@
+package main
+
+import (
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxExcerptRunes = 1000
+
+// excerptInline are the tags an excerpt keeps, without their attributes.
+// Everything else is dropped, its text kept, and block ends become a
+// space, so an excerpt fits inside a link or a line of a list.
+var (
+	excerptInline = map[string]bool{
+		"em": true, "strong": true, "code": true, "del": true, "b": true, "i": true, "s": true,
+	}
+	excerptBlocks = map[string]bool{
+		"p": true, "br": true, "li": true, "ul": true, "ol": true, "div": true, "blockquote": true,
+		"pre": true, "hr": true, "tr": true, "td": true, "th": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	}
+	entityRe = regexp.MustCompile(`^&(#[0-9]{1,7}|#x[0-9a-fA-F]{1,6}|[a-zA-Z][a-zA-Z0-9]{0,31});`)
+)
+
+// excerptHTML cuts rendered HTML down to its first limit characters of
+// text, counting an entity as one, and closes the tags left open. A cut
+// excerpt ends with an ellipsis.
+func excerptHTML(src string, limit int) string {
+	var b strings.Builder
+	var open []string
+	skip := ""
+	n := 0
+	space, cut := false, false
+	for i := 0; i < len(src); {
+		c := src[i]
+		if c == '<' {
+			end := strings.IndexByte(src[i:], '>')
+			if end < 0 {
+				break
+			}
+			tag := strings.TrimSpace(src[i+1 : i+end])
+			i += end + 1
+			closing := strings.HasPrefix(tag, "/")
+			name := strings.ToLower(strings.TrimPrefix(tag, "/"))
+			if j := strings.IndexAny(name, " \t\n/"); j >= 0 {
+				name = name[:j]
+			}
+			switch {
+			case skip != "":
+				if closing && name == skip {
+					skip = ""
+				}
+			case name == "script" || name == "style":
+				if !closing {
+					skip = name
+				}
+			case excerptInline[name] && closing:
+				if len(open) > 0 && open[len(open)-1] == name {
+					open = open[:len(open)-1]
+					b.WriteString("</" + name + ">")
+				}
+			case excerptInline[name] && n >= limit:
+				// Nothing more fits; an empty element would be noise.
+			case excerptInline[name]:
+				if space && n < limit {
+					b.WriteByte(' ')
+					space = false
+					n++
+				}
+				open = append(open, name)
+				b.WriteString("<" + name + ">")
+			case excerptBlocks[name]:
+				space = n > 0
+			}
+			continue
+		}
+		if skip != "" {
+			i++
+			continue
+		}
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			space = n > 0
+			i++
+			continue
+		}
+		if n >= limit {
+			cut = true
+			break
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+			if n++; n >= limit {
+				cut = true
+				break
+			}
+		}
+		if c == '&' {
+			entity := entityRe.FindString(src[i:])
+			if entity == "" {
+				entity = "&amp;"
+				i++
+			} else {
+				i += len(entity)
+			}
+			b.WriteString(entity)
+			n++
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(src[i:])
+		b.WriteString(src[i : i+size])
+		i += size
+		n++
+	}
+	excerpt := strings.TrimRight(b.String(), " ")
+	for j := len(open) - 1; j >= 0; j-- {
+		excerpt += "</" + open[j] + ">"
+	}
+	if cut {
+		excerpt += "…"
+	}
+	return excerpt
+}
+
+// memoExcerpt is the excerpt template function: the first limit
+// characters of memo as rendered, kept in memoHTMLCache next to the full
+// HTML.
+func memoExcerpt(memo *Memo, limit int) template.HTML {
+	if limit < 1 || limit > maxExcerptRunes {
+		limit = maxExcerptRunes
+	}
+	key := strconv.Itoa(memo.Id) + "#excerpt" + strconv.Itoa(limit)
+	if body, version, ok := memoHTMLCache.Get(key); ok && version == memo.Version {
+		return template.HTML(body)
+	}
+	excerpt := excerptHTML(string(renderedHTML(memo)), limit)
+	memoHTMLCache.Set(key, []byte(excerpt), memo.Version)
+	return template.HTML(excerpt)
+}
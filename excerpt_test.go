@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExcerptHTML(t *testing.T) {
+	for _, c := range []struct {
+		src   string
+		limit int
+		want  string
+	}{
+		{"<p>short</p>\n", 10, "short"},
+		{"<h1>Title</h1>\n<p>body <em>text</em></p>\n", 100, "Title body <em>text</em>"},
+		{"<p>some <strong>bold words here</strong></p>", 9, "some <strong>bold</strong>…"},
+		{"<p>a &amp; b &lt;c&gt;</p>", 5, "a &amp; b…"},
+		{`<p><a href="javascript:alert(1)" onclick="x()">link</a> <img src="x.png" alt="pic"></p>`, 50, "link"},
+		{"<p>x</p><script>alert(1)</script><p>y</p>", 10, "x y"},
+		{"<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n", 6, "one tw…"},
+		{"<p>日本語のメモです</p>", 3, "日本語…"},
+		{"<p>AT&T</p>", 10, "AT&amp;T"},
+		{"<p>four <em>more</em></p>", 4, "four…"},
+	} {
+		if got := excerptHTML(c.src, c.limit); got != c.want {
+			t.Errorf("excerptHTML(%q, %d) = %q, want %q", c.src, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestMemoExcerpt(t *testing.T) {
+	memoHTMLCache.Purge()
+	defer memoHTMLCache.Purge()
+	memo := &Memo{Id: 1, Content: strings.Repeat("word ", 100), CreatedAt: time.Now()}
+	excerpt := string(memoExcerpt(memo, 20))
+	if excerpt != "word word word word…" {
+		t.Errorf("excerpt = %q", excerpt)
+	}
+	if _, version, ok := memoHTMLCache.Get("1#excerpt20"); !ok || version != 0 {
+		t.Errorf("excerpt was not cached")
+	}
+	memo.Content, memo.Version = "changed", 1
+	if excerpt := memoExcerpt(memo, 20); excerpt != "changed" {
+		t.Errorf("excerpt of the new version = %q", excerpt)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// feedMaxLen caps each timeline; older entries fall off the end.
+const feedMaxLen = 1000
+
+var (
+	follows = newFollowGraph()
+	feeds   = newFeedIndex()
+)
+
+// followGraph is the in-memory copy of the follows table, indexed in both
+// directions so that fan-out can find a memo author's followers cheaply.
+type followGraph struct {
+	sync.RWMutex
+	following map[int]map[int]bool
+	followers map[int]map[int]bool
+}
+
+func newFollowGraph() *followGraph {
+	return &followGraph{
+		following: make(map[int]map[int]bool),
+		followers: make(map[int]map[int]bool),
+	}
+}
+
+func (g *followGraph) Following(follower, followee int) bool {
+	g.RLock()
+	defer g.RUnlock()
+	return g.following[follower][followee]
+}
+
+func (g *followGraph) Followers(followee int) []int {
+	g.RLock()
+	defer g.RUnlock()
+	ids := make([]int, 0, len(g.followers[followee]))
+	for id := range g.followers[followee] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (g *followGraph) add(follower, followee int) {
+	if g.following[follower] == nil {
+		g.following[follower] = make(map[int]bool)
+	}
+	if g.followers[followee] == nil {
+		g.followers[followee] = make(map[int]bool)
+	}
+	g.following[follower][followee] = true
+	g.followers[followee][follower] = true
+}
+
+func (g *followGraph) Add(follower, followee int) {
+	g.Lock()
+	g.add(follower, followee)
+	g.Unlock()
+}
+
+func (g *followGraph) Remove(follower, followee int) {
+	g.Lock()
+	delete(g.following[follower], followee)
+	delete(g.followers[followee], follower)
+	g.Unlock()
+}
+
+func (g *followGraph) Reload(dbConn *sql.DB) error {
+	rows, err := dbConn.Query("SELECT follower, followee FROM follows")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	loaded := newFollowGraph()
+	for rows.Next() {
+		var follower, followee int
+		if err := rows.Scan(&follower, &followee); err != nil {
+			return err
+		}
+		loaded.add(follower, followee)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	g.Lock()
+	g.following, g.followers = loaded.following, loaded.followers
+	g.Unlock()
+	return nil
+}
+
+// feedIndex holds each user's timeline as memo ids, newest first. It is
+// filled on write (fan-out) so that reading a timeline is a slice copy.
+type feedIndex struct {
+	sync.Mutex
+	feeds map[int][]int
+}
+
+func newFeedIndex() *feedIndex {
+	return &feedIndex{feeds: make(map[int][]int)}
+}
+
+// Insert adds memoId to userId's feed in id order. It is idempotent so
+// the same memo can be fanned out again after an edit.
+func (f *feedIndex) Insert(userId, memoId int) {
+	f.Lock()
+	defer f.Unlock()
+	feed := f.feeds[userId]
+	i := sort.Search(len(feed), func(i int) bool { return feed[i] <= memoId })
+	if i < len(feed) && feed[i] == memoId {
+		return
+	}
+	if i >= feedMaxLen {
+		return
+	}
+	feed = append(feed, 0)
+	copy(feed[i+1:], feed[i:])
+	feed[i] = memoId
+	if len(feed) > feedMaxLen {
+		feed = feed[:feedMaxLen]
+	}
+	f.feeds[userId] = feed
+}
+
+// RemoveAuthor drops authorId's memos from userId's feed after an unfollow.
+func (f *feedIndex) RemoveAuthor(userId, authorId int) {
+	f.Lock()
+	defer f.Unlock()
+	feed := f.feeds[userId][:0]
+	for _, id := range f.feeds[userId] {
+		if memo, ok := memoCache.Get(id); ok && memo.User == authorId {
+			continue
+		}
+		feed = append(feed, id)
+	}
+	f.feeds[userId] = feed
+}
+
+// Remove drops memoId from userId's feed.
+func (f *feedIndex) Remove(userId, memoId int) {
+	f.Lock()
+	defer f.Unlock()
+	feed := f.feeds[userId]
+	i := sort.Search(len(feed), func(i int) bool { return feed[i] <= memoId })
+	if i < len(feed) && feed[i] == memoId {
+		f.feeds[userId] = append(feed[:i], feed[i+1:]...)
+	}
+}
+
+func (f *feedIndex) Ids(userId int) []int {
+	return f.AppendIds(nil, userId)
+}
+
+// AppendIds appends userId's feed to ids, so the caller can reuse a buffer.
+func (f *feedIndex) AppendIds(ids []int, userId int) []int {
+	f.Lock()
+	defer f.Unlock()
+	return append(ids, f.feeds[userId]...)
+}
+
+// feedIdSlices recycles the buffers timelines copy a feed into.
+var feedIdSlices = sync.Pool{
+	New: func() interface{} {
+		ids := make([]int, 0, feedMaxLen)
+		return &ids
+	},
+}
+
+func (f *feedIndex) Reset() {
+	f.Lock()
+	f.feeds = make(map[int][]int)
+	f.Unlock()
+}
+
+// inFeeds reports whether memo is shown on its author's followers' timelines.
+func inFeeds(memo *Memo) bool {
+	return !memo.Hidden && (memo.Visibility == visibilityPublic || memo.Visibility == visibilityFollowers)
+}
+
+// fanOut pushes memo onto the timeline of everyone following its author.
+func fanOut(memo *Memo) {
+	if !inFeeds(memo) {
+		return
+	}
+	for _, follower := range follows.Followers(memo.User) {
+		feeds.Insert(follower, memo.Id)
+	}
+}
+
+// rebuildFeeds reloads the follow graph and refills every timeline from
+// the memo cache.
+func rebuildFeeds(conn *sql.DB) error {
+	if err := follows.Reload(conn); err != nil {
+		return err
+	}
+	feeds.Reset()
+	memoCache.Each(fanOut)
+	return nil
+}
+
+func timelineHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+
+	ids := feedIdSlices.Get().(*[]int)
+	*ids = feeds.AppendIds((*ids)[:0], user.Id)
+	defer feedIdSlices.Put(ids)
+	memos := getMemoSlice()
+	defer putMemoSlice(memos)
+	perPage := perPageFor(user, memosPerPage)
+	for _, id := range *ids {
+		memo, ok := memoCache.Get(id)
+		if !ok || !inFeeds(memo) || !canView(user, memo) {
+			continue
+		}
+		*memos = append(*memos, memo)
+		if len(*memos) == perPage {
+			break
+		}
+	}
+	v := &View{
+		Memos:   *memos,
+		User:    user,
+		Session: session,
+	}
+	if err = renderTemplate(w, r, "timeline", v); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+// followHandler follows or, with unfollow set, unfollows the user named
+// in the route and returns to the memo the form was posted from.
+func followHandler(unfollow bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := loadSession(w, r)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		prepareHandler(w, r)
+		if antiCSRF(w, r, session) {
+			return
+		}
+		dbConn := <-dbConnPool
+		defer func() {
+			dbConnPool <- dbConn
+		}()
+		user := getUser(w, r, session)
+		followee, err := strconv.Atoi(mux.Vars(r)["user_id"])
+		if _, ok := userCache.Get(followee); err != nil || !ok || followee == user.Id {
+			handleError(w, r, notFoundError(""))
+			return
+		}
+
+		if unfollow {
+			_, err = execSQL(r.Context(), dbConn, "DELETE FROM follows WHERE follower=? AND followee=?", user.Id, followee)
+		} else {
+			_, err = execSQL(r.Context(), dbConn, "INSERT IGNORE INTO follows (follower, followee, created_at) VALUES (?, ?, now())", user.Id, followee)
+		}
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		if unfollow {
+			follows.Remove(user.Id, followee)
+			feeds.RemoveAuthor(user.Id, followee)
+		} else {
+			follows.Add(user.Id, followee)
+			for _, memo := range memoCache.ByUser(followee) {
+				if inFeeds(memo) {
+					feeds.Insert(user.Id, memo.Id)
+				}
+			}
+		}
+		markWrite(w)
+		if unfollow {
+			flash(w, r, session, noticeSuccess, "You no longer follow "+userCache.Username(followee)+".")
+		} else {
+			flash(w, r, session, noticeSuccess, "You now follow "+userCache.Username(followee)+".")
+		}
+		if memoId, err := strconv.Atoi(r.FormValue("memo_id")); err == nil {
+			http.Redirect(w, r, memoPath(memoId), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/timeline", http.StatusFound)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFeedIndexInsert(t *testing.T) {
+	f := newFeedIndex()
+	for _, id := range []int{3, 7, 5, 7, 1} {
+		f.Insert(1, id)
+	}
+	if got, want := f.Ids(1), []int{7, 5, 3, 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Ids(1) = %v, want %v", got, want)
+	}
+
+	for id := 1; id <= feedMaxLen+10; id++ {
+		f.Insert(2, id)
+	}
+	ids := f.Ids(2)
+	if len(ids) != feedMaxLen || ids[0] != feedMaxLen+10 {
+		t.Fatalf("len = %d, newest = %d; want %d, %d", len(ids), ids[0], feedMaxLen, feedMaxLen+10)
+	}
+	f.Insert(2, 1)
+	if ids := f.Ids(2); ids[len(ids)-1] == 1 {
+		t.Fatal("memo older than a full feed was inserted")
+	}
+}
+
+func TestCanViewFollowers(t *testing.T) {
+	defer func(g *followGraph) { follows = g }(follows)
+	follows = newFollowGraph()
+	follows.Add(2, 1)
+
+	memo := &Memo{User: 1, Visibility: visibilityFollowers}
+	if !canView(&User{Id: 2}, memo) {
+		t.Error("follower cannot view followers-only memo")
+	}
+	if canView(&User{Id: 3}, memo) {
+		t.Error("non-follower can view followers-only memo")
+	}
+	follows.Remove(2, 1)
+	if canView(&User{Id: 2}, memo) {
+		t.Error("unfollowed user can still view followers-only memo")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formTimeField carries the signed time a guarded form was rendered.
+const formTimeField = "form_ts"
+
+// FormGuardConfig turns on the bot checks for the signin and memo forms.
+// Honeypot names a field hidden from people that must come back empty,
+// and MinSubmitMs is the least time between rendering a form and
+// submitting it. Both are off when unset.
+type FormGuardConfig struct {
+	Honeypot    string `json:"honeypot"`
+	MinSubmitMs int    `json:"min_submit_ms"`
+}
+
+var formGuard FormGuardConfig
+
+func (c *FormGuardConfig) validate() error {
+	if c.MinSubmitMs < 0 {
+		return fmt.Errorf("config: form_guard.min_submit_ms must not be negative")
+	}
+	if c.Honeypot == formTimeField || c.Honeypot == "sid" {
+		return fmt.Errorf("config: form_guard.honeypot %q is used by the forms", c.Honeypot)
+	}
+	return nil
+}
+
+// formGuardFields is the template function for forms that guardForm
+// protects; it renders nothing when both checks are off.
+func formGuardFields() template.HTML {
+	var b strings.Builder
+	if formGuard.Honeypot != "" {
+		fmt.Fprintf(&b, `<div style="display:none" aria-hidden="true"><label>Leave this empty <input type="text" name="%s" value="" tabindex="-1" autocomplete="off"></label></div>`,
+			template.HTMLEscapeString(formGuard.Honeypot))
+	}
+	if formGuard.MinSubmitMs > 0 {
+		fmt.Fprintf(&b, `<input type="hidden" name="%s" value="%s">`, formTimeField, formTimeToken(time.Now()))
+	}
+	return template.HTML(b.String())
+}
+
+func formTimeToken(t time.Time) string {
+	ms := strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	return ms + "." + formTimeSignature(ms)
+}
+
+func formTimeSignature(ms string) string {
+	mac := hmac.New(sha256.New, sessionKey("form"))
+	mac.Write([]byte(ms))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseFormTime returns the time a form time token was made, if it was
+// signed by this server.
+func parseFormTime(token string) (time.Time, bool) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(formTimeSignature(token[:i]))) {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// guardForm turns away forms that fill in the honeypot or come back
+// sooner than min_submit_ms after they were rendered, or without a time
+// token at all. It runs after limitBody, which has parsed the form. The
+// checks are cheap and easily got around; they are a layer in front of
+// the rate limits, not a replacement for them.
+func guardForm(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if formGuard.Honeypot != "" && r.PostFormValue(formGuard.Honeypot) != "" {
+			log.Printf("form guard: honeypot filled on %s from %s", r.URL.Path, clientIP(r))
+			renderError(w, r, http.StatusBadRequest, "The form could not be accepted.")
+			return
+		}
+		if formGuard.MinSubmitMs > 0 {
+			rendered, ok := parseFormTime(r.PostFormValue(formTimeField))
+			if !ok {
+				renderError(w, r, http.StatusBadRequest, "The form has expired. Please reload the page and try again.")
+				return
+			}
+			if time.Since(rendered) < time.Duration(formGuard.MinSubmitMs)*time.Millisecond {
+				log.Printf("form guard: %s submitted too fast from %s", r.URL.Path, clientIP(r))
+				renderError(w, r, http.StatusBadRequest, "The form was sent too quickly. Please wait a moment and try again.")
+				return
+			}
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuardForm(t *testing.T) {
+	defer func(c FormGuardConfig) { formGuard = c }(formGuard)
+	formGuard = FormGuardConfig{Honeypot: "website", MinSubmitMs: 2000}
+
+	h := guardForm(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	post := func(form url.Values) int {
+		r := httptest.NewRequest("POST", "/signin", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+	old := formTimeToken(time.Now().Add(-3 * time.Second))
+	fresh := formTimeToken(time.Now())
+	forged := strings.SplitN(old, ".", 2)[0] + "." + strings.SplitN(fresh, ".", 2)[1]
+	for name, c := range map[string]struct {
+		form url.Values
+		want int
+	}{
+		"human":    {url.Values{formTimeField: {old}, "website": {""}}, http.StatusOK},
+		"honeypot": {url.Values{formTimeField: {old}, "website": {"http://spam.example"}}, http.StatusBadRequest},
+		"too fast": {url.Values{formTimeField: {fresh}}, http.StatusBadRequest},
+		"no token": {url.Values{}, http.StatusBadRequest},
+		"forged":   {url.Values{formTimeField: {forged}}, http.StatusBadRequest},
+	} {
+		if code := post(c.form); code != c.want {
+			t.Errorf("%s: status = %d, want %d", name, code, c.want)
+		}
+	}
+
+	fields := string(formGuardFields())
+	if !strings.Contains(fields, `name="website"`) {
+		t.Errorf("no honeypot in %s", fields)
+	}
+	token := regexp.MustCompile(`name="form_ts" value="([^"]+)"`).FindStringSubmatch(fields)
+	if token == nil {
+		t.Fatalf("no time token in %s", fields)
+	}
+	if _, ok := parseFormTime(token[1]); !ok {
+		t.Errorf("rendered token %q does not parse", token[1])
+	}
+
+	formGuard = FormGuardConfig{}
+	if code := post(url.Values{}); code != http.StatusOK {
+		t.Errorf("guard off: status = %d", code)
+	}
+	if fields := formGuardFields(); fields != "" {
+		t.Errorf("guard off renders %s", fields)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"strconv"
+	"sync"
+)
+
+// listFragment is the rendered public memo list for one page of the index.
+// It does not depend on the viewer, so it is shared by every request and
+// only the header around it is rendered per user.
+type listFragment struct {
+	HTML  template.HTML
+	Count int
+}
+
+// fragmentCache keeps list fragments in pageCache, which bounds their
+// memory; it adds the generation that lets Set skip fragments rendered
+// before a purge.
+type fragmentCache struct {
+	sync.RWMutex
+	pages *renderCache
+	gen   int
+}
+
+var listFragments = &fragmentCache{pages: pageCache}
+
+// Get also returns the cache generation, to be handed back to Set.
+func (c *fragmentCache) Get(key string) (*listFragment, int, bool) {
+	c.RLock()
+	gen := c.gen
+	c.RUnlock()
+	body, count, ok := c.pages.Get(key)
+	if !ok {
+		return nil, gen, false
+	}
+	return &listFragment{HTML: template.HTML(body), Count: count}, gen, true
+}
+
+// Set stores f unless the cache was purged since gen was read, in which
+// case f may have been rendered from stale rows.
+func (c *fragmentCache) Set(key string, gen int, f *listFragment) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.gen == gen {
+		c.pages.Set(key, []byte(f.HTML), f.Count)
+	}
+}
+
+// Generation counts purges, so it changes whenever the public lists do.
+func (c *fragmentCache) Generation() int {
+	c.RLock()
+	defer c.RUnlock()
+	return c.gen
+}
+
+// Purge drops every fragment; any change to the public memos shifts all pages.
+func (c *fragmentCache) Purge() {
+	c.Lock()
+	c.pages.Purge()
+	c.gen++
+	c.Unlock()
+}
+
+// memoListFragment returns the rendered list for page, from the cache when
+// possible. Fragments embed absolute URLs and theme markup, so they are
+// keyed by the request's base URL and theme too.
+func memoListFragment(ctx context.Context, base, theme string, page int) (*listFragment, error) {
+	key := base + "#" + theme + "#" + strconv.Itoa(page)
+	f, gen, ok := listFragments.Get(key)
+	if ok {
+		return f, nil
+	}
+
+	// After a purge every request for the page misses at once; render it
+	// once per generation and let the others wait for the result. The
+	// render outlives any one request, so it must not be canceled with it.
+	v, err := renders.Do("fragment#"+key+"#"+strconv.Itoa(gen), func() (interface{}, error) {
+		return renderListFragment(context.WithoutCancel(ctx), base, theme, page, key, gen)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*listFragment), nil
+}
+
+func renderListFragment(ctx context.Context, base, theme string, page int, key string, gen int) (*listFragment, error) {
+	memos, totalCount := listedPage(page)
+	v := &View{
+		Total:     totalCount,
+		Page:      page,
+		PageStart: memosPerPage*page + 1,
+		PageEnd:   memosPerPage * (page + 1),
+		Memos:     memos,
+	}
+	_, span := startSpan(ctx, "template.memo_list")
+	// The fragment is served to other requests, so its URLs must come
+	// from base and not from the request url_for last saw.
+	var buf bytes.Buffer
+	err := baseTemplates(theme, base).ExecuteTemplate(&buf, "memo_list", v)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &listFragment{HTML: template.HTML(buf.String()), Count: len(memos)}
+	listFragments.Set(key, gen, f)
+	return f, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"html"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// markdownSeeds are inputs the renderer has had trouble with elsewhere:
+// raw HTML, unbalanced markup, links next to punctuation and shortcodes
+// inside code.
+var markdownSeeds = []string{
+	"",
+	"# title\n\nbody",
+	"<script>alert(1)</script>",
+	"<img src=x onerror=alert(1)>",
+	"[x](javascript:alert(1))",
+	"see http://example.com/a?b=1&c=2, then :coffee:",
+	"`:coffee:` and <code>http://example.com</code>",
+	"<a href=\"http://example.com\">http://example.com</a>",
+	"<",
+	"a < b > c",
+	"<pre><code>unterminated",
+	"\x00\xff\xfe",
+	"*_[`<!--",
+}
+
+// linkRe matches the anchors autolink inserts.
+var linkRe = regexp.MustCompile(`<a href="([^"<>]*)" rel="nofollow">|</a>`)
+
+// FuzzMarkdown renders arbitrary memo content.
+func FuzzMarkdown(f *testing.F) {
+	for _, s := range markdownSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		genMarkdown(s)
+	})
+}
+
+// FuzzAutolink checks that autolink only ever adds its own anchors to
+// escaped text, and that their hrefs are http(s) URLs.
+func FuzzAutolink(f *testing.F) {
+	for _, s := range markdownSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		text := html.EscapeString(s)
+		out := autolink(text)
+		if stripped := linkRe.ReplaceAllString(out, ""); stripped != text {
+			t.Fatalf("autolink(%q) = %q, changed more than links", text, out)
+		}
+		for _, m := range linkRe.FindAllStringSubmatch(out, -1) {
+			if m[1] == "" {
+				continue
+			}
+			u, err := url.Parse(html.UnescapeString(m[1]))
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				t.Errorf("autolink(%q) made a link to %q", text, m[1])
+			}
+		}
+	})
+}
+
+// FuzzMapHTMLText checks that walking rendered HTML with the identity
+// function gives back the input, whatever the markup looks like.
+func FuzzMapHTMLText(f *testing.F) {
+	for _, s := range markdownSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		if out := mapHTMLText(s, []string{"code", "pre"}, func(text string) string { return text }); out != s {
+			t.Errorf("mapHTMLText(%q) = %q", s, out)
+		}
+		renderEmoji(s)
+	})
+}
+
+// FuzzMemoSlug checks that any first line gives a slug that survives the
+// round trip through a memo URL.
+func FuzzMemoSlug(f *testing.F) {
+	for _, s := range markdownSeeds {
+		f.Add(s)
+	}
+	f.Add("Ünïcödé  --  ＴＩＴＬＥ ２０１３")
+	f.Fuzz(func(t *testing.T, content string) {
+		slug := memoSlug(memoTitle(content))
+		if strings.HasPrefix(slug, "-") || strings.HasSuffix(slug, "-") || strings.Contains(slug, "--") {
+			t.Errorf("slug %q for %q has stray hyphens", slug, content)
+		}
+		if utf8.RuneCountInString(slug) > slugMaxRunes {
+			t.Errorf("slug %q is longer than %d runes", slug, slugMaxRunes)
+		}
+		memo := &Memo{Id: 42, Slug: slug}
+		segment := strings.TrimPrefix(memo.Path(), "/memo/")
+		ref, err := url.PathUnescape(segment)
+		if err != nil {
+			t.Fatalf("path %q: %s", memo.Path(), err)
+		}
+		if id, err := parseMemoRef(ref); err != nil || id != 42 {
+			t.Errorf("parseMemoRef(%q) = %d, %v", ref, id, err)
+		}
+	})
+}
+
+// FuzzVisibilityForm checks that the memo form's visibility fields give
+// either a valid visibility or an error.
+func FuzzVisibilityForm(f *testing.F) {
+	f.Add("", "")
+	f.Add("", "1")
+	f.Add("public", "1")
+	f.Add("team", "")
+	f.Add("PUBLIC", "0")
+	f.Fuzz(func(t *testing.T, visibility, private string) {
+		form := url.Values{"visibility": {visibility}, "is_private": {private}}
+		r := httptest.NewRequest("POST", "/memo", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		v, err := visibilityFromForm(r)
+		if err == nil && !v.valid() {
+			t.Errorf("visibility %q, is_private %q gave invalid %q", visibility, private, v)
+		}
+	})
+}
+
+// FuzzMemoPost posts arbitrary memo forms through the whole handler stack
+// with a memory database behind it.
+func FuzzMemoPost(f *testing.F) {
+	for _, s := range markdownSeeds {
+		f.Add(s, "public", "")
+	}
+	f.Add("team memo", "team", "nosuchteam")
+	f.Add("private memo", "private", "")
+	f.Add("odd", "bogus", "")
+	app := startMemoryApp(f, memorySeed{Seed: 1, Users: 3, Memos: 10})
+	f.Fuzz(func(t *testing.T, content, visibility, team string) {
+		res := app.postMemo(t, url.Values{
+			"content":    {content},
+			"visibility": {visibility},
+			"team":       {team},
+		})
+		if res.StatusCode >= 500 {
+			t.Fatalf("posting %q (%q, team %q): %d", content, visibility, team, res.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"./sessions"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenFixture is the data every golden page is rendered from: a user,
+// their three memos and a signed-in session.
+func goldenFixture(t *testing.T) (*User, Memos, *sessions.Session) {
+	at := func(s string) time.Time {
+		created, err := time.ParseInLocation(dbTimeLayout, s, dbLocation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created
+	}
+	user := &User{Id: 1, Username: "isucon1"}
+	memos := Memos{
+		{Id: 3, User: 1, Username: "isucon1", Content: "# Third\n\nnewest", Title: "Third", Slug: "third",
+			Visibility: visibilityPublic, CreatedAt: at("2013-10-05 12:00:00"), Chars: 16, Words: 3, ReadMins: 1},
+		{Id: 2, User: 1, Username: "isucon1", Content: "<b>second</b> & more", Title: "<b>second</b> & more",
+			Visibility: visibilityPrivate, CreatedAt: at("2013-10-04 08:30:00"), Chars: 20, Words: 3, ReadMins: 1},
+		{Id: 1, User: 1, Username: "isucon1", Content: "first", Title: "first", Slug: "first",
+			Visibility: visibilityUnlisted, CreatedAt: at("2013-10-03 23:59:59"), Chars: 5, Words: 1, ReadMins: 1},
+	}
+	session := sessions.NewSession(nil, sessionName)
+	session.Values["user_id"] = user.Id
+	session.Values["token"] = "0123456789abcdef"
+	return user, memos, session
+}
+
+// renderGolden renders name with v and compares it with
+// testdata/golden/<file>, or rewrites the file with -update.
+func renderGolden(t *testing.T, file, name string, v *View) {
+	var buf bytes.Buffer
+	if err := themeTemplates(defaultTheme).ExecuteTemplate(&buf, name, v); err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	path := filepath.Join("testdata", "golden", file)
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s (run go test -run Golden -update to create it)", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("%s differs from %s; if the change is intended, run go test -run Golden -update\n%s",
+			name, path, firstDifference(buf.Bytes(), want))
+	}
+}
+
+// firstDifference shows the line where got and want part.
+func firstDifference(got, want []byte) string {
+	gotLines, wantLines := bytes.Split(got, []byte("\n")), bytes.Split(want, []byte("\n"))
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w []byte
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if !bytes.Equal(g, w) {
+			return "line " + strconv.Itoa(i+1) + ":\n got: " + string(g) + "\nwant: " + string(w)
+		}
+	}
+	return ""
+}
+
+func TestGoldenTemplates(t *testing.T) {
+	defer func(u *url.URL, loc *time.Location) { baseUrl, dbLocation = u, loc }(baseUrl, dbLocation)
+	baseUrl, _ = url.Parse("http://isucon.example")
+	dbLocation = time.UTC
+	user, memos, session := goldenFixture(t)
+	signedOut := sessions.NewSession(nil, sessionName)
+
+	var list bytes.Buffer
+	listed := Memos{memos[0]}
+	err := themeTemplates(defaultTheme).ExecuteTemplate(&list, "memo_list", &View{
+		Memos: listed, Total: len(listed), PageStart: 1, PageEnd: len(listed),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renderGolden(t, "index.html", "index", &View{
+		List:    template.HTML(list.String()),
+		Summary: &apiSummary{Total: len(listed), Newest: listed[0].Id},
+		Session: signedOut,
+	})
+
+	renderGolden(t, "memo.html", "memo", &View{
+		User:     user,
+		Memo:     memos[0],
+		Older:    memos[2],
+		Content:  template.HTML("<h1>Third</h1>\n\n<p>newest</p>\n"),
+		Visitors: 7,
+		Session:  session,
+	})
+	renderGolden(t, "memo_other.html", "memo", &View{
+		User:      &User{Id: 2, Username: "isucon2"},
+		Memo:      memos[0],
+		Older:     memos[2],
+		Content:   template.HTML("<h1>Third</h1>\n\n<p>newest</p>\n"),
+		Following: true,
+		Session:   session,
+	})
+
+	renderGolden(t, "mypage.html", "mypage", &View{
+		User:    user,
+		Memos:   memos,
+		Teams:   []*Team{{Id: 1, Name: "backend"}},
+		Reports: []*MemoReport{{MemoId: 2, Title: "second", Reason: "spam", Status: "open"}},
+		Session: session,
+	})
+
+	renderGolden(t, "signin.html", "signin", &View{Session: signedOut})
+
+	withPrefs := *user
+	withPrefs.Prefs = Preferences{PerPage: 50, Timezone: "Asia/Tokyo", Language: "ja", HardBreaks: true}
+	renderGolden(t, "settings.html", "settings", &View{
+		User:      &withPrefs,
+		Themes:    []string{"default", "minimal"},
+		PageSizes: preferencePageSizes,
+		Languages: preferenceLanguages,
+		Session:   session,
+	})
+}
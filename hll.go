@@ -0,0 +1,66 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision gives 2^8 one-byte registers per sketch, about 6.5%
+// standard error, which is plenty for a view counter.
+const (
+	hllPrecision = 8
+	hllRegisters = 1 << hllPrecision
+)
+
+// hyperLogLog estimates the number of distinct 64-bit hashes added to it
+// without remembering the hashes themselves.
+type hyperLogLog [hllRegisters]uint8
+
+// hllHash hashes s for Add. FNV alone leaves the high bits of similar
+// strings correlated, so the result is run through a 64-bit finalizer.
+func hllHash(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *hyperLogLog) Add(hash uint64) {
+	idx := hash >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h[idx] {
+		h[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) Merge(other *hyperLogLog) {
+	for i, r := range other {
+		if r > h[i] {
+			h[i] = r
+		}
+	}
+}
+
+func (h *hyperLogLog) Estimate() int {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range h {
+		sum += math.Exp2(-float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(estimate + 0.5)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 50000} {
+		var h hyperLogLog
+		for i := 0; i < n; i++ {
+			h.Add(hllHash("visitor-" + strconv.Itoa(i)))
+			h.Add(hllHash("visitor-" + strconv.Itoa(i)))
+		}
+		got := h.Estimate()
+		if diff := float64(got - n); diff > 0.2*float64(n)+1 || -diff > 0.2*float64(n)+1 {
+			t.Errorf("Estimate() = %d for %d distinct values", got, n)
+		}
+	}
+
+	var a, b hyperLogLog
+	for i := 0; i < 500; i++ {
+		a.Add(hllHash("a-" + strconv.Itoa(i)))
+		b.Add(hllHash("b-" + strconv.Itoa(i)))
+	}
+	a.Merge(&b)
+	if got := a.Estimate(); got < 800 || got > 1200 {
+		t.Errorf("merged Estimate() = %d, want about 1000", got)
+	}
+}
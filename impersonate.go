@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"./sessions"
+)
+
+// Session values of an admin viewing the site as another user.
+const (
+	impersonateKey      = "impersonate"
+	impersonatorKey     = "impersonator"
+	impersonateUntilKey = "impersonate_until"
+
+	maxImpersonation = 30 * time.Minute
+)
+
+// Impersonation is an admin viewing the site as User, for debugging what
+// they can see. It is read-only and ends by itself after
+// maxImpersonation.
+type Impersonation struct {
+	User  *User
+	By    string
+	Until time.Time
+}
+
+// impersonation returns the session's impersonation, or nil if there is
+// none or it ran out.
+func impersonation(session *sessions.Session) *Impersonation {
+	if session == nil {
+		return nil
+	}
+	userId, ok := session.Values[impersonateKey].(int)
+	if !ok {
+		return nil
+	}
+	until, _ := session.Values[impersonateUntilKey].(int64)
+	if time.Now().Unix() >= until {
+		return nil
+	}
+	user, ok := userCache.Get(userId)
+	if !ok {
+		return nil
+	}
+	by, _ := session.Values[impersonatorKey].(string)
+	return &Impersonation{User: user, By: by, Until: time.Unix(until, 0)}
+}
+
+// sessionUserId is the user the session acts as: the one viewed as
+// during an impersonation, otherwise the one signed in.
+func sessionUserId(session *sessions.Session) (int, bool) {
+	if imp := impersonation(session); imp != nil {
+		return imp.User.Id, true
+	}
+	userId, ok := session.Values["user_id"].(int)
+	return userId, ok
+}
+
+// Impersonation is shown as a banner on every page while it lasts.
+func (v *View) Impersonation() *Impersonation {
+	return impersonation(v.Session)
+}
+
+// endImpersonation removes the impersonation from session, if there is
+// one, and records why in the audit log. The caller saves the session.
+func endImpersonation(session *sessions.Session, reason string) {
+	userId, ok := session.Values[impersonateKey].(int)
+	if !ok {
+		return
+	}
+	by, _ := session.Values[impersonatorKey].(string)
+	audit(by, "impersonate.stop", []string{userCache.Username(userId), reason})
+	delete(session.Values, impersonateKey)
+	delete(session.Values, impersonatorKey)
+	delete(session.Values, impersonateUntilKey)
+}
+
+// impersonationWritable are the routes a session can still post to while
+// viewing as someone: the ones ending it, and the admin routes, which
+// check the admin token rather than the session.
+func impersonationWritable(route string) bool {
+	return route == "/signout" || route == "/impersonate/stop" || strings.HasPrefix(route, "/admin/")
+}
+
+// impersonationMiddleware refuses every write made while viewing as
+// another user, and clears impersonations that ran out.
+func impersonationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, err := r.Cookie(sessionName); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session, err := loadSession(w, r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := session.Values[impersonateKey]; !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		imp := impersonation(session)
+		if imp == nil {
+			endImpersonation(session, "expired")
+			if err := session.Save(r, w); err != nil {
+				handleError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !impersonationWritable(routeName(r)) {
+			writeError(w, r, http.StatusForbidden, "Viewing as "+imp.User.Username+" is read-only.", session)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func impersonateFormHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+	v := struct {
+		Username string
+	}{r.FormValue("username")}
+	if err := themeTemplates(defaultTheme).ExecuteTemplate(w, "admin_impersonate", v); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+// impersonateHandler starts viewing as username in the browser that
+// posts the form, after the admin token was checked. The reason is
+// required so the audit log says why.
+func impersonateHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := userCache.GetByName(r.FormValue("username"))
+	if !ok {
+		handleError(w, r, notFoundError("no such user"))
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		handleError(w, r, validationError("a reason is required"))
+		return
+	}
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	endImpersonation(session, "replaced")
+	actor := "admin " + r.RemoteAddr
+	session.Values[impersonateKey] = user.Id
+	session.Values[impersonatorKey] = actor
+	session.Values[impersonateUntilKey] = time.Now().Add(maxImpersonation).Unix()
+	if err := session.Save(r, w); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	audit(actor, "impersonate.start", []string{user.Username, strconv.Itoa(user.Id), reason})
+	http.Redirect(w, r, "/mypage", http.StatusFound)
+}
+
+func impersonateStopHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+	endImpersonation(session, "stopped")
+	flash(w, r, session, noticeInfo, "You stopped viewing as another user.")
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestImpersonation views the site as user2 from user1's browser, checks
+// that nothing can be written meanwhile, and stops again.
+func TestImpersonation(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 5, Users: 3, Memos: 10})
+	config.AdminToken = "impersonate-token"
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	start := func(form url.Values) (*http.Response, string) {
+		form.Set("admin_token", config.AdminToken)
+		res, err := app.client.PostForm(app.URL+"/admin/impersonate", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(body)
+	}
+	if res, _ := start(url.Values{"username": {"user2"}}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("without a reason: %d", res.StatusCode)
+	}
+	if res, _ := start(url.Values{"username": {"nobody"}, "reason": {"ticket 12"}}); res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown user: %d", res.StatusCode)
+	}
+	res, body := start(url.Values{"username": {"user2"}, "reason": {"ticket 12"}})
+	if res.Request.URL.Path != "/mypage" || !strings.Contains(body, "Hello user2!") {
+		t.Fatalf("impersonation ended at %s:\n%s", res.Request.URL.Path, body)
+	}
+	if !strings.Contains(body, `id="impersonation"`) {
+		t.Errorf("no impersonation banner")
+	}
+	if !strings.Contains(buf.String(), "impersonate.start") || !strings.Contains(buf.String(), "ticket 12") {
+		t.Errorf("start not audited: %s", buf.String())
+	}
+
+	if res := app.postMemo(t, url.Values{"content": {"as someone else"}, "visibility": {"public"}}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("memo posted while impersonating: %d", res.StatusCode)
+	}
+
+	res = app.post(t, "/impersonate/stop", url.Values{})
+	if res.StatusCode != http.StatusOK || res.Request.URL.Path != "/" {
+		t.Fatalf("stop: %d at %s", res.StatusCode, res.Request.URL.Path)
+	}
+	if body := app.get(t, "/mypage"); !strings.Contains(body, "Hello user1!") || strings.Contains(body, `id="impersonation"`) {
+		t.Errorf("still impersonating after stop")
+	}
+	if !strings.Contains(buf.String(), "impersonate.stop") {
+		t.Errorf("stop not audited: %s", buf.String())
+	}
+}
+
+func TestImpersonationExpires(t *testing.T) {
+	startMemoryApp(t, memorySeed{Seed: 5, Users: 3, Memos: 1})
+	session := anonymousSession()
+	session.Values["user_id"] = 1
+	session.Values[impersonateKey] = 2
+	session.Values[impersonateUntilKey] = time.Now().Add(time.Minute).Unix()
+	if userId, _ := sessionUserId(session); userId != 2 {
+		t.Errorf("acting as %d, want 2", userId)
+	}
+	session.Values[impersonateUntilKey] = time.Now().Add(-time.Second).Unix()
+	if impersonation(session) != nil {
+		t.Errorf("expired impersonation still in effect")
+	}
+	if userId, _ := sessionUserId(session); userId != 1 {
+		t.Errorf("acting as %d after expiry, want 1", userId)
+	}
+}
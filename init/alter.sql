@@ -1,3 +1,108 @@
 ALTER TABLE `memos` ADD INDEX `i1` (`is_private`, `created_at`);
 ALTER TABLE `memos` ADD INDEX `i2` (`user`, `is_private`, `created_at`);
 ALTER TABLE `memos` ADD INDEX `i3` (`user`, `created_at`);
+ALTER TABLE `memos` ADD COLUMN `version` INT NOT NULL DEFAULT 0;
+ALTER TABLE `memos` ADD COLUMN `visibility` ENUM('public', 'unlisted', 'followers', 'private') NOT NULL DEFAULT 'public';
+UPDATE `memos` SET `visibility`='private' WHERE `is_private`=1;
+ALTER TABLE `memos` DROP INDEX `i1`, DROP INDEX `i2`, DROP COLUMN `is_private`;
+ALTER TABLE `memos` ADD INDEX `i4` (`visibility`, `created_at`);
+ALTER TABLE `memos` ADD INDEX `i5` (`user`, `visibility`, `created_at`);
+CREATE TABLE `follows` (
+  `follower` INT NOT NULL,
+  `followee` INT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  PRIMARY KEY (`follower`, `followee`),
+  KEY `followee` (`followee`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `memo_views` (
+  `memo_id` INT NOT NULL,
+  `hour` DATETIME NOT NULL,
+  `views` INT NOT NULL,
+  PRIMARY KEY (`memo_id`, `hour`),
+  KEY `hour` (`hour`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `memo_visitors` (
+  `memo_id` INT NOT NULL,
+  `day` DATE NOT NULL,
+  `registers` VARBINARY(256) NOT NULL,
+  `visitors` INT NOT NULL,
+  PRIMARY KEY (`memo_id`, `day`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+ALTER TABLE `memos` ADD COLUMN `slug` VARCHAR(191) NULL, ADD UNIQUE INDEX `slug` (`slug`);
+ALTER TABLE `memos` ADD COLUMN `hidden` TINYINT NOT NULL DEFAULT 0;
+CREATE TABLE `memo_flags` (
+  `memo_id` INT NOT NULL PRIMARY KEY,
+  `reason` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `site_banner` (
+  `id` INT NOT NULL PRIMARY KEY,
+  `message` TEXT NOT NULL,
+  `updated_at` DATETIME NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+ALTER TABLE `users` ADD UNIQUE INDEX `username` (`username`);
+CREATE TABLE `teams` (
+  `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `name` VARCHAR(30) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  UNIQUE KEY `name` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `team_members` (
+  `team_id` INT NOT NULL,
+  `user_id` INT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  PRIMARY KEY (`team_id`, `user_id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+ALTER TABLE `memos` MODIFY COLUMN `visibility` ENUM('public', 'unlisted', 'followers', 'private', 'team') NOT NULL DEFAULT 'public', ADD COLUMN `team_id` INT NULL, ADD INDEX `team` (`team_id`, `created_at`);
+ALTER TABLE `memos` ADD COLUMN `locked` TINYINT NOT NULL DEFAULT 0, ADD COLUMN `moderation_note` VARCHAR(255) NULL;
+CREATE TABLE `memo_reports` (
+  `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `memo_id` INT NOT NULL,
+  `reporter` INT NOT NULL,
+  `reason` VARCHAR(255) NOT NULL,
+  `status` ENUM('open', 'approved', 'hidden', 'deleted') NOT NULL DEFAULT 'open',
+  `created_at` DATETIME NOT NULL,
+  `resolved_at` DATETIME NULL,
+  UNIQUE KEY `memo_reporter` (`memo_id`, `reporter`),
+  KEY `status` (`status`, `memo_id`),
+  KEY `reporter` (`reporter`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `api_refresh_tokens` (
+  `token_hash` CHAR(64) NOT NULL PRIMARY KEY,
+  `user_id` INT NOT NULL,
+  `expires_at` DATETIME NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `user_preferences` (
+  `user_id` INT NOT NULL PRIMARY KEY,
+  `per_page` INT NOT NULL DEFAULT 0,
+  `theme` VARCHAR(32) NOT NULL DEFAULT '',
+  `timezone` VARCHAR(64) NOT NULL DEFAULT '',
+  `language` VARCHAR(8) NOT NULL DEFAULT '',
+  `hard_breaks` TINYINT NOT NULL DEFAULT 0,
+  `updated_at` DATETIME NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `memo_templates` (
+  `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` INT NOT NULL,
+  `name` VARCHAR(64) NOT NULL,
+  `content` TEXT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NOT NULL,
+  UNIQUE KEY `user_name` (`user_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `memo_attachments` (
+  `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `memo_id` INT NOT NULL,
+  `user_id` INT NOT NULL,
+  `blob_key` VARCHAR(255) NOT NULL,
+  `filename` VARCHAR(255) NOT NULL,
+  `content_type` VARCHAR(128) NOT NULL,
+  `size` INT NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  KEY `memo_id` (`memo_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+ALTER TABLE `memo_attachments` ADD COLUMN `variants` VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE `memos` ADD INDEX `updated_at` (`updated_at`);
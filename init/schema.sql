@@ -0,0 +1,15 @@
+CREATE TABLE `users` (
+  `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `username` VARCHAR(255) NOT NULL,
+  `password` VARCHAR(255) NOT NULL,
+  `salt` VARCHAR(255) NOT NULL,
+  `last_access` DATETIME
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+CREATE TABLE `memos` (
+  `id` INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user` INT NOT NULL,
+  `content` TEXT,
+  `is_private` TINYINT NOT NULL DEFAULT 0,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
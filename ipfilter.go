@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// IPFilterConfig restricts who may reach the server by client address,
+// as clientIP finds it behind trusted_proxies. Deny and DenyCountries
+// turn addresses away everywhere; when Allow is set, only the addresses
+// in it get in at all. InternalPaths are the path prefixes, such as
+// "/admin/", "/reset" and "/debug/", that only the Internal ranges may
+// reach. Countries are looked up in GeoIPFile, a CSV file of CIDR
+// ranges and ISO 3166 country codes, one per line.
+type IPFilterConfig struct {
+	Allow         []string `json:"allow"`
+	Deny          []string `json:"deny"`
+	Internal      []string `json:"internal"`
+	InternalPaths []string `json:"internal_paths"`
+	DenyCountries []string `json:"deny_countries"`
+	GeoIPFile     string   `json:"geoip_file"`
+}
+
+func (c *IPFilterConfig) validate() error {
+	if len(c.InternalPaths) > 0 && len(c.Internal) == 0 {
+		return fmt.Errorf("config: ip_filter.internal_paths needs ip_filter.internal")
+	}
+	for _, p := range c.InternalPaths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("config: ip_filter.internal_paths: %q does not start with /", p)
+		}
+	}
+	if len(c.DenyCountries) > 0 && c.GeoIPFile == "" {
+		return fmt.Errorf("config: ip_filter.deny_countries needs ip_filter.geoip_file")
+	}
+	return nil
+}
+
+// geoIPDatabase finds the country of an address. Country returns ""
+// for addresses it doesn't know, which are never blocked by country.
+type geoIPDatabase interface {
+	Country(ip net.IP) string
+}
+
+// clientFilter is the serve command's ip_filter, nil when it has none.
+var clientFilter *ipFilter
+
+type ipFilter struct {
+	allow, deny, internal []*net.IPNet
+	internalPaths         []string
+	denyCountries         map[string]bool
+	geoIP                 geoIPDatabase
+}
+
+// newIPFilter parses c, or returns nil when it filters nothing.
+func newIPFilter(c IPFilterConfig) (*ipFilter, error) {
+	if len(c.Allow)+len(c.Deny)+len(c.InternalPaths)+len(c.DenyCountries) == 0 {
+		return nil, nil
+	}
+	f := &ipFilter{internalPaths: c.InternalPaths, denyCountries: make(map[string]bool)}
+	var err error
+	if f.allow, err = parseNets("ip_filter.allow range", c.Allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseNets("ip_filter.deny range", c.Deny); err != nil {
+		return nil, err
+	}
+	if f.internal, err = parseNets("ip_filter.internal range", c.Internal); err != nil {
+		return nil, err
+	}
+	for _, country := range c.DenyCountries {
+		f.denyCountries[strings.ToUpper(country)] = true
+	}
+	if len(f.denyCountries) > 0 {
+		if f.geoIP, err = loadGeoIPCSV(c.GeoIPFile); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// check returns why r is refused, or "" if it may pass.
+func (f *ipFilter) check(r *http.Request) string {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return "no client address"
+	}
+	if netsContain(f.deny, ip) {
+		return "denied"
+	}
+	if len(f.allow) > 0 && !netsContain(f.allow, ip) {
+		return "not allowed"
+	}
+	if f.geoIP != nil {
+		if country := f.geoIP.Country(ip); f.denyCountries[country] {
+			return "country " + country
+		}
+	}
+	path := routedPath(r.URL.Path)
+	for _, prefix := range f.internalPaths {
+		if pathUnder(path, prefix) && !netsContain(f.internal, ip) {
+			return "internal path"
+		}
+	}
+	return ""
+}
+
+// pathUnder reports whether path is prefix or below it, so that "/admin"
+// takes in "/admin/stats" but not "/administrators".
+func pathUnder(path, prefix string) bool {
+	if path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// withIPFilter puts f in front of h. It runs before the router, so it
+// also covers what is served beside it, like /debug/pprof, and answers
+// without looking at the session. Internal paths are matched under a
+// tenant's prefix as well.
+func withIPFilter(f *ipFilter, h http.Handler) http.Handler {
+	if f == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := f.check(r); reason != "" {
+			debugf("ip filter: %s %s from %s: %s", r.Method, r.URL.Path, clientIP(r), reason)
+			writeError(w, r, http.StatusForbidden, "", nil)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// geoIPCSV is a geoIPDatabase read from a CSV file. Ranges are kept by
+// prefix length, so a lookup is one map access per length in use,
+// longest first.
+type geoIPCSV struct {
+	lengths []int
+	nets    map[int]map[string]string
+}
+
+func loadGeoIPCSV(filename string) (*geoIPCSV, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	db := &geoIPCSV{nets: make(map[int]map[string]string)}
+	ranges := 0
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: want range,country", filename, line)
+		}
+		_, n, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			// A header line, as in the usual exports.
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: %s", filename, line, err)
+		}
+		ones, bits := n.Mask.Size()
+		if bits == 32 {
+			ones += 96
+		}
+		if db.nets[ones] == nil {
+			db.nets[ones] = make(map[string]string)
+			db.lengths = append(db.lengths, ones)
+		}
+		db.nets[ones][n.IP.To16().String()] = strings.ToUpper(strings.TrimSpace(fields[1]))
+		ranges++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(db.lengths)))
+	log.Printf("geoip: %d ranges from %s", ranges, filename)
+	return db, nil
+}
+
+func (db *geoIPCSV) Country(ip net.IP) string {
+	ip = ip.To16()
+	for _, ones := range db.lengths {
+		masked := ip.Mask(net.CIDRMask(ones, 128))
+		if country, ok := db.nets[ones][masked.String()]; ok {
+			return country
+		}
+	}
+	return ""
+}
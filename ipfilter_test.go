@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	trustedProxies, _ = parseTrustedProxies([]string{"127.0.0.1"})
+
+	geoip, err := ioutil.TempFile("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(geoip.Name())
+	geoip.WriteString("network,country\n198.51.100.0/24,xx\n198.51.100.128/25,YY\n2001:db8::/32,XX\n")
+	geoip.Close()
+
+	f, err := newIPFilter(IPFilterConfig{
+		Deny:          []string{"203.0.113.7"},
+		Internal:      []string{"10.0.0.0/8"},
+		InternalPaths: []string{"/admin", "/reset", "/debug/"},
+		DenyCountries: []string{"XX"},
+		GeoIPFile:     geoip.Name(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := withIPFilter(f, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		remote, forwarded, path string
+		want                    int
+	}{
+		{"192.0.2.1:1234", "", "/", http.StatusOK},
+		{"203.0.113.7:1234", "", "/", http.StatusForbidden},
+		{"192.0.2.1:1234", "", "/admin/stats", http.StatusForbidden},
+		{"192.0.2.1:1234", "", "/reset", http.StatusForbidden},
+		{"192.0.2.1:1234", "", "/debug/pprof/", http.StatusForbidden},
+		{"192.0.2.1:1234", "", "/administrators", http.StatusOK},
+		{"10.1.2.3:1234", "", "/admin/stats", http.StatusOK},
+		// A tenant's prefix doesn't get around them.
+		{"192.0.2.1:1234", "", "/t/staging/admin/stats", http.StatusForbidden},
+		{"192.0.2.1:1234", "", "/t/staging/reset", http.StatusForbidden},
+		{"192.0.2.1:1234", "", "/t/staging/t/other/reset", http.StatusForbidden},
+		{"192.0.2.1:1234", "", "/t/staging/recent/2", http.StatusOK},
+		{"10.1.2.3:1234", "", "/t/staging/reset", http.StatusOK},
+		// Behind the trusted proxy the forwarded address counts.
+		{"127.0.0.1:1234", "10.1.2.3", "/reset", http.StatusOK},
+		{"127.0.0.1:1234", "192.0.2.1", "/reset", http.StatusForbidden},
+		{"127.0.0.1:1234", "203.0.113.7", "/", http.StatusForbidden},
+		{"198.51.100.1:1234", "", "/", http.StatusForbidden},
+		// The longer range wins.
+		{"198.51.100.200:1234", "", "/", http.StatusOK},
+		{"[2001:db8::1]:1234", "", "/", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s %s (%s): %d, want %d", c.remote, c.path, c.forwarded, w.Code, c.want)
+		}
+	}
+
+	f, err = newIPFilter(IPFilterConfig{Allow: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	if reason := f.check(r); reason != "not allowed" {
+		t.Errorf("outside allow: %q", reason)
+	}
+	if f, _ := newIPFilter(IPFilterConfig{}); f != nil {
+		t.Errorf("empty config made a filter")
+	}
+	if _, err := newIPFilter(IPFilterConfig{Deny: []string{"not an address"}}); err == nil {
+		t.Errorf("bad range accepted")
+	}
+	if err := (&IPFilterConfig{InternalPaths: []string{"/admin"}}).validate(); err == nil {
+		t.Errorf("internal_paths without internal accepted")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJobWorkers     = 4
+	defaultJobMaxAttempts = 5
+	jobRetryBackoff       = time.Second
+	jobSnapshotInterval   = 5 * time.Second
+	failedJobCount        = 50
+)
+
+var errUnknownJob = errors.New("unknown job type")
+
+type JobsConfig struct {
+	Workers     int    `json:"workers"`
+	MaxAttempts int    `json:"max_attempts"`
+	StateFile   string `json:"state_file"`
+}
+
+type Job struct {
+	Id        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+}
+
+type jobHandler func(payload json.RawMessage) error
+
+type JobStats struct {
+	Done    int `json:"done"`
+	Retried int `json:"retried"`
+	Failed  int `json:"failed"`
+}
+
+// jobQueue runs jobs on a fixed pool of workers. Jobs that fail are
+// retried with exponential backoff up to maxAttempts times. Outstanding
+// jobs are periodically written to stateFile, if set, and picked up again
+// after a restart, so a job may run more than once.
+type jobQueue struct {
+	sync.Mutex
+	cond        *sync.Cond
+	ready       []*Job
+	outstanding map[int64]*Job
+	handlers    map[string]jobHandler
+	stats       map[string]*JobStats
+	failed      []*Job
+	nextId      int64
+	maxAttempts int
+	stateFile   string
+}
+
+var jobs = newJobQueue()
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{
+		outstanding: make(map[int64]*Job),
+		handlers:    make(map[string]jobHandler),
+		stats:       make(map[string]*JobStats),
+		maxAttempts: defaultJobMaxAttempts,
+	}
+	q.cond = sync.NewCond(&q.Mutex)
+	return q
+}
+
+func (q *jobQueue) Register(typ string, h jobHandler) {
+	q.Lock()
+	q.handlers[typ] = h
+	q.stats[typ] = &JobStats{}
+	q.Unlock()
+}
+
+func (q *jobQueue) Enqueue(typ string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	q.Lock()
+	q.nextId++
+	job := &Job{Id: q.nextId, Type: typ, Payload: b}
+	q.outstanding[job.Id] = job
+	q.push(job)
+	q.Unlock()
+	return nil
+}
+
+// push must be called with q locked.
+func (q *jobQueue) push(job *Job) {
+	q.ready = append(q.ready, job)
+	q.cond.Signal()
+}
+
+func (q *jobQueue) take() *Job {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.ready) == 0 {
+		q.cond.Wait()
+	}
+	job := q.ready[0]
+	q.ready = q.ready[1:]
+	return job
+}
+
+func (q *jobQueue) Start(c JobsConfig) {
+	if c.MaxAttempts > 0 {
+		q.maxAttempts = c.MaxAttempts
+	}
+	q.stateFile = c.StateFile
+	workers := c.Workers
+	if workers <= 0 {
+		workers = defaultJobWorkers
+	}
+	q.restore()
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	if q.stateFile != "" {
+		go func() {
+			for _ = range time.Tick(jobSnapshotInterval) {
+				if err := q.snapshot(); err != nil {
+					log.Printf("error saving jobs: %s", err)
+				}
+			}
+		}()
+	}
+}
+
+func (q *jobQueue) work() {
+	for {
+		job := q.take()
+		q.Lock()
+		h := q.handlers[job.Type]
+		q.Unlock()
+
+		var err error
+		if h == nil {
+			err = errUnknownJob
+		} else {
+			err = h(job.Payload)
+		}
+		q.finish(job, err)
+	}
+}
+
+func (q *jobQueue) finish(job *Job, err error) {
+	q.Lock()
+	defer q.Unlock()
+	stats, ok := q.stats[job.Type]
+	if !ok {
+		stats = &JobStats{}
+		q.stats[job.Type] = stats
+	}
+	job.Attempts++
+	if err == nil {
+		stats.Done++
+		delete(q.outstanding, job.Id)
+		return
+	}
+	job.LastError = err.Error()
+	if job.Attempts < q.maxAttempts && err != errUnknownJob {
+		stats.Retried++
+		delay := jobRetryBackoff << uint(job.Attempts-1)
+		time.AfterFunc(delay, func() {
+			q.Lock()
+			q.push(job)
+			q.Unlock()
+		})
+		return
+	}
+	stats.Failed++
+	delete(q.outstanding, job.Id)
+	log.Printf("job %d (%s) failed after %d attempts: %s", job.Id, job.Type, job.Attempts, err)
+	q.failed = append(q.failed, job)
+	if len(q.failed) > failedJobCount {
+		q.failed = q.failed[len(q.failed)-failedJobCount:]
+	}
+}
+
+func (q *jobQueue) pending() []*Job {
+	q.Lock()
+	defer q.Unlock()
+	list := make([]*Job, 0, len(q.outstanding))
+	for _, job := range q.outstanding {
+		copied := *job
+		list = append(list, &copied)
+	}
+	sort.Sort(jobsById(list))
+	return list
+}
+
+type jobsById []*Job
+
+func (s jobsById) Len() int           { return len(s) }
+func (s jobsById) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s jobsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (q *jobQueue) snapshot() error {
+	b, err := json.Marshal(q.pending())
+	if err != nil {
+		return err
+	}
+	tmp := q.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.stateFile)
+}
+
+func (q *jobQueue) restore() {
+	if q.stateFile == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(q.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("error loading jobs: %s", err)
+		}
+		return
+	}
+	var saved []*Job
+	if err := json.Unmarshal(b, &saved); err != nil {
+		log.Printf("error loading jobs: %s", err)
+		return
+	}
+	q.Lock()
+	for _, job := range saved {
+		if job.Id > q.nextId {
+			q.nextId = job.Id
+		}
+		q.outstanding[job.Id] = job
+		q.push(job)
+	}
+	q.Unlock()
+	log.Printf("restored %d jobs", len(saved))
+}
+
+type jobsStatus struct {
+	Pending []*Job               `json:"pending"`
+	Stats   map[string]*JobStats `json:"stats"`
+	Failed  []*Job               `json:"failed"`
+}
+
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	status := &jobsStatus{Pending: jobs.pending()}
+	jobs.Lock()
+	status.Stats = make(map[string]*JobStats, len(jobs.stats))
+	for typ, s := range jobs.stats {
+		copied := *s
+		status.Stats[typ] = &copied
+	}
+	status.Failed = append([]*Job(nil), jobs.failed...)
+	jobs.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
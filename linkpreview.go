@@ -0,0 +1,280 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	linkPreviewTTL      = 24 * time.Hour
+	linkPreviewTimeout  = 5 * time.Second
+	linkPreviewMaxBody  = 512 << 10
+	linkPreviewMaxLinks = 3
+	// linkPreviewMaxCards bounds the cards kept; the least recently shown
+	// go first.
+	linkPreviewMaxCards = 10000
+)
+
+// LinkPreview is the card shown under a memo for one external link.
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	Image       string
+	fetchedAt   time.Time
+	failed      bool
+}
+
+type linkPreviewJob struct {
+	URL string `json:"url"`
+}
+
+var (
+	hrefRe       = regexp.MustCompile(`<a href="(https?://[^"]+)"`)
+	titleRe      = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	metaRe       = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrRe   = regexp.MustCompile(`(?is)(property|name|content)\s*=\s*("[^"]*"|'[^']*')`)
+	errBlockedIP = errors.New("link preview: address not allowed")
+
+	linkPreviews = &linkPreviewCache{
+		previews: make(map[string]*list.Element),
+		lru:      list.New(),
+		pending:  make(map[string]bool),
+	}
+
+	// reservedNets are ranges that aren't on the internet either but that
+	// net.IP has no method for: shared address space for carrier-grade
+	// NAT, and benchmarking.
+	reservedNets, _ = parseNets("reserved range", []string{"100.64.0.0/10", "198.18.0.0/15"})
+
+	// previewClient only connects to public addresses. The check runs on
+	// every dial, after DNS resolution, so redirects and rebinding can't
+	// reach internal services either.
+	previewClient = &http.Client{
+		Timeout: linkPreviewTimeout,
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: (&net.Dialer{
+				Timeout: linkPreviewTimeout,
+				Control: func(network, address string, _ syscall.RawConn) error {
+					host, port, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					ip := net.ParseIP(host)
+					if ip == nil || !publicIP(ip) || (port != "80" && port != "443") {
+						return errBlockedIP
+					}
+					return nil
+				},
+			}).DialContext,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("link preview: too many redirects")
+			}
+			return nil
+		},
+	}
+)
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		netsContain(reservedNets, ip))
+}
+
+type linkPreviewCache struct {
+	sync.Mutex
+	previews map[string]*list.Element
+	lru      *list.List
+	pending  map[string]bool
+}
+
+// memoLinks returns the first linkPreviewMaxLinks external links of memo.
+// They are kept next to its HTML in memoHTMLCache, so the HTML is only
+// searched once per version.
+func memoLinks(memo *Memo) []string {
+	key := strconv.Itoa(memo.Id) + "#links"
+	if body, version, ok := memoHTMLCache.Get(key); ok && version == memo.Version {
+		return strings.Fields(string(body))
+	}
+	var links []string
+	seen := make(map[string]bool)
+	for _, m := range hrefRe.FindAllStringSubmatch(string(renderedHTML(memo)), -1) {
+		link := html.UnescapeString(m[1])
+		if seen[link] || strings.ContainsAny(link, " \t\r\n") {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+		if len(links) == linkPreviewMaxLinks {
+			break
+		}
+	}
+	memoHTMLCache.Set(key, []byte(strings.Join(links, "\n")), memo.Version)
+	return links
+}
+
+// get returns the card for link, marking it as recently shown.
+func (c *linkPreviewCache) get(link string) (*LinkPreview, bool) {
+	e, ok := c.previews[link]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*LinkPreview), true
+}
+
+// For returns the cached cards for memo's external links and queues a
+// fetch for any that are missing or stale; those show up on a later view.
+func (c *linkPreviewCache) For(memo *Memo) []*LinkPreview {
+	var cards []*LinkPreview
+	for _, link := range memoLinks(memo) {
+		c.Lock()
+		p, ok := c.get(link)
+		stale := !ok || time.Since(p.fetchedAt) > linkPreviewTTL
+		queue := stale && !c.pending[link]
+		if queue {
+			c.pending[link] = true
+		}
+		c.Unlock()
+		if queue {
+			if err := jobs.Enqueue("link.preview", &linkPreviewJob{URL: link}); err != nil {
+				c.Lock()
+				delete(c.pending, link)
+				c.Unlock()
+			}
+		}
+		if ok && !p.failed && p.Title != "" {
+			cards = append(cards, p)
+		}
+	}
+	return cards
+}
+
+func (c *linkPreviewCache) store(p *LinkPreview) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.pending, p.URL)
+	if e, ok := c.previews[p.URL]; ok {
+		e.Value = p
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.previews[p.URL] = c.lru.PushFront(p)
+	for c.lru.Len() > linkPreviewMaxCards {
+		oldest := c.lru.Remove(c.lru.Back()).(*LinkPreview)
+		delete(c.previews, oldest.URL)
+	}
+}
+
+// fetchLinkPreviewJob fetches a page's title, description and image. A
+// failed fetch is cached like a successful one so it isn't retried until
+// the entry goes stale.
+func fetchLinkPreviewJob(payload json.RawMessage) error {
+	var job linkPreviewJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	p, err := fetchLinkPreview(job.URL)
+	if err != nil {
+		debugf("link preview %s: %s", job.URL, err)
+		p = &LinkPreview{URL: job.URL, failed: true}
+	}
+	p.fetchedAt = time.Now()
+	linkPreviews.store(p)
+	return nil
+}
+
+func fetchLinkPreview(link string) (*LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("unsupported URL")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "isucon-memo-linkpreview/1.0")
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		return nil, fmt.Errorf("content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, linkPreviewMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	p := parseLinkPreview(string(body))
+	p.URL = link
+	if p.Image != "" {
+		// Only keep absolute http(s) images, resolved against the page.
+		img, err := resp.Request.URL.Parse(p.Image)
+		if err != nil || (img.Scheme != "http" && img.Scheme != "https") {
+			p.Image = ""
+		} else {
+			p.Image = img.String()
+		}
+	}
+	return p, nil
+}
+
+// parseLinkPreview reads Open Graph tags, falling back to <title> and the
+// description meta tag.
+func parseLinkPreview(page string) *LinkPreview {
+	p := &LinkPreview{}
+	meta := make(map[string]string)
+	for _, tag := range metaRe.FindAllString(page, -1) {
+		var key, content string
+		for _, attr := range metaAttrRe.FindAllStringSubmatch(tag, -1) {
+			value := html.UnescapeString(attr[2][1 : len(attr[2])-1])
+			if strings.ToLower(attr[1]) == "content" {
+				content = value
+			} else {
+				key = strings.ToLower(value)
+			}
+		}
+		if key != "" {
+			if _, ok := meta[key]; !ok {
+				meta[key] = strings.TrimSpace(content)
+			}
+		}
+	}
+	p.Title = meta["og:title"]
+	if p.Title == "" {
+		if m := titleRe.FindStringSubmatch(page); m != nil {
+			p.Title = strings.TrimSpace(html.UnescapeString(m[1]))
+		}
+	}
+	p.Description = meta["og:description"]
+	if p.Description == "" {
+		p.Description = meta["description"]
+	}
+	p.Image = meta["og:image"]
+	return p
+}
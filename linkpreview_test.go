@@ -0,0 +1,90 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAutolink(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"<p>see http://example.com/a?b=1&amp;c=2.</p>", `<p>see <a href="http://example.com/a?b=1&amp;c=2" rel="nofollow">http://example.com/a?b=1&amp;c=2</a>.</p>`},
+		{`<p><a href="http://example.com/">http://example.com/</a></p>`, `<p><a href="http://example.com/">http://example.com/</a></p>`},
+		{"<p><code>http://localhost/</code></p>", "<p><code>http://localhost/</code></p>"},
+		{"<p><abbr>https://example.com</abbr></p>", `<p><abbr><a href="https://example.com" rel="nofollow">https://example.com</a></abbr></p>`},
+	}
+	for _, tt := range tests {
+		if got := autolink(tt.in); got != tt.want {
+			t.Errorf("autolink(%q) =\n%q, want\n%q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseLinkPreview(t *testing.T) {
+	p := parseLinkPreview(`<html><head><title>Fallback</title>
+<meta property="og:title" content="Open &amp; Graph">
+<meta name="description" content='plain description'>
+<meta content="/img.png" property="og:image">
+</head></html>`)
+	if p.Title != "Open & Graph" || p.Description != "plain description" || p.Image != "/img.png" {
+		t.Errorf("parseLinkPreview = %+v", p)
+	}
+	if p := parseLinkPreview("<title> Only title </title>"); p.Title != "Only title" {
+		t.Errorf("Title = %q, want %q", p.Title, "Only title")
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "100.64.0.1", "100.127.255.254", "::ffff:100.100.1.1", "198.18.0.1", "192.168.0.1", "169.254.169.254", "::1", "fd00::1", "0.0.0.0"} {
+		if publicIP(net.ParseIP(addr)) {
+			t.Errorf("publicIP(%s) = true", addr)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34", "100.128.0.1", "2606:2800:220:1::1"} {
+		if !publicIP(net.ParseIP(addr)) {
+			t.Errorf("publicIP(%s) = false", addr)
+		}
+	}
+}
+
+func TestMemoLinks(t *testing.T) {
+	memoHTMLCache.Purge()
+	defer memoHTMLCache.Purge()
+	memo := &Memo{Id: 1, Version: 1, Content: "http://a.example/ http://b.example/?x=1&y=2 http://a.example/ http://c.example/ http://d.example/"}
+	links := memoLinks(memo)
+	if len(links) != linkPreviewMaxLinks || links[0] != "http://a.example/" || links[1] != "http://b.example/?x=1&y=2" || links[2] != "http://c.example/" {
+		t.Fatalf("memoLinks = %q", links)
+	}
+	// The links are kept per version; an edit finds them again.
+	memo.Content = "nothing to see"
+	if again := memoLinks(memo); len(again) != len(links) {
+		t.Errorf("links of the same version were looked up again: %q", again)
+	}
+	memo.Version++
+	if edited := memoLinks(memo); len(edited) != 0 {
+		t.Errorf("links after an edit: %q", edited)
+	}
+}
+
+func TestLinkPreviewCacheBound(t *testing.T) {
+	c := &linkPreviewCache{previews: make(map[string]*list.Element), lru: list.New(), pending: make(map[string]bool)}
+	link := func(i int) string { return "http://example.com/" + strconv.Itoa(i) }
+	for i := 0; i < linkPreviewMaxCards; i++ {
+		c.store(&LinkPreview{URL: link(i), fetchedAt: time.Now()})
+	}
+	c.get(link(0))
+	c.store(&LinkPreview{URL: link(linkPreviewMaxCards), fetchedAt: time.Now()})
+	if len(c.previews) != linkPreviewMaxCards || c.lru.Len() != linkPreviewMaxCards {
+		t.Fatalf("%d cards, want %d", len(c.previews), linkPreviewMaxCards)
+	}
+	if _, ok := c.get(link(0)); !ok {
+		t.Errorf("the card shown last was evicted")
+	}
+	if _, ok := c.get(link(1)); ok {
+		t.Errorf("the least recently shown card was kept")
+	}
+}
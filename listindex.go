@@ -0,0 +1,215 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoIndexes are the sorted lists MemoCache keeps next to its map: every
+// listed memo, and each author's memos, all newest first, so that
+// handlers page through them without sorting or copying. A list handed
+// out is never written again; a change builds a new one in place of the
+// list it touches. That costs a copy of the list per write, which is
+// cheap next to the reads and the fragment purge that follow.
+type memoIndexes struct {
+	sync.RWMutex
+	listed Memos
+	byUser map[int]Memos
+}
+
+func newMemoIndexes() *memoIndexes {
+	return &memoIndexes{byUser: make(map[int]Memos)}
+}
+
+// memoNewer orders memos the way the public lists show them.
+func memoNewer(a, b *Memo) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.Id > b.Id
+}
+
+// build fills the indexes from scratch, sorting once rather than
+// inserting memo by memo.
+func (x *memoIndexes) build(memos Memos) {
+	sorted := make(Memos, len(memos))
+	copy(sorted, memos)
+	sort.Slice(sorted, func(i, j int) bool {
+		return memoNewer(sorted[i], sorted[j])
+	})
+	listed := make(Memos, 0, len(sorted))
+	byUser := make(map[int]Memos)
+	for _, memo := range sorted {
+		if memo.Listed() {
+			listed = append(listed, memo)
+		}
+		byUser[memo.User] = append(byUser[memo.User], memo)
+	}
+	x.Lock()
+	x.listed, x.byUser = listed, byUser
+	x.Unlock()
+}
+
+// put files memo in place of old, the same memo as cached before or nil.
+func (x *memoIndexes) put(old, memo *Memo) {
+	x.Lock()
+	defer x.Unlock()
+	if old != nil && old.User != memo.User {
+		x.setUser(old.User, spliceMemo(x.byUser[old.User], old, nil))
+		old = nil
+	}
+	x.setUser(memo.User, spliceMemo(x.byUser[memo.User], old, memo))
+	if (old != nil && old.Listed()) || memo.Listed() {
+		if !memo.Listed() {
+			memo = nil
+		}
+		x.listed = spliceMemo(x.listed, old, memo)
+	}
+}
+
+func (x *memoIndexes) remove(old *Memo) {
+	x.Lock()
+	defer x.Unlock()
+	x.setUser(old.User, spliceMemo(x.byUser[old.User], old, nil))
+	if old.Listed() {
+		x.listed = spliceMemo(x.listed, old, nil)
+	}
+}
+
+func (x *memoIndexes) setUser(userId int, memos Memos) {
+	if len(memos) == 0 {
+		delete(x.byUser, userId)
+		return
+	}
+	x.byUser[userId] = memos
+}
+
+func (x *memoIndexes) replace(src *memoIndexes) {
+	src.RLock()
+	listed, byUser := src.listed, src.byUser
+	src.RUnlock()
+	x.Lock()
+	x.listed, x.byUser = listed, byUser
+	x.Unlock()
+}
+
+func (x *memoIndexes) listedMemos() Memos {
+	x.RLock()
+	defer x.RUnlock()
+	return x.listed[:len(x.listed):len(x.listed)]
+}
+
+func (x *memoIndexes) userMemos(userId int) Memos {
+	x.RLock()
+	defer x.RUnlock()
+	memos := x.byUser[userId]
+	return memos[:len(memos):len(memos)]
+}
+
+// spliceMemo returns a copy of memos, which are newest first, without the
+// memo with old's id and with memo in its place in the order. Either may
+// be nil.
+func spliceMemo(memos Memos, old, memo *Memo) Memos {
+	out := make(Memos, 0, len(memos)+1)
+	placed := memo == nil
+	for _, m := range memos {
+		if old != nil && m.Id == old.Id {
+			continue
+		}
+		if !placed && memoNewer(memo, m) {
+			out = append(out, memo)
+			placed = true
+		}
+		out = append(out, m)
+	}
+	if !placed {
+		out = append(out, memo)
+	}
+	return out
+}
+
+// listedPage returns one page of the public list and the number of
+// listed memos. The page is capped so appending to it cannot write into
+// the shared index.
+func listedPage(page int) (Memos, int) {
+	memos := memoCache.Listed()
+	start, end := pageBounds(page, memosPerPage, len(memos))
+	if start == end {
+		return nil, len(memos)
+	}
+	return memos[start:end:end], len(memos)
+}
+
+// listedBefore returns the page of listed memos that follows the one
+// ending at (createdAt, id).
+func listedBefore(createdAt time.Time, id int) Memos {
+	memos := memoCache.Listed()
+	cursor := &Memo{CreatedAt: createdAt, Id: id}
+	start := sort.Search(len(memos), func(i int) bool {
+		return memoNewer(cursor, memos[i])
+	})
+	end := start + memosPerPage
+	if end > len(memos) {
+		end = len(memos)
+	}
+	return memos[start:end:end]
+}
+
+// userNeighbors finds the author's memos either side of memo in the
+// index: all of them when all is set, the listed ones otherwise.
+func userNeighbors(memo *Memo, all bool) (older, newer *Memo) {
+	memos := memoCache.ByUser(memo.User)
+	i := sort.Search(len(memos), func(i int) bool {
+		return !memoNewer(memos[i], memo)
+	})
+	if i == len(memos) || memos[i].Id != memo.Id {
+		return nil, nil
+	}
+	for j := i + 1; j < len(memos); j++ {
+		if all || memos[j].Listed() {
+			older = memos[j]
+			break
+		}
+	}
+	for j := i - 1; j >= 0; j-- {
+		if all || memos[j].Listed() {
+			newer = memos[j]
+			break
+		}
+	}
+	return older, newer
+}
+
+// userPage returns one page of the author's memos, newest first, and
+// whether older ones follow. perPage 0 means all of them. The page is
+// shared with the index.
+func userPage(userId, page, perPage int) (Memos, bool) {
+	memos := memoCache.ByUser(userId)
+	if perPage == 0 {
+		return memos, false
+	}
+	start, end := pageBounds(page, perPage, len(memos))
+	return memos[start:end:end], end < len(memos)
+}
+
+// memoSlices recycles the slices that per-user lists are collected into;
+// they only live until the page is rendered.
+var memoSlices = sync.Pool{
+	New: func() interface{} {
+		memos := make(Memos, 0, memosPerPage)
+		return &memos
+	},
+}
+
+func getMemoSlice() *Memos {
+	return memoSlices.Get().(*Memos)
+}
+
+func putMemoSlice(memos *Memos) {
+	for i := range *memos {
+		(*memos)[i] = nil
+	}
+	*memos = (*memos)[:0]
+	memoSlices.Put(memos)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var listTestEpoch = time.Date(2013, 10, 5, 0, 0, 0, 0, time.Local)
+
+// putListedMemos caches n public memos, one per second starting at
+// 2013-10-05 00:00:00, and removes them when the test ends.
+func putListedMemos(tb testing.TB, n int) {
+	for i := 1; i <= n; i++ {
+		memoCache.Put(&Memo{
+			Id:         i,
+			User:       1,
+			Visibility: visibilityPublic,
+			CreatedAt:  listTestEpoch.Add(time.Duration(i) * time.Second),
+		})
+	}
+	listFragments.Purge()
+	tb.Cleanup(func() {
+		for i := 1; i <= n; i++ {
+			memoCache.Delete(i)
+		}
+		listFragments.Purge()
+	})
+}
+
+func TestListedPage(t *testing.T) {
+	putListedMemos(t, 250)
+	memoCache.Put(&Memo{Id: 251, User: 1, Visibility: visibilityPrivate, CreatedAt: listTestEpoch.Add(24 * time.Hour)})
+	defer memoCache.Delete(251)
+	listFragments.Purge()
+
+	page, total := listedPage(0)
+	if total != 250 || len(page) != memosPerPage || page[0].Id != 250 || page[99].Id != 151 {
+		t.Fatalf("page 0 = %d memos from %d, total %d", len(page), page[0].Id, total)
+	}
+	if page, _ := listedPage(2); len(page) != 50 || page[49].Id != 1 {
+		t.Errorf("page 2 has %d memos", len(page))
+	}
+	if page, _ := listedPage(3); page != nil {
+		t.Errorf("page 3 = %d memos, want none", len(page))
+	}
+	if cap(page) != len(page) {
+		t.Errorf("page has spare capacity into the shared index")
+	}
+
+	next := listedBefore(page[99].CreatedAt, page[99].Id)
+	if len(next) != memosPerPage || next[0].Id != 150 {
+		t.Errorf("listedBefore(memo 151) starts at %d", next[0].Id)
+	}
+
+	memoCache.Put(&Memo{Id: 252, User: 1, Visibility: visibilityPublic, CreatedAt: listTestEpoch.Add(24 * time.Hour)})
+	defer memoCache.Delete(252)
+	listFragments.Purge()
+	if page, total := listedPage(0); total != 251 || page[0].Id != 252 {
+		t.Errorf("index was not rebuilt after a purge")
+	}
+}
+
+func BenchmarkListedPage(b *testing.B) {
+	putListedMemos(b, 10000)
+	listedPage(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		listedPage(i % 100)
+	}
+}
+
+func BenchmarkTimelineCollect(b *testing.B) {
+	putListedMemos(b, feedMaxLen)
+	f := newFeedIndex()
+	for i := 1; i <= feedMaxLen; i++ {
+		f.feeds[1] = append(f.feeds[1], i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ids := feedIdSlices.Get().(*[]int)
+		*ids = f.AppendIds((*ids)[:0], 1)
+		memos := getMemoSlice()
+		for _, id := range *ids {
+			if memo, ok := memoCache.Get(id); ok {
+				*memos = append(*memos, memo)
+				if len(*memos) == memosPerPage {
+					break
+				}
+			}
+		}
+		putMemoSlice(memos)
+		feedIdSlices.Put(ids)
+	}
+}
+
+func TestMemoIndexes(t *testing.T) {
+	at := func(sec int) time.Time { return listTestEpoch.Add(time.Duration(sec) * time.Second) }
+	c := newMemoCacheOf(Memos{
+		{Id: 3, User: 1, CreatedAt: at(30), Visibility: visibilityPublic},
+		{Id: 1, User: 1, CreatedAt: at(10), Visibility: visibilityPublic},
+		{Id: 2, User: 2, CreatedAt: at(20), Visibility: visibilityPublic},
+	})
+	c.Put(&Memo{Id: 4, User: 1, CreatedAt: at(20), Visibility: visibilityPrivate})
+	if ids := memoIds(c.ByUser(1)); ids != "[3 4 1]" {
+		t.Fatalf("user 1 = %s", ids)
+	}
+	if ids := memoIds(c.Listed()); ids != "[3 2 1]" {
+		t.Fatalf("listed = %s", ids)
+	}
+	held, heldListed := c.ByUser(1), c.Listed()
+	c.Put(&Memo{Id: 5, User: 1, CreatedAt: at(40), Visibility: visibilityPublic})
+	c.Put(&Memo{Id: 4, User: 1, CreatedAt: at(20), Visibility: visibilityPublic, Version: 1})
+	c.Put(&Memo{Id: 3, User: 1, CreatedAt: at(30), Visibility: visibilityPublic, Hidden: true})
+	c.Delete(1)
+	if ids := memoIds(c.ByUser(1)); ids != "[5 3 4]" || c.ByUser(1)[2].Version != 1 {
+		t.Errorf("user 1 = %s", ids)
+	}
+	if ids := memoIds(c.Listed()); ids != "[5 4 2]" {
+		t.Errorf("listed = %s", ids)
+	}
+	if memoIds(held) != "[3 4 1]" || memoIds(heldListed) != "[3 2 1]" {
+		t.Errorf("lists handed out changed to %s and %s", memoIds(held), memoIds(heldListed))
+	}
+	c.Delete(2)
+	if memos := c.ByUser(2); len(memos) != 0 {
+		t.Errorf("user 2 = %s", memoIds(memos))
+	}
+
+	defer memoCache.Replace(NewMemoCache())
+	memoCache.Replace(c)
+	private := &Memo{Id: 6, User: 1, CreatedAt: at(35), Visibility: visibilityPrivate}
+	memoCache.Put(private)
+	five, _ := memoCache.Get(5)
+	if older, newer := findNeighbors(nil, five); older == nil || older.Id != 4 || newer != nil {
+		t.Errorf("neighbors for others = %v, %v", older, newer)
+	}
+	if older, newer := findNeighbors(&User{Id: 1}, five); older != private || newer != nil {
+		t.Errorf("neighbors for the author = %v, %v", older, newer)
+	}
+	if page, more := userPage(1, 1, 2); memoIds(page) != "[3 4]" || more {
+		t.Errorf("page 1 = %s, more %t", memoIds(page), more)
+	}
+	if page, more := userPage(1, 0, 2); memoIds(page) != "[5 6]" || !more {
+		t.Errorf("page 0 = %s, more %t", memoIds(page), more)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		listedPage(0)
+		userPage(1, 0, 2)
+	}); allocs != 0 {
+		t.Errorf("paging allocates %.0f times", allocs)
+	}
+}
+
+// TestMemoIndexesConcurrent adds, edits and deletes memos from several
+// goroutines while others page through the lists, then checks that both
+// indexes hold what the map does, in order.
+func TestMemoIndexesConcurrent(t *testing.T) {
+	c := NewMemoCache()
+	const writers, perWriter = 4, 200
+	visibilities := []Visibility{visibilityPublic, visibilityPrivate, visibilityUnlisted}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				id := w*perWriter + i + 1
+				memo := &Memo{Id: id, User: id % 5, CreatedAt: listTestEpoch.Add(time.Duration(id%37) * time.Second), Visibility: visibilities[i%3]}
+				c.Put(memo)
+				if i%4 == 1 {
+					edited := *memo
+					edited.Visibility = visibilities[(i+1)%3]
+					edited.Version++
+					c.Put(&edited)
+				}
+				if i%5 == 2 {
+					c.Delete(id)
+				}
+			}
+		}(w)
+	}
+	readers := sync.WaitGroup{}
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, memos := range []Memos{c.Listed(), c.ByUser(3)} {
+					for i := 1; i < len(memos); i++ {
+						if !memoNewer(memos[i-1], memos[i]) {
+							t.Errorf("list out of order at %d", i)
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	var all Memos
+	c.Each(func(memo *Memo) {
+		all = append(all, memo)
+	})
+	want := newMemoCacheOf(all)
+	if memoIds(c.Listed()) != memoIds(want.Listed()) {
+		t.Errorf("listed index drifted:\n%s\nwant\n%s", memoIds(c.Listed()), memoIds(want.Listed()))
+	}
+	for user := 0; user < 5; user++ {
+		if got := c.ByUser(user); memoIds(got) != memoIds(want.ByUser(user)) {
+			t.Errorf("index of user %d drifted: %s, want %s", user, memoIds(got), memoIds(want.ByUser(user)))
+		}
+		for _, memo := range c.ByUser(user) {
+			if cached, _ := c.Get(memo.Id); cached != memo {
+				t.Errorf("index of user %d holds a stale copy of memo %d", user, memo.Id)
+			}
+		}
+	}
+}
+
+// TestMemoListFragmentBase renders the same page for two hosts while the
+// global base URL points at a third, and checks that each fragment links
+// to its own host.
+func TestMemoListFragmentBase(t *testing.T) {
+	putListedMemos(t, 3)
+	defer func(u *url.URL) { baseUrl = u }(baseUrl)
+	baseUrl, _ = url.Parse("http://other.example")
+
+	for _, base := range []string{"http://a.example", "https://b.example/t/b"} {
+		for i := 0; i < 2; i++ {
+			f, err := memoListFragment(context.Background(), base, defaultTheme, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			html := string(f.HTML)
+			if !strings.Contains(html, base+"/memo/3") || strings.Contains(html, "other.example") {
+				t.Errorf("fragment for %s:\n%s", base, html)
+			}
+		}
+	}
+
+	// Made-up Host headers don't keep the real host's fragment out of the
+	// cache.
+	for i := 0; i < 2*maxBaseTemplateSets; i++ {
+		if _, err := memoListFragment(context.Background(), "http://junk"+strconv.Itoa(i)+".example", defaultTheme, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := memoListFragment(context.Background(), "http://a.example", defaultTheme, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := listFragments.Get("http://a.example#" + defaultTheme + "#1"); !ok {
+		t.Errorf("the fragment was not cached after junk hosts")
+	}
+	baseSets.Lock()
+	n := baseSets.lru.Len()
+	baseSets.Unlock()
+	if n > maxBaseTemplateSets {
+		t.Errorf("%d template sets kept", n)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+const shedRetryAfter = "1"
+
+var (
+	inFlight       int64
+	routeInFlight  = make(map[string]*int64)
+	routeInFlightM sync.Mutex
+)
+
+func routeCounter(route string) *int64 {
+	routeInFlightM.Lock()
+	defer routeInFlightM.Unlock()
+	n, ok := routeInFlight[route]
+	if !ok {
+		n = new(int64)
+		routeInFlight[route] = n
+	}
+	return n
+}
+
+// acquire increments counter and reports whether it stayed within limit.
+// The increment is undone when the limit is exceeded.
+func acquire(counter *int64, limit int) bool {
+	if atomic.AddInt64(counter, 1) > int64(limit) && limit > 0 {
+		atomic.AddInt64(counter, -1)
+		return false
+	}
+	return true
+}
+
+// loadSheddingMiddleware rejects requests with 503 once the configured
+// number of in-flight requests is reached, rather than queueing them.
+func loadSheddingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentRuntimeConfig()
+		if !acquire(&inFlight, c.MaxInFlight) {
+			shed(w, r)
+			return
+		}
+		defer atomic.AddInt64(&inFlight, -1)
+
+		route := routeName(r)
+		if limit, ok := c.RouteMaxInFlight[route]; ok {
+			counter := routeCounter(route)
+			if !acquire(counter, limit) {
+				shed(w, r)
+				return
+			}
+			defer atomic.AddInt64(counter, -1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shed skips the session lookup so that rejecting a request stays cheap.
+func shed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", shedRetryAfter)
+	writeError(w, r, http.StatusServiceUnavailable, "", nil)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestLoadShedding holds requests in a handler and checks that those over
+// the overall and the per-route limits are answered 503 at once.
+func TestLoadShedding(t *testing.T) {
+	defer setRuntimeConfig(currentRuntimeConfig())
+	setRuntimeConfig(RuntimeConfig{LogLevel: "info", MaxInFlight: 3, RouteMaxInFlight: map[string]int{"/slow/{id}": 1}})
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	router := mux.NewRouter()
+	router.Use(loadSheddingMiddleware)
+	hold := func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}
+	router.HandleFunc("/slow/{id}", hold)
+	router.HandleFunc("/held", hold)
+	router.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	var wg sync.WaitGroup
+	holdRequest := func(path string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := serve(path); w.Code != http.StatusOK {
+				t.Errorf("held %s: %d", path, w.Code)
+			}
+		}()
+		<-entered
+	}
+	shedding := func(path string) bool {
+		w := serve(path)
+		if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != shedRetryAfter {
+			t.Errorf("%s: Retry-After %q", path, w.Header().Get("Retry-After"))
+		}
+		return w.Code == http.StatusServiceUnavailable
+	}
+
+	holdRequest("/slow/1")
+	holdRequest("/held")
+	if !shedding("/slow/2") {
+		t.Errorf("/slow/2 passed the route limit")
+	}
+	if shedding("/fast") {
+		t.Errorf("/fast was shed under the overall limit")
+	}
+	holdRequest("/held")
+	if !shedding("/fast") {
+		t.Errorf("/fast passed the overall limit")
+	}
+	close(release)
+	wg.Wait()
+
+	if shedding("/fast") {
+		t.Errorf("shed after the held requests finished")
+	}
+	if n := *routeCounter("/slow/{id}"); n != 0 {
+		t.Errorf("route counter = %d after the requests finished", n)
+	}
+}
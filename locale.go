@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Locale formats dates and counts for one language. The templates
+// themselves are not translated.
+type Locale struct {
+	Tag        string
+	dateLayout string
+	thousands  string
+	// unitSpace separates a number from its unit, as in "3 memos" but
+	// not "3件".
+	unitSpace bool
+	// units are the singular and plural forms of each counted thing.
+	units map[string][2]string
+}
+
+// locales are the languages pages can be formatted in, by tag. The tags
+// are also the choices of the language preference.
+var locales = map[string]*Locale{
+	"en": {
+		Tag:        "en",
+		dateLayout: dbTimeLayout,
+		thousands:  ",",
+		unitSpace:  true,
+		units: map[string][2]string{
+			"memo":     {"memo", "memos"},
+			"char":     {"char", "chars"},
+			"word":     {"word", "words"},
+			"min_read": {"min read", "min read"},
+			"view":     {"view", "views"},
+			"byte":     {"byte", "bytes"},
+		},
+	},
+	"ja": {
+		Tag:        "ja",
+		dateLayout: "2006年1月2日 15:04:05",
+		thousands:  ",",
+		units: map[string][2]string{
+			"memo":     {"件", "件"},
+			"char":     {"文字", "文字"},
+			"word":     {"語", "語"},
+			"min_read": {"分で読めます", "分で読めます"},
+			"view":     {"回表示", "回表示"},
+			"byte":     {"バイト", "バイト"},
+		},
+	},
+}
+
+// Date formats t, already in the viewer's zone.
+func (l *Locale) Date(t time.Time) string {
+	return t.Format(l.dateLayout)
+}
+
+// Number formats n with its thousands grouped.
+func (l *Locale) Number(n int) string {
+	s := strconv.Itoa(n)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + l.thousands + s[i:]
+	}
+	return sign + s
+}
+
+// Count formats n of unit, such as "102 memos". Units the locale does not
+// know are used as they are.
+func (l *Locale) Count(n int, unit string) string {
+	word := unit
+	if forms, ok := l.units[unit]; ok {
+		word = forms[1]
+		if n == 1 {
+			word = forms[0]
+		}
+	}
+	if l.unitSpace {
+		return l.Number(n) + " " + word
+	}
+	return l.Number(n) + word
+}
+
+type acceptedLanguage struct {
+	tag string
+	q   float64
+}
+
+// acceptLanguages returns the primary tags of an Accept-Language header,
+// most wanted first.
+func acceptLanguages(header string) []string {
+	var accepted []acceptedLanguage
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		if i := strings.IndexByte(tag, '-'); i >= 0 {
+			tag = tag[:i]
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			accepted = append(accepted, acceptedLanguage{tag, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+	tags := make([]string, len(accepted))
+	for i, a := range accepted {
+		tags[i] = a.tag
+	}
+	return tags
+}
+
+// resolveLocale picks the user's language if they chose one, else the
+// best of the browser's that there is a locale for.
+func resolveLocale(user *User, r *http.Request) *Locale {
+	if user != nil {
+		if l, ok := locales[user.Prefs.Language]; ok {
+			return l
+		}
+	}
+	for _, tag := range acceptLanguages(r.Header.Get("Accept-Language")) {
+		if l, ok := locales[tag]; ok {
+			return l
+		}
+	}
+	return locales[defaultLanguage]
+}
+
+// Locale is how the page's dates and counts are formatted. Views that
+// were not rendered through renderTemplate, which has the request, go by
+// the user's choice alone.
+func (v *View) Locale() *Locale {
+	if v.locale != nil {
+		return v.locale
+	}
+	if v.User != nil {
+		if l, ok := locales[v.User.Prefs.Language]; ok {
+			return l
+		}
+	}
+	return locales[defaultLanguage]
+}
+
+// Local formats t in the viewer's time zone and locale.
+func (v *View) Local(t time.Time) string {
+	if v.User != nil {
+		t = t.In(v.User.Prefs.Location())
+	} else {
+		t = t.In(dbLocation)
+	}
+	return v.Locale().Date(t)
+}
+
+// Lang is the language the page is marked up as.
+func (v *View) Lang() string {
+	return v.Locale().Tag
+}
+
+func (v *View) Count(n int, unit string) string {
+	return v.Locale().Count(n, unit)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptLanguages(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"ja-JP,ja;q=0.9,en;q=0.8", []string{"ja", "ja", "en"}},
+		{"en;q=0.5, ja", []string{"ja", "en"}},
+		{"fr, de;q=0", []string{"fr"}},
+	} {
+		if got := acceptLanguages(c.header); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("acceptLanguages(%q) = %q, want %q", c.header, got, c.want)
+		}
+	}
+}
+
+func TestResolveLocale(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "fr, ja;q=0.8, en;q=0.5")
+	if l := resolveLocale(nil, r); l.Tag != "ja" {
+		t.Errorf("browser locale = %s, want ja", l.Tag)
+	}
+	user := &User{Prefs: Preferences{Language: "en"}}
+	if l := resolveLocale(user, r); l.Tag != "en" {
+		t.Errorf("chosen locale = %s, want en", l.Tag)
+	}
+	r.Header.Del("Accept-Language")
+	if l := resolveLocale(nil, r); l.Tag != defaultLanguage {
+		t.Errorf("default locale = %s, want %s", l.Tag, defaultLanguage)
+	}
+}
+
+func TestLocaleFormats(t *testing.T) {
+	en, ja := locales["en"], locales["ja"]
+	for _, c := range []struct{ got, want string }{
+		{en.Number(0), "0"},
+		{en.Number(999), "999"},
+		{en.Number(1234567), "1,234,567"},
+		{en.Number(-1000), "-1,000"},
+		{en.Count(1, "memo"), "1 memo"},
+		{en.Count(102, "memo"), "102 memos"},
+		{en.Count(2, "min_read"), "2 min read"},
+		{ja.Count(102, "memo"), "102件"},
+		{en.Count(3, "gopher"), "3 gopher"},
+	} {
+		if c.got != c.want {
+			t.Errorf("got %q, want %q", c.got, c.want)
+		}
+	}
+	at := time.Date(2013, 10, 5, 9, 3, 0, 0, time.UTC)
+	if got := ja.Date(at); got != "2013年10月5日 09:03:00" {
+		t.Errorf("ja date = %q", got)
+	}
+	if got := en.Date(at); got != "2013-10-05 09:03:00" {
+		t.Errorf("en date = %q", got)
+	}
+}
+
+func TestLocalePages(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 10})
+	res := app.postMemo(t, url.Values{"content": {"# locale\nformatted per browser"}, "visibility": {"public"}})
+	path := res.Request.URL.Path
+	get := func(lang string) string {
+		req, _ := http.NewRequest("GET", app.URL+path, nil)
+		req.Header.Set("Accept-Language", lang)
+		res, err := app.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if vary := res.Header.Get("Vary"); !strings.Contains(vary, "Accept-Language") {
+			t.Errorf("Vary = %q", vary)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+	if page := get("ja-JP,ja;q=0.9"); !strings.Contains(page, `<html lang="ja">`) || !strings.Contains(page, "文字") {
+		t.Errorf("memo page is not formatted for ja")
+	}
+	if page := get("en-US"); !strings.Contains(page, `<html lang="en">`) || !strings.Contains(page, " chars,") {
+		t.Errorf("memo page is not formatted for en")
+	}
+}
@@ -0,0 +1,1287 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// memoryDriverName is the database/sql driver that -memory runs the app
+// against instead of MySQL. It keeps every table in maps and answers
+// exactly the statements the app sends, looked up by their text in
+// memoryStatements, so a new query needs an entry there too; anything
+// else fails with an "unsupported query" error. Transactions roll back
+// but are not isolated from each other.
+const memoryDriverName = "isucon-memory"
+
+const (
+	defaultSeedUsers = 100
+	defaultSeedMemos = 2000
+)
+
+// memorySeed describes the generated data set a memory database starts
+// with. The same seed always gives the same users, memos and follows.
+type memorySeed struct {
+	Seed  int64
+	Users int
+	Memos int
+}
+
+var defaultMemorySeed = memorySeed{Seed: 1, Users: defaultSeedUsers, Memos: defaultSeedMemos}
+
+func (s memorySeed) dsn() string {
+	v := url.Values{}
+	v.Set("seed", strconv.FormatInt(s.Seed, 10))
+	v.Set("users", strconv.Itoa(s.Users))
+	v.Set("memos", strconv.Itoa(s.Memos))
+	return v.Encode()
+}
+
+func parseMemorySeed(dsn string) (memorySeed, error) {
+	s := defaultMemorySeed
+	v, err := url.ParseQuery(dsn)
+	if err != nil {
+		return s, err
+	}
+	if seed := v.Get("seed"); seed != "" {
+		if s.Seed, err = strconv.ParseInt(seed, 10, 64); err != nil {
+			return s, fmt.Errorf("memory: bad seed %q", seed)
+		}
+	}
+	for key, n := range map[string]*int{"users": &s.Users, "memos": &s.Memos} {
+		if val := v.Get(key); val != "" {
+			if *n, err = strconv.Atoi(val); err != nil || *n < 0 {
+				return s, fmt.Errorf("memory: bad %s %q", key, val)
+			}
+		}
+	}
+	if s.Users == 0 && s.Memos > 0 {
+		return s, errors.New("memory: memos need at least one user")
+	}
+	return s, nil
+}
+
+// useMemoryDatabase switches config to the memory driver: replicas and
+// the cache snapshot are turned off as they would outlive the data.
+func useMemoryDatabase(config *Config, seed memorySeed) (string, string) {
+	log.Printf("db: in memory, seed %d with %d users and %d memos", seed.Seed, seed.Users, seed.Memos)
+	config.Replicas = nil
+	config.Snapshot.Disabled = true
+	return memoryDriverName, seed.dsn()
+}
+
+func init() {
+	sql.Register(memoryDriverName, memoryDriver{})
+	// The memory store has every table, so every schema step is in place.
+	for _, step := range schemaSteps {
+		memoryStatements[step.probe] = memStatement{query: func(s *memStore, args []driver.Value) *memRows {
+			return &memRows{columns: 1}
+		}}
+	}
+	for n := 1; n <= viewFlushBatch; n++ {
+		memoryStatements[flushViewsSQL(n)] = memStatement{args: 2 * n, exec: addMemViews}
+	}
+}
+
+// memDuplicate is the error MySQL gives for a row that breaks a unique
+// index, so that duplicateEntry recognizes it.
+func memDuplicate(format string, args ...interface{}) error {
+	return &mysql.MySQLError{Number: 1062, Message: fmt.Sprintf("memory: duplicate entry "+format, args...)}
+}
+
+// addMemViews adds the (memo_id, views) pairs of a flushViewsSQL statement
+// to the current hour.
+func addMemViews(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+	hour := time.Now().In(dbLocation).Format("2006-01-02 15:00:00")
+	for i := 0; i < len(args); i += 2 {
+		key := memViewKey{memoId: argInt(args[i]), hour: hour}
+		old, ok := s.views[key]
+		s.views[key] = old + argInt(args[i+1])
+		undo(func() {
+			if ok {
+				s.views[key] = old
+			} else {
+				delete(s.views, key)
+			}
+		})
+	}
+	return memResult{affected: int64(len(args) / 2)}, nil
+}
+
+// memoryStores holds one store per DSN, so that every connection opened
+// with the same seed sees the same data.
+var memoryStores = struct {
+	sync.Mutex
+	stores map[string]*memStore
+}{stores: make(map[string]*memStore)}
+
+func openMemoryStore(dsn string) (*memStore, error) {
+	memoryStores.Lock()
+	defer memoryStores.Unlock()
+	if s, ok := memoryStores.stores[dsn]; ok {
+		return s, nil
+	}
+	seed, err := parseMemorySeed(dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := newMemStore()
+	s.seed(seed)
+	memoryStores.stores[dsn] = s
+	return s, nil
+}
+
+// forgetMemoryStore drops dsn's data; the next connection starts over
+// from the seed.
+func forgetMemoryStore(dsn string) {
+	memoryStores.Lock()
+	delete(memoryStores.stores, dsn)
+	memoryStores.Unlock()
+}
+
+type memReport struct {
+	id        int
+	memoId    int
+	reporter  int
+	reason    string
+	status    string
+	createdAt string
+}
+
+type memFlag struct {
+	reason    string
+	createdAt string
+}
+
+type memViewKey struct {
+	memoId int
+	hour   string
+}
+
+type memVisitorKey struct {
+	memoId int
+	day    string
+}
+
+// memRefreshToken is an api_refresh_tokens row, keyed by token_hash.
+type memRefreshToken struct {
+	userId    int
+	expiresAt string
+}
+
+type memMemoTemplate struct {
+	userId  int
+	name    string
+	content string
+}
+
+type memAttachment struct {
+	memoId      int
+	userId      int
+	key         string
+	filename    string
+	contentType string
+	size        int
+	variants    string
+}
+
+type memVisitors struct {
+	registers []byte
+	visitors  int
+}
+
+// memStore is the memory database. Memo rows are kept as *Memo with only
+// the stored columns set, and are copied rather than changed in place.
+type memStore struct {
+	sync.Mutex
+	users         map[int]*User
+	memos         map[int]*Memo
+	lastMemoId    int
+	follows       map[[2]int]bool
+	teams         map[int]string
+	lastTeamId    int
+	teamMembers   map[[2]int]bool
+	flags         map[int]memFlag
+	reports       []*memReport
+	lastReportId  int
+	views         map[memViewKey]int
+	visitors      map[memVisitorKey]memVisitors
+	banner        *string
+	refreshTokens map[string]memRefreshToken
+	prefs         map[int]Preferences
+	templates     map[int]memMemoTemplate
+	lastTemplate  int
+	attachments   map[int]memAttachment
+	lastAttach    int
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		users:         make(map[int]*User),
+		memos:         make(map[int]*Memo),
+		follows:       make(map[[2]int]bool),
+		teams:         make(map[int]string),
+		teamMembers:   make(map[[2]int]bool),
+		flags:         make(map[int]memFlag),
+		views:         make(map[memViewKey]int),
+		visitors:      make(map[memVisitorKey]memVisitors),
+		refreshTokens: make(map[string]memRefreshToken),
+		prefs:         make(map[int]Preferences),
+		templates:     make(map[int]memMemoTemplate),
+		attachments:   make(map[int]memAttachment),
+	}
+}
+
+var (
+	seedWords = strings.Fields(`isucon go memo cache index query session
+		mysql nginx benchmark score latency tuning profile template markdown
+		timeline follow team archive slug render shard pool worker deploy`)
+	seedVisibilities = []Visibility{
+		visibilityPublic, visibilityPublic, visibilityPublic, visibilityPublic,
+		visibilityPublic, visibilityPublic, visibilityPublic,
+		visibilityUnlisted, visibilityFollowers, visibilityPrivate,
+	}
+	seedFollowsPerUser = 5
+)
+
+// seedEpoch is when the first seeded memo was written.
+func seedEpoch() time.Time {
+	return time.Date(2013, time.October, 1, 0, 0, 0, 0, dbLocation)
+}
+
+func seedSentence(rng *rand.Rand, words int) string {
+	s := make([]string, words)
+	for i := range s {
+		s[i] = seedWords[rng.Intn(len(seedWords))]
+	}
+	return strings.Join(s, " ")
+}
+
+// seed fills an empty store. User n is "user<n>" with that as password.
+func (s *memStore) seed(c memorySeed) {
+	rng := rand.New(rand.NewSource(c.Seed))
+	for id := 1; id <= c.Users; id++ {
+		name := "user" + strconv.Itoa(id)
+		salt := strconv.FormatInt(rng.Int63(), 36)
+		s.users[id] = &User{Id: id, Username: name, Password: passwordHash(salt, name), Salt: salt}
+	}
+	for id := 1; id <= c.Users && c.Users > 1; id++ {
+		for i := rng.Intn(seedFollowsPerUser + 1); i > 0; i-- {
+			if followee := 1 + rng.Intn(c.Users); followee != id {
+				s.follows[[2]int{id, followee}] = true
+			}
+		}
+	}
+	slugs := make(map[string]bool)
+	t := seedEpoch()
+	for id := 1; id <= c.Memos; id++ {
+		t = t.Add(time.Duration(1+rng.Intn(600)) * time.Second)
+		content := "# " + seedSentence(rng, 2+rng.Intn(4)) + "\n\n"
+		for i := rng.Intn(4); i >= 0; i-- {
+			content += seedSentence(rng, 5+rng.Intn(20)) + ".\n"
+		}
+		memo := &Memo{
+			Id:         id,
+			User:       1 + rng.Intn(c.Users),
+			Content:    content,
+			Visibility: seedVisibilities[rng.Intn(len(seedVisibilities))],
+			CreatedAt:  t,
+			UpdatedAt:  t,
+		}
+		if slug := memoSlug(memoTitle(content)); slug != "" {
+			if slugs[slug] {
+				slug = fmt.Sprintf("%s-%d", slug, id)
+			}
+			slugs[slug] = true
+			memo.Slug = slug
+		}
+		s.memos[id] = memo
+	}
+	s.lastMemoId = c.Memos
+}
+
+func (s *memStore) now() string {
+	return formatDBTime(time.Now())
+}
+
+func (s *memStore) slugTaken(slug string) bool {
+	for _, m := range s.memos {
+		if m.Slug == slug {
+			return true
+		}
+	}
+	return false
+}
+
+// putMemo replaces memo id's row with the result of change, a copy, and
+// arranges for the old row to come back on rollback.
+func (s *memStore) putMemo(id int, undo func(func()), change func(m *Memo)) bool {
+	old, ok := s.memos[id]
+	if !ok {
+		return false
+	}
+	m := *old
+	change(&m)
+	s.memos[id] = &m
+	undo(func() { s.memos[id] = old })
+	return true
+}
+
+// memoryDriver implements database/sql/driver on top of memStore.
+type memoryDriver struct{}
+
+func (memoryDriver) Open(dsn string) (driver.Conn, error) {
+	store, err := openMemoryStore(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &memConn{store: store}, nil
+}
+
+type memConn struct {
+	store *memStore
+	inTx  bool
+	undo  []func()
+}
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) {
+	if _, ok := memoryStatements[query]; !ok {
+		return nil, fmt.Errorf("memory: unsupported query %q", query)
+	}
+	return &memStmt{conn: c, query: query}, nil
+}
+
+func (c *memConn) Close() error {
+	return nil
+}
+
+func (c *memConn) Begin() (driver.Tx, error) {
+	if c.inTx {
+		return nil, errors.New("memory: transaction already open")
+	}
+	c.inTx = true
+	return c, nil
+}
+
+func (c *memConn) Commit() error {
+	c.inTx, c.undo = false, nil
+	return nil
+}
+
+func (c *memConn) Rollback() error {
+	c.store.Lock()
+	for i := len(c.undo) - 1; i >= 0; i-- {
+		c.undo[i]()
+	}
+	c.store.Unlock()
+	c.inTx, c.undo = false, nil
+	return nil
+}
+
+// onRollback records how to reverse a change made in a transaction. It
+// is called, and the function it is given is later run, with the store
+// locked.
+func (c *memConn) onRollback(fn func()) {
+	if c.inTx {
+		c.undo = append(c.undo, fn)
+	}
+}
+
+type memStmt struct {
+	conn  *memConn
+	query string
+}
+
+func (s *memStmt) Close() error {
+	return nil
+}
+
+func (s *memStmt) NumInput() int {
+	return memoryStatements[s.query].args
+}
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	st := memoryStatements[s.query]
+	if st.exec == nil {
+		return nil, fmt.Errorf("memory: %q is not a statement", s.query)
+	}
+	s.conn.store.Lock()
+	defer s.conn.store.Unlock()
+	return st.exec(s.conn.store, args, s.conn.onRollback)
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	st := memoryStatements[s.query]
+	if st.query == nil {
+		return nil, fmt.Errorf("memory: %q is not a query", s.query)
+	}
+	s.conn.store.Lock()
+	defer s.conn.store.Unlock()
+	return st.query(s.conn.store, args), nil
+}
+
+type memResult struct {
+	id       int64
+	affected int64
+}
+
+func (r memResult) LastInsertId() (int64, error) {
+	return r.id, nil
+}
+
+func (r memResult) RowsAffected() (int64, error) {
+	return r.affected, nil
+}
+
+type memRows struct {
+	columns int
+	rows    [][]driver.Value
+}
+
+func (r *memRows) Columns() []string {
+	names := make([]string, r.columns)
+	for i := range names {
+		names[i] = "col" + strconv.Itoa(i+1)
+	}
+	return names
+}
+
+func (r *memRows) Close() error {
+	return nil
+}
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func argInt(v driver.Value) int {
+	switch v := v.(type) {
+	case int64:
+		return int(v)
+	case bool:
+		if v {
+			return 1
+		}
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	case []byte:
+		n, _ := strconv.Atoi(string(v))
+		return n
+	}
+	return 0
+}
+
+func argString(v driver.Value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return ""
+}
+
+func argBytes(v driver.Value) []byte {
+	if b, ok := v.([]byte); ok {
+		return append([]byte(nil), b...)
+	}
+	return []byte(argString(v))
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func memoRow(m *Memo) []driver.Value {
+	return []driver.Value{
+		int64(m.Id), int64(m.User), m.Content, string(m.Visibility),
+		formatDBTime(m.CreatedAt), formatDBTime(m.UpdatedAt), int64(m.Version), m.Slug,
+		boolValue(m.Hidden), int64(m.Team), boolValue(m.Locked), m.ModerationNote,
+	}
+}
+
+// selectMemos returns the memo rows match accepts, ordered by less.
+func (s *memStore) selectMemos(match func(m *Memo) bool, less func(a, b *Memo) bool) []*Memo {
+	memos := make([]*Memo, 0)
+	for _, m := range s.memos {
+		if match(m) {
+			memos = append(memos, m)
+		}
+	}
+	sort.Slice(memos, func(i, j int) bool { return less(memos[i], memos[j]) })
+	return memos
+}
+
+func memoRows(memos []*Memo) *memRows {
+	rows := &memRows{columns: 12}
+	for _, m := range memos {
+		rows.rows = append(rows.rows, memoRow(m))
+	}
+	return rows
+}
+
+func memoById(a, b *Memo) bool {
+	return a.Id < b.Id
+}
+
+func memoOlder(a, b *Memo) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.Id < b.Id
+}
+
+func attachmentRow(id int, a memAttachment) []driver.Value {
+	return []driver.Value{int64(id), int64(a.memoId), int64(a.userId), a.key, a.filename, a.contentType, int64(a.size), a.variants}
+}
+
+func userRows(s *memStore, minId int) *memRows {
+	ids := make([]int, 0, len(s.users))
+	for id := range s.users {
+		if id > minId {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	rows := &memRows{columns: 5}
+	for _, id := range ids {
+		u := s.users[id]
+		var lastAccess driver.Value
+		if u.LastAccess != "" {
+			lastAccess = u.LastAccess
+		}
+		rows.rows = append(rows.rows, []driver.Value{int64(u.Id), u.Username, u.Password, u.Salt, lastAccess})
+	}
+	return rows
+}
+
+// memoryModeration applies one of moderateMemo's SET clauses, which takes
+// params arguments before the memo id, to a row.
+func memoryModeration(params int, set func(m *Memo, args []driver.Value)) memStatement {
+	return memStatement{args: params + 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[len(args)-1])
+		ok := s.putMemo(id, undo, func(m *Memo) {
+			set(m, args[:len(args)-1])
+			m.Version++
+			m.UpdatedAt, _ = parseDBTime(s.now())
+		})
+		if !ok {
+			return memResult{}, nil
+		}
+		return memResult{affected: 1}, nil
+	}}
+}
+
+// memStatement is how the memory driver runs one statement text: query
+// for those returning rows and exec for the others. args is the number
+// of placeholders.
+type memStatement struct {
+	args  int
+	query func(s *memStore, args []driver.Value) *memRows
+	exec  func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error)
+}
+
+var memoryStatements = map[string]memStatement{
+	showTablesSQL: {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		rows := &memRows{columns: 1}
+		for _, table := range []string{"api_refresh_tokens", "follows", "memo_attachments", "memo_flags", "memo_reports", "memo_templates", "memo_views", "memo_visitors", "memos", "site_banner", "team_members", "teams", "user_preferences", "users"} {
+			rows.rows = append(rows.rows, []driver.Value{table})
+		}
+		return rows
+	}},
+	cacheAuditCountsSQL: {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		listed := 0
+		for _, m := range s.memos {
+			if m.Listed() {
+				listed++
+			}
+		}
+		return &memRows{columns: 3, rows: [][]driver.Value{{int64(len(s.users)), int64(len(s.memos)), int64(listed)}}}
+	}},
+	listIndexesSQL: {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		// The memory store looks rows up in maps, as if it had every index
+		// of init/alter.sql.
+		rows := &memRows{columns: 3}
+		for _, index := range [][]string{
+			{"memos", "PRIMARY", "id"},
+			{"memos", "i4", "visibility,created_at"},
+			{"memos", "i5", "user,visibility,created_at"},
+			{"memos", "i3", "user,created_at"},
+			{"memos", "updated_at", "updated_at"},
+			{"users", "PRIMARY", "id"},
+			{"users", "username", "username"},
+		} {
+			rows.rows = append(rows.rows, []driver.Value{index[0], index[1], index[2]})
+		}
+		return rows
+	}},
+	"SELECT id, username, password, salt, last_access FROM users": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		return userRows(s, 0)
+	}},
+	snapshotUserCatchUpSQL: {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		return userRows(s, argInt(args[0]))
+	}},
+	selectPreferencesSQL: {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		rows := &memRows{columns: 6}
+		for userId, p := range s.prefs {
+			rows.rows = append(rows.rows, []driver.Value{int64(userId), int64(p.PerPage), p.Theme, p.Timezone, p.Language, p.HardBreaks})
+		}
+		return rows
+	}},
+	savePreferencesSQL: {args: 6, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		userId := argInt(args[0])
+		old, ok := s.prefs[userId]
+		s.prefs[userId] = Preferences{
+			PerPage: argInt(args[1]), Theme: argString(args[2]), Timezone: argString(args[3]),
+			Language: argString(args[4]), HardBreaks: argInt(args[5]) != 0,
+		}
+		undo(func() {
+			if ok {
+				s.prefs[userId] = old
+			} else {
+				delete(s.prefs, userId)
+			}
+		})
+		if ok {
+			return memResult{affected: 2}, nil
+		}
+		return memResult{affected: 1}, nil
+	}},
+	"UPDATE users SET last_access=now() WHERE id=?": {args: 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[0])
+		old, ok := s.users[id]
+		if !ok {
+			return memResult{}, nil
+		}
+		u := *old
+		u.LastAccess = s.now()
+		s.users[id] = &u
+		undo(func() { s.users[id] = old })
+		return memResult{affected: 1}, nil
+	}},
+	"INSERT INTO users (username, password, salt, last_access) VALUES (?, ?, ?, now())": {args: 3, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		name := argString(args[0])
+		id := 1
+		for _, u := range s.users {
+			if u.Username == name {
+				return nil, memDuplicate("%q for key 'username'", name)
+			}
+			if u.Id >= id {
+				id = u.Id + 1
+			}
+		}
+		s.users[id] = &User{Id: id, Username: name, Password: argString(args[1]), Salt: argString(args[2]), LastAccess: s.now()}
+		undo(func() { delete(s.users, id) })
+		return memResult{id: int64(id), affected: 1}, nil
+	}},
+
+	"SELECT " + memoColumns + " FROM memos": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		return memoRows(s.selectMemos(func(m *Memo) bool { return true }, memoById))
+	}},
+	"SELECT " + memoColumns + " FROM memos WHERE id=?": {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		id := argInt(args[0])
+		return memoRows(s.selectMemos(func(m *Memo) bool { return m.Id == id }, memoById))
+	}},
+	"SELECT " + memoColumns + " FROM memos WHERE id > ? OR updated_at >= ?": {args: 2, query: func(s *memStore, args []driver.Value) *memRows {
+		id := argInt(args[0])
+		since, _ := parseDBTime(argString(args[1]))
+		return memoRows(s.selectMemos(func(m *Memo) bool { return m.Id > id || !m.UpdatedAt.Before(since) }, memoById))
+	}},
+	"SELECT " + memoColumns + " FROM memos WHERE user=?  ORDER BY created_at, id": {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		user := argInt(args[0])
+		return memoRows(s.selectMemos(func(m *Memo) bool { return m.User == user }, memoOlder))
+	}},
+	"SELECT " + memoColumns + " FROM memos WHERE user=? AND " + listedCond + " ORDER BY created_at, id": {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		user := argInt(args[0])
+		return memoRows(s.selectMemos(func(m *Memo) bool {
+			return m.User == user && m.Visibility == visibilityPublic && !m.Hidden
+		}, memoOlder))
+	}},
+	shadowListedSQL: {args: 2, query: func(s *memStore, args []driver.Value) *memRows {
+		memos := s.selectMemos((*Memo).Listed, memoNewer)
+		limit, offset := argInt(args[0]), argInt(args[1])
+		if offset > len(memos) {
+			offset = len(memos)
+		}
+		if offset+limit < len(memos) {
+			memos = memos[:offset+limit]
+		}
+		return memoRows(memos[offset:])
+	}},
+	shadowCountSQL: {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		return &memRows{columns: 1, rows: [][]driver.Value{{int64(len(s.selectMemos((*Memo).Listed, memoNewer)))}}}
+	}},
+	shadowBeforeSQL: {args: 4, query: func(s *memStore, args []driver.Value) *memRows {
+		before, _ := parseDBTime(argString(args[0]))
+		id, limit := argInt(args[2]), argInt(args[3])
+		memos := s.selectMemos(func(m *Memo) bool {
+			return m.Listed() && (m.CreatedAt.Before(before) || m.CreatedAt.Equal(before) && m.Id < id)
+		}, memoNewer)
+		if len(memos) > limit {
+			memos = memos[:limit]
+		}
+		return memoRows(memos)
+	}},
+	"INSERT INTO memos (user, content, visibility, team_id, hidden, created_at) VALUES (?, ?, ?, ?, ?, now())": {args: 5, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		now, _ := parseDBTime(s.now())
+		s.lastMemoId++
+		id := s.lastMemoId
+		s.memos[id] = &Memo{
+			Id:         id,
+			User:       argInt(args[0]),
+			Content:    argString(args[1]),
+			Visibility: Visibility(argString(args[2])),
+			Team:       argInt(args[3]),
+			Hidden:     argInt(args[4]) != 0,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		undo(func() { delete(s.memos, id) })
+		return memResult{id: int64(id), affected: 1}, nil
+	}},
+	"UPDATE memos SET slug=? WHERE id=?": {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		slug := argString(args[0])
+		if s.slugTaken(slug) {
+			return nil, memDuplicate("%q for key 'slug'", slug)
+		}
+		if !s.putMemo(argInt(args[1]), undo, func(m *Memo) { m.Slug = slug }) {
+			return memResult{}, nil
+		}
+		return memResult{affected: 1}, nil
+	}},
+	"UPDATE memos SET content=?, visibility=?, team_id=?, version=version+1, updated_at=now() WHERE id=? AND user=? AND version=? AND locked=0": {args: 6, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id, user, version := argInt(args[3]), argInt(args[4]), argInt(args[5])
+		if m, ok := s.memos[id]; !ok || m.User != user || m.Version != version || m.Locked {
+			return memResult{}, nil
+		}
+		s.putMemo(id, undo, func(m *Memo) {
+			m.Content = argString(args[0])
+			m.Visibility = Visibility(argString(args[1]))
+			m.Team = argInt(args[2])
+			m.Version++
+			m.UpdatedAt, _ = parseDBTime(s.now())
+		})
+		return memResult{affected: 1}, nil
+	}},
+	setVisibilitySQL: {args: 4, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		visibility, id, user := Visibility(argString(args[0])), argInt(args[1]), argInt(args[2])
+		if m, ok := s.memos[id]; !ok || m.User != user || m.Locked || m.Visibility == visibility {
+			return memResult{}, nil
+		}
+		s.putMemo(id, undo, func(m *Memo) {
+			m.Visibility = visibility
+			m.Team = 0
+			m.Version++
+			m.UpdatedAt, _ = parseDBTime(s.now())
+		})
+		return memResult{affected: 1}, nil
+	}},
+	"DELETE FROM memos WHERE id=?": {args: 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[0])
+		old, ok := s.memos[id]
+		if !ok {
+			return memResult{}, nil
+		}
+		delete(s.memos, id)
+		undo(func() { s.memos[id] = old })
+		return memResult{affected: 1}, nil
+	}},
+	"UPDATE memos SET " + moderationActions["lock"] + ", version=version+1, updated_at=now() WHERE id=?": memoryModeration(1, func(m *Memo, args []driver.Value) {
+		m.Locked, m.ModerationNote = true, argString(args[0])
+	}),
+	"UPDATE memos SET " + moderationActions["unlock"] + ", version=version+1, updated_at=now() WHERE id=?": memoryModeration(0, func(m *Memo, args []driver.Value) {
+		m.Locked = false
+		if !m.Hidden {
+			m.ModerationNote = ""
+		}
+	}),
+	"UPDATE memos SET " + moderationActions["hide"] + ", version=version+1, updated_at=now() WHERE id=?": memoryModeration(1, func(m *Memo, args []driver.Value) {
+		m.Hidden, m.ModerationNote = true, argString(args[0])
+	}),
+	"UPDATE memos SET " + moderationActions["unhide"] + ", version=version+1, updated_at=now() WHERE id=?": memoryModeration(0, func(m *Memo, args []driver.Value) {
+		m.Hidden = false
+		if !m.Locked {
+			m.ModerationNote = ""
+		}
+	}),
+	"UPDATE memos SET hidden=1, version=version+1, updated_at=now() WHERE id=?": memoryModeration(0, func(m *Memo, args []driver.Value) {
+		m.Hidden = true
+	}),
+
+	"SELECT follower, followee FROM follows": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		return pairRows(s.follows)
+	}},
+	"INSERT IGNORE INTO follows (follower, followee, created_at) VALUES (?, ?, now())": {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		return insertPair(s.follows, [2]int{argInt(args[0]), argInt(args[1])}, undo), nil
+	}},
+	"DELETE FROM follows WHERE follower=? AND followee=?": {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		return deletePair(s.follows, [2]int{argInt(args[0]), argInt(args[1])}, undo), nil
+	}},
+
+	"SELECT id, name FROM teams": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		rows := &memRows{columns: 2}
+		for id, name := range s.teams {
+			rows.rows = append(rows.rows, []driver.Value{int64(id), name})
+		}
+		return rows
+	}},
+	"INSERT INTO teams (name, created_at) VALUES (?, now())": {args: 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		name := argString(args[0])
+		for _, n := range s.teams {
+			if strings.EqualFold(n, name) {
+				return nil, memDuplicate("%q for key 'name'", name)
+			}
+		}
+		s.lastTeamId++
+		id := s.lastTeamId
+		s.teams[id] = name
+		undo(func() { delete(s.teams, id) })
+		return memResult{id: int64(id), affected: 1}, nil
+	}},
+	"SELECT team_id, user_id FROM team_members": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		return pairRows(s.teamMembers)
+	}},
+	"INSERT IGNORE INTO team_members (team_id, user_id, created_at) VALUES (?, ?, now())": {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		return insertPair(s.teamMembers, [2]int{argInt(args[0]), argInt(args[1])}, undo), nil
+	}},
+	"DELETE FROM team_members WHERE team_id=? AND user_id=?": {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		return deletePair(s.teamMembers, [2]int{argInt(args[0]), argInt(args[1])}, undo), nil
+	}},
+
+	"SELECT memo_id, reason, created_at FROM memo_flags ORDER BY created_at": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		ids := make([]int, 0, len(s.flags))
+		for id := range s.flags {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			a, b := s.flags[ids[i]], s.flags[ids[j]]
+			if a.createdAt != b.createdAt {
+				return a.createdAt < b.createdAt
+			}
+			return ids[i] < ids[j]
+		})
+		rows := &memRows{columns: 3}
+		for _, id := range ids {
+			rows.rows = append(rows.rows, []driver.Value{int64(id), s.flags[id].reason, s.flags[id].createdAt})
+		}
+		return rows
+	}},
+	"INSERT INTO memo_flags (memo_id, reason, created_at) VALUES (?, ?, now())": {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[0])
+		if _, ok := s.flags[id]; ok {
+			return nil, memDuplicate("'%d' for key 'PRIMARY'", id)
+		}
+		s.flags[id] = memFlag{reason: argString(args[1]), createdAt: s.now()}
+		undo(func() { delete(s.flags, id) })
+		return memResult{affected: 1}, nil
+	}},
+	"DELETE FROM memo_flags WHERE memo_id=?": {args: 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[0])
+		old, ok := s.flags[id]
+		if !ok {
+			return memResult{}, nil
+		}
+		delete(s.flags, id)
+		undo(func() { s.flags[id] = old })
+		return memResult{affected: 1}, nil
+	}},
+
+	"INSERT INTO memo_reports (memo_id, reporter, reason, created_at) VALUES (?, ?, ?, now()) ON DUPLICATE KEY UPDATE reason=IF(status='open', VALUES(reason), reason)": {args: 3, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		memoId, reporter, reason := argInt(args[0]), argInt(args[1]), argString(args[2])
+		for i, old := range s.reports {
+			if old.memoId != memoId || old.reporter != reporter {
+				continue
+			}
+			if old.status != "open" || old.reason == reason {
+				return memResult{}, nil
+			}
+			report := *old
+			report.reason = reason
+			s.reports[i] = &report
+			undo(func() { s.reports[i] = old })
+			return memResult{affected: 2}, nil
+		}
+		s.lastReportId++
+		s.reports = append(s.reports, &memReport{
+			id: s.lastReportId, memoId: memoId, reporter: reporter,
+			reason: reason, status: "open", createdAt: s.now(),
+		})
+		n := len(s.reports) - 1
+		undo(func() { s.reports = s.reports[:n] })
+		return memResult{id: int64(s.lastReportId), affected: 1}, nil
+	}},
+	"UPDATE memo_reports SET status=?, resolved_at=now() WHERE memo_id=? AND status='open'": {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		status, memoId := argString(args[0]), argInt(args[1])
+		var n int64
+		for i, old := range s.reports {
+			if old.memoId == memoId && old.status == "open" {
+				i, old := i, old
+				report := *old
+				report.status = status
+				s.reports[i] = &report
+				undo(func() { s.reports[i] = old })
+				n++
+			}
+		}
+		return memResult{affected: n}, nil
+	}},
+	"SELECT memo_id, reason, status, created_at FROM memo_reports WHERE reporter=? ORDER BY created_at DESC, id DESC LIMIT ?": {args: 2, query: func(s *memStore, args []driver.Value) *memRows {
+		reporter, limit := argInt(args[0]), argInt(args[1])
+		reports := make([]*memReport, 0)
+		for _, r := range s.reports {
+			if r.reporter == reporter {
+				reports = append(reports, r)
+			}
+		}
+		sort.Slice(reports, func(i, j int) bool {
+			if reports[i].createdAt != reports[j].createdAt {
+				return reports[i].createdAt > reports[j].createdAt
+			}
+			return reports[i].id > reports[j].id
+		})
+		if len(reports) > limit {
+			reports = reports[:limit]
+		}
+		rows := &memRows{columns: 4}
+		for _, r := range reports {
+			rows.rows = append(rows.rows, []driver.Value{int64(r.memoId), r.reason, r.status, r.createdAt})
+		}
+		return rows
+	}},
+	"SELECT memo_id, COUNT(*), MIN(created_at) FROM memo_reports WHERE status='open' GROUP BY memo_id ORDER BY COUNT(*) DESC, MIN(created_at)": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		type group struct {
+			memoId  int
+			count   int
+			firstAt string
+		}
+		groups := make(map[int]*group)
+		for _, r := range s.reports {
+			if r.status != "open" {
+				continue
+			}
+			g, ok := groups[r.memoId]
+			if !ok {
+				g = &group{memoId: r.memoId, firstAt: r.createdAt}
+				groups[r.memoId] = g
+			}
+			g.count++
+			if r.createdAt < g.firstAt {
+				g.firstAt = r.createdAt
+			}
+		}
+		sorted := make([]*group, 0, len(groups))
+		for _, g := range groups {
+			sorted = append(sorted, g)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].count != sorted[j].count {
+				return sorted[i].count > sorted[j].count
+			}
+			if sorted[i].firstAt != sorted[j].firstAt {
+				return sorted[i].firstAt < sorted[j].firstAt
+			}
+			return sorted[i].memoId < sorted[j].memoId
+		})
+		rows := &memRows{columns: 3}
+		for _, g := range sorted {
+			rows.rows = append(rows.rows, []driver.Value{int64(g.memoId), int64(g.count), g.firstAt})
+		}
+		return rows
+	}},
+	"SELECT reason FROM memo_reports WHERE memo_id=? AND status='open' ORDER BY created_at": {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		memoId := argInt(args[0])
+		rows := &memRows{columns: 1}
+		for _, r := range s.reports {
+			if r.memoId == memoId && r.status == "open" {
+				rows.rows = append(rows.rows, []driver.Value{r.reason})
+			}
+		}
+		return rows
+	}},
+
+	insertRefreshTokenSQL: {args: 3, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		hash := argString(args[0])
+		if _, ok := s.refreshTokens[hash]; ok {
+			return nil, memDuplicate("%q for key 'PRIMARY'", hash)
+		}
+		s.refreshTokens[hash] = memRefreshToken{userId: argInt(args[1]), expiresAt: argString(args[2])}
+		undo(func() { delete(s.refreshTokens, hash) })
+		return memResult{affected: 1}, nil
+	}},
+	selectRefreshTokenSQL: {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		rows := &memRows{columns: 2}
+		if t, ok := s.refreshTokens[argString(args[0])]; ok {
+			rows.rows = append(rows.rows, []driver.Value{int64(t.userId), t.expiresAt})
+		}
+		return rows
+	}},
+	deleteRefreshTokenSQL: {args: 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		hash := argString(args[0])
+		old, ok := s.refreshTokens[hash]
+		if !ok {
+			return memResult{}, nil
+		}
+		delete(s.refreshTokens, hash)
+		undo(func() { s.refreshTokens[hash] = old })
+		return memResult{affected: 1}, nil
+	}},
+	sweepRefreshTokensSQL: {args: 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		before := argString(args[0])
+		var n int64
+		for hash, old := range s.refreshTokens {
+			if old.expiresAt < before {
+				hash, old := hash, old
+				delete(s.refreshTokens, hash)
+				undo(func() { s.refreshTokens[hash] = old })
+				n++
+			}
+		}
+		return memResult{affected: n}, nil
+	}},
+
+	listAttachmentsSQL: {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		memoId := argInt(args[0])
+		ids := make([]int, 0)
+		for id, a := range s.attachments {
+			if a.memoId == memoId {
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+		rows := &memRows{columns: 8}
+		for _, id := range ids {
+			rows.rows = append(rows.rows, attachmentRow(id, s.attachments[id]))
+		}
+		return rows
+	}},
+	getAttachmentSQL: {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		rows := &memRows{columns: 8}
+		id := argInt(args[0])
+		if a, ok := s.attachments[id]; ok {
+			rows.rows = append(rows.rows, attachmentRow(id, a))
+		}
+		return rows
+	}},
+	insertAttachmentSQL: {args: 6, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		last := s.lastAttach
+		s.lastAttach++
+		id := s.lastAttach
+		s.attachments[id] = memAttachment{
+			memoId:      argInt(args[0]),
+			userId:      argInt(args[1]),
+			key:         argString(args[2]),
+			filename:    argString(args[3]),
+			contentType: argString(args[4]),
+			size:        argInt(args[5]),
+		}
+		undo(func() {
+			delete(s.attachments, id)
+			s.lastAttach = last
+		})
+		return memResult{id: int64(id), affected: 1}, nil
+	}},
+	updateAttachmentVariantsSQL: {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[1])
+		old, ok := s.attachments[id]
+		if !ok {
+			return memResult{}, nil
+		}
+		a := old
+		a.variants = argString(args[0])
+		s.attachments[id] = a
+		undo(func() { s.attachments[id] = old })
+		return memResult{affected: 1}, nil
+	}},
+	deleteMemoAttachmentsSQL: {args: 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		memoId := argInt(args[0])
+		var n int64
+		for id, a := range s.attachments {
+			if a.memoId == memoId {
+				id, a := id, a
+				delete(s.attachments, id)
+				undo(func() { s.attachments[id] = a })
+				n++
+			}
+		}
+		return memResult{affected: n}, nil
+	}},
+	deleteAttachmentSQL: {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[0])
+		old, ok := s.attachments[id]
+		if !ok || old.userId != argInt(args[1]) {
+			return memResult{}, nil
+		}
+		delete(s.attachments, id)
+		undo(func() { s.attachments[id] = old })
+		return memResult{affected: 1}, nil
+	}},
+
+	listMemoTemplatesSQL: {args: 1, query: func(s *memStore, args []driver.Value) *memRows {
+		userId := argInt(args[0])
+		ids := make([]int, 0)
+		for id, t := range s.templates {
+			if t.userId == userId {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return s.templates[ids[i]].name < s.templates[ids[j]].name })
+		rows := &memRows{columns: 3}
+		for _, id := range ids {
+			rows.rows = append(rows.rows, []driver.Value{int64(id), s.templates[id].name, s.templates[id].content})
+		}
+		return rows
+	}},
+	getMemoTemplateSQL: {args: 2, query: func(s *memStore, args []driver.Value) *memRows {
+		rows := &memRows{columns: 3}
+		id := argInt(args[0])
+		if t, ok := s.templates[id]; ok && t.userId == argInt(args[1]) {
+			rows.rows = append(rows.rows, []driver.Value{int64(id), t.name, t.content})
+		}
+		return rows
+	}},
+	insertMemoTemplateSQL: {args: 3, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		userId, name := argInt(args[0]), argString(args[1])
+		for _, t := range s.templates {
+			if t.userId == userId && strings.EqualFold(t.name, name) {
+				return nil, memDuplicate("'%d-%s' for key 'user_name'", userId, name)
+			}
+		}
+		last := s.lastTemplate
+		s.lastTemplate++
+		id := s.lastTemplate
+		s.templates[id] = memMemoTemplate{userId: userId, name: name, content: argString(args[2])}
+		undo(func() {
+			delete(s.templates, id)
+			s.lastTemplate = last
+		})
+		return memResult{id: int64(id), affected: 1}, nil
+	}},
+	updateMemoTemplateSQL: {args: 4, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[2])
+		old, ok := s.templates[id]
+		if !ok || old.userId != argInt(args[3]) {
+			return memResult{}, nil
+		}
+		s.templates[id] = memMemoTemplate{userId: old.userId, name: argString(args[0]), content: argString(args[1])}
+		undo(func() { s.templates[id] = old })
+		return memResult{affected: 1}, nil
+	}},
+	deleteMemoTemplateSQL: {args: 2, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		id := argInt(args[0])
+		old, ok := s.templates[id]
+		if !ok || old.userId != argInt(args[1]) {
+			return memResult{}, nil
+		}
+		delete(s.templates, id)
+		undo(func() { s.templates[id] = old })
+		return memResult{affected: 1}, nil
+	}},
+
+	"SELECT memo_id, TIMESTAMPDIFF(HOUR, hour, now()), views FROM memo_views WHERE hour >= now() - INTERVAL 7 DAY": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		now, _ := parseDBTime(s.now())
+		rows := &memRows{columns: 3}
+		for key, views := range s.views {
+			hour, err := parseDBTime(key.hour)
+			if err != nil || hour.Before(now.AddDate(0, 0, -7)) {
+				continue
+			}
+			rows.rows = append(rows.rows, []driver.Value{int64(key.memoId), int64(now.Sub(hour) / time.Hour), int64(views)})
+		}
+		return rows
+	}},
+	"INSERT INTO memo_visitors (memo_id, day, registers, visitors) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE registers=VALUES(registers), visitors=VALUES(visitors)": {args: 4, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		key := memVisitorKey{memoId: argInt(args[0]), day: argString(args[1])}
+		old, ok := s.visitors[key]
+		s.visitors[key] = memVisitors{registers: argBytes(args[2]), visitors: argInt(args[3])}
+		undo(func() {
+			if ok {
+				s.visitors[key] = old
+			} else {
+				delete(s.visitors, key)
+			}
+		})
+		return memResult{affected: 1}, nil
+	}},
+	"SELECT memo_id, DATE_FORMAT(day, '%Y-%m-%d'), registers, visitors FROM memo_visitors": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		rows := &memRows{columns: 4}
+		for key, v := range s.visitors {
+			rows.rows = append(rows.rows, []driver.Value{int64(key.memoId), key.day, v.registers, int64(v.visitors)})
+		}
+		return rows
+	}},
+
+	"SELECT message FROM site_banner WHERE id=1": {args: 0, query: func(s *memStore, args []driver.Value) *memRows {
+		rows := &memRows{columns: 1}
+		if s.banner != nil {
+			rows.rows = append(rows.rows, []driver.Value{*s.banner})
+		}
+		return rows
+	}},
+	"INSERT INTO site_banner (id, message, updated_at) VALUES (1, ?, now()) ON DUPLICATE KEY UPDATE message=VALUES(message), updated_at=now()": {args: 1, exec: func(s *memStore, args []driver.Value, undo func(func())) (driver.Result, error) {
+		old := s.banner
+		message := argString(args[0])
+		s.banner = &message
+		undo(func() { s.banner = old })
+		return memResult{affected: 1}, nil
+	}},
+}
+
+// pairRows lists a two-column key table in key order.
+func pairRows(pairs map[[2]int]bool) *memRows {
+	keys := make([][2]int, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	rows := &memRows{columns: 2}
+	for _, key := range keys {
+		rows.rows = append(rows.rows, []driver.Value{int64(key[0]), int64(key[1])})
+	}
+	return rows
+}
+
+func insertPair(pairs map[[2]int]bool, key [2]int, undo func(func())) driver.Result {
+	if pairs[key] {
+		return memResult{}
+	}
+	pairs[key] = true
+	undo(func() { delete(pairs, key) })
+	return memResult{affected: 1}
+}
+
+func deletePair(pairs map[[2]int]bool, key [2]int, undo func(func())) driver.Result {
+	if !pairs[key] {
+		return memResult{}
+	}
+	delete(pairs, key)
+	undo(func() { pairs[key] = true })
+	return memResult{affected: 1}
+}
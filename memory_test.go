@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemorySeedDeterministic(t *testing.T) {
+	seed := memorySeed{Seed: 42, Users: 10, Memos: 50}
+	a, b := newMemStore(), newMemStore()
+	a.seed(seed)
+	b.seed(seed)
+	if !reflect.DeepEqual(a.users, b.users) || !reflect.DeepEqual(a.memos, b.memos) || !reflect.DeepEqual(a.follows, b.follows) {
+		t.Fatalf("the same seed gave different data")
+	}
+	seed.Seed++
+	c := newMemStore()
+	c.seed(seed)
+	if reflect.DeepEqual(a.memos, c.memos) {
+		t.Errorf("a different seed gave the same memos")
+	}
+	if len(a.users) != 10 || len(a.memos) != 50 {
+		t.Errorf("seeded %d users and %d memos, want 10 and 50", len(a.users), len(a.memos))
+	}
+	if user := a.users[3]; passwordHash(user.Salt, "user3") != user.Password {
+		t.Errorf("user3 cannot sign in with its name as password")
+	}
+}
+
+func openTestMemoryDB(t *testing.T, seed memorySeed) *sql.DB {
+	dsn := seed.dsn()
+	forgetMemoryStore(dsn)
+	db, err := sql.Open(memoryDriverName, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		forgetMemoryStore(dsn)
+	})
+	return db
+}
+
+func TestMemoryRollback(t *testing.T) {
+	db := openTestMemoryDB(t, memorySeed{Seed: 1, Users: 2, Memos: 3})
+	ctx := context.Background()
+	err := withTx(ctx, db, func(tx *sql.Tx) error {
+		if _, err := execSQL(ctx, tx, "INSERT INTO memos (user, content, visibility, team_id, hidden, created_at) VALUES (?, ?, ?, ?, ?, now())", 1, "# rolled back", "public", nil, false); err != nil {
+			return err
+		}
+		return assignSlug(ctx, tx, 4, "# rolled back")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadMemo(ctx, db, 4); err != nil {
+		t.Fatalf("committed memo: %s", err)
+	}
+
+	err = withTx(ctx, db, func(tx *sql.Tx) error {
+		if _, err := moderateMemo(ctx, tx, 4, moderationActions["lock"], "spam"); err != nil {
+			return err
+		}
+		_, err := execSQL(ctx, tx, "UPDATE memos SET slug=? WHERE id=?", "rolled-back", 1)
+		return err
+	})
+	if err == nil {
+		t.Fatalf("duplicate slug was accepted")
+	}
+	memo, err := loadMemo(ctx, db, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memo.Locked || memo.Version != 0 {
+		t.Errorf("lock survived the rollback: %+v", memo)
+	}
+}
+
+func TestMemoryUnsupportedQuery(t *testing.T) {
+	db := openTestMemoryDB(t, memorySeed{Seed: 1})
+	if _, err := db.Exec("DROP TABLE memos"); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("err = %v, want unsupported query", err)
+	}
+}
+
+// sqlStatementRe matches the start of the statements the app sends.
+var sqlStatementRe = regexp.MustCompile(`^(SELECT|INSERT|UPDATE|DELETE|REPLACE|SHOW)\s`)
+
+// TestMemoryStatementsComplete finds every statement in the package's
+// source that is a constant, literals and named constants joined with +,
+// and checks that the memory driver knows it; the driver only takes exact
+// strings, so a statement changed in one place fails here rather than in
+// whichever test first runs it. Statements built at run time are not
+// constants and are left to the tests that run them.
+func TestMemoryStatementsComplete(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consts := make(map[string]ast.Expr)
+	var files []*ast.File
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			files = append(files, f)
+			for _, decl := range f.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.CONST {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					vs := spec.(*ast.ValueSpec)
+					for i, name := range vs.Names {
+						if i < len(vs.Values) {
+							consts[name.Name] = vs.Values[i]
+						}
+					}
+				}
+			}
+		}
+	}
+	var constString func(e ast.Expr) (string, bool)
+	constString = func(e ast.Expr) (string, bool) {
+		switch e := e.(type) {
+		case *ast.BasicLit:
+			if e.Kind == token.STRING {
+				s, err := strconv.Unquote(e.Value)
+				return s, err == nil
+			}
+		case *ast.Ident:
+			if v, ok := consts[e.Name]; ok {
+				return constString(v)
+			}
+		case *ast.ParenExpr:
+			return constString(e.X)
+		case *ast.BinaryExpr:
+			x, ok := constString(e.X)
+			y, ok2 := constString(e.Y)
+			return x + y, e.Op == token.ADD && ok && ok2
+		}
+		return "", false
+	}
+
+	checked := 0
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n.(type) {
+			case *ast.BasicLit, *ast.BinaryExpr:
+			default:
+				return true
+			}
+			// A statement joined at run time is skipped whole: its
+			// constant first part is not a statement of its own.
+			query, ok := constString(n.(ast.Expr))
+			if ok && sqlStatementRe.MatchString(query) {
+				checked++
+				if _, ok := memoryStatements[query]; !ok {
+					t.Errorf("%s: the memory driver lacks %q", fset.Position(n.Pos()), query)
+				}
+			}
+			return false
+		})
+	}
+	if checked < 50 {
+		t.Errorf("only %d statements found", checked)
+	}
+}
+
+// memoryApp is the router serving a memory database, with a client
+// signed in as user1.
+type memoryApp struct {
+	*httptest.Server
+	client *http.Client
+	sid    string
+}
+
+func startMemoryApp(tb testing.TB, seed memorySeed) *memoryApp {
+	c, pool, dir := config, dbConnPool, sessionFile
+	tb.Cleanup(func() {
+		config, dbConnPool, sessionFile = c, pool, dir
+	})
+	config = &Config{RateLimits: RateLimitConfig{MemoPerUser: 1 << 20, MemoPerIP: 1 << 20}}
+	config.BodyLimits.setDefaults()
+	setupRateLimits(config.RateLimits)
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	sessionFile = dir
+
+	dsn := seed.dsn()
+	forgetMemoryStore(dsn)
+	db, err := sql.Open(memoryDriverName, dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dbConnPool = make(chan *sql.DB, 1)
+	dbConnPool <- db
+	// Memo ids start over with every data set.
+	memoHTMLCache.Purge()
+	if err := initialize(db); err != nil {
+		tb.Fatal(err)
+	}
+	app := &memoryApp{Server: httptest.NewServer(newRouter())}
+	tb.Cleanup(func() {
+		app.Close()
+		db.Close()
+		forgetMemoryStore(dsn)
+		empty := memorySeed{}
+		db, _ := sql.Open(memoryDriverName, empty.dsn())
+		initialize(db)
+		db.Close()
+	})
+
+	return app.signIn(tb, "user1")
+}
+
+// signIn returns a client of app's server signed in as username, whose
+// password is the same in the seeded data.
+func (app *memoryApp) signIn(tb testing.TB, username string) *memoryApp {
+	jar, _ := cookiejar.New(nil)
+	as := &memoryApp{Server: app.Server, client: &http.Client{Jar: jar}}
+	res, err := as.client.PostForm(as.URL+"/signin", url.Values{"username": {username}, "password": {username}})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Request.URL.Path != "/mypage" {
+		tb.Fatalf("signin ended at %s, want /mypage", res.Request.URL.Path)
+	}
+	sid := regexp.MustCompile(`name="sid" value="([0-9a-f]+)"`).FindStringSubmatch(as.get(tb, "/mypage"))
+	if sid == nil {
+		tb.Fatalf("mypage has no sid")
+	}
+	as.sid = sid[1]
+	return as
+}
+
+func (app *memoryApp) get(tb testing.TB, path string) string {
+	res, err := app.client.Get(app.URL + path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		tb.Fatalf("GET %s: %d", path, res.StatusCode)
+	}
+	return string(body)
+}
+
+// post submits form, with the CSRF token added, and returns the
+// response after redirects.
+func (app *memoryApp) post(tb testing.TB, path string, form url.Values) *http.Response {
+	form.Set("sid", app.sid)
+	res, err := app.client.PostForm(app.URL+path, form)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func (app *memoryApp) postMemo(tb testing.TB, form url.Values) *http.Response {
+	return app.post(tb, "/memo", form)
+}
+
+// TestMemoryHandlerStack signs in and posts a memo through the router
+// with the memory database behind it.
+func TestMemoryHandlerStack(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 7, Users: 5, Memos: 40})
+	if top := app.get(t, "/"); !strings.Contains(top, "memo") {
+		t.Errorf("top page has no memos")
+	}
+	res := app.postMemo(t, url.Values{
+		"content":    {"# Posted in memory\n\nhello"},
+		"visibility": {"public"},
+	})
+	if path := res.Request.URL.Path; path != "/memo/41-posted-in-memory" {
+		t.Fatalf("post ended at %s", path)
+	}
+	if page := app.get(t, "/memo/41-posted-in-memory"); !strings.Contains(page, "hello") {
+		t.Errorf("memo page does not show the memo")
+	}
+	if mine := app.get(t, "/mypage"); !strings.Contains(mine, "Posted in memory") {
+		t.Errorf("mypage does not list the memo")
+	}
+}
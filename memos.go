@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// memoColumns is the column list every memo query selects, in the order
+// queryMemos scans them.
+const memoColumns = "id, user, content, visibility, created_at, updated_at, version, IFNULL(slug, ''), hidden, IFNULL(team_id, 0), locked, IFNULL(moderation_note, '')"
+
+// listedCond selects the memos that Memo.Listed accepts.
+const listedCond = "visibility='public' AND hidden=0"
+
+// dbTimeLayout is how MySQL returns DATETIME values to a connection
+// without parseTime.
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+// dbLocation is the zone DATETIME values are stored in, from
+// Config.Timezone. Times are shown to users in the same zone.
+var dbLocation = time.Local
+
+func parseDBTime(s string) (time.Time, error) {
+	return time.ParseInLocation(dbTimeLayout, s, dbLocation)
+}
+
+// formatDBTime formats t for a DATETIME comparison or the page.
+func formatDBTime(t time.Time) string {
+	return t.In(dbLocation).Format(dbTimeLayout)
+}
+
+const (
+	memoShardCount = 64
+	titleMaxRunes  = 80
+	wordsPerMinute = 200
+	cjkPerMinute   = 500
+)
+
+var (
+	markdownLinkRe   = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	markdownPrefixRe = regexp.MustCompile(`^\s*(#{1,6}\s+|>\s*|[-*+]\s+|\d+\.\s+)`)
+	markdownMarkRe   = regexp.MustCompile("[*_`~]+")
+)
+
+// MemoCache holds every memo keyed by id. The map is split into shards
+// guarded by their own lock so that readers and the occasional writer
+// only contend when they touch the same shard. indexes keeps the same
+// memos in the order the lists show them.
+type MemoCache struct {
+	shards  [memoShardCount]*memoShard
+	indexes *memoIndexes
+}
+
+// Each shard counts its own lookups so that the counters don't become
+// the one place every reader contends on.
+type memoShard struct {
+	hits   int64
+	misses int64
+	sync.RWMutex
+	memos map[int]*Memo
+}
+
+func NewMemoCache() *MemoCache {
+	c := &MemoCache{indexes: newMemoIndexes()}
+	for i := range c.shards {
+		c.shards[i] = &memoShard{memos: make(map[int]*Memo)}
+	}
+	return c
+}
+
+// newMemoCacheOf builds a cache holding memos, to be swapped in with
+// Replace.
+func newMemoCacheOf(memos Memos) *MemoCache {
+	c := NewMemoCache()
+	for _, memo := range memos {
+		c.shard(memo.Id).memos[memo.Id] = memo
+	}
+	c.indexes.build(memos)
+	return c
+}
+
+func (c *MemoCache) shard(id int) *memoShard {
+	return c.shards[uint(id)%memoShardCount]
+}
+
+func (c *MemoCache) Get(id int) (*Memo, bool) {
+	s := c.shard(id)
+	s.RLock()
+	memo, ok := s.memos[id]
+	s.RUnlock()
+	if ok {
+		atomic.AddInt64(&s.hits, 1)
+	} else {
+		atomic.AddInt64(&s.misses, 1)
+	}
+	return memo, ok
+}
+
+// Put and Delete update the indexes under the shard lock, so two writes
+// of one memo reach both in the same order.
+func (c *MemoCache) Put(memo *Memo) {
+	s := c.shard(memo.Id)
+	s.Lock()
+	old := s.memos[memo.Id]
+	s.memos[memo.Id] = memo
+	c.indexes.put(old, memo)
+	s.Unlock()
+}
+
+func (c *MemoCache) Delete(id int) {
+	s := c.shard(id)
+	s.Lock()
+	if old, ok := s.memos[id]; ok {
+		delete(s.memos, id)
+		c.indexes.remove(old)
+	}
+	s.Unlock()
+}
+
+// ByUser returns the author's memos, newest first. The slice is shared
+// and must not be modified.
+func (c *MemoCache) ByUser(userId int) Memos {
+	return c.indexes.userMemos(userId)
+}
+
+// Listed returns every listed memo, newest first. The slice is shared and
+// must not be modified.
+func (c *MemoCache) Listed() Memos {
+	return c.indexes.listedMemos()
+}
+
+func (c *MemoCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.RLock()
+		n += len(s.memos)
+		s.RUnlock()
+	}
+	return n
+}
+
+// Stats sums the shards' lookup counters. Nothing is ever evicted.
+func (c *MemoCache) Stats() CacheStats {
+	st := CacheStats{Name: "memo"}
+	for _, s := range c.shards {
+		st.Hits += atomic.LoadInt64(&s.hits)
+		st.Misses += atomic.LoadInt64(&s.misses)
+		s.RLock()
+		st.Entries += len(s.memos)
+		s.RUnlock()
+	}
+	return st
+}
+
+// Replace swaps in the contents of src. All shards are locked while the
+// maps are exchanged so readers never observe a half-replaced cache.
+func (c *MemoCache) Replace(src *MemoCache) {
+	for _, s := range c.shards {
+		s.Lock()
+	}
+	for i, s := range c.shards {
+		s.memos = src.shards[i].memos
+	}
+	c.indexes.replace(src.indexes)
+	for _, s := range c.shards {
+		s.Unlock()
+	}
+}
+
+// Each calls f for every cached memo, one shard at a time.
+func (c *MemoCache) Each(f func(*Memo)) {
+	for _, s := range c.shards {
+		s.RLock()
+		for _, memo := range s.memos {
+			f(memo)
+		}
+		s.RUnlock()
+	}
+}
+
+// Visibility controls who can see a memo and whether it appears in the
+// public lists.
+type Visibility string
+
+const (
+	visibilityPublic    Visibility = "public"
+	visibilityUnlisted  Visibility = "unlisted"
+	visibilityFollowers Visibility = "followers"
+	visibilityPrivate   Visibility = "private"
+	visibilityTeam      Visibility = "team"
+)
+
+func (v Visibility) valid() bool {
+	switch v {
+	case visibilityPublic, visibilityUnlisted, visibilityFollowers, visibilityPrivate, visibilityTeam:
+		return true
+	}
+	return false
+}
+
+// visibilityFromForm reads the visibility field, falling back to the old
+// is_private checkbox for forms that predate it.
+func visibilityFromForm(r *http.Request) (Visibility, error) {
+	v := Visibility(r.FormValue("visibility"))
+	if v == "" {
+		if r.FormValue("is_private") == "1" {
+			return visibilityPrivate, nil
+		}
+		return visibilityPublic, nil
+	}
+	if !v.valid() {
+		return "", validationError("invalid visibility")
+	}
+	return v, nil
+}
+
+// Listed reports whether memo belongs in the public lists.
+func (memo *Memo) Listed() bool {
+	return memo.Visibility == visibilityPublic && !memo.Hidden
+}
+
+// memoTitle derives a plain-text title from the first line of content.
+func memoTitle(content string) string {
+	line := content
+	if i := strings.IndexAny(line, "\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	line = markdownPrefixRe.ReplaceAllString(line, "")
+	line = markdownLinkRe.ReplaceAllString(line, "$1")
+	line = markdownMarkRe.ReplaceAllString(line, "")
+	line = strings.TrimSpace(line)
+	if utf8.RuneCountInString(line) > titleMaxRunes {
+		line = string([]rune(line)[:titleMaxRunes-1]) + "…"
+	}
+	return line
+}
+
+// countWords counts space-separated words, treating each CJK character as
+// a word of its own since those scripts don't separate words with spaces.
+func countWords(content string) (words, cjk int) {
+	inWord := false
+	for _, r := range content {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana):
+			cjk++
+			inWord = false
+		case unicode.IsSpace(r) || unicode.IsPunct(r):
+			inWord = false
+		default:
+			if !inWord {
+				words++
+			}
+			inWord = true
+		}
+	}
+	return words, cjk
+}
+
+// prepareMemo fills in the fields derived from a memo's row, including the
+// rendered content, so that they are computed once per write rather than
+// on every request.
+func prepareMemo(memo *Memo) {
+	memo.Username = userCache.Username(memo.User)
+	memo.Title = memoTitle(memo.Content)
+	memo.Chars = utf8.RuneCountInString(memo.Content)
+	words, cjk := countWords(memo.Content)
+	memo.Words = words + cjk
+	if memo.Words > 0 {
+		memo.ReadMins = (words*cjkPerMinute+cjk*wordsPerMinute)/(wordsPerMinute*cjkPerMinute) + 1
+	}
+}
+
+// canView reports whether user (nil when signed out) may see memo.
+// Unlisted memos are viewable by anyone with the URL; hidden memos only
+// by their author, who sees nothing different.
+func canView(user *User, memo *Memo) bool {
+	if memo.Hidden {
+		return user != nil && user.Id == memo.User
+	}
+	switch memo.Visibility {
+	case visibilityPublic, visibilityUnlisted:
+		return true
+	case visibilityFollowers:
+		return user != nil && (user.Id == memo.User || follows.Following(user.Id, memo.User))
+	case visibilityTeam:
+		return user != nil && (user.Id == memo.User || teams.Member(memo.Team, user.Id))
+	}
+	return user != nil && user.Id == memo.User
+}
+
+// findMemo returns the cached memo id if user may see it. Memos user may
+// not see are reported as missing rather than forbidden.
+func findMemo(user *User, id int) (*Memo, error) {
+	memo, ok := memoCache.Get(id)
+	if !ok || !canView(user, memo) {
+		return nil, notFoundError("")
+	}
+	return memo, nil
+}
+
+// scanMemo reads one row of memoColumns. DATETIME columns come back as
+// strings and are parsed here, once, in dbLocation.
+func scanMemo(scan func(dest ...interface{}) error) (*Memo, error) {
+	memo := &Memo{}
+	var createdAt, updatedAt string
+	if err := scan(&memo.Id, &memo.User, &memo.Content, &memo.Visibility, &createdAt, &updatedAt, &memo.Version, &memo.Slug, &memo.Hidden, &memo.Team, &memo.Locked, &memo.ModerationNote); err != nil {
+		return nil, err
+	}
+	var err error
+	if memo.CreatedAt, err = parseDBTime(createdAt); err != nil {
+		return nil, err
+	}
+	if memo.UpdatedAt, err = parseDBTime(updatedAt); err != nil {
+		return nil, err
+	}
+	return memo, nil
+}
+
+// queryMemos runs a query selecting memoColumns and returns the scanned memos.
+func queryMemos(ctx context.Context, dbConn querier, query string, args ...interface{}) (memos Memos, err error) {
+	ctx, span := startSQLSpan(ctx, query, args...)
+	defer func() { span.Finish(err) }()
+
+	rows, err := dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memos = make(Memos, 0)
+	for rows.Next() {
+		memo, err := scanMemo(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		prepareMemo(memo)
+		memos = append(memos, memo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return memos, nil
+}
+
+func queryCount(ctx context.Context, dbConn querier, query string, args ...interface{}) (count int, err error) {
+	ctx, span := startSQLSpan(ctx, query, args...)
+	defer func() { span.Finish(err) }()
+
+	err = dbConn.QueryRowContext(ctx, query, args...).Scan(&count)
+	return count, err
+}
+
+func loadMemo(ctx context.Context, dbConn querier, id int64) (memo *Memo, err error) {
+	query := "SELECT " + memoColumns + " FROM memos WHERE id=?"
+	ctx, span := startSQLSpan(ctx, query, id)
+	defer func() { span.Finish(err) }()
+
+	memo, err = scanMemo(dbConn.QueryRowContext(ctx, query, id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, &AppError{Kind: KindNotFound, Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	prepareMemo(memo)
+	return memo, nil
+}
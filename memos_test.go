@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const benchMemoCount = 20000
+
+type memoCacher interface {
+	Get(id int) (*Memo, bool)
+	Put(memo *Memo)
+}
+
+// lockedMemoCache is a single map behind a single lock.
+type lockedMemoCache struct {
+	sync.RWMutex
+	memos map[int]*Memo
+}
+
+func (c *lockedMemoCache) Get(id int) (*Memo, bool) {
+	c.RLock()
+	memo, ok := c.memos[id]
+	c.RUnlock()
+	return memo, ok
+}
+
+func (c *lockedMemoCache) Put(memo *Memo) {
+	c.Lock()
+	c.memos[memo.Id] = memo
+	c.Unlock()
+}
+
+// snapshotMemoCache never mutates a published map; writers copy it and swap
+// the pointer, so readers take no lock at all.
+type snapshotMemoCache struct {
+	mu      sync.Mutex
+	current atomic.Value
+}
+
+func (c *snapshotMemoCache) Get(id int) (*Memo, bool) {
+	memo, ok := c.current.Load().(map[int]*Memo)[id]
+	return memo, ok
+}
+
+func (c *snapshotMemoCache) Put(memo *Memo) {
+	c.mu.Lock()
+	old := c.current.Load().(map[int]*Memo)
+	next := make(map[int]*Memo, len(old)+1)
+	for k, v := range old {
+		next[k] = v
+	}
+	next[memo.Id] = memo
+	c.current.Store(next)
+	c.mu.Unlock()
+}
+
+func fillMemoCache(c memoCacher) {
+	for i := 1; i <= benchMemoCount; i++ {
+		c.Put(&Memo{Id: i})
+	}
+}
+
+// benchmarkMemoCache issues one write per writeEvery operations.
+func benchmarkMemoCache(b *testing.B, c memoCacher, writeEvery int) {
+	fillMemoCache(c)
+	var seq int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := int(atomic.AddInt64(&seq, 1))
+			id := n%benchMemoCount + 1
+			if n%writeEvery == 0 {
+				c.Put(&Memo{Id: id})
+			} else if _, ok := c.Get(id); !ok {
+				b.Fatalf("memo %d not found", id)
+			}
+		}
+	})
+}
+
+func newSnapshotMemoCache() *snapshotMemoCache {
+	c := &snapshotMemoCache{}
+	c.current.Store(make(map[int]*Memo))
+	return c
+}
+
+func BenchmarkMemoCacheLockedReadOnly(b *testing.B) {
+	benchmarkMemoCache(b, &lockedMemoCache{memos: make(map[int]*Memo)}, 1<<62)
+}
+
+func BenchmarkMemoCacheShardedReadOnly(b *testing.B) {
+	benchmarkMemoCache(b, NewMemoCache(), 1<<62)
+}
+
+func BenchmarkMemoCacheSnapshotReadOnly(b *testing.B) {
+	benchmarkMemoCache(b, newSnapshotMemoCache(), 1<<62)
+}
+
+func BenchmarkMemoCacheLockedMixed(b *testing.B) {
+	benchmarkMemoCache(b, &lockedMemoCache{memos: make(map[int]*Memo)}, 100)
+}
+
+func BenchmarkMemoCacheShardedMixed(b *testing.B) {
+	benchmarkMemoCache(b, NewMemoCache(), 100)
+}
+
+func BenchmarkMemoCacheSnapshotMixed(b *testing.B) {
+	benchmarkMemoCache(b, newSnapshotMemoCache(), 100)
+}
+
+func TestMemoCache(t *testing.T) {
+	c := NewMemoCache()
+	for i := 1; i <= 1000; i++ {
+		c.Put(&Memo{Id: i, Content: "memo"})
+	}
+	if n := c.Len(); n != 1000 {
+		t.Fatalf("Len() = %d, want 1000", n)
+	}
+	if memo, ok := c.Get(500); !ok || memo.Id != 500 {
+		t.Fatalf("Get(500) = %v, %v", memo, ok)
+	}
+	c.Delete(500)
+	if _, ok := c.Get(500); ok {
+		t.Fatal("memo 500 still cached after Delete")
+	}
+	if n := c.Len(); n != 999 {
+		t.Fatalf("Len() = %d, want 999", n)
+	}
+}
+
+func TestMemoTitle(t *testing.T) {
+	long := strings.Repeat("あ", titleMaxRunes+10)
+	tests := []struct {
+		content, want string
+	}{
+		{"hello\nworld", "hello"},
+		{"# Heading\nbody", "Heading"},
+		{"  - **bold** item\r\n", "bold item"},
+		{"see [the docs](http://example.com/)", "see the docs"},
+		{"", ""},
+		{long, strings.Repeat("あ", titleMaxRunes-1) + "…"},
+	}
+	for _, tt := range tests {
+		if got := memoTitle(tt.content); got != tt.want {
+			t.Errorf("memoTitle(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestPrepareMemoStats(t *testing.T) {
+	memo := &Memo{Content: "hello, world\nこんにちは"}
+	prepareMemo(memo)
+	if memo.Chars != 18 {
+		t.Errorf("Chars = %d, want 18", memo.Chars)
+	}
+	if memo.Words != 7 {
+		t.Errorf("Words = %d, want 7", memo.Words)
+	}
+	if memo.ReadMins != 1 {
+		t.Errorf("ReadMins = %d, want 1", memo.ReadMins)
+	}
+
+	memo = &Memo{Content: strings.Repeat("word ", 450)}
+	prepareMemo(memo)
+	if memo.ReadMins != 3 {
+		t.Errorf("ReadMins = %d, want 3", memo.ReadMins)
+	}
+}
+
+func TestCanView(t *testing.T) {
+	author := &User{Id: 1}
+	other := &User{Id: 2}
+	tests := []struct {
+		visibility          Visibility
+		anon, other, author bool
+	}{
+		{visibilityPublic, true, true, true},
+		{visibilityUnlisted, true, true, true},
+		{visibilityFollowers, false, false, true},
+		{visibilityPrivate, false, false, true},
+	}
+	for _, tt := range tests {
+		memo := &Memo{User: author.Id, Visibility: tt.visibility}
+		if got := canView(nil, memo); got != tt.anon {
+			t.Errorf("%s: canView(anonymous) = %v", tt.visibility, got)
+		}
+		if got := canView(other, memo); got != tt.other {
+			t.Errorf("%s: canView(other) = %v", tt.visibility, got)
+		}
+		if got := canView(author, memo); got != tt.author {
+			t.Errorf("%s: canView(author) = %v", tt.visibility, got)
+		}
+		if memo.Listed() != (tt.visibility == visibilityPublic) {
+			t.Errorf("%s: Listed() = %v", tt.visibility, memo.Listed())
+		}
+	}
+}
+
+func TestMemoSlug(t *testing.T) {
+	tests := []struct {
+		title, want string
+	}{
+		{"My First Note", "my-first-note"},
+		{"  Hello, World!! ", "hello-world"},
+		{"日本語 のメモ", "日本語-のメモ"},
+		{"!!!", ""},
+		{strings.Repeat("a", slugMaxRunes+5), strings.Repeat("a", slugMaxRunes)},
+	}
+	for _, tt := range tests {
+		if got := memoSlug(tt.title); got != tt.want {
+			t.Errorf("memoSlug(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+
+	memo := &Memo{Id: 12, Slug: "メモ"}
+	if got, want := memo.Path(), "/memo/12-%E3%83%A1%E3%83%A2"; got != want {
+		t.Errorf("Path() = %q, want %q", got, want)
+	}
+	for _, ref := range []string{"12", "12-my-first-note"} {
+		if id, err := parseMemoRef(ref); err != nil || id != 12 {
+			t.Errorf("parseMemoRef(%q) = %d, %v", ref, id, err)
+		}
+	}
+}
+
+// TestAssignSlug posts memo 5 titled "Note 7", which takes the slug
+// "note-7", then memos 6 and 7 titled "Note".
+func TestAssignSlug(t *testing.T) {
+	db := openTestMemoryDB(t, memorySeed{Seed: 2, Users: 1, Memos: 4})
+	ctx := context.Background()
+	for _, content := range []string{"# Note 7", "# Note", "# Note"} {
+		err := withTx(ctx, db, func(tx *sql.Tx) error {
+			res, err := execSQL(ctx, tx, "INSERT INTO memos (user, content, visibility, team_id, hidden, created_at) VALUES (?, ?, ?, ?, ?, now())", 1, content, "public", nil, false)
+			if err != nil {
+				return err
+			}
+			id, _ := res.LastInsertId()
+			return assignSlug(ctx, tx, id, content)
+		})
+		if err != nil {
+			t.Fatalf("%q: %s", content, err)
+		}
+	}
+	for id, want := range map[int64]string{5: "note-7", 6: "note", 7: ""} {
+		if memo, err := loadMemo(ctx, db, id); err != nil || memo.Slug != want {
+			t.Errorf("memo %d has slug %q (%v), want %q", id, memo.Slug, err, want)
+		}
+	}
+}
+
+// TestConcurrentSlugs posts memos with the same title at once, which all
+// have to go in.
+func TestConcurrentSlugs(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 3, Users: 4})
+	clients := []*memoryApp{app, app.signIn(t, "user2"), app.signIn(t, "user3"), app.signIn(t, "user4")}
+	codes := make([]int, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *memoryApp) {
+			defer wg.Done()
+			codes[i] = c.postMemo(t, url.Values{"content": {"# Same title"}, "visibility": {"public"}}).StatusCode
+		}(i, c)
+	}
+	wg.Wait()
+	slugs := make(map[string]bool)
+	memoCache.Each(func(memo *Memo) {
+		if strings.HasPrefix(memo.Slug, "same-title") {
+			slugs[memo.Slug] = true
+		}
+	})
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("post %d: %d", i, code)
+		}
+	}
+	if len(slugs) != len(clients) || !slugs["same-title"] {
+		t.Errorf("slugs = %v", slugs)
+	}
+}
+
+func TestRenderEmoji(t *testing.T) {
+	defer func(c *Config) { config = c }(config)
+	config = &Config{Emoji: map[string]string{"isucon": "isucon.png"}}
+	tests := []struct {
+		in, want string
+	}{
+		{"<p>hi :smile: :nope:</p>", "<p>hi 😄 :nope:</p>"},
+		{"<p>:+1:<code>:smile:</code> :tada:</p>", "<p>👍<code>:smile:</code> 🎉</p>"},
+		{"<pre><code>:fire:\n</code></pre>:fire:", "<pre><code>:fire:\n</code></pre>🔥"},
+		{`<a title=":smile:">x</a>`, `<a title=":smile:">x</a>`},
+		{"<p>:isucon:</p>", `<p><img class="emoji" src="/emoji/isucon.png" alt=":isucon:" title=":isucon:"></p>`},
+	}
+	for _, tt := range tests {
+		if got := renderEmoji(tt.in); got != tt.want {
+			t.Errorf("renderEmoji(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxMemoTemplates       = 50
+	maxMemoTemplateNameLen = 64
+)
+
+const (
+	listMemoTemplatesSQL  = "SELECT id, name, content FROM memo_templates WHERE user_id=? ORDER BY name"
+	getMemoTemplateSQL    = "SELECT id, name, content FROM memo_templates WHERE id=? AND user_id=?"
+	insertMemoTemplateSQL = "INSERT INTO memo_templates (user_id, name, content, created_at, updated_at) VALUES (?, ?, ?, now(), now())"
+	updateMemoTemplateSQL = "UPDATE memo_templates SET name=?, content=?, updated_at=now() WHERE id=? AND user_id=?"
+	deleteMemoTemplateSQL = "DELETE FROM memo_templates WHERE id=? AND user_id=?"
+)
+
+// MemoTemplate is a user's saved starting point for new memos.
+type MemoTemplate struct {
+	Id      int
+	Name    string
+	Content string
+}
+
+func listMemoTemplates(ctx context.Context, q querier, userId int) ([]*MemoTemplate, error) {
+	rows, err := q.QueryContext(ctx, listMemoTemplatesSQL, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var templates []*MemoTemplate
+	for rows.Next() {
+		t := &MemoTemplate{}
+		if err := rows.Scan(&t.Id, &t.Name, &t.Content); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// findMemoTemplate returns the user's template id, or a not-found error.
+func findMemoTemplate(ctx context.Context, q querier, userId, id int) (*MemoTemplate, error) {
+	t := &MemoTemplate{}
+	err := q.QueryRowContext(ctx, getMemoTemplateSQL, id, userId).Scan(&t.Id, &t.Name, &t.Content)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("no such template")
+	}
+	return t, err
+}
+
+// memoTemplateFromForm reads and checks a template's name and content.
+// Names are unique per user; id is the template being saved, 0 for a new
+// one.
+func memoTemplateFromForm(r *http.Request, existing []*MemoTemplate, id int) (*MemoTemplate, error) {
+	t := &MemoTemplate{
+		Id:      id,
+		Name:    strings.TrimSpace(r.FormValue("name")),
+		Content: r.FormValue("content"),
+	}
+	if t.Name == "" || utf8.RuneCountInString(t.Name) > maxMemoTemplateNameLen {
+		return nil, validationError("template names are 1 to 64 characters")
+	}
+	if strings.TrimSpace(t.Content) == "" {
+		return nil, validationError("the template is empty")
+	}
+	for _, other := range existing {
+		if other.Id != id && strings.EqualFold(other.Name, t.Name) {
+			return nil, conflictError("you already have a template with that name")
+		}
+	}
+	return t, nil
+}
+
+func memoTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+	templates, err := listMemoTemplates(r.Context(), readDB(r, dbConn), user.Id)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	v := &View{User: user, MemoTemplates: templates, Session: session}
+	if err := renderTemplate(w, r, "settings_templates", v); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+// memoTemplatePostHandler saves a new template.
+func memoTemplatePostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	if antiCSRF(w, r, session) {
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+	existing, err := listMemoTemplates(r.Context(), dbConn, user.Id)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if len(existing) >= maxMemoTemplates {
+		handleError(w, r, validationError("you have too many templates; delete one first"))
+		return
+	}
+	t, err := memoTemplateFromForm(r, existing, 0)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if _, err := execSQL(r.Context(), dbConn, insertMemoTemplateSQL, user.Id, t.Name, t.Content); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	markWrite(w)
+	flash(w, r, session, noticeSuccess, "The template was saved.")
+	http.Redirect(w, r, "/settings/templates", http.StatusFound)
+}
+
+// memoTemplateUpdateHandler saves changes to a template, or deletes it
+// with delete=1.
+func memoTemplateUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	if antiCSRF(w, r, session) {
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+	id, _ := strconv.Atoi(mux.Vars(r)["template_id"])
+	if _, err := findMemoTemplate(r.Context(), dbConn, user.Id, id); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if r.FormValue("delete") == "1" {
+		_, err = execSQL(r.Context(), dbConn, deleteMemoTemplateSQL, id, user.Id)
+	} else {
+		var existing []*MemoTemplate
+		var t *MemoTemplate
+		if existing, err = listMemoTemplates(r.Context(), dbConn, user.Id); err == nil {
+			if t, err = memoTemplateFromForm(r, existing, id); err == nil {
+				_, err = execSQL(r.Context(), dbConn, updateMemoTemplateSQL, t.Name, t.Content, id, user.Id)
+			}
+		}
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	markWrite(w)
+	if r.FormValue("delete") == "1" {
+		flash(w, r, session, noticeSuccess, "The template was deleted.")
+	} else {
+		flash(w, r, session, noticeSuccess, "The template was saved.")
+	}
+	http.Redirect(w, r, "/settings/templates", http.StatusFound)
+}
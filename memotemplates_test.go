@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMemoTemplates(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 10})
+	if page := app.get(t, "/settings/templates"); !strings.Contains(page, "no templates yet") {
+		t.Fatalf("templates page is not empty")
+	}
+	if page := app.get(t, "/mypage"); strings.Contains(page, `id="template_picker"`) {
+		t.Errorf("mypage shows a picker without templates")
+	}
+
+	res := app.post(t, "/settings/templates", url.Values{"name": {" "}, "content": {"body"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("blank name: %d, want 400", res.StatusCode)
+	}
+	res = app.post(t, "/settings/templates", url.Values{"name": {"meeting"}, "content": {"# meeting\n\n## agenda"}})
+	if res.StatusCode != http.StatusOK || res.Request.URL.Path != "/settings/templates" {
+		t.Fatalf("create: %d at %s", res.StatusCode, res.Request.URL.Path)
+	}
+	res = app.post(t, "/settings/templates", url.Values{"name": {"Meeting"}, "content": {"again"}})
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate name: %d, want 409", res.StatusCode)
+	}
+
+	mypage := app.get(t, "/mypage")
+	m := regexp.MustCompile(`<option value="(\d+)">meeting</option>`).FindStringSubmatch(mypage)
+	if m == nil {
+		t.Fatalf("mypage has no template picker")
+	}
+	id := m[1]
+	if page := app.get(t, "/mypage?template="+id); !strings.Contains(page, "<textarea name=\"content\"># meeting\n\n## agenda</textarea>") {
+		t.Errorf("the memo form is not filled from the template")
+	}
+
+	res = app.post(t, "/settings/templates/"+id, url.Values{"name": {"standup"}, "content": {"- yesterday\n- today"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("update: %d", res.StatusCode)
+	}
+	if page := app.get(t, "/settings/templates"); !strings.Contains(page, `value="standup"`) || strings.Contains(page, `value="meeting"`) {
+		t.Errorf("template was not renamed")
+	}
+	res = app.post(t, "/settings/templates/999", url.Values{"name": {"x"}, "content": {"y"}})
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown template: %d, want 404", res.StatusCode)
+	}
+
+	res = app.post(t, "/settings/templates/"+id, url.Values{"delete": {"1"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: %d", res.StatusCode)
+	}
+	if page := app.get(t, "/settings/templates"); !strings.Contains(page, "no templates yet") {
+		t.Errorf("template was not deleted")
+	}
+}
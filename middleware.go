@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"./sessions"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo collects facts learned while handling a request, such as the
+// signed-in user, so that middleware can report them afterwards.
+type requestInfo struct {
+	// Id names the request in logs and, through the SQL comments added by
+	// appDriver, in MySQL's.
+	Id       string
+	Route    string
+	ClientIP string
+	UserId   int
+	session  *sessions.Session
+	// bearer is set when the request was authenticated by an access
+	// token rather than the session cookie, and csrf is the route's
+	// policy; see antiCSRF.
+	bearer bool
+	csrf   csrfPolicy
+	// timings is set when the route has a latency budget.
+	timings *phaseTimings
+	// err is the error a 500 was answered for, for the error report.
+	err error
+}
+
+func requestInfoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{
+			Id:       requestId(r),
+			Route:    r.Method + " " + routeName(r),
+			ClientIP: clientIP(r),
+		}
+		w.Header().Set("X-Request-Id", info.Id)
+		next.ServeHTTP(w, withRequestInfo(r, info))
+	})
+}
+
+var (
+	requestIdPrefix = hex.EncodeToString(securecookie.GenerateRandomKey(3))
+	requestCount    uint64
+	requestIdRe     = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// requestId takes X-Request-Id from a trusted proxy, such as nginx's
+// $request_id, so that its access log and ours agree. Other requests get
+// the next of this process's ids.
+func requestId(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && fromTrustedProxy(r) && requestIdRe.MatchString(id) {
+		return id
+	}
+	return requestIdPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&requestCount, 1), 36)
+}
+
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// ensureRequestInfo returns r's info, adding one for requests that did
+// not pass requestInfoMiddleware.
+func ensureRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		return r, info
+	}
+	info := &requestInfo{}
+	return withRequestInfo(r, info), info
+}
+
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// limitBody caps the request body at limit bytes and parses the form up
+// front, answering 413 for oversized bodies and 400 for malformed ones
+// before the handler runs.
+func limitBody(limit int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			tooLarge(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		var err error
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			err = r.ParseMultipartForm(multipartMemory)
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				tooLarge(w, r)
+				return
+			}
+			handleError(w, r, validationError("malformed request body"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func tooLarge(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusRequestEntityTooLarge, "")
+}
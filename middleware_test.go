@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitBody(t *testing.T) {
+	h := limitBody(64, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.PostFormValue("content")))
+	})
+	post := func(body io.Reader, length int64) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/memo", body)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ContentLength = length
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	if w := post(strings.NewReader("content=hello"), 13); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("small body: %d %q", w.Code, w.Body.String())
+	}
+	big := "content=" + strings.Repeat("a", 100)
+	if w := post(strings.NewReader(big), int64(len(big))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared oversized body: %d, want 413", w.Code)
+	}
+	// A chunked body has no length to refuse it by up front.
+	if w := post(strings.NewReader(big), -1); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked oversized body: %d, want 413", w.Code)
+	}
+	if w := post(strings.NewReader("content=%zz"), 11); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed body: %d, want 400", w.Code)
+	}
+}
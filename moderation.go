@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const moderationNoteMaxLen = 255
+
+// moderationActions maps each action /admin/memos/{id}/moderate accepts
+// to the columns it sets. The note is the reason shown to the author; it
+// is cleared when the memo is neither locked nor hidden any more.
+var moderationActions = map[string]string{
+	"lock":   "locked=1, moderation_note=?",
+	"unlock": "locked=0, moderation_note=IF(hidden=1, moderation_note, NULL)",
+	"hide":   "hidden=1, moderation_note=?",
+	"unhide": "hidden=0, moderation_note=IF(locked=1, moderation_note, NULL)",
+}
+
+// editableMemo is ownMemo for the write paths, which a lock closes.
+func editableMemo(r *http.Request, user *User) (*Memo, error) {
+	memo, err := ownMemo(r, user)
+	if err != nil {
+		return nil, err
+	}
+	if memo.Locked {
+		return nil, forbiddenError("this memo was locked by a moderator")
+	}
+	return memo, nil
+}
+
+// moderateMemo applies set to memoId and brings the caches and indexes
+// in line with the new row. The version is bumped so that other
+// processes pick the change up through cache sync.
+func moderateMemo(ctx context.Context, dbConn querier, memoId int, set string, args ...interface{}) (*Memo, error) {
+	args = append(args, memoId)
+	result, err := execSQL(ctx, dbConn, "UPDATE memos SET "+set+", version=version+1, updated_at=now() WHERE id=?", args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, notFoundError("")
+	}
+	memo, err := loadMemo(ctx, dbConn, int64(memoId))
+	if err != nil {
+		return nil, err
+	}
+	old, _ := memoCache.Get(memoId)
+	memoCache.Put(memo)
+	fanOut(memo)
+	indexTeamMemo(old, memo)
+	if memo.Listed() || (old != nil && old.Listed()) {
+		listFragments.Purge()
+	}
+	return memo, nil
+}
+
+func moderateHandler(w http.ResponseWriter, r *http.Request) {
+	memoId, _ := strconv.Atoi(mux.Vars(r)["memo_id"])
+	action := r.FormValue("action")
+	set, ok := moderationActions[action]
+	if !ok {
+		handleError(w, r, validationError("action must be lock, unlock, hide or unhide"))
+		return
+	}
+	reason := r.FormValue("reason")
+	var args []interface{}
+	if action == "lock" || action == "hide" {
+		if reason == "" || len(reason) > moderationNoteMaxLen {
+			handleError(w, r, validationError("give a reason of up to 255 bytes for the author"))
+			return
+		}
+		args = append(args, reason)
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	memo, err := moderateMemo(r.Context(), dbConn, memoId, set, args...)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	audit("admin "+r.RemoteAddr, "memo."+action, []string{"memo " + strconv.Itoa(memoId), reason})
+	writeJSON(w, http.StatusOK, &apiMemo{Memo: memo, Hidden: memo.Hidden, ModerationNote: memo.ModerationNote})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestEditableMemo(t *testing.T) {
+	memoCache.Put(&Memo{Id: 10, User: 1})
+	memoCache.Put(&Memo{Id: 11, User: 1, Locked: true, ModerationNote: "off topic"})
+	defer func() {
+		memoCache.Delete(10)
+		memoCache.Delete(11)
+	}()
+
+	for _, c := range []struct {
+		id   string
+		kind ErrorKind
+		ok   bool
+	}{
+		{"10", 0, true},
+		{"11", KindForbidden, false},
+		{"12", KindNotFound, false},
+	} {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/memo/"+c.id+"/edit", nil), map[string]string{"memo_id": c.id})
+		memo, err := editableMemo(r, &User{Id: 1})
+		if c.ok {
+			if err != nil || memo == nil {
+				t.Errorf("memo %s: %v", c.id, err)
+			}
+			continue
+		}
+		if errorKind(err) != c.kind {
+			t.Errorf("memo %s: error %v, want kind %d", c.id, err, c.kind)
+		}
+	}
+}
+
+func TestModerationNoteInJSON(t *testing.T) {
+	memo := &Memo{Id: 11, Locked: true, Hidden: true, ModerationNote: "off topic"}
+	b, _ := json.Marshal(&apiMemo{Memo: memo})
+	if !strings.Contains(string(b), `"locked":true`) || strings.Contains(string(b), "off topic") || strings.Contains(string(b), "hidden") {
+		t.Errorf("JSON for others = %s", b)
+	}
+	b, _ = json.Marshal(&apiMemo{Memo: memo, Hidden: memo.Hidden, ModerationNote: memo.ModerationNote})
+	if !strings.Contains(string(b), `"moderation_note":"off topic"`) || !strings.Contains(string(b), `"hidden":true`) {
+		t.Errorf("JSON for the author = %s", b)
+	}
+}
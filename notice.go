@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"./sessions"
+)
+
+const (
+	noticeSuccess = "success"
+	noticeInfo    = "info"
+	noticeWarning = "warning"
+	noticeError   = "error"
+
+	// noticesKey holds the flashes waiting for the next page the session
+	// is shown.
+	noticesKey = "_notices"
+)
+
+// Notice is a message shown at the top of a page, from a flash left by
+// the handler that redirected there or from the handler rendering it.
+type Notice struct {
+	Level   string
+	Message string
+}
+
+// Role is the ARIA role of the notice: errors and warnings interrupt a
+// screen reader, the others are read when it is idle.
+func (n Notice) Role() string {
+	if n.Level == noticeError || n.Level == noticeWarning {
+		return "alert"
+	}
+	return "status"
+}
+
+// addNotice leaves a notice in session for the next page rendered for
+// it, to be saved with the session.
+func addNotice(session *sessions.Session, level, message string) {
+	session.AddFlash(level+"\x00"+message, noticesKey)
+}
+
+// flash adds a notice and saves the session. Failing to save it is
+// logged rather than failing what the handler did.
+func flash(w http.ResponseWriter, r *http.Request, session *sessions.Session, level, message string) {
+	addNotice(session, level, message)
+	if err := session.Save(r, w); err != nil {
+		log.Printf("flash: %s", err)
+	}
+}
+
+// takeNotices removes the flashes from session and returns them. The
+// session is only saved when there were any.
+func takeNotices(w http.ResponseWriter, r *http.Request, session *sessions.Session) []Notice {
+	if session == nil {
+		return nil
+	}
+	if _, ok := session.Values[noticesKey]; !ok {
+		return nil
+	}
+	var notices []Notice
+	for _, f := range session.Flashes(noticesKey) {
+		s, _ := f.(string)
+		if level, message := splitNotice(s); message != "" {
+			notices = append(notices, Notice{Level: level, Message: message})
+		}
+	}
+	if err := session.Save(r, w); err != nil {
+		log.Printf("flash: %s", err)
+	}
+	return notices
+}
+
+func splitNotice(s string) (level, message string) {
+	parts := strings.SplitN(s, "\x00", 2)
+	if len(parts) != 2 {
+		return noticeInfo, s
+	}
+	return parts[0], parts[1]
+}
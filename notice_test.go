@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSplitNotice(t *testing.T) {
+	if level, message := splitNotice(noticeWarning + "\x00careful"); level != noticeWarning || message != "careful" {
+		t.Errorf("splitNotice = %q, %q", level, message)
+	}
+	if level, message := splitNotice("bare"); level != noticeInfo || message != "bare" {
+		t.Errorf("splitNotice without a level = %q, %q", level, message)
+	}
+	if (Notice{Level: noticeError}).Role() != "alert" || (Notice{Level: noticeSuccess}).Role() != "status" {
+		t.Errorf("wrong roles")
+	}
+}
+
+// TestNotices checks that a flash is shown once on the page redirected
+// to, and that a failed signin shows an alert.
+func TestNotices(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 3, Users: 2, Memos: 4})
+
+	form := url.Values{"per_page": {"20"}, "timezone": {"Asia/Tokyo"}, "sid": {app.sid}}
+	res, err := app.client.PostForm(app.URL+"/settings", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	saved := `<div class="alert alert-success" role="status">Your settings were saved.</div>`
+	if !strings.Contains(string(body), saved) {
+		t.Errorf("settings page has no success notice:\n%s", body)
+	}
+	if body := app.get(t, "/settings"); strings.Contains(body, "Your settings were saved.") {
+		t.Errorf("notice shown twice")
+	}
+
+	res, err = http.PostForm(app.URL+"/signin", url.Values{"username": {"user1"}, "password": {"wrong"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(body), `role="alert">The username or password is incorrect.</div>`) {
+		t.Errorf("failed signin has no alert:\n%s", body)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+const defaultMemosPerPage = 100
+
+// PagingConfig sizes the memo lists. PerPage applies to the public lists,
+// the timeline, archives and the API; MaxPage caps how deep /recent and
+// /api/recent go (0 for no cap); MypagePerPage pages "my memos", which
+// shows everything when it is 0.
+type PagingConfig struct {
+	PerPage       int `json:"per_page"`
+	MaxPage       int `json:"max_page"`
+	MypagePerPage int `json:"mypage_per_page"`
+}
+
+var (
+	memosPerPage  = defaultMemosPerPage
+	maxPage       = 0
+	mypagePerPage = 0
+)
+
+func setupPaging(c PagingConfig) {
+	memosPerPage = defaultMemosPerPage
+	if c.PerPage > 0 {
+		memosPerPage = c.PerPage
+	}
+	maxPage = c.MaxPage
+	mypagePerPage = c.MypagePerPage
+}
+
+// validPage reports whether page may be requested from a public list.
+func validPage(page int) bool {
+	return page >= 0 && (maxPage <= 0 || page <= maxPage)
+}
+
+// pageBounds returns the slice bounds of page among n items shown
+// perPage at a time. page comes from the URL, so it is compared before
+// multiplying, which could overflow.
+func pageBounds(page, perPage, n int) (start, end int) {
+	if page < 0 || perPage <= 0 || page > n/perPage {
+		return n, n
+	}
+	start = page * perPage
+	end = n
+	if perPage < n-start {
+		end = start + perPage
+	}
+	return start, end
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPageBounds(t *testing.T) {
+	cases := []struct {
+		page, perPage, n int
+		start, end       int
+	}{
+		{0, 10, 25, 0, 10},
+		{2, 10, 25, 20, 25},
+		{3, 10, 25, 25, 25},
+		{9, 10, 25, 25, 25},
+		{-1, 10, 25, 25, 25},
+		{0, 10, 0, 0, 0},
+		{math.MaxInt64, 10, 25, 25, 25},
+		{math.MaxInt64 / 10, 10, 25, 25, 25},
+		{2, math.MaxInt64, 25, 25, 25},
+		{0, math.MaxInt64, 25, 0, 25},
+	}
+	for _, c := range cases {
+		start, end := pageBounds(c.page, c.perPage, c.n)
+		if start != c.start || end != c.end {
+			t.Errorf("pageBounds(%d, %d, %d) = %d, %d; want %d, %d", c.page, c.perPage, c.n, start, end, c.start, c.end)
+		}
+	}
+}
+
+func TestSetupPaging(t *testing.T) {
+	defer setupPaging(PagingConfig{})
+
+	setupPaging(PagingConfig{PerPage: 20, MaxPage: 5, MypagePerPage: 30})
+	if memosPerPage != 20 || mypagePerPage != 30 {
+		t.Errorf("memosPerPage, mypagePerPage = %d, %d; want 20, 30", memosPerPage, mypagePerPage)
+	}
+	if !validPage(5) || validPage(6) || validPage(-1) {
+		t.Error("validPage does not honor max_page 5")
+	}
+
+	setupPaging(PagingConfig{})
+	if memosPerPage != defaultMemosPerPage {
+		t.Errorf("memosPerPage = %d; want the default %d", memosPerPage, defaultMemosPerPage)
+	}
+	if !validPage(100000) {
+		t.Error("validPage capped pages without max_page")
+	}
+}
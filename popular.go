@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	popularMaxLen = 100
+	// viewFlushBatch bounds the memos one flush statement writes.
+	viewFlushBatch = 100
+)
+
+// popularWindows maps the window names accepted by /popular to how far
+// back views are counted and how quickly they decay.
+var popularWindows = map[string]struct {
+	hours    int
+	halfLife float64
+}{
+	"24h": {24, 6},
+	"7d":  {7 * 24, 48},
+}
+
+var (
+	memoViews    = &viewBuffer{counts: make(map[int]int)}
+	popularMutex sync.RWMutex
+	popularMemos = make(map[string][]int)
+)
+
+// viewBuffer accumulates view counts in memory; they reach the database
+// only when the view_flush task runs, so a page view never waits on a write.
+type viewBuffer struct {
+	sync.Mutex
+	counts map[int]int
+}
+
+func (b *viewBuffer) Add(memoId int) {
+	b.Lock()
+	b.counts[memoId]++
+	b.Unlock()
+}
+
+func (b *viewBuffer) take() map[int]int {
+	b.Lock()
+	counts := b.counts
+	b.counts = make(map[int]int)
+	b.Unlock()
+	return counts
+}
+
+// flushViewsSQL adds n memos' counts to the current hour's rows in one
+// statement.
+func flushViewsSQL(n int) string {
+	return "INSERT INTO memo_views (memo_id, hour, views) VALUES " +
+		strings.TrimPrefix(strings.Repeat(", (?, DATE_FORMAT(now(), '%Y-%m-%d %H:00:00'), ?)", n), ", ") +
+		" ON DUPLICATE KEY UPDATE views=views+VALUES(views)"
+}
+
+// flushViewsTask adds the buffered counts to the current hour's rows,
+// viewFlushBatch memos per statement. The ids are sorted so that
+// concurrent flushes lock the rows in the same order. Counts that fail to
+// write are put back for the next run.
+func flushViewsTask() error {
+	counts := memoViews.take()
+	if len(counts) == 0 {
+		return nil
+	}
+	ids := make([]int, 0, len(counts))
+	for memoId := range counts {
+		ids = append(ids, memoId)
+	}
+	sort.Ints(ids)
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > viewFlushBatch {
+			batch = batch[:viewFlushBatch]
+		}
+		args := make([]interface{}, 0, 2*len(batch))
+		for _, memoId := range batch {
+			args = append(args, memoId, counts[memoId])
+		}
+		if _, err := execSQL(context.Background(), dbConn, flushViewsSQL(len(batch)), args...); err != nil {
+			memoViews.Lock()
+			for _, memoId := range ids {
+				memoViews.counts[memoId] += counts[memoId]
+			}
+			memoViews.Unlock()
+			return err
+		}
+		ids = ids[len(batch):]
+	}
+	return nil
+}
+
+// rankPopularTask scores public memos by their hourly views, each hour
+// weighted down by its age so that recent attention counts the most.
+func rankPopularTask() error {
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	rows, err := dbConn.Query("SELECT memo_id, TIMESTAMPDIFF(HOUR, hour, now()), views FROM memo_views WHERE hour >= now() - INTERVAL 7 DAY")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	scores := make(map[string]map[int]float64)
+	for name := range popularWindows {
+		scores[name] = make(map[int]float64)
+	}
+	for rows.Next() {
+		var memoId, age, views int
+		if err := rows.Scan(&memoId, &age, &views); err != nil {
+			return err
+		}
+		for name, w := range popularWindows {
+			if age < w.hours {
+				scores[name][memoId] += float64(views) * math.Exp2(-float64(age)/w.halfLife)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ranked := make(map[string][]int)
+	for name, s := range scores {
+		ids := make([]int, 0, len(s))
+		for id := range s {
+			if memo, ok := memoCache.Get(id); ok && memo.Listed() {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if s[ids[i]] != s[ids[j]] {
+				return s[ids[i]] > s[ids[j]]
+			}
+			return ids[i] > ids[j]
+		})
+		if len(ids) > popularMaxLen {
+			ids = ids[:popularMaxLen]
+		}
+		ranked[name] = ids
+	}
+	popularMutex.Lock()
+	popularMemos = ranked
+	popularMutex.Unlock()
+	return nil
+}
+
+func popularHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	window := r.FormValue("window")
+	if window == "" {
+		window = "24h"
+	}
+	if _, ok := popularWindows[window]; !ok {
+		handleError(w, r, notFoundError(""))
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	user := getUser(w, r, session)
+
+	popularMutex.RLock()
+	ids := popularMemos[window]
+	popularMutex.RUnlock()
+	memos := getMemoSlice()
+	defer putMemoSlice(memos)
+	for _, id := range ids {
+		// The ranking is only refreshed periodically, so recheck that
+		// each memo is still public.
+		if memo, ok := memoCache.Get(id); ok && memo.Listed() {
+			*memos = append(*memos, memo)
+		}
+	}
+	v := &View{
+		Memos:   *memos,
+		User:    user,
+		Window:  window,
+		Session: session,
+	}
+	if err = renderTemplate(w, r, "popular", v); err != nil {
+		handleError(w, r, err)
+	}
+}
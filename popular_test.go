@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+// memoViewTotals sums memo_views over the last week by memo.
+func memoViewTotals(t *testing.T) map[int]int {
+	db := <-dbConnPool
+	defer func() { dbConnPool <- db }()
+	rows, err := db.Query("SELECT memo_id, TIMESTAMPDIFF(HOUR, hour, now()), views FROM memo_views WHERE hour >= now() - INTERVAL 7 DAY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	views := make(map[int]int)
+	for rows.Next() {
+		var id, age, v int
+		if err := rows.Scan(&id, &age, &v); err != nil {
+			t.Fatal(err)
+		}
+		views[id] += v
+	}
+	return views
+}
+
+// TestFlushViews flushes more memos than fit in one statement and checks
+// that every count reached memo_views.
+func TestFlushViews(t *testing.T) {
+	startMemoryApp(t, memorySeed{Seed: 3, Users: 2, Memos: 1})
+	memoViews.take()
+	before := memoViewTotals(t)
+	n := 2*viewFlushBatch + 5
+	for id := 1; id <= n; id++ {
+		for i := 0; i < id%3+1; i++ {
+			memoViews.Add(id)
+		}
+	}
+	if err := flushViewsTask(); err != nil {
+		t.Fatal(err)
+	}
+	if left := len(memoViews.take()); left != 0 {
+		t.Errorf("%d counts left in the buffer", left)
+	}
+	memoViews.Add(1)
+	if err := flushViewsTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := memoViewTotals(t)
+	for id := 1; id <= n; id++ {
+		want := id%3 + 1
+		if id == 1 {
+			want++
+		}
+		if got := after[id] - before[id]; got != want {
+			t.Errorf("memo %d: %d views added, want %d", id, got, want)
+		}
+	}
+}
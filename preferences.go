@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Preferences are a user's display settings. The zero value means the
+// site's defaults throughout.
+type Preferences struct {
+	// PerPage sizes the lists rendered for the user alone: my memos, the
+	// timeline and team pages. The public lists are shared by everyone
+	// and keep the site's size.
+	PerPage    int
+	Theme      string
+	Timezone   string
+	Language   string
+	HardBreaks bool
+}
+
+const (
+	selectPreferencesSQL = "SELECT user_id, per_page, theme, timezone, language, hard_breaks FROM user_preferences"
+	savePreferencesSQL   = "INSERT INTO user_preferences (user_id, per_page, theme, timezone, language, hard_breaks, updated_at) VALUES (?, ?, ?, ?, ?, ?, now()) " +
+		"ON DUPLICATE KEY UPDATE per_page=VALUES(per_page), theme=VALUES(theme), timezone=VALUES(timezone), language=VALUES(language), hard_breaks=VALUES(hard_breaks), updated_at=VALUES(updated_at)"
+	defaultLanguage   = "en"
+	maxTimezoneLength = 64
+)
+
+var (
+	preferencePageSizes = []int{20, 50, 100, 200}
+	preferenceLanguages = []string{"en", "ja"}
+)
+
+// locations caches loaded time zones by name; time.LoadLocation reads the
+// zone file every time.
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// Location is where the user's times are shown, the database's zone
+// unless they chose one.
+func (p Preferences) Location() *time.Location {
+	if p.Timezone != "" {
+		if loc, err := loadLocation(p.Timezone); err == nil {
+			return loc
+		}
+	}
+	return dbLocation
+}
+
+func (p Preferences) validate() error {
+	if p.PerPage != 0 && !containsInt(preferencePageSizes, p.PerPage) {
+		return validationError("unknown page size")
+	}
+	if p.Theme != "" && !validTheme(p.Theme) {
+		return validationError("unknown theme")
+	}
+	if p.Language != "" && !containsString(preferenceLanguages, p.Language) {
+		return validationError("unknown language")
+	}
+	if p.Timezone != "" {
+		if _, err := loadLocation(p.Timezone); err != nil || len(p.Timezone) > maxTimezoneLength {
+			return validationError("unknown time zone")
+		}
+	}
+	return nil
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// perPageFor returns the user's page size, or def if they have none.
+func perPageFor(user *User, def int) int {
+	if user != nil && user.Prefs.PerPage > 0 {
+		return user.Prefs.PerPage
+	}
+	return def
+}
+
+// loadPreferences sets the Prefs of the users in c from the table. c must
+// not be shared yet.
+func loadPreferences(dbConn *sql.DB, c *UserCache) error {
+	rows, err := dbConn.Query(selectPreferencesSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId int
+		var p Preferences
+		if err := rows.Scan(&userId, &p.PerPage, &p.Theme, &p.Timezone, &p.Language, &p.HardBreaks); err != nil {
+			return err
+		}
+		if user, ok := c.users[userId]; ok {
+			user.Prefs = p
+		}
+	}
+	return rows.Err()
+}
+
+var (
+	blockStartRe = regexp.MustCompile(`^ {0,3}([-*+>#|]|\d+\.|=+\s*$|` + "```" + `)`)
+	codeLineRe   = regexp.MustCompile("^(    |\t)")
+)
+
+// hardBreaks ends every line of a paragraph followed by another with two
+// spaces, so that Markdown keeps the line break. Code and the lines before
+// block markup are left alone.
+func hardBreaks(s string) string {
+	lines := strings.Split(s, "\n")
+	fenced := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimLeft(line, " "), "```") {
+			fenced = !fenced
+			continue
+		}
+		if fenced || i == len(lines)-1 || strings.TrimSpace(line) == "" || codeLineRe.MatchString(line) {
+			continue
+		}
+		next := lines[i+1]
+		if strings.TrimSpace(next) == "" || blockStartRe.MatchString(next) || strings.HasSuffix(line, "  ") {
+			continue
+		}
+		lines[i] = strings.TrimRight(line, "\r") + "  "
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderedHTMLFor renders memo with the viewer's hard-break preference.
+// Both forms share memoHTMLCache, under different keys.
+func renderedHTMLFor(memo *Memo, user *User) template.HTML {
+	if user == nil || !user.Prefs.HardBreaks {
+		return renderedHTML(memo)
+	}
+	key := strconv.Itoa(memo.Id) + "#br"
+	if body, version, ok := memoHTMLCache.Get(key); ok && version == memo.Version {
+		return template.HTML(body)
+	}
+	html := genMarkdown(hardBreaks(memo.Content))
+	memoHTMLCache.Set(key, []byte(html), memo.Version)
+	return html
+}
+
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	v := &View{
+		User:      getUser(w, r, session),
+		Themes:    themeNames(),
+		PageSizes: preferencePageSizes,
+		Languages: preferenceLanguages,
+		Session:   session,
+	}
+	if err := renderTemplate(w, r, "settings", v); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+func settingsPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	if antiCSRF(w, r, session) {
+		return
+	}
+	user := getUser(w, r, session)
+	perPage, _ := strconv.Atoi(r.FormValue("per_page"))
+	prefs := Preferences{
+		PerPage:    perPage,
+		Theme:      r.FormValue("theme"),
+		Timezone:   strings.TrimSpace(r.FormValue("timezone")),
+		Language:   r.FormValue("language"),
+		HardBreaks: r.FormValue("hard_breaks") == "1",
+	}
+	if err := prefs.validate(); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	_, err = execSQL(r.Context(), dbConn, savePreferencesSQL,
+		user.Id, prefs.PerPage, prefs.Theme, prefs.Timezone, prefs.Language, prefs.HardBreaks)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	// Cached users are shared by concurrent requests, so put a copy.
+	updated := *user
+	updated.Prefs = prefs
+	userCache.Put(&updated)
+	flash(w, r, session, noticeSuccess, "Your settings were saved.")
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
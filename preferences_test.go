@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHardBreaks(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"one\ntwo\nthree", "one  \ntwo  \nthree"},
+		{"one\n\ntwo", "one\n\ntwo"},
+		{"para\n- item\n- item", "para\n- item\n- item"},
+		{"```\ncode\nmore\n```\nafter\nline", "```\ncode\nmore\n```\nafter  \nline"},
+		{"    code\n    more", "    code\n    more"},
+		{"Title\n=====", "Title\n====="},
+		{"already  \nbroken", "already  \nbroken"},
+	} {
+		if got := hardBreaks(c.in); got != c.want {
+			t.Errorf("hardBreaks(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestPreferencesValidate(t *testing.T) {
+	valid := []Preferences{
+		{},
+		{PerPage: 50, Theme: "minimal", Timezone: "Asia/Tokyo", Language: "ja", HardBreaks: true},
+	}
+	for _, p := range valid {
+		if err := p.validate(); err != nil {
+			t.Errorf("%+v: %s", p, err)
+		}
+	}
+	invalid := []Preferences{
+		{PerPage: 7},
+		{Theme: "nosuchtheme"},
+		{Timezone: "Mars/Olympus_Mons"},
+		{Timezone: "../../etc/passwd"},
+		{Language: "tlh"},
+	}
+	for _, p := range invalid {
+		if err := p.validate(); err == nil {
+			t.Errorf("%+v passed validation", p)
+		}
+	}
+}
+
+func TestSettings(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 30})
+	if page := app.get(t, "/settings"); !strings.Contains(page, `name="timezone"`) {
+		t.Fatalf("settings page has no form")
+	}
+	res := app.post(t, "/settings", url.Values{"timezone": {"Mars/Olympus_Mons"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad time zone: %d, want 400", res.StatusCode)
+	}
+
+	res = app.post(t, "/settings", url.Values{
+		"per_page": {"20"}, "theme": {"minimal"}, "timezone": {"Asia/Tokyo"}, "language": {"ja"}, "hard_breaks": {"1"},
+	})
+	if res.StatusCode != http.StatusOK || res.Request.URL.Path != "/settings" {
+		t.Fatalf("save: %d at %s", res.StatusCode, res.Request.URL.Path)
+	}
+	user, _ := userCache.GetByName("user1")
+	want := Preferences{PerPage: 20, Theme: "minimal", Timezone: "Asia/Tokyo", Language: "ja", HardBreaks: true}
+	if user.Prefs != want {
+		t.Fatalf("cached prefs = %+v, want %+v", user.Prefs, want)
+	}
+
+	mypage := app.get(t, "/mypage")
+	if !strings.Contains(mypage, `<html lang="ja">`) {
+		t.Errorf("mypage is not marked up as ja")
+	}
+	if !strings.Contains(mypage, `| <a href=`) {
+		t.Errorf("mypage is not in the minimal theme")
+	}
+	if n := strings.Count(mypage, "<li>"); n > 20 {
+		t.Errorf("mypage lists %d memos, want at most 20", n)
+	}
+
+	res = app.postMemo(t, url.Values{"content": {"# breaks\nfirst line\nsecond line"}, "visibility": {"public"}})
+	page := app.get(t, res.Request.URL.Path)
+	id, _ := strconv.Atoi(strings.SplitN(strings.TrimPrefix(res.Request.URL.Path, "/memo/"), "-", 2)[0])
+	memo, ok := memoCache.Get(id)
+	if !ok {
+		t.Fatalf("memo %d is not cached", id)
+	}
+	if _, _, ok := memoHTMLCache.Get(strconv.Itoa(id) + "#br"); !ok {
+		t.Errorf("memo was not rendered with hard breaks")
+	}
+	tokyo := memo.CreatedAt.In(time.FixedZone("JST", 9*60*60)).Format("2006年1月2日 15:04:05")
+	if !strings.Contains(page, tokyo) {
+		t.Errorf("memo page does not show the Tokyo time %s", tokyo)
+	}
+
+	// Reloading the cache keeps the stored preferences.
+	db := <-dbConnPool
+	dbConnPool <- db
+	if err := userCache.Reload(db); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := userCache.GetByName("user1"); user.Prefs != want {
+		t.Errorf("reloaded prefs = %+v, want %+v", user.Prefs, want)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// previewLimiter allows each user a burst of previews while typing and
+// then one every two seconds.
+var previewLimiter = newRateLimiter(2*time.Second, 10)
+
+// apiMarkdownHandler renders content as the memo page will, raw HTML and
+// all. The edit form shows the result in a sandboxed frame, where none of
+// it can run scripts or reach the site's origin.
+func apiMarkdownHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+	user := getUser(w, r, session)
+	if !previewLimiter.Allow(strconv.Itoa(user.Id)) {
+		w.Header().Set("Retry-After", "2")
+		renderError(w, r, http.StatusTooManyRequests, "")
+		return
+	}
+	content := r.FormValue("content")
+	if user.Prefs.HardBreaks {
+		content = hardBreaks(content)
+	}
+	writeJSON(w, http.StatusOK, map[string]template.HTML{"html": genMarkdown(content)})
+}
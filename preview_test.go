@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestMarkdownPreview checks that the preview is the memo page's HTML and
+// that the form shows it in a sandboxed frame rather than the page.
+func TestMarkdownPreview(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 1})
+	content := "# title\n\n[click](javascript:alert(1)) <b>raw</b> http://example.com/"
+	res, err := app.client.PostForm(app.URL+"/api/markdown/render", url.Values{"content": {content}, "sid": {app.sid}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var preview struct{ Html string }
+	if err := json.NewDecoder(res.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	if want := string(genMarkdown(content)); preview.Html != want {
+		t.Errorf("preview = %q, want the memo page's %q", preview.Html, want)
+	}
+
+	page := app.get(t, "/mypage")
+	if !strings.Contains(page, `<iframe id="preview" sandbox=""`) || strings.Contains(page, "innerHTML") {
+		t.Errorf("preview is not shown in a sandboxed frame")
+	}
+}
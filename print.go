@@ -0,0 +1,62 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	hiddenElementRe = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>`)
+	lineBreakTagRe  = regexp.MustCompile(`(?i)(<br\s*/?>|</(p|h[1-6]|li|pre|blockquote|div|tr|dt|dd)\s*>)\n?`)
+	anyTagRe        = regexp.MustCompile(`<[^>]*>`)
+	blankLinesRe    = regexp.MustCompile(`\n{3,}`)
+)
+
+// plainText turns rendered memo HTML into text: block ends become line
+// breaks, tags go and entities are decoded.
+func plainText(s string) string {
+	s = hiddenElementRe.ReplaceAllString(s, "")
+	s = lineBreakTagRe.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(anyTagRe.ReplaceAllString(s, ""))
+	s = blankLinesRe.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s) + "\n"
+}
+
+// memoTextHandler serves a memo as text: its Markdown source to the
+// author, the rendered text to everyone else who may see it.
+func memoTextHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	memoId, err := parseMemoRef(mux.Vars(r)["memo_id"])
+	if err != nil {
+		handleError(w, r, notFoundError(""))
+		return
+	}
+	user := getUser(w, r, session)
+	memo, err := findMemo(user, memoId)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	text := memo.Content
+	if user == nil || user.Id != memo.User {
+		text = plainText(string(renderedHTML(memo)))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(text))
+}
+
+// renderMemoPrint renders memo alone on a page without navigation, for
+// printing.
+func renderMemoPrint(w http.ResponseWriter, r *http.Request, v *View) error {
+	w.Header().Set("X-Robots-Tag", "noindex")
+	return renderTemplate(w, r, "memo_print", v)
+}
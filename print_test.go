@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPlainText(t *testing.T) {
+	in := "<h1>Title</h1>\n\n<p>one &amp; <em>two</em><br />three</p>\n\n\n\n<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<script>alert(1)</script>"
+	want := "Title\n\none & two\nthree\n\na\nb\n"
+	if got := plainText(in); got != want {
+		t.Errorf("plainText = %q, want %q", got, want)
+	}
+}
+
+func TestMemoTextAndPrint(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 8, Users: 2, Memos: 0})
+	public := app.postMemo(t, url.Values{"content": {"# Hello\n\n*plain* text"}, "visibility": {"public"}}).Request.URL.Path
+	private := app.postMemo(t, url.Values{"content": {"secret"}, "visibility": {"private"}}).Request.URL.Path
+	textPath := func(path string) string {
+		return "/memo/" + strings.SplitN(strings.TrimPrefix(path, "/memo/"), "-", 2)[0] + ".txt"
+	}
+
+	if got := app.get(t, textPath(public)); got != "# Hello\n\n*plain* text" {
+		t.Errorf("author's text = %q, want the source", got)
+	}
+	res, err := http.Get(app.URL + textPath(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if strings.Contains(string(body), "<") || !strings.Contains(string(body), "plain") {
+		t.Errorf("anonymous text = %q, want it without markup", body)
+	}
+	if res, err := http.Get(app.URL + textPath(private)); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Errorf("anonymous text of a private memo: %v %v, want 404", res.StatusCode, err)
+	}
+
+	print := app.get(t, public+"?print=1")
+	if !strings.Contains(print, `<div id="content_html">`) || strings.Contains(print, "navbar") {
+		t.Errorf("print view is not the bare memo:\n%s", print)
+	}
+	if res, err := http.Get(app.URL + private + "?print=1"); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Errorf("anonymous print of a private memo: %v %v, want 404", res.StatusCode, err)
+	}
+}
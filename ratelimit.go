@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemoPerUser = 10
+	defaultMemoPerIP   = 30
+)
+
+// RateLimitConfig sets how many memos may be posted per minute by one user
+// and from one client address. With Redis set the counts are shared by
+// every instance; otherwise each process counts on its own.
+type RateLimitConfig struct {
+	Redis       string `json:"redis"`
+	MemoPerUser int    `json:"memo_per_user"`
+	MemoPerIP   int    `json:"memo_per_ip"`
+}
+
+func (c *RateLimitConfig) setDefaults() {
+	if c.MemoPerUser == 0 {
+		c.MemoPerUser = defaultMemoPerUser
+	}
+	if c.MemoPerIP == 0 {
+		c.MemoPerIP = defaultMemoPerIP
+	}
+}
+
+func (c *RateLimitConfig) validate() error {
+	if c.MemoPerUser < 0 || c.MemoPerIP < 0 {
+		return fmt.Errorf("config: rate_limits.memo_per_user and memo_per_ip must not be negative")
+	}
+	return nil
+}
+
+// diff lists the limits that changed, for the reload audit log.
+func (c RateLimitConfig) diff(old RateLimitConfig) []string {
+	c.setDefaults()
+	old.setDefaults()
+	changes := make([]string, 0)
+	if c.MemoPerUser != old.MemoPerUser {
+		changes = append(changes, fmt.Sprintf("rate_limits.memo_per_user: %d -> %d", old.MemoPerUser, c.MemoPerUser))
+	}
+	if c.MemoPerIP != old.MemoPerIP {
+		changes = append(changes, fmt.Sprintf("rate_limits.memo_per_ip: %d -> %d", old.MemoPerIP, c.MemoPerIP))
+	}
+	if c.Redis != old.Redis {
+		changes = append(changes, fmt.Sprintf("rate_limits.redis: %q -> %q (needs a restart)", old.Redis, c.Redis))
+	}
+	return changes
+}
+
+// Limiter decides whether one more request under key is allowed.
+type Limiter interface {
+	Allow(key string) bool
+	// SetLimit changes how many requests a key may make per minute,
+	// keeping what was counted so far.
+	SetLimit(perMinute int)
+}
+
+var (
+	memoUserLimiter Limiter
+	memoIPLimiter   Limiter
+)
+
+func setupRateLimits(c RateLimitConfig) {
+	c.setDefaults()
+	if c.Redis != "" {
+		pool := newRedisPool(c.Redis)
+		memoUserLimiter = &redisLimiter{pool: pool, prefix: tenantKeyPrefix + "memo:user", limit: int64(c.MemoPerUser), window: time.Minute}
+		memoIPLimiter = &redisLimiter{pool: pool, prefix: tenantKeyPrefix + "memo:ip", limit: int64(c.MemoPerIP), window: time.Minute}
+		return
+	}
+	memoUserLimiter = newRateLimiter(time.Minute/time.Duration(c.MemoPerUser), c.MemoPerUser)
+	memoIPLimiter = newRateLimiter(time.Minute/time.Duration(c.MemoPerIP), c.MemoPerIP)
+}
+
+// applyRateLimits changes the limits on a config reload. The limiters
+// setupRateLimits made are kept, so a new redis address needs a restart.
+func applyRateLimits(c RateLimitConfig) {
+	c.setDefaults()
+	memoUserLimiter.SetLimit(c.MemoPerUser)
+	memoIPLimiter.SetLimit(c.MemoPerIP)
+}
+
+// limitWrites answers 429 with a friendly page when the client or the
+// signed-in user has posted too much in the last minute.
+func limitWrites(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := loadSession(w, r)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		user := getUser(w, r, session)
+		if !memoIPLimiter.Allow(clientIP(r)) || (user != nil && !memoUserLimiter.Allow(strconv.Itoa(user.Id))) {
+			w.Header().Set("Retry-After", "60")
+			writeError(w, r, http.StatusTooManyRequests, "You are posting too quickly. Please wait a minute and try again.", session)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// rateLimiter is a token bucket per key: each key may make burst requests
+// at once and then one every interval.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	burst    float64
+	buckets  map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{
+		interval: interval,
+		burst:    float64(burst),
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from key's bucket, reporting false if it is empty.
+func (l *rateLimiter) Allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) > 10000 {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(l.interval)
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) SetLimit(perMinute int) {
+	l.Lock()
+	l.interval = time.Minute / time.Duration(perMinute)
+	l.burst = float64(perMinute)
+	l.Unlock()
+}
+
+// sweep forgets buckets that have refilled, which behave like new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst * float64(l.interval))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
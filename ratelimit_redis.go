@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisLimiter counts requests per key in fixed windows stored in Redis,
+// so that every app instance enforces the same limit.
+type redisLimiter struct {
+	pool   *redis.Pool
+	prefix string
+	limit  int64
+	window time.Duration
+}
+
+func newRedisPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     4,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr,
+				redis.DialConnectTimeout(time.Second),
+				redis.DialReadTimeout(time.Second),
+				redis.DialWriteTimeout(time.Second),
+			)
+		},
+	}
+}
+
+// Allow fails open: if Redis can't be reached, writes are not blocked.
+func (l *redisLimiter) Allow(key string) bool {
+	conn := l.pool.Get()
+	defer conn.Close()
+	window := time.Now().UnixNano() / int64(l.window)
+	k := l.prefix + ":" + key + ":" + strconv.FormatInt(window, 10)
+	n, err := redis.Int(conn.Do("INCR", k))
+	if err != nil {
+		log.Printf("rate limit: %s", err)
+		return true
+	}
+	if n == 1 {
+		conn.Do("PEXPIRE", k, int64(l.window/time.Millisecond))
+	}
+	return int64(n) <= atomic.LoadInt64(&l.limit)
+}
+
+func (l *redisLimiter) SetLimit(perMinute int) {
+	atomic.StoreInt64(&l.limit, int64(perMinute))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(time.Hour, 3)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("request %d within burst was refused", i+1)
+		}
+	}
+	if l.Allow("a") {
+		t.Error("request beyond burst was allowed")
+	}
+	if !l.Allow("b") {
+		t.Error("another key shares the exhausted bucket")
+	}
+
+	l.buckets["a"].last = time.Now().Add(-time.Hour)
+	if !l.Allow("a") {
+		t.Error("bucket did not refill after an interval")
+	}
+}
+
+// TestReloadLimitsAndBudgets changes the rate limits and a render cache
+// budget through a config reload.
+func TestReloadLimitsAndBudgets(t *testing.T) {
+	defer func(c *Config, file string, runtime RuntimeConfig) {
+		config, configFile = c, file
+		setRuntimeConfig(runtime)
+		setupRateLimits(RateLimitConfig{})
+		setupRenderCaches(RenderCacheConfig{})
+	}(config, configFile, currentRuntimeConfig())
+	config = &Config{}
+	setupRateLimits(config.RateLimits)
+
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"rate_limits": {"memo_per_user": 2}, "render_cache": {"page_budget_mb": 1}}`)
+	f.Close()
+	configFile = f.Name()
+
+	limiter := memoUserLimiter.(*rateLimiter)
+	changes, err := reloadConfig("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := strings.Join(changes, "\n")
+	for _, want := range []string{"rate_limits.memo_per_user: 10 -> 2", "render_cache.page_budget_mb: 0 -> 1"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("changes lack %q: %v", want, changes)
+		}
+	}
+	if memoUserLimiter != limiter || limiter.burst != 2 || limiter.interval != 30*time.Second {
+		t.Errorf("user limiter: burst %g, interval %s", limiter.burst, limiter.interval)
+	}
+	if pageCache.Stats().Budget != 1<<20 {
+		t.Errorf("page cache budget = %d", pageCache.Stats().Budget)
+	}
+}
+
+func TestRateLimitConfigValidate(t *testing.T) {
+	for _, c := range []RateLimitConfig{{MemoPerUser: -1}, {MemoPerIP: -5}} {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+	if c := (RateLimitConfig{MemoPerUser: 3}); c.validate() != nil {
+		t.Errorf("%+v refused", c)
+	}
+}
+
+// TestLimitWrites posts memos past the per-IP and then the per-user limit.
+func TestLimitWrites(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 6, Users: 2, Memos: 1})
+	defer setupRateLimits(RateLimitConfig{})
+	post := func() *http.Response {
+		return app.postMemo(t, url.Values{"content": {"limited"}, "visibility": {"public"}})
+	}
+
+	memoIPLimiter, memoUserLimiter = newRateLimiter(time.Hour, 1), newRateLimiter(time.Hour, 10)
+	if res := post(); res.StatusCode != http.StatusOK {
+		t.Fatalf("first post: %d", res.StatusCode)
+	}
+	if res := post(); res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "60" {
+		t.Errorf("post over the IP limit: %d, Retry-After %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+
+	memoIPLimiter, memoUserLimiter = newRateLimiter(time.Hour, 10), newRateLimiter(time.Hour, 1)
+	if res := post(); res.StatusCode != http.StatusOK {
+		t.Fatalf("post under new limits: %d", res.StatusCode)
+	}
+	if res := post(); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("post over the user limit: %d", res.StatusCode)
+	}
+}
+
+// fakeRedis answers INCR and PEXPIRE, enough for redisLimiter.
+type fakeRedis struct {
+	net.Listener
+	mu      sync.Mutex
+	counts  map[string]int
+	expires map[string]string
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{Listener: l, counts: make(map[string]int), expires: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+				return
+			}
+			b := make([]byte, size+2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			args[i] = string(b[:size])
+		}
+		s.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "INCR":
+			s.counts[args[1]]++
+			fmt.Fprintf(conn, ":%d\r\n", s.counts[args[1]])
+		case "PEXPIRE":
+			s.expires[args[1]] = args[2]
+			fmt.Fprint(conn, ":1\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command %s\r\n", args[0])
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestRedisLimiter(t *testing.T) {
+	server := startFakeRedis(t)
+	l := &redisLimiter{pool: newRedisPool(server.Addr().String()), prefix: "memo:user", limit: 2, window: time.Hour}
+	defer l.pool.Close()
+
+	for i := 0; i < 2; i++ {
+		if !l.Allow("1") {
+			t.Fatalf("request %d within the limit was refused", i+1)
+		}
+	}
+	if l.Allow("1") {
+		t.Errorf("request beyond the limit was allowed")
+	}
+	if !l.Allow("2") {
+		t.Errorf("another key shares the exhausted count")
+	}
+	// Refused requests count too, so this allows one more.
+	l.SetLimit(4)
+	if !l.Allow("1") {
+		t.Errorf("raised limit was not applied")
+	}
+
+	server.mu.Lock()
+	if len(server.expires) != 2 {
+		t.Errorf("expiries set: %v", server.expires)
+	}
+	for key, ms := range server.expires {
+		if !strings.HasPrefix(key, "memo:user:") || ms != "3600000" {
+			t.Errorf("PEXPIRE %s %s", key, ms)
+		}
+	}
+	server.mu.Unlock()
+
+	// Redis going away must not block writes.
+	server.Close()
+	l.pool.Close()
+	l.pool = newRedisPool(server.Addr().String())
+	if !l.Allow("1") {
+		t.Errorf("limiter did not fail open")
+	}
+}
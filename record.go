@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRecordMaxBody = 64 << 10
+	recordQueueLen       = 1024
+	redacted             = "REDACTED"
+)
+
+// RecordConfig turns on recording of sampled requests to Path, one JSON
+// object per line, for tools/replay. Nothing is recorded without a path.
+type RecordConfig struct {
+	Path        string  `json:"path"`
+	SampleRatio float64 `json:"sample_ratio"`
+	// MaxBodyBytes caps the form bodies kept; longer ones are left out.
+	MaxBodyBytes int `json:"max_body_bytes"`
+}
+
+// recordedFields are form and query values that are never written out.
+// sid is the CSRF token, which replay takes from the pages it gets back.
+var recordedFields = map[string]bool{"password": true, "sid": true, "admin_token": true, "refresh_token": true}
+
+// RecordedRequest is one line of a recording. Clients are named by a
+// hash of their session cookie: Client is the cookie the request
+// carried, SetsClient the one the response handed out.
+type RecordedRequest struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	URI         string    `json:"uri"`
+	Host        string    `json:"host"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        string    `json:"body,omitempty"`
+	BodySkipped bool      `json:"body_skipped,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	SetsClient  string    `json:"sets_client,omitempty"`
+	Status      int       `json:"status"`
+	Bytes       int       `json:"bytes"`
+	DurationMs  float64   `json:"duration_ms"`
+}
+
+type recorder struct {
+	c      RecordConfig
+	queue  chan *RecordedRequest
+	done   chan struct{}
+	mu     sync.Mutex
+	closed bool
+	drops  int64
+}
+
+var requestRecorder *recorder
+
+// startRecording opens c.Path for appending and starts the writer; the
+// file is flushed and closed on shutdown.
+func startRecording(c RecordConfig) error {
+	if c.Path == "" {
+		return nil
+	}
+	if c.SampleRatio <= 0 || c.SampleRatio > 1 {
+		c.SampleRatio = 1
+	}
+	if c.MaxBodyBytes <= 0 {
+		c.MaxBodyBytes = defaultRecordMaxBody
+	}
+	f, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	rec := &recorder{c: c, queue: make(chan *RecordedRequest, recordQueueLen), done: make(chan struct{})}
+	go rec.write(f)
+	onShutdown(rec.close)
+	requestRecorder = rec
+	log.Printf("recording %.0f%% of requests to %s", c.SampleRatio*100, c.Path)
+	return nil
+}
+
+func (rec *recorder) write(f *os.File) {
+	defer close(rec.done)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for req := range rec.queue {
+		if err := enc.Encode(req); err != nil {
+			log.Printf("record: %s", err)
+		}
+		if len(rec.queue) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	f.Close()
+}
+
+func (rec *recorder) close() {
+	rec.mu.Lock()
+	if !rec.closed {
+		rec.closed = true
+		close(rec.queue)
+	}
+	rec.mu.Unlock()
+	<-rec.done
+	if rec.drops > 0 {
+		log.Printf("record: dropped %d requests while the writer was behind", rec.drops)
+	}
+}
+
+// add never blocks a request; when the writer falls behind the request
+// is dropped from the recording.
+func (rec *recorder) add(req *RecordedRequest) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.closed {
+		return
+	}
+	select {
+	case rec.queue <- req:
+	default:
+		rec.drops++
+	}
+}
+
+func clientKey(cookie string) string {
+	if cookie == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(cookie)))[:16]
+}
+
+// sanitizeValues replaces the values of recordedFields.
+func sanitizeValues(raw string) string {
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		return ""
+	}
+	for name := range values {
+		if recordedFields[name] {
+			for i := range values[name] {
+				values[name][i] = redacted
+			}
+		}
+	}
+	return values.Encode()
+}
+
+func sanitizeURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	return u.EscapedPath() + "?" + sanitizeValues(u.RawQuery)
+}
+
+// recordMiddleware records a sample of requests with what became of them.
+// Form bodies are kept with their secrets redacted; other bodies are left
+// out.
+func recordMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := requestRecorder
+		if rec == nil || rand.Float64() >= rec.c.SampleRatio {
+			next.ServeHTTP(w, r)
+			return
+		}
+		req := &RecordedRequest{
+			Time:        time.Now(),
+			Method:      r.Method,
+			URI:         sanitizeURI(r.URL),
+			Host:        r.Host,
+			ContentType: r.Header.Get("Content-Type"),
+		}
+		if c, err := r.Cookie(sessionName); err == nil {
+			req.Client = clientKey(c.Value)
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			if strings.HasPrefix(req.ContentType, "application/x-www-form-urlencoded") {
+				body, _ := ioutil.ReadAll(io.LimitReader(r.Body, int64(rec.c.MaxBodyBytes)+1))
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+				if len(body) > rec.c.MaxBodyBytes {
+					req.BodySkipped = true
+				} else {
+					req.Body = sanitizeValues(string(body))
+				}
+			} else {
+				req.BodySkipped = true
+			}
+		}
+
+		cw := &countingWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		next.ServeHTTP(cw, r)
+		req.DurationMs = ms(time.Since(req.Time))
+		req.Status = cw.Status()
+		req.Bytes = cw.n
+		for _, c := range readSetCookies(cw.Header()) {
+			if c.Name == sessionName && c.MaxAge >= 0 {
+				req.SetsClient = clientKey(c.Value)
+			}
+		}
+		rec.add(req)
+	})
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type countingWriter struct {
+	statusWriter
+	n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.statusWriter.Write(b)
+	w.n += n
+	return n, err
+}
+
+func readSetCookies(h http.Header) []*http.Cookie {
+	resp := &http.Response{Header: h}
+	return resp.Cookies()
+}
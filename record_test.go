@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeValues(t *testing.T) {
+	got, _ := url.ParseQuery(sanitizeValues("username=alice&password=hunter2&sid=abc&refresh_token=f00d&content=hi"))
+	if got.Get("password") != redacted || got.Get("sid") != redacted || got.Get("refresh_token") != redacted {
+		t.Errorf("secrets kept: %v", got)
+	}
+	if got.Get("username") != "alice" || got.Get("content") != "hi" {
+		t.Errorf("fields lost: %v", got)
+	}
+}
+
+func TestRecordMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.jsonl")
+	if err := startRecording(RecordConfig{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	rec := requestRecorder
+	defer func() { requestRecorder = nil }()
+
+	var seen string
+	h := recordMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		seen = r.FormValue("password")
+		http.SetCookie(w, &http.Cookie{Name: sessionName, Value: "new-session"})
+		w.WriteHeader(http.StatusFound)
+	}))
+	r := httptest.NewRequest("POST", "/signin?admin_token=secret", strings.NewReader("username=alice&password=hunter2"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: sessionName, Value: "old-session"})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	rec.close()
+
+	if seen != "hunter2" {
+		t.Errorf("handler saw password %q; the body was not restored", seen)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "hunter2") || strings.Contains(string(b), "secret") || strings.Contains(string(b), "session\"") {
+		t.Errorf("recording holds a secret: %s", b)
+	}
+	var got RecordedRequest
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != http.StatusFound || got.Client != clientKey("old-session") || got.SetsClient != clientKey("new-session") {
+		t.Errorf("recorded %+v", got)
+	}
+	os.Remove(path)
+}
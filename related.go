@@ -0,0 +1,216 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	relatedMaxLen = 5
+	// relatedMaxTerms is how many of a memo's best terms are compared with
+	// other memos'. The tail of rare words adds little and makes every
+	// comparison slower.
+	relatedMaxTerms = 20
+)
+
+var (
+	relatedMutex sync.RWMutex
+	relatedMemos = make(map[int][]int)
+	// relatedGeneration counts the rankings, for the API's ETag.
+	relatedGeneration int
+)
+
+var relatedStopWords = map[string]bool{
+	"an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "from": true, "has": true, "have": true,
+	"in": true, "is": true, "it": true, "its": true, "not": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "this": true, "to": true,
+	"was": true, "we": true, "were": true, "with": true, "you": true,
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// relatedTerms counts the words of content. Japanese has no spaces, so
+// runs of kana and kanji are cut into overlapping pairs of characters.
+func relatedTerms(content string) map[string]int {
+	terms := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		runes := []rune(word)
+		if isCJK(runes[0]) {
+			if len(runes) == 1 {
+				terms[word]++
+			}
+			for i := 0; i+1 < len(runes); i++ {
+				terms[string(runes[i:i+2])]++
+			}
+			continue
+		}
+		if len(runes) >= 2 && !relatedStopWords[word] {
+			terms[word]++
+		}
+	}
+	return terms
+}
+
+type relatedPosting struct {
+	doc    int
+	weight float64
+}
+
+// rankRelatedTask finds, for each public memo, the public memos whose
+// words are most alike: the cosine similarity of their TF-IDF vectors.
+// Words found in a single memo cannot match anything, and those in more
+// than half of them say little, so both are left out.
+func rankRelatedTask() error {
+	var ids []int
+	var counts []map[string]int
+	memoCache.Each(func(memo *Memo) {
+		if memo.Listed() {
+			ids = append(ids, memo.Id)
+			counts = append(counts, relatedTerms(memo.Content))
+		}
+	})
+	df := make(map[string]int)
+	for _, terms := range counts {
+		for term := range terms {
+			df[term]++
+		}
+	}
+
+	n := len(ids)
+	docs := make([]map[string]float64, n)
+	postings := make(map[string][]relatedPosting)
+	for i, terms := range counts {
+		weights := make(map[string]float64, len(terms))
+		for term, tf := range terms {
+			if df[term] < 2 || df[term]*2 > n {
+				continue
+			}
+			weights[term] = (1 + math.Log(float64(tf))) * math.Log(float64(n)/float64(df[term]))
+		}
+		if len(weights) > relatedMaxTerms {
+			best := make([]string, 0, len(weights))
+			for term := range weights {
+				best = append(best, term)
+			}
+			sort.Slice(best, func(a, b int) bool {
+				if weights[best[a]] != weights[best[b]] {
+					return weights[best[a]] > weights[best[b]]
+				}
+				return best[a] < best[b]
+			})
+			for _, term := range best[relatedMaxTerms:] {
+				delete(weights, term)
+			}
+		}
+		var norm float64
+		for _, w := range weights {
+			norm += w * w
+		}
+		norm = math.Sqrt(norm)
+		for term, w := range weights {
+			weights[term] = w / norm
+			postings[term] = append(postings[term], relatedPosting{doc: i, weight: w / norm})
+		}
+		docs[i] = weights
+	}
+
+	ranked := make(map[int][]int, n)
+	for i, weights := range docs {
+		scores := make(map[int]float64)
+		for term, w := range weights {
+			for _, p := range postings[term] {
+				if p.doc != i {
+					scores[p.doc] += w * p.weight
+				}
+			}
+		}
+		if len(scores) == 0 {
+			continue
+		}
+		similar := make([]int, 0, len(scores))
+		for doc := range scores {
+			similar = append(similar, doc)
+		}
+		sort.Slice(similar, func(a, b int) bool {
+			if scores[similar[a]] != scores[similar[b]] {
+				return scores[similar[a]] > scores[similar[b]]
+			}
+			return ids[similar[a]] > ids[similar[b]]
+		})
+		if len(similar) > relatedMaxLen {
+			similar = similar[:relatedMaxLen]
+		}
+		related := make([]int, len(similar))
+		for j, doc := range similar {
+			related[j] = ids[doc]
+		}
+		ranked[ids[i]] = related
+	}
+	relatedMutex.Lock()
+	relatedMemos = ranked
+	relatedGeneration++
+	relatedMutex.Unlock()
+	return nil
+}
+
+// relatedTo returns the memos last ranked as related to memoId that are
+// still public.
+func relatedTo(memoId int) (memos Memos, generation int) {
+	relatedMutex.RLock()
+	ids := relatedMemos[memoId]
+	generation = relatedGeneration
+	relatedMutex.RUnlock()
+	for _, id := range ids {
+		if memo, ok := memoCache.Get(id); ok && memo.Listed() {
+			memos = append(memos, memo)
+		}
+	}
+	return memos, generation
+}
+
+type apiRelated struct {
+	Memos []*apiNeighbor `json:"memos"`
+}
+
+// apiRelatedHandler returns the memos related to a memo, which the memo
+// page loads after it is shown.
+func apiRelatedHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	memoId, _ := strconv.Atoi(mux.Vars(r)["memo_id"])
+	user := getUser(w, r, session)
+	memo, err := findMemo(user, memoId)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	v := &apiRelated{Memos: []*apiNeighbor{}}
+	etag := []interface{}{"related", memo.Id}
+	if memo.Listed() {
+		memos, generation := relatedTo(memo.Id)
+		etag = append(etag, generation)
+		for _, m := range memos {
+			v.Memos = append(v.Memos, newAPINeighbor(m))
+			etag = append(etag, m.Id, m.Version)
+		}
+	}
+	if checkETag(w, r, versionETag(etag...)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
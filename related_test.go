@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRelatedTerms(t *testing.T) {
+	got := relatedTerms("The Gopher and the gopher, in 2013: 東京都")
+	want := map[string]int{"gopher": 2, "2013": 1, "東京": 1, "京都": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("relatedTerms = %v, want %v", got, want)
+	}
+}
+
+func TestRelated(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 20})
+	post := func(content, visibility string) string {
+		res := app.postMemo(t, url.Values{"content": {content}, "visibility": {visibility}})
+		return strings.SplitN(strings.TrimPrefix(res.Request.URL.Path, "/memo/"), "-", 2)[0]
+	}
+	gopher := post("# gophers\ngopher channel goroutine select", "public")
+	channels := post("# channels\nchannel goroutine select deadlock", "public")
+	post("# lunch\nsushi ramen tempura udon", "public")
+	post("# dinner\nsushi ramen tempura soba", "public")
+	private := post("# secret\ngopher channel goroutine select deadlock", "private")
+	if err := rankRelatedTask(); err != nil {
+		t.Fatal(err)
+	}
+
+	var v apiRelated
+	if err := json.Unmarshal([]byte(app.get(t, "/api/memo/"+gopher+"/related")), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Memos) == 0 || v.Memos[0].Title != "channels" {
+		t.Fatalf("related to gophers = %+v, want channels first", v.Memos)
+	}
+	for _, m := range v.Memos {
+		if m.Title == "secret" {
+			t.Errorf("a private memo is listed as related")
+		}
+	}
+	if page := app.get(t, "/memo/"+channels); !strings.Contains(page, `id="related"`) {
+		t.Errorf("memo page has no related section")
+	}
+
+	if err := json.Unmarshal([]byte(app.get(t, "/api/memo/"+private+"/related")), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Memos) != 0 {
+		t.Errorf("private memo has related memos %+v", v.Memos)
+	}
+}
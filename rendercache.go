@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/list"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultMemoHTMLBudgetMB = 64
+	defaultPageBudgetMB     = 16
+	// renderEntryOverhead approximates the list element, map entry and
+	// struct kept per cached body.
+	renderEntryOverhead = 96
+	compressMinBytes    = 512
+)
+
+// RenderCacheConfig bounds the memory used by rendered memo bodies, list
+// pages and the stale copies of pages kept by withSLO. Compress stores
+// bodies deflated, trading CPU on every hit for roughly a third of the
+// memory.
+type RenderCacheConfig struct {
+	MemoBudgetMB  int  `json:"memo_budget_mb"`
+	PageBudgetMB  int  `json:"page_budget_mb"`
+	StaleBudgetMB int  `json:"stale_budget_mb"`
+	Compress      bool `json:"compress"`
+}
+
+func (c RenderCacheConfig) budgets() (memo, page int64) {
+	memo, page = int64(c.MemoBudgetMB), int64(c.PageBudgetMB)
+	if memo <= 0 {
+		memo = defaultMemoHTMLBudgetMB
+	}
+	if page <= 0 {
+		page = defaultPageBudgetMB
+	}
+	return memo << 20, page << 20
+}
+
+// diff lists the budgets that changed, for the reload audit log.
+func (c RenderCacheConfig) diff(old RenderCacheConfig) []string {
+	changes := make([]string, 0)
+	for _, b := range []struct {
+		name     string
+		old, new int
+	}{
+		{"memo_budget_mb", old.MemoBudgetMB, c.MemoBudgetMB},
+		{"page_budget_mb", old.PageBudgetMB, c.PageBudgetMB},
+		{"stale_budget_mb", old.StaleBudgetMB, c.StaleBudgetMB},
+	} {
+		if b.old != b.new {
+			changes = append(changes, fmt.Sprintf("render_cache.%s: %d -> %d", b.name, b.old, b.new))
+		}
+	}
+	if c.Compress != old.Compress {
+		changes = append(changes, fmt.Sprintf("render_cache.compress: %t -> %t", old.Compress, c.Compress))
+	}
+	return changes
+}
+
+func (c RenderCacheConfig) staleBudget() int64 {
+	if c.StaleBudgetMB <= 0 {
+		return defaultStaleBudgetMB << 20
+	}
+	return int64(c.StaleBudgetMB) << 20
+}
+
+type renderEntry struct {
+	key        string
+	body       []byte
+	n          int
+	compressed bool
+}
+
+func (e *renderEntry) size() int64 {
+	return int64(len(e.key) + len(e.body) + renderEntryOverhead)
+}
+
+// RenderCacheStats is reported by /admin/caches.
+type RenderCacheStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	Budget    int64 `json:"budget"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// renderCache is an LRU of rendered bodies that evicts the least recently
+// used ones once their total size passes the budget. Each body is kept
+// with a number the caller chooses, such as the version it was rendered
+// from.
+type renderCache struct {
+	sync.Mutex
+	budget   int64
+	compress bool
+	ll       *list.List
+	entries  map[string]*list.Element
+	stats    RenderCacheStats
+}
+
+func newRenderCache(budget int64, compress bool) *renderCache {
+	return &renderCache{
+		budget:   budget,
+		compress: compress,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+var (
+	memoHTMLCache = newRenderCache(defaultMemoHTMLBudgetMB<<20, false)
+	pageCache     = newRenderCache(defaultPageBudgetMB<<20, false)
+)
+
+func setupRenderCaches(c RenderCacheConfig) {
+	memo, page := c.budgets()
+	memoHTMLCache.Configure(memo, c.Compress)
+	pageCache.Configure(page, c.Compress)
+	staleCache.Configure(c.staleBudget(), c.Compress)
+}
+
+// Configure changes the budget, evicting at once if it shrank. Bodies
+// already stored keep the form they were stored in.
+func (c *renderCache) Configure(budget int64, compress bool) {
+	c.Lock()
+	c.budget = budget
+	c.compress = compress
+	c.evict()
+	c.Unlock()
+}
+
+func (c *renderCache) Get(key string) ([]byte, int, bool) {
+	c.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		c.Unlock()
+		return nil, 0, false
+	}
+	c.stats.Hits++
+	c.ll.MoveToFront(el)
+	e := el.Value.(*renderEntry)
+	c.Unlock()
+
+	body, err := e.decode()
+	if err != nil {
+		log.Printf("render cache: %s: %s", key, err)
+		return nil, 0, false
+	}
+	return body, e.n, true
+}
+
+func (e *renderEntry) decode() ([]byte, error) {
+	if !e.compressed {
+		return e.body, nil
+	}
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(e.body)))
+}
+
+// Each calls f for every body, least recently used first, so that storing
+// them again in that order keeps their recency.
+func (c *renderCache) Each(f func(key string, body []byte, n int)) {
+	c.Lock()
+	entries := make([]*renderEntry, 0, c.ll.Len())
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		entries = append(entries, el.Value.(*renderEntry))
+	}
+	c.Unlock()
+	for _, e := range entries {
+		if body, err := e.decode(); err == nil {
+			f(e.key, body, e.n)
+		}
+	}
+}
+
+// Set stores body, which must not be modified afterwards.
+func (c *renderCache) Set(key string, body []byte, n int) {
+	e := &renderEntry{key: key, body: body, n: n}
+	c.Lock()
+	compress := c.compress
+	c.Unlock()
+	if compress && len(body) >= compressMinBytes {
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		zw.Write(body)
+		zw.Close()
+		if buf.Len() < len(body) {
+			e.body = buf.Bytes()
+			e.compressed = true
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.stats.Bytes -= el.Value.(*renderEntry).size()
+		c.ll.Remove(el)
+		delete(c.entries, key)
+	}
+	if e.size() > c.budget {
+		return
+	}
+	c.entries[key] = c.ll.PushFront(e)
+	c.stats.Bytes += e.size()
+	c.evict()
+}
+
+func (c *renderCache) evict() {
+	for c.stats.Bytes > c.budget {
+		el := c.ll.Back()
+		if el == nil {
+			return
+		}
+		e := el.Value.(*renderEntry)
+		c.ll.Remove(el)
+		delete(c.entries, e.key)
+		c.stats.Bytes -= e.size()
+		c.stats.Evictions++
+	}
+}
+
+func (c *renderCache) Purge() {
+	c.Lock()
+	c.ll.Init()
+	c.entries = make(map[string]*list.Element)
+	c.stats.Bytes = 0
+	c.Unlock()
+}
+
+func (c *renderCache) cacheStats(name string) CacheStats {
+	s := c.Stats()
+	return CacheStats{
+		Name:      name,
+		Hits:      s.Hits,
+		Misses:    s.Misses,
+		Evictions: s.Evictions,
+		Entries:   s.Entries,
+		Bytes:     s.Bytes,
+		Budget:    s.Budget,
+	}
+}
+
+func (c *renderCache) Stats() RenderCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	s := c.stats
+	s.Entries = c.ll.Len()
+	s.Budget = c.budget
+	return s
+}
+
+// renderedHTML returns memo's content as HTML, rendering it only if the
+// cached copy is missing or from an older version.
+func renderedHTML(memo *Memo) template.HTML {
+	key := strconv.Itoa(memo.Id)
+	if body, version, ok := memoHTMLCache.Get(key); ok && version == memo.Version {
+		return template.HTML(body)
+	}
+	html := genMarkdown(memo.Content)
+	memoHTMLCache.Set(key, []byte(html), memo.Version)
+	return html
+}
+
+func cachesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]RenderCacheStats{
+		"memo_html": memoHTMLCache.Stats(),
+		"pages":     pageCache.Stats(),
+		"stale":     staleCache.Stats(),
+	})
+}
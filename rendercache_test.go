@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRenderCacheEvictsToBudget(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 1000)
+	entry := (&renderEntry{key: "a", body: body}).size()
+	c := newRenderCache(3*entry, false)
+	c.Set("a", body, 1)
+	c.Set("b", body, 1)
+	c.Set("c", body, 1)
+	c.Get("a")
+	c.Set("d", body, 1)
+
+	if _, _, ok := c.Get("b"); ok {
+		t.Errorf("least recently used entry b was not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+	s := c.Stats()
+	if s.Entries != 3 || s.Bytes > s.Budget || s.Evictions != 1 || s.Hits != 4 || s.Misses != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	c.Configure(entry, false)
+	if s := c.Stats(); s.Entries != 1 || s.Evictions != 3 {
+		t.Errorf("after shrinking the budget, stats = %+v", s)
+	}
+}
+
+func TestRenderCacheCompress(t *testing.T) {
+	body := []byte(strings.Repeat("<p>hello, world</p>\n", 100))
+	c := newRenderCache(1<<20, true)
+	c.Set("memo", body, 3)
+	got, n, ok := c.Get("memo")
+	if !ok || n != 3 || !bytes.Equal(got, body) {
+		t.Fatalf("Get = %d bytes, %d, %v", len(got), n, ok)
+	}
+	if s := c.Stats(); s.Bytes >= int64(len(body)) {
+		t.Errorf("compressed entry takes %d bytes for a %d byte body", s.Bytes, len(body))
+	}
+}
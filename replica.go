@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicaCheckInterval = 5 * time.Second
+	readYourWritesCookie = "isucon_rw"
+	readYourWritesWindow = 5 // seconds
+)
+
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy int32
+}
+
+var (
+	replicas    []*replica
+	replicaNext uint32
+)
+
+func openReplicas(configs []DatabaseConfig) error {
+	for _, c := range configs {
+		db, err := sql.Open(mysqlDriverName, c.dsn())
+		if err != nil {
+			return err
+		}
+		rep := &replica{name: c.Host, db: db, healthy: 1}
+		replicas = append(replicas, rep)
+		log.Printf("replica: %s", c.dsn())
+	}
+	if len(replicas) > 0 {
+		go checkReplicas(replicaCheckInterval)
+	}
+	return nil
+}
+
+func checkReplicas(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		for _, rep := range replicas {
+			healthy := int32(1)
+			if err := rep.db.Ping(); err != nil {
+				healthy = 0
+			}
+			if atomic.SwapInt32(&rep.healthy, healthy) != healthy {
+				log.Printf("replica %s healthy=%d", rep.name, healthy)
+			}
+		}
+	}
+}
+
+// markWrite makes the client's reads go to the primary for a few seconds so
+// that it sees its own write even if the replicas lag behind.
+func markWrite(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     readYourWritesCookie,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   readYourWritesWindow,
+		HttpOnly: true,
+	})
+}
+
+// readDB picks a healthy replica round-robin for a read-only query, or
+// primary when there is none or the client wrote recently. Results that
+// end up in shared caches must not be read from here, since a lagging
+// replica would pin stale data until the next invalidation.
+func readDB(r *http.Request, primary *sql.DB) querier {
+	if len(replicas) == 0 {
+		return primary
+	}
+	if _, err := r.Cookie(readYourWritesCookie); err == nil {
+		return primary
+	}
+	n := atomic.AddUint32(&replicaNext, 1)
+	for i := 0; i < len(replicas); i++ {
+		rep := replicas[(int(n)+i)%len(replicas)]
+		if atomic.LoadInt32(&rep.healthy) == 1 {
+			return rep.db
+		}
+	}
+	return primary
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	reportReasonMaxLen = 255
+	// myReportsShown caps the reports listed back to their reporter on
+	// mypage.
+	myReportsShown = 20
+)
+
+// reportOutcomes maps each admin action on a reported memo to the status
+// its open reports are closed with.
+var reportOutcomes = map[string]string{
+	"approve": "approved",
+	"hide":    "hidden",
+	"delete":  "deleted",
+}
+
+// MemoReport is one user's report, as shown back to them.
+type MemoReport struct {
+	MemoId    int    `json:"memo_id"`
+	Title     string `json:"title"`
+	Reason    string `json:"reason"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ReportSummary is a memo in the admin queue with its open reports.
+type ReportSummary struct {
+	MemoId  int      `json:"memo_id"`
+	User    int      `json:"user"`
+	Title   string   `json:"title"`
+	Reports int      `json:"reports"`
+	Reasons []string `json:"reasons"`
+	FirstAt string   `json:"first_reported_at"`
+}
+
+// reportable reports whether user may report memo: anyone signed in but
+// its author, for memos anyone with the URL can read.
+func reportable(user *User, memo *Memo) bool {
+	return user != nil && user.Id != memo.User && !memo.Hidden &&
+		(memo.Visibility == visibilityPublic || memo.Visibility == visibilityUnlisted)
+}
+
+// reportHandler records the signed-in user's report on a memo. Reporting
+// again while the first report is open replaces its reason.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	if antiCSRF(w, r, session) {
+		return
+	}
+	user := getUser(w, r, session)
+	memoId, _ := strconv.Atoi(mux.Vars(r)["memo_id"])
+	memo, err := findMemo(user, memoId)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if !reportable(user, memo) {
+		handleError(w, r, forbiddenError("this memo can't be reported"))
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" || len(reason) > reportReasonMaxLen {
+		handleError(w, r, validationError("give a reason of up to 255 bytes"))
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	_, err = execSQL(r.Context(), dbConn,
+		"INSERT INTO memo_reports (memo_id, reporter, reason, created_at) VALUES (?, ?, ?, now()) ON DUPLICATE KEY UPDATE reason=IF(status='open', VALUES(reason), reason)",
+		memo.Id, user.Id, reason,
+	)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	markWrite(w)
+	flash(w, r, session, noticeSuccess, "Thank you. A moderator will look at this memo.")
+	http.Redirect(w, r, memo.Path(), http.StatusFound)
+}
+
+// myReports returns userId's latest reports and what became of them.
+func myReports(ctx context.Context, dbConn querier, userId int) ([]*MemoReport, error) {
+	rows, err := dbConn.QueryContext(ctx,
+		"SELECT memo_id, reason, status, created_at FROM memo_reports WHERE reporter=? ORDER BY created_at DESC, id DESC LIMIT ?",
+		userId, myReportsShown,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reports []*MemoReport
+	for rows.Next() {
+		report := &MemoReport{}
+		if err := rows.Scan(&report.MemoId, &report.Reason, &report.Status, &report.CreatedAt); err != nil {
+			return nil, err
+		}
+		if memo, ok := memoCache.Get(report.MemoId); ok {
+			report.Title = memo.Title
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// reportsHandler lists the memos with open reports, most reported first.
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	rows, err := dbConn.QueryContext(r.Context(),
+		"SELECT memo_id, COUNT(*), MIN(created_at) FROM memo_reports WHERE status='open' GROUP BY memo_id ORDER BY COUNT(*) DESC, MIN(created_at)")
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	queue := make([]*ReportSummary, 0)
+	for rows.Next() {
+		s := &ReportSummary{Reasons: make([]string, 0)}
+		if err := rows.Scan(&s.MemoId, &s.Reports, &s.FirstAt); err != nil {
+			handleError(w, r, err)
+			return
+		}
+		if memo, ok := memoCache.Get(s.MemoId); ok {
+			s.User, s.Title = memo.User, memo.Title
+		}
+		queue = append(queue, s)
+	}
+	if err := rows.Err(); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	for _, s := range queue {
+		reasons, err := dbConn.QueryContext(r.Context(), "SELECT reason FROM memo_reports WHERE memo_id=? AND status='open' ORDER BY created_at", s.MemoId)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		for reasons.Next() {
+			var reason string
+			if err := reasons.Scan(&reason); err == nil {
+				s.Reasons = append(s.Reasons, reason)
+			}
+		}
+		reasons.Close()
+	}
+	writeJSON(w, http.StatusOK, queue)
+}
+
+// reportReviewHandler closes a memo's open reports: action=approve keeps
+// the memo, hide hides it with reason shown to the author, and delete
+// removes it. Reporters see the outcome on their page.
+func reportReviewHandler(w http.ResponseWriter, r *http.Request) {
+	memoId, _ := strconv.Atoi(mux.Vars(r)["memo_id"])
+	action := r.FormValue("action")
+	status, ok := reportOutcomes[action]
+	if !ok {
+		handleError(w, r, validationError("action must be approve, hide or delete"))
+		return
+	}
+	reason := r.FormValue("reason")
+	if action == "hide" && (reason == "" || len(reason) > moderationNoteMaxLen) {
+		handleError(w, r, validationError("give a reason of up to 255 bytes for the author"))
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	result, err := execSQL(r.Context(), dbConn,
+		"UPDATE memo_reports SET status=?, resolved_at=now() WHERE memo_id=? AND status='open'", status, memoId)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		handleError(w, r, notFoundError(""))
+		return
+	}
+	switch action {
+	case "hide":
+		_, err = moderateMemo(r.Context(), dbConn, memoId, moderationActions["hide"], reason)
+	case "delete":
+		err = deleteMemo(r.Context(), dbConn, memoId)
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	audit("admin "+r.RemoteAddr, "report."+action, []string{"memo " + strconv.Itoa(memoId), reason})
+	writeJSON(w, http.StatusOK, map[string]string{"result": status})
+}
+
+// deleteMemo removes a memo for good, with its attachments. Their files
+// go once the rows are gone; one that can't be deleted is left behind and
+// logged. Other processes keep their cached copy until the next /reset,
+// as with any deletion.
+func deleteMemo(ctx context.Context, dbConn *sql.DB, memoId int) error {
+	var attachments []*Attachment
+	err := withTx(ctx, dbConn, func(tx *sql.Tx) error {
+		var err error
+		if attachments, err = listAttachments(ctx, tx, memoId); err != nil {
+			return err
+		}
+		if _, err = execSQL(ctx, tx, deleteMemoAttachmentsSQL, memoId); err != nil {
+			return err
+		}
+		_, err = execSQL(ctx, tx, "DELETE FROM memos WHERE id=?", memoId)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		for _, key := range a.blobKeys() {
+			if err := blobs.Delete(ctx, key); err != nil {
+				log.Printf("attachment: leaving blob %s: %s", key, err)
+			}
+		}
+	}
+	old, ok := memoCache.Get(memoId)
+	memoCache.Delete(memoId)
+	if ok && old.Listed() {
+		listFragments.Purge()
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReportable(t *testing.T) {
+	author, other := &User{Id: 1}, &User{Id: 2}
+	for _, c := range []struct {
+		user *User
+		memo *Memo
+		want bool
+	}{
+		{other, &Memo{User: 1, Visibility: visibilityPublic}, true},
+		{other, &Memo{User: 1, Visibility: visibilityUnlisted}, true},
+		{nil, &Memo{User: 1, Visibility: visibilityPublic}, false},
+		{author, &Memo{User: 1, Visibility: visibilityPublic}, false},
+		{other, &Memo{User: 1, Visibility: visibilityFollowers}, false},
+		{other, &Memo{User: 1, Visibility: visibilityPublic, Hidden: true}, false},
+	} {
+		if got := reportable(c.user, c.memo); got != c.want {
+			t.Errorf("reportable(%+v, %+v) = %v, want %v", c.user, c.memo, got, c.want)
+		}
+	}
+}
+
+// adminRequest sends a request with the admin token and returns the
+// status and body.
+func adminRequest(t *testing.T, app *memoryApp, method, path string, form url.Values) (int, string) {
+	req, err := http.NewRequest(method, app.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Admin-Token", config.AdminToken)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+// TestReports reports user2's memos as two other users, then works
+// through the admin queue.
+func TestReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(b BlobStore) { blobs = b }(blobs)
+	blobs = &localBlobStore{dir: dir}
+
+	user1 := startMemoryApp(t, memorySeed{Seed: 8, Users: 3})
+	config.AdminToken = "reports-token"
+	user2, user3 := user1.signIn(t, "user2"), user1.signIn(t, "user3")
+	for i := 0; i < 3; i++ {
+		if res := user2.postMemo(t, url.Values{"content": {"# reported " + strconv.Itoa(i)}, "visibility": {"public"}}); res.StatusCode != http.StatusOK {
+			t.Fatalf("post: %d", res.StatusCode)
+		}
+	}
+	var memos []int
+	memoCache.Each(func(memo *Memo) {
+		if memo.User == 2 && strings.HasPrefix(memo.Content, "# reported") {
+			memos = append(memos, memo.Id)
+		}
+	})
+	sort.Ints(memos)
+	if len(memos) != 3 {
+		t.Fatalf("user2 has memos %v", memos)
+	}
+	a, b, c := memos[0], memos[1], memos[2]
+	report := func(app *memoryApp, memoId int, reason string) int {
+		return app.post(t, "/memo/"+strconv.Itoa(memoId)+"/report", url.Values{"reason": {reason}}).StatusCode
+	}
+
+	if code := report(user1, a, "spam"); code != http.StatusOK {
+		t.Fatalf("report: %d", code)
+	}
+	if code := report(user1, a, "spam, really"); code != http.StatusOK {
+		t.Errorf("second report: %d", code)
+	}
+	if code := report(user3, a, "rude"); code != http.StatusOK {
+		t.Errorf("report by user3: %d", code)
+	}
+	if code := report(user2, a, "my own"); code != http.StatusForbidden {
+		t.Errorf("report by the author: %d, want 403", code)
+	}
+	if code := report(user1, b, ""); code != http.StatusBadRequest {
+		t.Errorf("report without a reason: %d, want 400", code)
+	}
+	report(user1, b, "off topic")
+	report(user3, c, "duplicate")
+
+	code, body := adminRequest(t, user1, "GET", "/admin/reports", url.Values{})
+	var queue []*ReportSummary
+	if err := json.Unmarshal([]byte(body), &queue); code != http.StatusOK || err != nil {
+		t.Fatalf("queue: %d %s", code, body)
+	}
+	if len(queue) != 3 || queue[0].MemoId != a || queue[0].Reports != 2 || queue[0].User != 2 {
+		t.Fatalf("queue = %s", body)
+	}
+	// One report per user: reporting again replaced the reason.
+	if reasons := strings.Join(queue[0].Reasons, ","); reasons != "spam, really,rude" {
+		t.Errorf("reasons of memo %d: %q", a, reasons)
+	}
+
+	review := func(memoId int, form url.Values) (int, string) {
+		return adminRequest(t, user1, "POST", "/admin/reports/"+strconv.Itoa(memoId), form)
+	}
+	if code, _ := review(a, url.Values{"action": {"ban"}}); code != http.StatusBadRequest {
+		t.Errorf("unknown action: %d", code)
+	}
+	if code, body := review(a, url.Values{"action": {"approve"}}); code != http.StatusOK || !strings.Contains(body, "approved") {
+		t.Errorf("approve: %d %s", code, body)
+	}
+	if code, _ := review(a, url.Values{"action": {"approve"}}); code != http.StatusNotFound {
+		t.Errorf("approving again: %d, want 404", code)
+	}
+	if memo, _ := memoCache.Get(a); memo == nil || memo.Hidden {
+		t.Errorf("approved memo %d is gone or hidden", a)
+	}
+
+	if code, _ := review(b, url.Values{"action": {"hide"}}); code != http.StatusBadRequest {
+		t.Errorf("hide without a reason: %d", code)
+	}
+	if code, _ := review(b, url.Values{"action": {"hide"}, "reason": {"off topic here"}}); code != http.StatusOK {
+		t.Errorf("hide: %d", code)
+	}
+	if memo, _ := memoCache.Get(b); memo == nil || !memo.Hidden {
+		t.Errorf("memo %d was not hidden", b)
+	}
+
+	if res := user2.upload(t, "/memo/"+strconv.Itoa(c)+"/attachments", "notes.txt", []byte("attached")); res.StatusCode != http.StatusOK {
+		t.Fatalf("upload: %d", res.StatusCode)
+	}
+	if code, _ := review(c, url.Values{"action": {"delete"}}); code != http.StatusOK {
+		t.Errorf("delete: %d", code)
+	}
+	conn := <-dbConnPool
+	attachments, err := listAttachments(context.Background(), conn, c)
+	dbConnPool <- conn
+	if err != nil || len(attachments) != 0 {
+		t.Errorf("deleted memo %d left attachments %v (%v)", c, attachments, err)
+	}
+	if files, _ := ioutil.ReadDir(dir + "/memos/" + strconv.Itoa(c)); len(files) != 0 {
+		t.Errorf("deleted memo %d left %d files", c, len(files))
+	}
+	if _, ok := memoCache.Get(c); ok {
+		t.Errorf("memo %d is still cached", c)
+	}
+	if res, _ := user3.client.Get(user3.URL + "/memo/" + strconv.Itoa(c)); res.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted memo: %d", res.StatusCode)
+	}
+
+	if _, body := adminRequest(t, user1, "GET", "/admin/reports", url.Values{}); strings.TrimSpace(body) != "[]" {
+		t.Errorf("queue after review: %s", body)
+	}
+	if page := user1.get(t, "/mypage"); !strings.Contains(page, "reviewed, left as it is") || !strings.Contains(page, "[hidden]") {
+		t.Errorf("mypage does not show the outcomes")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSchedule is used for tasks that have no entry in config.Schedule.
+var defaultSchedule = map[string]string{
+	"user_reconcile": "@every 30s",
+	"session_sweep":  "17 * * * *",
+	"view_flush":     "@every 10s",
+	"popular_rank":   "*/5 * * * *",
+	"related_rank":   "*/10 * * * *",
+	"visitor_flush":  "@every 1m",
+	"banner_refresh": "@every 30s",
+	"token_sweep":    "@every 10m",
+	"cache_audit":    "@every 5m",
+}
+
+// cronSpec is a parsed schedule: either a fixed interval ("@every 30s")
+// or the five classic cron fields, each a set of allowed values.
+type cronSpec struct {
+	every                         time.Duration
+	minute, hour, dom, month, dow map[int]bool
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("bad range %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(expr[len("@every "):]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("schedule %q: bad interval", expr)
+		}
+		return &cronSpec{every: d}, nil
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want 5 fields", expr)
+	}
+	spec := &cronSpec{}
+	var err error
+	targets := []*map[int]bool{&spec.minute, &spec.hour, &spec.dom, &spec.month, &spec.dow}
+	limits := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	for i, f := range fields {
+		if *targets[i], err = parseCronField(f, limits[i][0], limits[i][1]); err != nil {
+			return nil, fmt.Errorf("schedule %q: %s", expr, err)
+		}
+	}
+	return spec, nil
+}
+
+// next returns the first time after t that matches the spec.
+func (s *cronSpec) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for ; t.Before(limit); t = t.Add(time.Minute) {
+		if s.minute[t.Minute()] && s.hour[t.Hour()] && s.dom[t.Day()] &&
+			s.month[int(t.Month())] && s.dow[int(t.Weekday())] {
+			return t
+		}
+	}
+	return limit
+}
+
+type TaskStatus struct {
+	Schedule   string  `json:"schedule"`
+	Running    bool    `json:"running"`
+	Runs       int     `json:"runs"`
+	Skipped    int     `json:"skipped"`
+	LastStart  string  `json:"last_start,omitempty"`
+	LastMs     float64 `json:"last_duration_ms"`
+	LastError  string  `json:"last_error,omitempty"`
+	NextRunAt  string  `json:"next_run_at,omitempty"`
+	running    bool
+	lastFinish time.Time
+}
+
+type scheduledTask struct {
+	name string
+	spec *cronSpec
+	fn   func() error
+}
+
+var (
+	taskMutex    sync.Mutex
+	taskStatuses = make(map[string]*TaskStatus)
+)
+
+// startScheduler runs each task on its schedule with up to jitter of random
+// delay. A run that comes due while the previous one is still going is
+// skipped rather than started concurrently.
+func startScheduler(schedule map[string]string, jitter time.Duration, tasks map[string]func() error) error {
+	for name, fn := range tasks {
+		expr, ok := schedule[name]
+		if !ok {
+			expr = defaultSchedule[name]
+		}
+		if expr == "" || expr == "off" {
+			continue
+		}
+		spec, err := parseCron(expr)
+		if err != nil {
+			return fmt.Errorf("task %s: %s", name, err)
+		}
+		taskMutex.Lock()
+		taskStatuses[name] = &TaskStatus{Schedule: expr}
+		taskMutex.Unlock()
+		go runTask(&scheduledTask{name: name, spec: spec, fn: fn}, jitter)
+	}
+	return nil
+}
+
+func runTask(task *scheduledTask, jitter time.Duration) {
+	for {
+		next := task.spec.next(time.Now())
+		if jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		taskMutex.Lock()
+		taskStatuses[task.name].NextRunAt = next.Format(time.RFC3339)
+		taskMutex.Unlock()
+		time.Sleep(next.Sub(time.Now()))
+
+		taskMutex.Lock()
+		status := taskStatuses[task.name]
+		if status.running {
+			status.Skipped++
+			taskMutex.Unlock()
+			continue
+		}
+		status.running = true
+		taskMutex.Unlock()
+
+		go func() {
+			start := time.Now()
+			err := task.fn()
+			taskMutex.Lock()
+			status.running = false
+			status.Runs++
+			status.LastStart = start.Format(time.RFC3339)
+			status.LastMs = float64(time.Since(start)) / float64(time.Millisecond)
+			status.LastError = ""
+			if err != nil {
+				status.LastError = err.Error()
+				log.Printf("task %s failed: %s", task.name, err)
+			}
+			taskMutex.Unlock()
+		}()
+	}
+}
+
+func reconcileUsersTask() error {
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	if err := userCache.Reload(dbConn); err != nil {
+		return err
+	}
+	debugf("reconciled %d users", userCache.Len())
+	return nil
+}
+
+// sweepSessionsTask removes session files that outlived the cookie MaxAge.
+func sweepSessionsTask() error {
+	if cookieSessions {
+		return nil
+	}
+	files, err := ioutil.ReadDir(sessionFile)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-sessionMaxAge)
+	removed := 0
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "session_") || f.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(sessionFile, f.Name())); err == nil {
+			removed++
+		}
+	}
+	debugf("swept %d expired sessions", removed)
+	return nil
+}
+
+func tasksHandler(w http.ResponseWriter, r *http.Request) {
+	taskMutex.Lock()
+	statuses := make(map[string]TaskStatus, len(taskStatuses))
+	for name, s := range taskStatuses {
+		copied := *s
+		copied.Running = s.running
+		statuses[name] = copied
+	}
+	taskMutex.Unlock()
+	writeJSON(w, http.StatusOK, statuses)
+}
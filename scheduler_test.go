@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	base := time.Date(2013, 10, 5, 10, 30, 15, 0, time.Local)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2013, 10, 5, 10, 31, 0, 0, time.Local)},
+		{"17 * * * *", time.Date(2013, 10, 5, 11, 17, 0, 0, time.Local)},
+		{"*/20 * * * *", time.Date(2013, 10, 5, 10, 40, 0, 0, time.Local)},
+		{"0 3 * * 1-5", time.Date(2013, 10, 7, 3, 0, 0, 0, time.Local)},
+		{"0 0 1 1 *", time.Date(2014, 1, 1, 0, 0, 0, 0, time.Local)},
+		{"@every 45s", base.Add(45 * time.Second)},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %s", tt.expr, err)
+			continue
+		}
+		if got := spec.next(base); !got.Equal(tt.want) {
+			t.Errorf("next(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "@every soon"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
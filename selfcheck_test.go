@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelfCheck(t *testing.T) {
+	c, dir := config, sessionFile
+	defer func() { config, sessionFile = c, dir }()
+	config = &Config{}
+	var err error
+	if sessionFile, err = ioutil.TempDir("", "sessions"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sessionFile)
+
+	seed := memorySeed{Seed: 1, Users: 2, Memos: 3}
+	defer forgetMemoryStore(seed.dsn())
+	report := selfCheck(memoryDriverName, seed.dsn())
+	if !report.OK {
+		t.Fatalf("self-check failed: %+v", report.Checks)
+	}
+	if len(report.Checks) != 6 || report.Checks[1].Name != "schema" || report.Checks[1].Detail != "version 24 of 24" || report.Checks[2].Name != "indexes" || report.Checks[2].Status != checkOK {
+		t.Errorf("checks = %+v", report.Checks)
+	}
+	if files, _ := ioutil.ReadDir(sessionFile); len(files) != 0 {
+		t.Errorf("the session check left %d files behind", len(files))
+	}
+
+	var buf bytes.Buffer
+	if err := report.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded checkReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || !decoded.OK || len(decoded.Checks) != 6 {
+		t.Errorf("report does not round-trip: %s", buf.String())
+	}
+
+	sessionFile = filepath.Join(sessionFile, "missing")
+	config.AdminToken = "short"
+	report = selfCheck("nosuchdriver", "")
+	if report.OK {
+		t.Fatalf("self-check passed without a database or session store")
+	}
+	want := map[string]string{"db": checkFail, "schema": checkFail, "templates": checkOK, "sessions": checkFail, "config": checkWarn}
+	for _, c := range report.Checks {
+		if want[c.Name] != c.Status {
+			t.Errorf("%s: %s, want %s", c.Name, c.Status, want[c.Name])
+		}
+	}
+
+	// Cookie sessions signed with the secret in the source can be forged.
+	defer setupSessions(SessionConfig{})
+	cookieSessions = true
+	report = &checkReport{OK: true}
+	checkConfig(report)
+	if report.OK || report.Checks[0].Status != checkFail {
+		t.Errorf("cookie sessions with the default secret: %+v", report.Checks)
+	}
+}
+
+func TestMissingIndexes(t *testing.T) {
+	// The contest's schema has only the primary keys.
+	have := map[string][][]string{"memos": {{"id"}}, "users": {{"id"}}}
+	missing := missingIndexes(have)
+	if len(missing) != 4 || missing[0] != "ALTER TABLE `memos` ADD INDEX `i4` (`visibility`, `created_at`)" {
+		t.Errorf("missing = %q", missing)
+	}
+
+	// Wider indexes serve as well; an index on the wrong order does not.
+	have["memos"] = append(have["memos"], []string{"visibility", "created_at", "id"}, []string{"created_at", "user"}, []string{"user", "created_at"}, []string{"updated_at"})
+	have["users"] = append(have["users"], []string{"USERNAME"})
+	if missing := missingIndexes(have); len(missing) != 0 {
+		t.Errorf("missing = %q", missing)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	listenFdEnv         = "ISUCON_LISTEN_FD"
+	readyFdEnv          = "ISUCON_READY_FD"
+	defaultDrainTimeout = 10 * time.Second
+	handOffTimeout      = 2 * time.Minute
+)
+
+// ServerConfig controls the listening socket. Sending SIGUSR2 starts the
+// binary at os.Args[0] on the same socket and, once it has warmed its
+// caches and is serving, drains this process and exits. With ReusePort
+// the socket can instead be shared with a process started by hand, and
+// the old one stopped with SIGTERM.
+//
+// Protocol "fcgi" answers FastCGI on the same socket instead of HTTP, for
+// running behind nginx's fastcgi_pass.
+//
+// AdminAddr moves the admin routes and pprof off that socket to a second
+// one, answering plain HTTP, such as "127.0.0.1:5001". It is opened with
+// SO_REUSEPORT so that the process a SIGUSR2 starts can open it too.
+type ServerConfig struct {
+	Protocol       string `json:"protocol"`
+	ReusePort      bool   `json:"reuse_port"`
+	DrainTimeoutMs int    `json:"drain_timeout_ms"`
+	AdminAddr      string `json:"admin_addr"`
+}
+
+func (c ServerConfig) validate() error {
+	switch c.Protocol {
+	case "", "http", "fcgi":
+	default:
+		return fmt.Errorf("config: unknown server protocol %q", c.Protocol)
+	}
+	if c.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			return fmt.Errorf("config: bad server admin_addr %q: %s", c.AdminAddr, err)
+		}
+	}
+	return nil
+}
+
+// adminPath reports whether path is one of the routes AdminAddr moves off
+// the public socket, for any tenant.
+func adminPath(path string) bool {
+	path = routedPath(path)
+	return pathUnder(path, "/admin") || pathUnder(path, "/debug") || path == "/metrics" || path == "/reset"
+}
+
+// withoutAdminPaths answers the admin routes with a 404, as if they were
+// not there.
+func withoutAdminPaths(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminPath(r.URL.Path) {
+			writeError(w, r, http.StatusNotFound, "", nil)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (c ServerConfig) drainTimeout() time.Duration {
+	if c.DrainTimeoutMs <= 0 {
+		return defaultDrainTimeout
+	}
+	return time.Duration(c.DrainTimeoutMs) * time.Millisecond
+}
+
+// shutdownHooks run after the last request has been answered, and
+// handOffHooks before a new process is started on the socket, in the
+// order they were added.
+var shutdownHooks, handOffHooks []func()
+
+func onShutdown(f func()) {
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+func onHandOff(f func()) {
+	handOffHooks = append(handOffHooks, f)
+}
+
+// listen opens addr, or takes over the socket passed by the process that
+// started this one.
+func listen(addr string, c ServerConfig) (net.Listener, error) {
+	if fd := os.Getenv(listenFdEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, err
+		}
+		f := os.NewFile(uintptr(n), "listener")
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	lc := net.ListenConfig{}
+	if c.ReusePort {
+		lc.Control = reusePort
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenAdmin opens the admin socket. It is never passed on by handOff:
+// the new process opens its own next to this one's.
+func listenAdmin(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePort}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var err error
+	cerr := conn.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// notifyReady tells the parent, if there is one, that this process is
+// accepting connections.
+func notifyReady() {
+	fd := os.Getenv(readyFdEnv)
+	os.Unsetenv(listenFdEnv)
+	os.Unsetenv(readyFdEnv)
+	if fd == "" {
+		return
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handOff starts a new copy of the server on ln and waits until it
+// reports that it is serving.
+func handOff(ln net.Listener) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener cannot be passed on")
+	}
+	lf, err := tl.File()
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	for _, f := range handOffHooks {
+		f()
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, listenFdEnv+"=") && !strings.HasPrefix(kv, readyFdEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	// ExtraFiles start at fd 3.
+	env = append(env, listenFdEnv+"=3", readyFdEnv+"=4")
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{lf, readyW}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	// The child closing its end without writing means it died starting up.
+	readyR.SetReadDeadline(time.Now().Add(handOffTimeout))
+	if _, err := io.ReadFull(readyR, make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	cmd.Process.Release()
+	return nil
+}
+
+// serve answers requests on listenAddr until SIGTERM or SIGINT, or until
+// SIGUSR2 has handed the socket to a new process, then drains. With
+// AdminAddr set, h serves everything there, and everything but the admin
+// routes on listenAddr.
+func serve(h http.Handler, c ServerConfig) error {
+	ln, err := listen(listenAddr, c)
+	if err != nil {
+		return err
+	}
+	servers := make([]server, 0, 2)
+	if c.AdminAddr != "" {
+		aln, err := listenAdmin(c.AdminAddr)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		admin := &http.Server{Handler: h}
+		go func() {
+			if err := admin.Serve(aln); err != nil && err != http.ErrServerClosed {
+				log.Printf("admin listener: %s", err)
+			}
+		}()
+		log.Printf("admin routes on %s", aln.Addr())
+		servers = append(servers, admin)
+		h = withoutAdminPaths(h)
+	}
+	var srv server
+	if c.Protocol == "fcgi" {
+		srv = newFastCGIServer(h)
+	} else {
+		srv = &http.Server{Handler: h}
+	}
+	servers = append(servers, srv)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	notifyReady()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case sig := <-sigc:
+			if sig == syscall.SIGUSR2 {
+				if err := handOff(ln); err != nil {
+					log.Printf("restart: %s", err)
+					continue
+				}
+				log.Printf("restart: new process is serving, draining")
+			}
+			return drain(servers, c.drainTimeout())
+		}
+	}
+}
+
+// server is what serve needs of http.Server.
+type server interface {
+	Serve(ln net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+// fastCGIServer gives fcgi.Serve the Shutdown that http.Server has:
+// stop accepting, then wait for the requests in flight.
+type fastCGIServer struct {
+	handler  http.Handler
+	inFlight sync.WaitGroup
+	mu       sync.Mutex
+	ln       net.Listener
+	closed   bool
+}
+
+func newFastCGIServer(h http.Handler) *fastCGIServer {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	return &fastCGIServer{handler: h}
+}
+
+func (s *fastCGIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *fastCGIServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	err := fcgi.Serve(ln, s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+func (s *fastCGIServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func drain(servers []server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	for _, srv := range servers {
+		if serr := srv.Shutdown(ctx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	for _, f := range shutdownHooks {
+		f()
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestListenReusePort(t *testing.T) {
+	c := ServerConfig{ReusePort: true}
+	first, err := listen("127.0.0.1:0", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := listen(first.Addr().String(), c)
+	if err != nil {
+		t.Fatalf("second listener on %s: %s", first.Addr(), err)
+	}
+	second.Close()
+
+	if c := (ServerConfig{}); c.drainTimeout() != defaultDrainTimeout {
+		t.Errorf("drainTimeout() = %s, want %s", c.drainTimeout(), defaultDrainTimeout)
+	}
+}
+
+func TestFastCGIServerShutdown(t *testing.T) {
+	ln, err := listen("127.0.0.1:0", ServerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newFastCGIServer(http.NotFoundHandler())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		t.Errorf("Serve = %v, want ErrServerClosed", err)
+	}
+	if err := (ServerConfig{Protocol: "scgi"}).validate(); err == nil {
+		t.Errorf("validate accepted protocol scgi")
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	first, err := listenAdmin("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// The process started on SIGUSR2 opens it while this one still has it.
+	second, err := listenAdmin(first.Addr().String())
+	if err != nil {
+		t.Fatalf("second admin listener on %s: %s", first.Addr(), err)
+	}
+	second.Close()
+
+	h := withoutAdminPaths(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, want := range map[string]int{
+		"/":               http.StatusOK,
+		"/recent/2":       http.StatusOK,
+		"/administrators": http.StatusOK,
+		"/admin/stats":    http.StatusNotFound,
+		"/metrics":        http.StatusNotFound,
+		"/reset":          http.StatusNotFound,
+		"/debug/pprof/":   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("public %s: %d, want %d", path, w.Code, want)
+		}
+	}
+
+	// With tenants, the public socket hides their admin routes too, the
+	// local tenant's and those proxied to another process.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	tenants := []TenantConfig{{Name: "production"}, {Name: "staging", Backend: backend.URL}}
+	h = withoutAdminPaths(newTenantRouter("production", tenants, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	for path, want := range map[string]int{
+		"/t/production/recent/2":    http.StatusOK,
+		"/t/staging/recent/2":       http.StatusOK,
+		"/t/production/admin/stats": http.StatusNotFound,
+		"/t/production/reset":       http.StatusNotFound,
+		"/t/staging/admin/stats":    http.StatusNotFound,
+		"/t/staging/metrics":        http.StatusNotFound,
+		"/t/staging/debug/pprof/":   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("public %s: %d, want %d", path, w.Code, want)
+		}
+	}
+
+	if err := (ServerConfig{AdminAddr: "localhost"}).validate(); err == nil {
+		t.Errorf("validate accepted admin_addr without a port")
+	}
+	if err := (ServerConfig{AdminAddr: "127.0.0.1:5001"}).validate(); err != nil {
+		t.Error(err)
+	}
+}
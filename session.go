@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"./sessions"
+)
+
+// sessionSecretEnv names the environment variable that, when set, takes
+// precedence over session.secret.
+const sessionSecretEnv = "ISUCON_SESSION_SECRET"
+
+// SessionConfig picks where session values are kept: in files under
+// sessionFile ("filesystem", the default), or in the cookie itself
+// ("cookie"), signed and encrypted, so that any app server can read them
+// without shared storage. Cookie sessions can't be revoked server-side:
+// signing out clears the cookie in the browser only.
+//
+// Secret replaces the secret in the source, which anyone who has read it
+// could forge cookie sessions with, so the cookie store needs one.
+type SessionConfig struct {
+	Store  string `json:"store"`
+	Secret string `json:"secret"`
+}
+
+// secret is the configured session secret, or "" for the default.
+func (c SessionConfig) secret() string {
+	if s := os.Getenv(sessionSecretEnv); s != "" {
+		return s
+	}
+	return c.Secret
+}
+
+// ownSecret is whether a secret other than the one in the source is set.
+func (c SessionConfig) ownSecret() bool {
+	s := c.secret()
+	return s != "" && s != defaultSessionSecret
+}
+
+func (c SessionConfig) validate() error {
+	switch c.Store {
+	case "", "filesystem":
+	case "cookie":
+		if !c.ownSecret() {
+			return fmt.Errorf("config: the cookie session store needs session.secret or $%s", sessionSecretEnv)
+		}
+	default:
+		return fmt.Errorf("config: unknown session store %q", c.Store)
+	}
+	if s := c.secret(); s != "" && len(s) < minSessionSecretLen {
+		return fmt.Errorf("config: the session secret is %d bytes, want at least %d", len(s), minSessionSecretLen)
+	}
+	return nil
+}
+
+var (
+	cookieSessions bool
+	// sessionSecret signs the filesystem store's cookies and is what
+	// sessionKey derives the other keys from.
+	sessionSecret = defaultSessionSecret
+)
+
+func setupSessions(c SessionConfig) {
+	cookieSessions = c.Store == "cookie"
+	sessionSecret = defaultSessionSecret
+	if s := c.secret(); s != "" {
+		sessionSecret = s
+	}
+}
+
+// sessionKey derives a key for purpose from sessionSecret, so that the
+// cookie store's signing and encryption keys differ.
+func sessionKey(purpose string) []byte {
+	sum := sha256.Sum256([]byte(purpose + "\x00" + sessionSecret))
+	return sum[:]
+}
+
+func newSessionStore() sessions.Store {
+	if cookieSessions {
+		return sessions.NewCookieStore(sessionKey("auth"), sessionKey("encrypt"))
+	}
+	return sessions.NewFilesystemStore(sessionFile, []byte(sessionSecret))
+}
+
+// anonymousSession is the session of a request without a session cookie.
+// There is nothing to load for it, so neither the store nor the session
+// registry is touched, and it is not counted as a session cache miss;
+// the store is only opened if the session gets saved.
+func anonymousSession() *sessions.Session {
+	session := sessions.NewSession(lazySessionStore{}, sessionName)
+	session.IsNew = true
+	session.Values[sessionVersionKey] = sessionVersion()
+	return session
+}
+
+// lazySessionStore opens the filesystem store when it is first needed.
+type lazySessionStore struct{}
+
+func (lazySessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return newSessionStore().Get(r, name)
+}
+
+func (lazySessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	return newSessionStore().New(r, name)
+}
+
+func (lazySessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options == nil {
+		session.Options = &sessions.Options{Path: "/", MaxAge: int(sessionMaxAge / time.Second)}
+	}
+	return newSessionStore().Save(r, w, session)
+}
+
+// sessionVersionKey holds the version of the layout of a session's
+// values, which is the number of sessionMigrations applied to it.
+const sessionVersionKey = "_v"
+
+// sessionMigrations bring the values of a session saved by an older
+// version of the app up to date, one version at a time. A migration that
+// fails drops the values, which signs the session out instead of letting
+// a handler trip over a value of the wrong type. Append to the list;
+// never change a migration that has shipped.
+var sessionMigrations = []func(values map[interface{}]interface{}) error{
+	// 0 → 1: sessions saved before they had a version. Check the types of
+	// the values and normalize user_id to an int.
+	func(values map[interface{}]interface{}) error {
+		switch id := values["user_id"].(type) {
+		case nil, int:
+		case int64:
+			values["user_id"] = int(id)
+		case string:
+			n, err := strconv.Atoi(id)
+			if err != nil {
+				return fmt.Errorf("user_id %q", id)
+			}
+			values["user_id"] = n
+		default:
+			return fmt.Errorf("user_id of type %T", id)
+		}
+		if token, ok := values["token"]; ok {
+			if _, ok := token.(string); !ok {
+				return fmt.Errorf("token of type %T", token)
+			}
+		}
+		if _, ok := values["theme"].(string); !ok {
+			delete(values, "theme")
+		}
+		if _, ok := values[noticesKey].([]interface{}); !ok {
+			delete(values, noticesKey)
+		}
+		return nil
+	},
+}
+
+func sessionVersion() int {
+	return len(sessionMigrations)
+}
+
+// migrateSession brings session up to the current version, and reports
+// whether its values changed. A session from a newer version, which this
+// one can't know how to read, is dropped like one that fails to migrate.
+func migrateSession(session *sessions.Session) bool {
+	version, _ := session.Values[sessionVersionKey].(int)
+	if version == sessionVersion() {
+		return false
+	}
+	var err error
+	if version > sessionVersion() {
+		err = fmt.Errorf("version %d is newer than %d", version, sessionVersion())
+	}
+	for ; err == nil && version < sessionVersion(); version++ {
+		if err = sessionMigrations[version](session.Values); err != nil {
+			err = fmt.Errorf("migrating from version %d: %s", version, err)
+		}
+	}
+	if err != nil {
+		log.Printf("session: dropping values: %s", err)
+		session.Values = make(map[interface{}]interface{})
+	}
+	session.Values[sessionVersionKey] = sessionVersion()
+	return true
+}
+
+// sessionPath is where the filesystem store keeps the session id.
+func sessionPath(id string) string {
+	return filepath.Join(sessionFile, "session_"+id)
+}
+
+// regenerateSession saves session under a new id and deletes the old
+// one, so that an id planted in the browser before a privilege change is
+// useless after it.
+func regenerateSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	old := session.ID
+	session.ID = ""
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
+	if old != "" {
+		if err := os.Remove(sessionPath(old)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroySession deletes session from the store and the browser.
+func destroySession(w http.ResponseWriter, session *sessions.Session) error {
+	http.SetCookie(w, sessions.NewCookie(sessionName, "", &sessions.Options{MaxAge: -1}))
+	if session.ID == "" {
+		return nil
+	}
+	if err := os.Remove(sessionPath(session.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"./sessions"
+)
+
+func TestRegenerateSession(t *testing.T) {
+	if err := os.MkdirAll(sessionFile, 0777); err != nil {
+		t.Skip(err)
+	}
+	store := sessions.NewFilesystemStore(sessionFile, []byte(sessionSecret))
+	r := httptest.NewRequest("POST", "/signin", nil)
+	session, _ := store.New(r, sessionName)
+	if err := session.Save(r, httptest.NewRecorder()); err != nil {
+		t.Fatal(err)
+	}
+	planted := session.ID
+
+	w := httptest.NewRecorder()
+	session.Values["user_id"] = 1
+	if err := regenerateSession(w, r, session); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(sessionPath(session.ID))
+	if session.ID == planted {
+		t.Fatalf("session id was not changed")
+	}
+	if _, err := os.Stat(sessionPath(planted)); !os.IsNotExist(err) {
+		t.Errorf("old session file still exists (%v)", err)
+	}
+	if _, err := os.Stat(sessionPath(session.ID)); err != nil {
+		t.Errorf("new session file: %s", err)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].Value != session.ID {
+		t.Errorf("cookies = %v, want the new id", c)
+	}
+}
+
+func TestAnonymousSession(t *testing.T) {
+	defer func(dir string) { sessionFile = dir }(sessionFile)
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sessionFile = dir
+
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := loadSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, lazy := session.Store().(lazySessionStore); !lazy || !session.IsNew {
+		t.Fatalf("a request without a cookie got a session from %T", session.Store())
+	}
+
+	w := httptest.NewRecorder()
+	session.Values["theme"] = "minimal"
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Path != "/" {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	if _, err := os.Stat(sessionPath(session.ID)); err != nil {
+		t.Fatalf("saved session: %s", err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	loaded, err := loadSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IsNew || loaded.Values["theme"] != "minimal" {
+		t.Errorf("loaded %+v, want the saved session", loaded)
+	}
+}
+
+func TestCookieSessions(t *testing.T) {
+	defer func(dir string) { sessionFile = dir; setupSessions(SessionConfig{}) }(sessionFile)
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sessionFile = dir
+	setupSessions(SessionConfig{Store: "cookie", Secret: strings.Repeat("s", minSessionSecretLen)})
+
+	r := httptest.NewRequest("POST", "/signin", nil)
+	session, _ := loadSession(httptest.NewRecorder(), r)
+	session.Values["user_id"] = 7
+	session.Values["token"] = "abc"
+	w := httptest.NewRecorder()
+	if err := regenerateSession(w, r, session); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("cookie sessions wrote %d files", len(files))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || strings.Contains(cookies[0].Value, "abc") {
+		t.Fatalf("cookies = %v", cookies)
+	}
+
+	r = httptest.NewRequest("GET", "/mypage", nil)
+	r.AddCookie(cookies[0])
+	loaded, err := loadSession(httptest.NewRecorder(), r)
+	if err != nil || loaded.Values["user_id"] != 7 || loaded.Values["token"] != "abc" {
+		t.Fatalf("loaded %v, %v", loaded.Values, err)
+	}
+
+	r = httptest.NewRequest("GET", "/mypage", nil)
+	r.AddCookie(&http.Cookie{Name: sessionName, Value: cookies[0].Value[:len(cookies[0].Value)-4] + "AAAA"})
+	if tampered, err := loadSession(httptest.NewRecorder(), r); err == nil && tampered.Values["user_id"] != nil {
+		t.Errorf("a tampered cookie was accepted: %v", tampered.Values)
+	}
+
+	if err := (SessionConfig{Store: "memcache"}).validate(); err == nil {
+		t.Errorf("unknown session store accepted")
+	}
+}
+
+func TestSessionSecret(t *testing.T) {
+	defer setupSessions(SessionConfig{})
+	defer os.Unsetenv(sessionSecretEnv)
+	secret := strings.Repeat("s", minSessionSecretLen)
+	for _, c := range []struct {
+		config SessionConfig
+		ok     bool
+	}{
+		{SessionConfig{}, true},
+		{SessionConfig{Store: "cookie"}, false},
+		{SessionConfig{Store: "cookie", Secret: defaultSessionSecret}, false},
+		{SessionConfig{Store: "cookie", Secret: "short"}, false},
+		{SessionConfig{Store: "filesystem", Secret: "short"}, false},
+		{SessionConfig{Store: "cookie", Secret: secret}, true},
+	} {
+		if err := c.config.validate(); (err == nil) != c.ok {
+			t.Errorf("%+v: %v", c.config, err)
+		}
+	}
+
+	os.Setenv(sessionSecretEnv, secret)
+	if err := (SessionConfig{Store: "cookie"}).validate(); err != nil {
+		t.Errorf("secret from the environment: %v", err)
+	}
+	setupSessions(SessionConfig{Store: "cookie", Secret: "from the config file, overridden"})
+	if sessionSecret != secret {
+		t.Errorf("session secret %q, want the environment's", sessionSecret)
+	}
+	os.Unsetenv(sessionSecretEnv)
+	setupSessions(SessionConfig{})
+	if sessionSecret != defaultSessionSecret {
+		t.Errorf("session secret %q without one configured", sessionSecret)
+	}
+}
+
+func TestMigrateSession(t *testing.T) {
+	defer func(dir string) { sessionFile = dir }(sessionFile)
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sessionFile = dir
+
+	// A session saved before sessions had a version, by a build that
+	// stored user_id as an int64.
+	store := sessions.NewFilesystemStore(sessionFile, []byte(sessionSecret))
+	r := httptest.NewRequest("GET", "/", nil)
+	old, _ := store.New(r, sessionName)
+	old.Values["user_id"] = int64(7)
+	old.Values["token"] = "abc"
+	w := httptest.NewRecorder()
+	if err := old.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	loaded, err := loadSession(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Values["user_id"] != 7 || loaded.Values["token"] != "abc" || loaded.Values[sessionVersionKey] != sessionVersion() {
+		t.Errorf("migrated values = %v", loaded.Values)
+	}
+	saved, err := sessions.NewFilesystemStore(sessionFile, []byte(sessionSecret)).Get(r, sessionName)
+	if err != nil || saved.Values[sessionVersionKey] != sessionVersion() {
+		t.Errorf("migrated session was not saved: %v, %v", saved.Values, err)
+	}
+
+	for name, values := range map[string]map[interface{}]interface{}{
+		"bad user_id": {"user_id": 7.5, "token": "abc"},
+		"bad token":   {"user_id": 7, "token": 1},
+		"newer":       {"user_id": 7, sessionVersionKey: sessionVersion() + 1},
+	} {
+		session := sessions.NewSession(store, sessionName)
+		session.Values = values
+		if !migrateSession(session) {
+			t.Errorf("%s: not migrated", name)
+		}
+		if len(session.Values) != 1 || session.Values[sessionVersionKey] != sessionVersion() {
+			t.Errorf("%s: values = %v, want them dropped", name, session.Values)
+		}
+	}
+
+	current := sessions.NewSession(store, sessionName)
+	current.Values = map[interface{}]interface{}{"user_id": 7, sessionVersionKey: sessionVersion()}
+	if migrateSession(current) {
+		t.Errorf("a current session was migrated")
+	}
+}
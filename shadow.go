@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The public list as it was read before the memo cache held it, paged
+// by MySQL. Shadow reads compare the cache with these; the contract
+// tests check the same thing against a fixed database.
+const (
+	shadowListedSQL = "SELECT " + memoColumns + " FROM memos WHERE " + listedCond + " ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+	shadowCountSQL  = "SELECT count(*) FROM memos WHERE " + listedCond
+	shadowBeforeSQL = "SELECT " + memoColumns + " FROM memos WHERE " + listedCond + " AND (created_at < ? OR (created_at = ? AND id < ?)) ORDER BY created_at DESC, id DESC LIMIT ?"
+
+	// maxShadowInFlight bounds the shadow reads running at once; a read
+	// sampled while they are all busy is skipped rather than queued.
+	maxShadowInFlight = 2
+	shadowTimeout     = 2 * time.Second
+	// shadowKept is how many divergences /admin/shadow shows.
+	shadowKept = 20
+)
+
+// ShadowDivergence is a shadow read whose result differed from the
+// cache's.
+type ShadowDivergence struct {
+	At     string `json:"at"`
+	Read   string `json:"read"`
+	Detail string `json:"detail"`
+}
+
+type ShadowStats struct {
+	Rate     float64 `json:"rate"`
+	Sampled  int64   `json:"sampled"`
+	Skipped  int64   `json:"skipped"`
+	Matched  int64   `json:"matched"`
+	Diverged int64   `json:"diverged"`
+	Errors   int64   `json:"errors"`
+	// PrimaryMs and SecondaryMs are the mean times of the cache and the
+	// SQL reads compared.
+	PrimaryMs   float64             `json:"primary_ms"`
+	SecondaryMs float64             `json:"secondary_ms"`
+	Recent      []*ShadowDivergence `json:"recent"`
+}
+
+var (
+	shadowMutex              sync.Mutex
+	shadowStats              ShadowStats
+	shadowPrimary, shadowSQL time.Duration
+	shadowSlots              = make(chan struct{}, maxShadowInFlight)
+	// shadowPending lets tests wait for the reads they started.
+	shadowPending sync.WaitGroup
+)
+
+// shadowListedPage mirrors a read of page of the public list, when the
+// shadow_reads sample picks it.
+func shadowListedPage(page int) {
+	shadowRead(fmt.Sprintf("listed page %d", page), func() (Memos, int) {
+		return listedPage(page)
+	}, func(ctx context.Context, q querier) (Memos, int, error) {
+		var total int
+		if err := q.QueryRowContext(ctx, shadowCountSQL).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+		memos, err := queryMemos(ctx, q, shadowListedSQL, memosPerPage, page*memosPerPage)
+		return memos, total, err
+	})
+}
+
+// shadowListedBefore mirrors a read of the public list by cursor.
+func shadowListedBefore(createdAt time.Time, id int) {
+	shadowRead(fmt.Sprintf("listed before %s/%d", formatDBTime(createdAt), id), func() (Memos, int) {
+		return listedBefore(createdAt, id), -1
+	}, func(ctx context.Context, q querier) (Memos, int, error) {
+		at := formatDBTime(createdAt)
+		memos, err := queryMemos(ctx, q, shadowBeforeSQL, at, at, id, memosPerPage)
+		return memos, -1, err
+	})
+}
+
+// shadowRead runs primary, the read the request was answered from, and
+// secondary against the database in the background, and records whether
+// they agree and how long each took. The request does not wait for it.
+// Both reads run together after the request, but a memo written in
+// between can still show up as a divergence that is gone on the next
+// read. A total of -1 is not compared.
+func shadowRead(read string, primary func() (Memos, int), secondary func(ctx context.Context, q querier) (Memos, int, error)) {
+	rate := currentRuntimeConfig().ShadowReads
+	if rate <= 0 || rand.Float64() >= rate {
+		return
+	}
+	select {
+	case shadowSlots <- struct{}{}:
+	default:
+		shadowCount(func(s *ShadowStats) { s.Skipped++ })
+		return
+	}
+	shadowPending.Add(1)
+	go func() {
+		defer shadowPending.Done()
+		defer func() { <-shadowSlots }()
+		// Only a connection no request is waiting for is borrowed.
+		dbConn := tryDBConn()
+		if dbConn == nil {
+			shadowCount(func(s *ShadowStats) { s.Skipped++ })
+			return
+		}
+		defer func() {
+			dbConnPool <- dbConn
+		}()
+
+		start := time.Now()
+		want, wantTotal := primary()
+		primaryTime := time.Since(start)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+		defer cancel()
+		start = time.Now()
+		got, gotTotal, err := secondary(ctx, dbConn)
+		secondaryTime := time.Since(start)
+		if err != nil {
+			log.Printf("shadow: %s: %s", read, err)
+			shadowCount(func(s *ShadowStats) { s.Sampled++; s.Errors++ })
+			return
+		}
+		detail := shadowDiff(want, wantTotal, got, gotTotal)
+		if detail != "" {
+			log.Printf("shadow: %s diverged: %s", read, detail)
+		}
+		shadowMutex.Lock()
+		defer shadowMutex.Unlock()
+		shadowStats.Sampled++
+		shadowPrimary += primaryTime
+		shadowSQL += secondaryTime
+		if detail == "" {
+			shadowStats.Matched++
+			return
+		}
+		shadowStats.Diverged++
+		d := &ShadowDivergence{At: time.Now().Format(time.RFC3339), Read: read, Detail: detail}
+		shadowStats.Recent = append([]*ShadowDivergence{d}, shadowStats.Recent...)
+		if len(shadowStats.Recent) > shadowKept {
+			shadowStats.Recent = shadowStats.Recent[:shadowKept]
+		}
+	}()
+}
+
+// tryDBConn takes a connection from the pool if one is free.
+func tryDBConn() *sql.DB {
+	select {
+	case conn := <-dbConnPool:
+		return conn
+	default:
+		return nil
+	}
+}
+
+func shadowCount(fn func(s *ShadowStats)) {
+	shadowMutex.Lock()
+	fn(&shadowStats)
+	shadowMutex.Unlock()
+}
+
+// shadowDiff describes the first difference between the cache's memos
+// and the database's, or returns "" if they match in ids, order and
+// versions.
+func shadowDiff(want Memos, wantTotal int, got Memos, gotTotal int) string {
+	if wantTotal != gotTotal {
+		return fmt.Sprintf("total: cache %d, db %d", wantTotal, gotTotal)
+	}
+	for i := 0; i < len(want) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Sprintf("#%d: cache memo %d, db none", i, want[i].Id)
+		case i >= len(want):
+			return fmt.Sprintf("#%d: cache none, db memo %d", i, got[i].Id)
+		case want[i].Id != got[i].Id:
+			return fmt.Sprintf("#%d: cache memo %d, db memo %d", i, want[i].Id, got[i].Id)
+		case want[i].Version != got[i].Version:
+			return fmt.Sprintf("#%d: memo %d version: cache %d, db %d", i, want[i].Id, want[i].Version, got[i].Version)
+		}
+	}
+	return ""
+}
+
+func currentShadowStats() ShadowStats {
+	shadowMutex.Lock()
+	defer shadowMutex.Unlock()
+	s := shadowStats
+	s.Rate = currentRuntimeConfig().ShadowReads
+	s.Recent = append(make([]*ShadowDivergence, 0, len(s.Recent)), s.Recent...)
+	if compared := s.Matched + s.Diverged; compared > 0 {
+		s.PrimaryMs = float64(shadowPrimary) / float64(compared) / float64(time.Millisecond)
+		s.SecondaryMs = float64(shadowSQL) / float64(compared) / float64(time.Millisecond)
+	}
+	return s
+}
+
+// shadowHandler shows how the shadow reads compare so far.
+func shadowHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentShadowStats())
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShadowReads(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 9, Users: 3, Memos: 30})
+	defer setRuntimeConfig(currentRuntimeConfig())
+	rc := currentRuntimeConfig()
+	rc.ShadowReads = 1
+	setRuntimeConfig(rc)
+	shadowCount(func(s *ShadowStats) { *s = ShadowStats{} })
+
+	app.get(t, "/")
+	app.get(t, "/api/memos")
+	first, _ := listedPage(0)
+	app.get(t, "/api/memos?cursor="+encodeCursor(first[len(first)-1]))
+	shadowPending.Wait()
+	if s := currentShadowStats(); s.Matched != 3 || s.Diverged != 0 || s.Errors != 0 {
+		t.Fatalf("consistent cache: %+v", s)
+	}
+
+	// Hide a listed memo behind the cache's back.
+	db := <-dbConnPool
+	dbConnPool <- db
+	if _, err := db.Exec("UPDATE memos SET hidden=1, version=version+1, updated_at=now() WHERE id=?", first[2].Id); err != nil {
+		t.Fatal(err)
+	}
+	app.get(t, "/api/recent/0")
+	shadowPending.Wait()
+	s := currentShadowStats()
+	if s.Diverged != 1 || len(s.Recent) != 1 || !strings.Contains(s.Recent[0].Detail, "total") {
+		t.Errorf("after drift: %+v", s)
+	}
+
+	rc.ShadowReads = 0
+	setRuntimeConfig(rc)
+	app.get(t, "/")
+	shadowPending.Wait()
+	if after := currentShadowStats(); after.Sampled != s.Sampled {
+		t.Errorf("shadow reads ran while off")
+	}
+
+	if shadowDiff(Memos{first[0]}, 1, Memos{first[0], first[1]}, 1) == "" {
+		t.Errorf("a missing memo went unnoticed")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"./sessions"
+)
+
+const (
+	defaultStaleBudgetMB = 8
+	// maxStaleAge is the oldest copy of a page served in place of one
+	// that misses its deadline.
+	maxStaleAge = 5 * time.Minute
+	// maxBackgroundRenders caps the renders left running after a stale
+	// copy was served in their place.
+	maxBackgroundRenders = 16
+)
+
+// staleCache keeps the last page each viewer was served by the routes
+// withSLO wraps. It is apart from pageCache, which is purged on every
+// change to the public list, just when a stale copy is most wanted.
+var staleCache = newRenderCache(defaultStaleBudgetMB<<20, false)
+
+// sloStats counts per route the requests that missed their deadline,
+// served from a stale copy or, when there was none, waited for.
+var sloStats = struct {
+	sync.Mutex
+	stale, missed map[string]int64
+}{stale: make(map[string]int64), missed: make(map[string]int64)}
+
+// backgroundRenders holds the stale keys whose render is running after
+// its request was answered, so that the page isn't rendered twice at once
+// and a slow database doesn't pile renders up.
+var backgroundRenders = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// startBackground claims a background render for key, unless one is
+// running for it already or maxBackgroundRenders are.
+func startBackground(key string) bool {
+	backgroundRenders.Lock()
+	defer backgroundRenders.Unlock()
+	if backgroundRenders.keys[key] || len(backgroundRenders.keys) >= maxBackgroundRenders {
+		return false
+	}
+	backgroundRenders.keys[key] = true
+	return true
+}
+
+func endBackground(key string) {
+	backgroundRenders.Lock()
+	delete(backgroundRenders.keys, key)
+	backgroundRenders.Unlock()
+}
+
+func renderingInBackground(key string) bool {
+	backgroundRenders.Lock()
+	defer backgroundRenders.Unlock()
+	return backgroundRenders.keys[key]
+}
+
+// sloDeadline returns the deadline for route, falling back to the "*"
+// entry.
+func sloDeadline(c RuntimeConfig, route string) time.Duration {
+	ms, ok := c.SLOMs[route]
+	if !ok {
+		ms = c.SLOMs["*"]
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// detachedWriter buffers a response, headers included, so that the
+// handler writing it can go on after the request was answered without it.
+type detachedWriter struct {
+	header   http.Header
+	buf      bytes.Buffer
+	code     int
+	panicked interface{}
+}
+
+func (w *detachedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *detachedWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *detachedWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.buf.Write(b)
+}
+
+func (w *detachedWriter) copyTo(dst http.ResponseWriter) {
+	for k, v := range w.header {
+		dst.Header()[k] = v
+	}
+	if w.code != 0 {
+		dst.WriteHeader(w.code)
+	}
+	dst.Write(w.buf.Bytes())
+}
+
+// withSLO gives a list page the deadline slo_ms sets for its route. A
+// page not rendered by then is answered with the copy last served to the
+// same viewer, if there is one from the last few minutes, and the render
+// goes on in the background to become the next copy; until it is done,
+// the page is answered with the copy without rendering it again. Without
+// a copy, or with maxBackgroundRenders running, the request waits as it
+// would have. Requests with notices waiting are not cut short, since the
+// render takes them.
+func withSLO(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := routeName(r)
+		deadline := sloDeadline(currentRuntimeConfig(), route)
+		if deadline == 0 || r.Method != "GET" && r.Method != "HEAD" {
+			h(w, r)
+			return
+		}
+		session, err := loadSession(w, r)
+		if err != nil {
+			h(w, r)
+			return
+		}
+		if _, ok := session.Values[noticesKey]; ok {
+			h(w, r)
+			return
+		}
+
+		key := staleKey(r, session)
+		if renderingInBackground(key) {
+			if body, age, ok := staleCopy(key); ok {
+				writeStale(w, route, body, age)
+				return
+			}
+		}
+		dw := &detachedWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		// The render may outlive the request, so it must not be canceled
+		// with it.
+		detached := r.WithContext(context.WithoutCancel(r.Context()))
+		go func() {
+			defer close(done)
+			defer func() {
+				dw.panicked = recover()
+			}()
+			h(dw, detached)
+			if dw.code == http.StatusOK {
+				staleCache.Set(key, dw.buf.Bytes(), int(time.Now().Unix()))
+			}
+		}()
+
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+		select {
+		case <-done:
+			finishDetached(w, dw)
+			return
+		case <-timer.C:
+		}
+		if body, age, ok := staleCopy(key); ok && startBackground(key) {
+			go func() {
+				logDetachedPanic(route, dw, done)
+				endBackground(key)
+			}()
+			writeStale(w, route, body, age)
+			return
+		}
+		countSLO(route, false)
+		<-done
+		finishDetached(w, dw)
+	}
+}
+
+// staleCopy returns the copy kept under key and its age, if it is recent
+// enough to serve.
+func staleCopy(key string) ([]byte, time.Duration, bool) {
+	body, at, ok := staleCache.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	age := time.Since(time.Unix(int64(at), 0))
+	return body, age, age <= maxStaleAge
+}
+
+func writeStale(w http.ResponseWriter, route string, body []byte, age time.Duration) {
+	countSLO(route, true)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Write(body)
+}
+
+// finishDetached sends the response the handler wrote, or raises its
+// panic again in the request's goroutine where net/http recovers it.
+func finishDetached(w http.ResponseWriter, dw *detachedWriter) {
+	if dw.panicked != nil {
+		panic(dw.panicked)
+	}
+	dw.copyTo(w)
+}
+
+func logDetachedPanic(route string, dw *detachedWriter, done chan struct{}) {
+	<-done
+	if dw.panicked != nil {
+		log.Printf("slo: %s: panic in background render: %v", route, dw.panicked)
+	}
+}
+
+// staleKey tells apart the copies of a page by theme and session, since
+// they carry the viewer's name and CSRF token.
+func staleKey(r *http.Request, session *sessions.Session) string {
+	token, _ := session.Values["token"].(string)
+	return r.URL.RequestURI() + "#" + themeFor(session) + "#" + token
+}
+
+func countSLO(route string, stale bool) {
+	sloStats.Lock()
+	if stale {
+		sloStats.stale[route]++
+	} else {
+		sloStats.missed[route]++
+	}
+	sloStats.Unlock()
+}
+
+// writeSLOMetrics adds the SLO counters to the Prometheus output.
+func writeSLOMetrics(w io.Writer) {
+	sloStats.Lock()
+	defer sloStats.Unlock()
+	for _, m := range []struct {
+		name, help string
+		counts     map[string]int64
+	}{
+		{"isucon_slo_stale_total", "List pages that missed their deadline and were served from a stale copy.", sloStats.stale},
+		{"isucon_slo_missed_total", "List pages that missed their deadline with no stale copy to serve.", sloStats.missed},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		routes := make([]string, 0, len(m.counts))
+		for route := range m.counts {
+			routes = append(routes, route)
+		}
+		sort.Strings(routes)
+		for _, route := range routes {
+			fmt.Fprintf(w, "%s{route=%q} %d\n", m.name, route, m.counts[route])
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithSLO(t *testing.T) {
+	defer setRuntimeConfig(currentRuntimeConfig())
+	setRuntimeConfig(RuntimeConfig{SLOMs: map[string]int{"/slow": 20}})
+	staleCache.Purge()
+
+	release := make(chan struct{})
+	body := "fresh"
+	var renders int32
+	h := withSLO(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&renders, 1)
+		if r.FormValue("wait") == "1" {
+			<-release
+		}
+		w.Write([]byte(body))
+	})
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/slow"+query, nil))
+		return w
+	}
+
+	if w := get(""); w.Body.String() != "fresh" || w.Header().Get("Warning") != "" {
+		t.Fatalf("fast render: %q %v", w.Body.String(), w.Header())
+	}
+
+	// A page without a copy waits for its render.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	start := time.Now()
+	if w := get("?wait=1"); w.Body.String() != "fresh" || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("no copy: %q after %s", w.Body.String(), time.Since(start))
+	}
+
+	// Once it has one, a slow render is answered from it.
+	release = make(chan struct{})
+	body = "newer"
+	w := get("?wait=1")
+	if w.Body.String() != "fresh" || !strings.Contains(w.Header().Get("Warning"), "Stale") {
+		t.Errorf("slow render: %q %v", w.Body.String(), w.Header())
+	}
+	// While that render runs, the page is not rendered again.
+	n := atomic.LoadInt32(&renders)
+	if w := get("?wait=1"); w.Body.String() != "fresh" || atomic.LoadInt32(&renders) != n {
+		t.Errorf("during the background render: %q, %d more renders", w.Body.String(), atomic.LoadInt32(&renders)-n)
+	}
+	close(release)
+	key := "/slow?wait=1#" + defaultTheme + "#"
+	deadline := time.Now().Add(time.Second)
+	for {
+		if copy, _, _ := staleCache.Get(key); string(copy) == "newer" && !renderingInBackground(key) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the background render was not kept")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// With the background full, a slow render is waited for.
+	for i := 0; i < maxBackgroundRenders; i++ {
+		startBackground("other" + strconv.Itoa(i))
+	}
+	release = make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	if w := get("?wait=1"); w.Body.String() != "newer" || w.Header().Get("Warning") != "" {
+		t.Errorf("background full: %q %v", w.Body.String(), w.Header())
+	}
+	for i := 0; i < maxBackgroundRenders; i++ {
+		endBackground("other" + strconv.Itoa(i))
+	}
+
+	sloStats.Lock()
+	stale, missed := sloStats.stale["/slow"], sloStats.missed["/slow"]
+	sloStats.Unlock()
+	if stale != 2 || missed != 2 {
+		t.Errorf("stale = %d, missed = %d", stale, missed)
+	}
+	var metrics strings.Builder
+	writeSLOMetrics(&metrics)
+	if !strings.Contains(metrics.String(), `isucon_slo_stale_total{route="/slow"} 2`) {
+		t.Errorf("metrics:\n%s", metrics.String())
+	}
+}
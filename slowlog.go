@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const slowEventCount = 200
+
+type SlowEvent struct {
+	Kind       string  `json:"kind"`
+	RequestId  string  `json:"request_id,omitempty"`
+	Time       string  `json:"time"`
+	Route      string  `json:"route"`
+	Statement  string  `json:"statement,omitempty"`
+	ParamsHash string  `json:"params_hash"`
+	DurationMs float64 `json:"duration_ms"`
+	UserId     int     `json:"user_id,omitempty"`
+	ClientIP   string  `json:"client_ip,omitempty"`
+}
+
+// slowLog keeps the most recent slow events in a fixed-size ring.
+type slowLog struct {
+	sync.Mutex
+	events [slowEventCount]SlowEvent
+	next   int
+	full   bool
+}
+
+var slowEvents = &slowLog{}
+
+func (l *slowLog) add(e SlowEvent) {
+	l.Lock()
+	l.events[l.next] = e
+	l.next = (l.next + 1) % slowEventCount
+	if l.next == 0 {
+		l.full = true
+	}
+	l.Unlock()
+}
+
+// Recent returns the recorded events, newest first.
+func (l *slowLog) Recent() []SlowEvent {
+	l.Lock()
+	defer l.Unlock()
+	n := l.next
+	if l.full {
+		n = slowEventCount
+	}
+	events := make([]SlowEvent, 0, n)
+	for i := 1; i <= n; i++ {
+		events = append(events, l.events[(l.next-i+slowEventCount)%slowEventCount])
+	}
+	return events
+}
+
+func paramsHash(v interface{}) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprint(v))))[:12]
+}
+
+func recordSlow(e SlowEvent, d time.Duration) {
+	e.Time = time.Now().Format(time.RFC3339Nano)
+	e.DurationMs = float64(d) / float64(time.Millisecond)
+	log.Printf("slow %s: req=%s route=%s params=%s duration=%.1fms user=%d ip=%s %s",
+		e.Kind, e.RequestId, e.Route, e.ParamsHash, e.DurationMs, e.UserId, e.ClientIP, e.Statement)
+	slowEvents.add(e)
+}
+
+func recordSlowQuery(ctx context.Context, query string, args []interface{}, d time.Duration) {
+	threshold := currentRuntimeConfig().SlowQueryMs
+	if threshold == 0 || d < time.Duration(threshold)*time.Millisecond {
+		return
+	}
+	e := SlowEvent{Kind: "query", Statement: query, ParamsHash: paramsHash(args)}
+	if info := requestInfoFrom(ctx); info != nil {
+		e.RequestId = info.Id
+		e.Route = info.Route
+		e.UserId = info.UserId
+		e.ClientIP = info.ClientIP
+	}
+	recordSlow(e, d)
+}
+
+func slowRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		d := time.Since(start)
+
+		threshold := currentRuntimeConfig().SlowRequestMs
+		if threshold == 0 || d < time.Duration(threshold)*time.Millisecond {
+			return
+		}
+		e := SlowEvent{Kind: "request", ParamsHash: paramsHash(r.URL.RawQuery)}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			e.RequestId = info.Id
+			e.Route = info.Route
+			e.UserId = info.UserId
+			e.ClientIP = info.ClientIP
+		}
+		recordSlow(e, d)
+	})
+}
+
+func slowEventsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, slowEvents.Recent())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const slugMaxRunes = 60
+
+// memoSlug turns a title into the readable part of a memo URL: letters and
+// digits lowercased, everything else collapsed into single hyphens.
+func memoSlug(title string) string {
+	var b strings.Builder
+	n := 0
+	hyphen := false
+	for _, r := range title {
+		if n >= slugMaxRunes {
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+				n++
+			}
+			b.WriteRune(unicode.ToLower(r))
+			n++
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	return b.String()
+}
+
+// assignSlug stores a slug for a newly inserted memo. Slugs are unique, and
+// the unique index decides between memos posted at once: a title that is
+// already taken gets the memo id appended. Should that be taken too, by a
+// title ending in the same number, the memo keeps a NULL slug and a plain
+// numeric URL, as do memos whose title has no letters or digits.
+func assignSlug(ctx context.Context, q querier, id int64, content string) error {
+	slug := memoSlug(memoTitle(content))
+	if slug == "" {
+		return nil
+	}
+	for _, s := range []string{slug, fmt.Sprintf("%s-%d", slug, id)} {
+		_, err := execSQL(ctx, q, "UPDATE memos SET slug=? WHERE id=?", s, id)
+		if !duplicateEntry(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Path is the canonical, escaped URL path of the memo.
+func (memo *Memo) Path() string {
+	if memo.Slug == "" {
+		return "/memo/" + strconv.Itoa(memo.Id)
+	}
+	return "/memo/" + strconv.Itoa(memo.Id) + "-" + url.PathEscape(memo.Slug)
+}
+
+// memoPath is Path for a memo known only by id.
+func memoPath(id int) string {
+	if memo, ok := memoCache.Get(id); ok {
+		return memo.Path()
+	}
+	return "/memo/" + strconv.Itoa(id)
+}
+
+// parseMemoRef reads the id from a "123" or "123-some-slug" path segment.
+// Only the id is used to find the memo; the slug is just decoration.
+func parseMemoRef(ref string) (int, error) {
+	if i := strings.IndexByte(ref, '-'); i >= 0 {
+		ref = ref[:i]
+	}
+	return strconv.Atoi(ref)
+}
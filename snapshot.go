@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	snapshotVersion        = 5
+	defaultSnapshotPath    = tmpDir + "isucon_cache.gob"
+	defaultSnapshotMaxAge  = 10 * time.Minute
+	snapshotUserCatchUpSQL = "SELECT id, username, password, salt, last_access FROM users WHERE id > ?"
+)
+
+// SnapshotConfig controls the cache snapshot written on shutdown (and
+// before handing the socket to a new process) and read by initialize in
+// place of the full table scans. A snapshot older than MaxAgeSec is
+// ignored. Memos deleted since the snapshot was taken stay cached until
+// the next /reset, as with cache sync.
+type SnapshotConfig struct {
+	Disabled  bool   `json:"disabled"`
+	Path      string `json:"path"`
+	MaxAgeSec int    `json:"max_age_sec"`
+}
+
+func (c SnapshotConfig) path() string {
+	if c.Path == "" {
+		return defaultSnapshotPath
+	}
+	return c.Path
+}
+
+func (c SnapshotConfig) maxAge() time.Duration {
+	if c.MaxAgeSec <= 0 {
+		return defaultSnapshotMaxAge
+	}
+	return time.Duration(c.MaxAgeSec) * time.Second
+}
+
+// cacheSnapshot is what is written to disk. Rendered memo bodies are
+// kept with the version they were rendered from.
+type cacheSnapshot struct {
+	Version  int
+	SavedAt  time.Time
+	Users    []*User
+	Memos    Memos
+	Rendered []renderedBody
+}
+
+type renderedBody struct {
+	Key     string
+	HTML    []byte
+	Version int
+}
+
+var errStaleSnapshot = errors.New("snapshot is stale")
+
+func saveSnapshot(path string) error {
+	snap := &cacheSnapshot{
+		Version: snapshotVersion,
+		SavedAt: time.Now(),
+		Users:   userCache.All(),
+		Memos:   make(Memos, 0, memoCache.Len()),
+	}
+	memoCache.Each(func(memo *Memo) {
+		snap.Memos = append(snap.Memos, memo)
+	})
+	memoHTMLCache.Each(func(key string, body []byte, version int) {
+		snap.Rendered = append(snap.Rendered, renderedBody{key, body, version})
+	})
+
+	// The snapshot holds password hashes, so only this user may read it.
+	// A temporary file left by a crash is removed rather than reused, as
+	// it keeps whatever mode it was made with.
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(f).Encode(snap); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readSnapshot(path string, maxAge time.Duration) (*cacheSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap := &cacheSnapshot{}
+	if err := gob.NewDecoder(f).Decode(snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d, want %d", snap.Version, snapshotVersion)
+	}
+	if time.Since(snap.SavedAt) > maxAge {
+		return nil, errStaleSnapshot
+	}
+	return snap, nil
+}
+
+// restoreSnapshot fills the user and memo caches from the snapshot at
+// path, then reads the rows written since it was saved.
+func restoreSnapshot(conn *sql.DB, path string, maxAge time.Duration) error {
+	snap, err := readSnapshot(path, maxAge)
+	if err != nil {
+		return err
+	}
+
+	users := NewUserCache()
+	maxUserId := 0
+	for _, user := range snap.Users {
+		users.Put(user)
+		if user.Id > maxUserId {
+			maxUserId = user.Id
+		}
+	}
+	rows, err := conn.Query(snapshotUserCatchUpSQL, maxUserId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user := &User{}
+		var lastAccess sql.NullString
+		if err := rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt, &lastAccess); err != nil {
+			return err
+		}
+		user.LastAccess = lastAccess.String
+		users.Put(user)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	userCache.Replace(users)
+	memoCache.Replace(newMemoCacheOf(snap.Memos))
+	for _, r := range snap.Rendered {
+		memoHTMLCache.Set(r.Key, r.HTML, r.Version)
+	}
+	memoWatermark.observe(snap.Memos)
+	if err := applyMemoChanges(context.Background(), conn); err != nil {
+		return err
+	}
+	log.Printf("restored %d users and %d memos from snapshot saved at %s", userCache.Len(), memoCache.Len(), snap.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// setupSnapshot saves the caches when the process hands over or shuts
+// down.
+func setupSnapshot(c SnapshotConfig) {
+	if c.Disabled {
+		return
+	}
+	save := func() {
+		if err := saveSnapshot(c.path()); err != nil {
+			log.Printf("snapshot: %s", err)
+		}
+	}
+	onHandOff(save)
+	onShutdown(save)
+}
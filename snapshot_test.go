@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	userCache.Put(&User{Id: 1, Username: "isucon1"})
+	defer userCache.Remove(1)
+	memo := &Memo{Id: 7, User: 1, Content: "# hello", Visibility: visibilityPublic, Version: 2}
+	prepareMemo(memo)
+	memoCache.Put(memo)
+	defer memoCache.Delete(7)
+
+	if err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := readSnapshot(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *Memo
+	for _, m := range snap.Memos {
+		if m.Id == 7 {
+			got = m
+		}
+	}
+	if got == nil || got.Title != memo.Title || got.Version != 2 {
+		t.Errorf("memo 7 = %+v, want %+v", got, memo)
+	}
+	html := renderedHTML(memo)
+	if err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if snap, err = readSnapshot(path, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, r := range snap.Rendered {
+		if r.Key == "7" && r.Version == 2 && string(r.HTML) == string(html) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("rendered body of memo 7 missing from snapshot")
+	}
+	if len(snap.Users) == 0 {
+		t.Errorf("snapshot has no users")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := readSnapshot(path, time.Millisecond); err != errStaleSnapshot {
+		t.Errorf("readSnapshot of an old file = %v, want errStaleSnapshot", err)
+	}
+}
+
+func TestSnapshotMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	// A readable leftover from a crashed save must not lend its mode.
+	if err := ioutil.WriteFile(path+".tmp", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("snapshot mode %o, want 600", mode)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// What happens to a post a content filter matched.
+const (
+	spamReject = "reject" // refuse the post
+	spamHide   = "hide"   // save it but show it to nobody but its author
+	spamFlag   = "flag"   // save it and list it for an admin to review
+)
+
+// SpamConfig configures the content filters run on new memos. Action
+// applies to every filter unless Actions names one for that filter.
+type SpamConfig struct {
+	BannedWords       []string          `json:"banned_words"`
+	MaxPostsPerMinute int               `json:"max_posts_per_minute"`
+	CheckURL          string            `json:"check_url"`
+	Action            string            `json:"action"`
+	Actions           map[string]string `json:"actions"`
+}
+
+func (c *SpamConfig) validate() error {
+	if c.Action == "" {
+		c.Action = spamFlag
+	}
+	for _, action := range append([]string{c.Action}, mapValues(c.Actions)...) {
+		switch action {
+		case spamReject, spamHide, spamFlag:
+		default:
+			return fmt.Errorf("config: unknown spam action %q", action)
+		}
+	}
+	return nil
+}
+
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// ContentFilter inspects a post before it is saved. Check returns a
+// non-empty reason when the post looks like spam or abuse.
+type ContentFilter interface {
+	Name() string
+	Check(ctx context.Context, user *User, content string) (reason string, err error)
+}
+
+var contentFilters []ContentFilter
+
+func buildContentFilters(c SpamConfig) []ContentFilter {
+	var filters []ContentFilter
+	if len(c.BannedWords) > 0 {
+		filters = append(filters, bannedWordFilter(c.BannedWords))
+	}
+	if c.MaxPostsPerMinute > 0 {
+		filters = append(filters, &postRateFilter{newRateLimiter(time.Minute/time.Duration(c.MaxPostsPerMinute), c.MaxPostsPerMinute)})
+	}
+	if c.CheckURL != "" {
+		filters = append(filters, &remoteFilter{url: c.CheckURL, client: &http.Client{Timeout: 2 * time.Second}})
+	}
+	return filters
+}
+
+type bannedWordFilter []string
+
+func (f bannedWordFilter) Name() string { return "banned_words" }
+
+func (f bannedWordFilter) Check(ctx context.Context, user *User, content string) (string, error) {
+	lower := strings.ToLower(content)
+	for _, word := range f {
+		if word != "" && strings.Contains(lower, strings.ToLower(word)) {
+			return fmt.Sprintf("contains %q", word), nil
+		}
+	}
+	return "", nil
+}
+
+// postRateFilter matches users posting faster than people type.
+type postRateFilter struct {
+	limiter *rateLimiter
+}
+
+func (f *postRateFilter) Name() string { return "post_rate" }
+
+func (f *postRateFilter) Check(ctx context.Context, user *User, content string) (string, error) {
+	if !f.limiter.Allow(strconv.Itoa(user.Id)) {
+		return "posting too fast", nil
+	}
+	return "", nil
+}
+
+// remoteFilter asks an external service, which answers a JSON post of the
+// content with {"spam": bool, "reason": string}.
+type remoteFilter struct {
+	url    string
+	client *http.Client
+}
+
+func (f *remoteFilter) Name() string { return "remote" }
+
+func (f *remoteFilter) Check(ctx context.Context, user *User, content string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{"user_id": user.Id, "content": content})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", f.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("spam check: status %d", resp.StatusCode)
+	}
+	var result struct {
+		Spam   bool   `json:"spam"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if !result.Spam {
+		return "", nil
+	}
+	if result.Reason == "" {
+		result.Reason = "rejected by spam check"
+	}
+	return result.Reason, nil
+}
+
+// checkContent runs the filters in order and returns the action and
+// reason for the first match, or "" when the post is fine. A filter that
+// errors is skipped so that an outage doesn't block posting.
+func checkContent(ctx context.Context, user *User, content string) (action, reason string) {
+	for _, f := range contentFilters {
+		reason, err := f.Check(ctx, user, content)
+		if err != nil {
+			log.Printf("content filter %s: %s", f.Name(), err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		action = config.Spam.Actions[f.Name()]
+		if action == "" {
+			action = config.Spam.Action
+		}
+		return action, f.Name() + ": " + reason
+	}
+	return "", ""
+}
+
+type MemoFlag struct {
+	MemoId    int    `json:"memo_id"`
+	User      int    `json:"user"`
+	Reason    string `json:"reason"`
+	CreatedAt string `json:"created_at"`
+	Title     string `json:"title"`
+}
+
+// flagsHandler lists memos waiting for review.
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	rows, err := dbConn.QueryContext(r.Context(), "SELECT memo_id, reason, created_at FROM memo_flags ORDER BY created_at")
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer rows.Close()
+	flags := make([]*MemoFlag, 0)
+	for rows.Next() {
+		flag := &MemoFlag{}
+		if err := rows.Scan(&flag.MemoId, &flag.Reason, &flag.CreatedAt); err != nil {
+			handleError(w, r, err)
+			return
+		}
+		if memo, ok := memoCache.Get(flag.MemoId); ok {
+			flag.User, flag.Title = memo.User, memo.Title
+		}
+		flags = append(flags, flag)
+	}
+	if err := rows.Err(); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, flags)
+}
+
+// flagReviewHandler resolves a flag: action=hide shadow-hides the memo,
+// action=dismiss leaves it as it is.
+func flagReviewHandler(w http.ResponseWriter, r *http.Request) {
+	memoId, _ := strconv.Atoi(mux.Vars(r)["memo_id"])
+	action := r.FormValue("action")
+	if action != "hide" && action != "dismiss" {
+		handleError(w, r, validationError("action must be hide or dismiss"))
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	result, err := execSQL(r.Context(), dbConn, "DELETE FROM memo_flags WHERE memo_id=?", memoId)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		handleError(w, r, notFoundError(""))
+		return
+	}
+	if action == "hide" {
+		if err := hideMemo(r.Context(), dbConn, memoId); err != nil {
+			handleError(w, r, err)
+			return
+		}
+	}
+	audit("admin "+r.RemoteAddr, "flag."+action, []string{"memo " + strconv.Itoa(memoId)})
+	writeJSON(w, http.StatusOK, map[string]string{"result": action})
+}
+
+// hideMemo hides a flagged memo without telling its author why.
+func hideMemo(ctx context.Context, dbConn querier, memoId int) error {
+	_, err := moderateMemo(ctx, dbConn, memoId, "hidden=1")
+	return err
+}
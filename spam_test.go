@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckContent(t *testing.T) {
+	defer func(c *Config, f []ContentFilter) { config, contentFilters = c, f }(config, contentFilters)
+	config = &Config{Spam: SpamConfig{
+		BannedWords:       []string{"Casino"},
+		MaxPostsPerMinute: 2,
+		Actions:           map[string]string{"banned_words": spamReject},
+	}}
+	if err := config.Spam.validate(); err != nil {
+		t.Fatal(err)
+	}
+	contentFilters = buildContentFilters(config.Spam)
+	user := &User{Id: 1}
+	ctx := context.Background()
+
+	if action, reason := checkContent(ctx, user, "best CASINO in town"); action != spamReject || reason == "" {
+		t.Errorf("banned word: action = %q, reason = %q", action, reason)
+	}
+	for _, content := range []string{"hello", "hello again"} {
+		if action, _ := checkContent(ctx, user, content); action != "" {
+			t.Errorf("%q: action = %q, want none", content, action)
+		}
+	}
+	if action, _ := checkContent(ctx, user, "and again"); action != spamFlag {
+		t.Errorf("third post within a minute: action = %q, want %q", action, spamFlag)
+	}
+
+	bad := SpamConfig{Action: "delete"}
+	if err := bad.validate(); err == nil {
+		t.Error("unknown action accepted")
+	}
+}
+
+func TestCanViewHidden(t *testing.T) {
+	memo := &Memo{User: 1, Visibility: visibilityPublic, Hidden: true}
+	if canView(nil, memo) || canView(&User{Id: 2}, memo) {
+		t.Error("hidden memo visible to others")
+	}
+	if !canView(&User{Id: 1}, memo) {
+		t.Error("hidden memo not visible to its author")
+	}
+	if memo.Listed() || inFeeds(memo) {
+		t.Error("hidden memo is listed")
+	}
+}
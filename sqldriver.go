@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlDriverName is MySQL wrapped in appDriver, what the app opens its
+// databases with.
+const mysqlDriverName = "mysql+app"
+
+func init() {
+	sql.Register(mysqlDriverName, appDriver{mysql.MySQLDriver{}})
+}
+
+// duplicateEntry reports whether err is MySQL's error 1062, a row that
+// would break a unique index. In MySQL only the statement is undone, so a
+// transaction can go on after it.
+func duplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// appDriver wraps a driver so that every statement sent on behalf of a
+// request ends with a comment naming it, as in
+//
+//	SELECT ... WHERE id=? /* req:5f3a9c-1k */
+//
+// which MySQL keeps in its slow query and process lists. It also times
+// statements for the query log and EXPLAIN of sqllog.go.
+type appDriver struct {
+	driver.Driver
+}
+
+func (d appDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.Driver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &appConn{Conn: c, explain: explainerFor(d.Driver, dsn)}, nil
+}
+
+// tagQuery appends the request id of ctx to query. Ids are checked when
+// the request arrives, so they cannot end the comment.
+func tagQuery(ctx context.Context, query string) string {
+	if info := requestInfoFrom(ctx); info != nil && info.Id != "" {
+		return query + " /* req:" + info.Id + " */"
+	}
+	return query
+}
+
+// appConn passes everything to the wrapped connection, the optional
+// interfaces included, so database/sql takes the same paths it would
+// without the wrapper.
+type appConn struct {
+	driver.Conn
+	explain *queryExplainer
+}
+
+func (c *appConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	tagged := tagQuery(ctx, query)
+	var s driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		s, err = p.PrepareContext(ctx, tagged)
+	} else {
+		s, err = c.Conn.Prepare(tagged)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &appStmt{Stmt: s, query: query, explain: c.explain}, nil
+}
+
+func (c *appConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := e.ExecContext(ctx, tagQuery(ctx, query), args)
+	if err != driver.ErrSkip {
+		observeQuery(ctx, c.explain, query, args, time.Since(start))
+	}
+	return result, err
+}
+
+func (c *appConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, tagQuery(ctx, query), args)
+	if err != driver.ErrSkip {
+		observeQuery(ctx, c.explain, query, args, time.Since(start))
+	}
+	return rows, err
+}
+
+func (c *appConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *appConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *appConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *appConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *appConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// appStmt times a prepared statement, which is how the MySQL driver runs
+// statements with arguments.
+type appStmt struct {
+	driver.Stmt
+	query   string
+	explain *queryExplainer
+}
+
+func (s *appStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = e.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			result, err = s.Stmt.Exec(values)
+		}
+	}
+	observeQuery(ctx, s.explain, s.query, args, time.Since(start))
+	return result, err
+}
+
+func (s *appStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	observeQuery(ctx, s.explain, s.query, args, time.Since(start))
+	return rows, err
+}
+
+func (s *appStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: the driver does not support named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDriver remembers the statements it is sent. Those containing
+// "SLOW" take a few milliseconds.
+type recordingDriver struct {
+	*queryRecorder
+}
+
+type queryRecorder struct {
+	sync.Mutex
+	queries []string
+}
+
+func (r *queryRecorder) add(query string) {
+	if strings.Contains(query, "SLOW") {
+		time.Sleep(5 * time.Millisecond)
+	}
+	r.Lock()
+	r.queries = append(r.queries, query)
+	r.Unlock()
+}
+
+func (r *queryRecorder) take() []string {
+	r.Lock()
+	defer r.Unlock()
+	queries := r.queries
+	r.queries = nil
+	return queries
+}
+
+func (d recordingDriver) Open(dsn string) (driver.Conn, error) {
+	return &recordingConn{d.queryRecorder}, nil
+}
+
+type recordingConn struct {
+	*queryRecorder
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c *recordingConn) Close() error                              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.add(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.add(query)
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return []string{"n"} }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+var recordedQueries = &queryRecorder{}
+
+func init() {
+	sql.Register("recording+app", appDriver{recordingDriver{recordedQueries}})
+}
+
+func TestQueryTags(t *testing.T) {
+	db, err := sql.Open("recording+app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	recordedQueries.take()
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, &requestInfo{Id: "abc-1"})
+	if _, err := db.ExecContext(ctx, "UPDATE memos SET hidden=1 WHERE id=?", 1); err != nil {
+		t.Fatal(err)
+	}
+	db.QueryRowContext(ctx, "SELECT 1").Scan(new(int))
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM memos"); err != nil {
+		t.Fatal(err)
+	}
+	sent := recordedQueries.take()
+	want := []string{
+		"UPDATE memos SET hidden=1 WHERE id=? /* req:abc-1 */",
+		"SELECT 1 /* req:abc-1 */",
+		"DELETE FROM memos",
+	}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %q, want %q", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Errorf("sent %q, want %q", sent[i], want[i])
+		}
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	trustedProxies, _ = parseTrustedProxies([]string{"10.0.0.1"})
+
+	for _, c := range []struct {
+		remote, header string
+		kept           bool
+	}{
+		{"10.0.0.1:1234", "nginx-0123abcd", true},
+		{"10.0.0.2:1234", "nginx-0123abcd", false},
+		{"10.0.0.1:1234", "x */ DROP TABLE memos; /*", false},
+		{"10.0.0.1:1234", "", false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.header != "" {
+			r.Header.Set("X-Request-Id", c.header)
+		}
+		id := requestId(r)
+		if (id == c.header) != c.kept || !requestIdRe.MatchString(id) {
+			t.Errorf("request id from %s with %q = %q", c.remote, c.header, id)
+		}
+	}
+	a, b := requestId(httptest.NewRequest("GET", "/", nil)), requestId(httptest.NewRequest("GET", "/", nil))
+	if a == b {
+		t.Errorf("two requests got id %s", a)
+	}
+
+	var seen string
+	h := requestInfoMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestInfoFrom(r.Context()).Id
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("X-Request-Id"); got == "" || got != seen {
+		t.Errorf("X-Request-Id %q, handler saw %q", got, seen)
+	}
+}
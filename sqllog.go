@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	explainTimeout      = 5 * time.Second
+	maxExplainedQueries = 1000
+	queryLogArgLen      = 64
+)
+
+// queryExplainer runs EXPLAIN for the slow statements of one database,
+// on a connection of its own outside the pool.
+type queryExplainer struct {
+	db   *sql.DB
+	busy int32
+
+	sync.Mutex
+	explained map[string]bool
+}
+
+var (
+	explainersMutex sync.Mutex
+	explainers      = make(map[string]*queryExplainer)
+)
+
+// dsnConnector opens connections with a driver directly, not through
+// appDriver, so that EXPLAIN is not itself logged and explained.
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func explainerFor(d driver.Driver, dsn string) *queryExplainer {
+	explainersMutex.Lock()
+	defer explainersMutex.Unlock()
+	e, ok := explainers[dsn]
+	if !ok {
+		e = &queryExplainer{db: sql.OpenDB(dsnConnector{d, dsn}), explained: make(map[string]bool)}
+		e.db.SetMaxOpenConns(1)
+		explainers[dsn] = e
+	}
+	return e
+}
+
+// observeQuery logs a statement when query_log is on, and explains it
+// when it took explain_ms or longer.
+func observeQuery(ctx context.Context, e *queryExplainer, query string, args []driver.NamedValue, d time.Duration) {
+	rc := currentRuntimeConfig()
+	if rc.QueryLog {
+		id := ""
+		if info := requestInfoFrom(ctx); info != nil {
+			id = info.Id
+		}
+		log.Printf("query: req=%s %.2fms %s %s", id, float64(d)/float64(time.Millisecond), query, formatQueryArgs(args))
+	}
+	if rc.ExplainMs > 0 && d >= time.Duration(rc.ExplainMs)*time.Millisecond && e != nil {
+		e.explain(query, args, rc.ExplainAnalyze)
+	}
+}
+
+func formatQueryArgs(args []driver.NamedValue) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		s := fmt.Sprintf("%v", arg.Value)
+		if b, ok := arg.Value.([]byte); ok {
+			s = string(b)
+		}
+		if len(s) > queryLogArgLen {
+			s = s[:queryLogArgLen] + "..."
+		}
+		parts[i] = fmt.Sprintf("%q", s)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// explainable reports whether EXPLAIN accepts query without running it.
+// With analyze only SELECT is, since EXPLAIN ANALYZE does run it.
+func explainable(query string, analyze bool) bool {
+	verb := strings.ToUpper(strings.SplitN(strings.TrimSpace(query), " ", 2)[0])
+	if analyze {
+		return verb == "SELECT"
+	}
+	return verb == "SELECT" || verb == "UPDATE" || verb == "DELETE" || verb == "INSERT" || verb == "REPLACE"
+}
+
+// explain logs the plan of query in the background, once per statement.
+// A statement that turns slow while another is being explained is
+// skipped rather than queued.
+func (e *queryExplainer) explain(query string, args []driver.NamedValue, analyze bool) {
+	if !explainable(query, analyze) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&e.busy, 0, 1) {
+		return
+	}
+	e.Lock()
+	seen := e.explained[query]
+	if !seen && len(e.explained) < maxExplainedQueries {
+		e.explained[query] = true
+	}
+	e.Unlock()
+	if seen {
+		atomic.StoreInt32(&e.busy, 0)
+		return
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	go func() {
+		defer atomic.StoreInt32(&e.busy, 0)
+		plan, err := e.plan(query, values, analyze)
+		if err != nil {
+			log.Printf("explain %s: %s", query, err)
+			return
+		}
+		log.Printf("explain %s\n%s", query, plan)
+	}()
+}
+
+// plan runs EXPLAIN and writes each row of it as column=value pairs,
+// marking full table scans, filesorts and temporary tables, the usual
+// signs of a missing index.
+func (e *queryExplainer) plan(query string, args []interface{}, analyze bool) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+	defer cancel()
+	prefix := "EXPLAIN "
+	if analyze {
+		prefix = "EXPLAIN ANALYZE "
+	}
+	rows, err := e.db.QueryContext(ctx, prefix+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		var warnings []string
+		for i, c := range columns {
+			if !values[i].Valid {
+				continue
+			}
+			v := values[i].String
+			if analyze {
+				b.WriteString(v)
+				continue
+			}
+			fmt.Fprintf(&b, "%s=%s ", c, v)
+			if strings.EqualFold(c, "type") && v == "ALL" {
+				warnings = append(warnings, "full scan")
+			}
+			if strings.EqualFold(c, "Extra") {
+				if strings.Contains(v, "filesort") {
+					warnings = append(warnings, "filesort")
+				}
+				if strings.Contains(v, "temporary") {
+					warnings = append(warnings, "temporary table")
+				}
+			}
+		}
+		if len(warnings) > 0 {
+			b.WriteString("<- " + strings.Join(warnings, ", "))
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimRight(b.String(), " \n"), rows.Err()
+}
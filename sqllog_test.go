@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	old := currentRuntimeConfig()
+	defer setRuntimeConfig(old)
+	rc := old
+	rc.QueryLog = true
+	rc.ExplainMs = 2
+	setRuntimeConfig(rc)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	db, err := sql.Open("recording+app", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	recordedQueries.take()
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, &requestInfo{Id: "abc-2"})
+	if _, err := db.ExecContext(ctx, "UPDATE memos SET content=? WHERE id=?", strings.Repeat("x", 100), 7); err != nil {
+		t.Fatal(err)
+	}
+	db.QueryRowContext(ctx, "SELECT id FROM memos WHERE content='SLOW'").Scan(new(int))
+	db.QueryRowContext(ctx, "SELECT id FROM memos WHERE content='SLOW'").Scan(new(int))
+
+	// The plan is fetched in the background, once.
+	explains := 0
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && explains == 0; time.Sleep(5 * time.Millisecond) {
+		for _, q := range recordedQueries.take() {
+			if strings.HasPrefix(q, "EXPLAIN SELECT id FROM memos WHERE content='SLOW'") {
+				explains++
+			}
+		}
+	}
+	e := explainerFor(recordingDriver{recordedQueries}, "querylog")
+	for atomic.LoadInt32(&e.busy) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, q := range recordedQueries.take() {
+		if strings.HasPrefix(q, "EXPLAIN") {
+			explains++
+		}
+	}
+	if explains != 1 {
+		t.Errorf("slow query explained %d times, want 1", explains)
+	}
+	out := buf.String()
+	if !strings.Contains(out, `query: req=abc-2`) || !strings.Contains(out, `"`+strings.Repeat("x", 64)+`..." "7"`) {
+		t.Errorf("query log:\n%s", out)
+	}
+	if strings.Contains(out, "EXPLAIN") {
+		t.Errorf("EXPLAIN was logged as a query:\n%s", out)
+	}
+}
+
+func TestExplainable(t *testing.T) {
+	for _, c := range []struct {
+		query   string
+		analyze bool
+		want    bool
+	}{
+		{"SELECT 1", false, true},
+		{"  update memos SET x=1", false, true},
+		{"UPDATE memos SET x=1", true, false},
+		{"BEGIN", false, false},
+		{"SHOW TABLES", false, false},
+	} {
+		if got := explainable(c.query, c.analyze); got != c.want {
+			t.Errorf("explainable(%q, %t) = %t", c.query, c.analyze, got)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// statsWindow is how many seconds /admin/stats looks back.
+	statsWindow = 60
+	// Latency histograms have buckets growing by a factor of two from
+	// 100µs; the last one holds everything slower.
+	statsFirstBucket  = 100 * time.Microsecond
+	statsBucketCount  = 18
+	statsRefreshEvery = 2 // seconds
+)
+
+// routeHistogram counts one route's requests in one second by latency.
+type routeHistogram struct {
+	count   int64
+	errors  int64
+	buckets [statsBucketCount]int64
+}
+
+func statsBucket(d time.Duration) int {
+	i := 0
+	for bound := statsFirstBucket; d > bound && i < statsBucketCount-1; bound *= 2 {
+		i++
+	}
+	return i
+}
+
+// statsBucketBound is the upper bound of bucket i, the latency reported
+// for a percentile that falls into it.
+func statsBucketBound(i int) time.Duration {
+	return statsFirstBucket << uint(i)
+}
+
+type statsSecond struct {
+	unix   int64
+	routes map[string]*routeHistogram
+}
+
+// statsRing keeps the last statsWindow seconds of requests, one slot per
+// second, reused as time goes round.
+type statsRing struct {
+	sync.Mutex
+	seconds [statsWindow]statsSecond
+}
+
+var requestStats = &statsRing{}
+
+func (s *statsRing) add(now time.Time, route string, d time.Duration, status int) {
+	unix := now.Unix()
+	s.Lock()
+	defer s.Unlock()
+	sec := &s.seconds[unix%statsWindow]
+	if unix < sec.unix {
+		// A request that started before the window came round again.
+		return
+	}
+	if sec.unix != unix {
+		sec.unix = unix
+		sec.routes = make(map[string]*routeHistogram)
+	}
+	h, ok := sec.routes[route]
+	if !ok {
+		h = &routeHistogram{}
+		sec.routes[route] = h
+	}
+	h.count++
+	if status >= 500 {
+		h.errors++
+	}
+	h.buckets[statsBucket(d)]++
+}
+
+// RouteStats is one route's traffic over the window.
+type RouteStats struct {
+	Route         string
+	Requests      int64
+	Errors        int64
+	PerSecond     float64
+	P50, P95, P99 time.Duration
+}
+
+// Routes sums the seconds before now that are still in the window, busiest
+// route first.
+func (s *statsRing) Routes(now time.Time) []RouteStats {
+	sums := make(map[string]*routeHistogram)
+	s.Lock()
+	for _, sec := range s.seconds {
+		if age := now.Unix() - sec.unix; age < 0 || age >= statsWindow {
+			continue
+		}
+		for route, h := range sec.routes {
+			sum, ok := sums[route]
+			if !ok {
+				sum = &routeHistogram{}
+				sums[route] = sum
+			}
+			sum.count += h.count
+			sum.errors += h.errors
+			for i, n := range h.buckets {
+				sum.buckets[i] += n
+			}
+		}
+	}
+	s.Unlock()
+
+	routes := make([]RouteStats, 0, len(sums))
+	for route, h := range sums {
+		routes = append(routes, RouteStats{
+			Route:     route,
+			Requests:  h.count,
+			Errors:    h.errors,
+			PerSecond: float64(h.count) / statsWindow,
+			P50:       h.percentile(50),
+			P95:       h.percentile(95),
+			P99:       h.percentile(99),
+		})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Requests != routes[j].Requests {
+			return routes[i].Requests > routes[j].Requests
+		}
+		return routes[i].Route < routes[j].Route
+	})
+	return routes
+}
+
+func (h *routeHistogram) percentile(p int64) time.Duration {
+	rank := (h.count*p + 99) / 100
+	var seen int64
+	for i, n := range h.buckets {
+		if seen += n; seen >= rank && n > 0 {
+			return statsBucketBound(i)
+		}
+	}
+	return 0
+}
+
+// statsMiddleware counts every request in requestStats. It comes first so
+// that shed requests are counted, as errors.
+func statsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		requestStats.add(start, r.Method+" "+routeName(r), time.Since(start), sw.Status())
+	})
+}
+
+// DBPoolStats shows how many handles are taken out of dbConnPool, and the
+// connections each replica holds.
+type DBPoolStats struct {
+	InUse, Size int
+	Replicas    []ReplicaPoolStats
+}
+
+type ReplicaPoolStats struct {
+	Name         string
+	InUse, Idle  int
+	WaitCount    int64
+	WaitDuration time.Duration
+}
+
+func dbPoolStats() DBPoolStats {
+	st := DBPoolStats{Size: cap(dbConnPool), InUse: cap(dbConnPool) - len(dbConnPool)}
+	for _, rep := range replicas {
+		s := rep.db.Stats()
+		st.Replicas = append(st.Replicas, ReplicaPoolStats{
+			Name: rep.name, InUse: s.InUse, Idle: s.Idle, WaitCount: s.WaitCount, WaitDuration: s.WaitDuration,
+		})
+	}
+	return st
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	prepareHandler(w, r)
+	v := struct {
+		Window, Refresh int
+		Routes          []RouteStats
+		Caches          []CacheStats
+		DB              DBPoolStats
+		Goroutines      int
+	}{
+		Window:     statsWindow,
+		Refresh:    statsRefreshEvery,
+		Routes:     requestStats.Routes(time.Now()),
+		Caches:     allCacheStats(),
+		DB:         dbPoolStats(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	if err := themeTemplates(defaultTheme).ExecuteTemplate(w, "admin_stats", v); err != nil {
+		handleError(w, r, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsBucket(t *testing.T) {
+	for _, c := range []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{100 * time.Microsecond, 0},
+		{101 * time.Microsecond, 1},
+		{time.Millisecond, 4},
+		{time.Hour, statsBucketCount - 1},
+	} {
+		if got := statsBucket(c.d); got != c.want {
+			t.Errorf("statsBucket(%s) = %d, want %d", c.d, got, c.want)
+		}
+	}
+}
+
+func TestStatsRing(t *testing.T) {
+	s := &statsRing{}
+	now := time.Unix(1000000, 0)
+	for i := 0; i < 100; i++ {
+		d := time.Millisecond
+		if i >= 90 {
+			d = 50 * time.Millisecond
+		}
+		s.add(now.Add(-time.Duration(i%10)*time.Second), "GET /", d, 200)
+	}
+	s.add(now, "GET /memo/{memo_id}", time.Millisecond, 500)
+	s.add(now.Add(-statsWindow*time.Second), "GET /old", time.Millisecond, 200)
+
+	routes := s.Routes(now)
+	if len(routes) != 2 {
+		t.Fatalf("routes = %+v", routes)
+	}
+	top := routes[0]
+	if top.Route != "GET /" || top.Requests != 100 || top.Errors != 0 {
+		t.Errorf("top = %+v", top)
+	}
+	if top.P50 != statsBucketBound(statsBucket(time.Millisecond)) || top.P95 != statsBucketBound(statsBucket(50*time.Millisecond)) {
+		t.Errorf("percentiles = %s/%s/%s", top.P50, top.P95, top.P99)
+	}
+	if routes[1].Errors != 1 {
+		t.Errorf("errors = %d, want 1", routes[1].Errors)
+	}
+	// The slot of a second that has gone round is reused, not added to.
+	s.add(now.Add(statsWindow*time.Second), "GET /", time.Millisecond, 200)
+	if got := s.Routes(now.Add(statsWindow * time.Second)); len(got) != 1 || got[0].Requests != 1 {
+		t.Errorf("after a full window: %+v", got)
+	}
+}
+
+func TestStatsPage(t *testing.T) {
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 5})
+	app.get(t, "/")
+	config.AdminToken = "stats"
+	req, _ := http.NewRequest("GET", app.URL+"/admin/stats", nil)
+	req.Header.Set("X-Admin-Token", config.AdminToken)
+	res, err := app.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	page := string(body)
+	for _, want := range []string{"<td>GET /</td>", "<td>memo</td>", `<p id="db-pool">`, "goroutines"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("stats page lacks %q:\n%s", want, page)
+		}
+	}
+}
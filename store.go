@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// querier is implemented by both *sql.DB and *sql.Tx, so the query helpers
+// work the same inside and outside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func execSQL(ctx context.Context, q querier, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startSQLSpan(ctx, query, args...)
+	result, err := q.ExecContext(ctx, query, args...)
+	span.Finish(err)
+	return result, err
+}
+
+// withTx runs fn in a transaction that is committed if fn returns nil and
+// rolled back otherwise, including when fn panics or ctx is cancelled.
+func withTx(ctx context.Context, dbConn *sql.DB, fn func(tx *sql.Tx) error) (err error) {
+	ctx, span := startSpan(ctx, "sql.tx")
+	defer func() { endSpan(span, err) }()
+
+	tx, err := dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			err = fmt.Errorf("commit: %s", err)
+		}
+	}()
+	return fn(tx)
+}
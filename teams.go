@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+var teamNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{2,30}$`)
+
+// Team is a group of users who can post memos that only its members see.
+type Team struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func (t *Team) Path() string {
+	return "/team/" + t.Name
+}
+
+var (
+	teams = newTeamDirectory()
+	// teamMemos lists each team's memos by team id, newest first, capped
+	// like a timeline.
+	teamMemos = newFeedIndex()
+)
+
+// teamDirectory is the in-memory copy of the teams and team_members
+// tables. Names are matched case-insensitively.
+type teamDirectory struct {
+	sync.RWMutex
+	byId    map[int]*Team
+	byName  map[string]*Team
+	members map[int]map[int]bool
+}
+
+func newTeamDirectory() *teamDirectory {
+	return &teamDirectory{
+		byId:    make(map[int]*Team),
+		byName:  make(map[string]*Team),
+		members: make(map[int]map[int]bool),
+	}
+}
+
+func (d *teamDirectory) put(team *Team) {
+	d.byId[team.Id] = team
+	d.byName[strings.ToLower(team.Name)] = team
+}
+
+func (d *teamDirectory) Put(team *Team) {
+	d.Lock()
+	d.put(team)
+	d.Unlock()
+}
+
+func (d *teamDirectory) Get(id int) (*Team, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	team, ok := d.byId[id]
+	return team, ok
+}
+
+func (d *teamDirectory) GetByName(name string) (*Team, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	team, ok := d.byName[strings.ToLower(name)]
+	return team, ok
+}
+
+func (d *teamDirectory) Member(teamId, userId int) bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.members[teamId][userId]
+}
+
+func (d *teamDirectory) Members(teamId int) []int {
+	d.RLock()
+	defer d.RUnlock()
+	ids := make([]int, 0, len(d.members[teamId]))
+	for id := range d.members[teamId] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Of returns the teams userId belongs to, by name.
+func (d *teamDirectory) Of(userId int) []*Team {
+	d.RLock()
+	var list []*Team
+	for id, members := range d.members {
+		if members[userId] {
+			list = append(list, d.byId[id])
+		}
+	}
+	d.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// All returns every team, by name.
+func (d *teamDirectory) All() []*Team {
+	d.RLock()
+	list := make([]*Team, 0, len(d.byId))
+	for _, team := range d.byId {
+		list = append(list, team)
+	}
+	d.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (d *teamDirectory) addMember(teamId, userId int) {
+	if d.members[teamId] == nil {
+		d.members[teamId] = make(map[int]bool)
+	}
+	d.members[teamId][userId] = true
+}
+
+func (d *teamDirectory) AddMember(teamId, userId int) {
+	d.Lock()
+	d.addMember(teamId, userId)
+	d.Unlock()
+}
+
+func (d *teamDirectory) RemoveMember(teamId, userId int) {
+	d.Lock()
+	delete(d.members[teamId], userId)
+	d.Unlock()
+}
+
+func (d *teamDirectory) Reload(dbConn *sql.DB) error {
+	loaded := newTeamDirectory()
+	rows, err := dbConn.Query("SELECT id, name FROM teams")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		team := &Team{}
+		if err := rows.Scan(&team.Id, &team.Name); err != nil {
+			return err
+		}
+		loaded.put(team)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = dbConn.Query("SELECT team_id, user_id FROM team_members")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var teamId, userId int
+		if err := rows.Scan(&teamId, &userId); err != nil {
+			return err
+		}
+		loaded.addMember(teamId, userId)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	d.Lock()
+	d.byId, d.byName, d.members = loaded.byId, loaded.byName, loaded.members
+	d.Unlock()
+	return nil
+}
+
+// inTeamList reports whether memo is shown on its team's page.
+func inTeamList(memo *Memo) bool {
+	return memo.Visibility == visibilityTeam && memo.Team != 0 && !memo.Hidden
+}
+
+// indexTeamMemo moves memo, last seen as old (nil if new), into its
+// team's list or out of the one it was in.
+func indexTeamMemo(old, memo *Memo) {
+	if old != nil && old.Team != 0 && (old.Team != memo.Team || !inTeamList(memo)) {
+		teamMemos.Remove(old.Team, old.Id)
+	}
+	if inTeamList(memo) {
+		teamMemos.Insert(memo.Team, memo.Id)
+	}
+}
+
+// rebuildTeams reloads the teams and refills their lists from the memo
+// cache.
+func rebuildTeams(conn *sql.DB) error {
+	if err := teams.Reload(conn); err != nil {
+		return err
+	}
+	teamMemos.Reset()
+	memoCache.Each(func(memo *Memo) {
+		indexTeamMemo(nil, memo)
+	})
+	return nil
+}
+
+// teamFromForm returns the team a memo with visibility v is posted to,
+// which user must belong to; 0 unless v is visibilityTeam.
+func teamFromForm(r *http.Request, user *User, v Visibility) (int, error) {
+	if v != visibilityTeam {
+		return 0, nil
+	}
+	team, ok := teams.GetByName(r.FormValue("team"))
+	if !ok || !teams.Member(team.Id, user.Id) {
+		return 0, validationError("choose one of your teams")
+	}
+	return team.Id, nil
+}
+
+// teamIdArg is the team_id column value for teamId.
+func teamIdArg(teamId int) interface{} {
+	if teamId == 0 {
+		return nil
+	}
+	return teamId
+}
+
+// teamHandler lists a team's memos to its members; to anyone else the
+// team does not exist.
+func teamHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	prepareHandler(w, r)
+	user := getUser(w, r, session)
+	team, ok := teams.GetByName(mux.Vars(r)["name"])
+	if !ok || !teams.Member(team.Id, user.Id) {
+		handleError(w, r, notFoundError(""))
+		return
+	}
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 {
+		page = 0
+	}
+
+	ids := feedIdSlices.Get().(*[]int)
+	*ids = teamMemos.AppendIds((*ids)[:0], team.Id)
+	defer feedIdSlices.Put(ids)
+	start, end := pageBounds(page, perPageFor(user, memosPerPage), len(*ids))
+	memos := getMemoSlice()
+	defer putMemoSlice(memos)
+	for _, id := range (*ids)[start:end] {
+		if memo, ok := memoCache.Get(id); ok && inTeamList(memo) && memo.Team == team.Id {
+			*memos = append(*memos, memo)
+		}
+	}
+	v := &View{
+		User:      user,
+		Team:      team,
+		Memos:     *memos,
+		Total:     len(*ids),
+		Page:      page,
+		PageStart: start + 1,
+		PageEnd:   end,
+		Session:   session,
+	}
+	if end < len(*ids) {
+		v.MorePath = team.Path() + "?page=" + strconv.Itoa(page+1)
+	}
+	if err = renderTemplate(w, r, "team", v); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+// TeamInfo is how /admin/teams reports a team.
+type TeamInfo struct {
+	*Team
+	Members []string `json:"members"`
+}
+
+func teamInfo(team *Team) TeamInfo {
+	info := TeamInfo{Team: team, Members: make([]string, 0)}
+	for _, id := range teams.Members(team.Id) {
+		info.Members = append(info.Members, userCache.Username(id))
+	}
+	return info
+}
+
+func teamsHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]TeamInfo, 0)
+	for _, team := range teams.All() {
+		list = append(list, teamInfo(team))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// teamPostHandler creates the team named in the form.
+func teamPostHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if !teamNamePattern.MatchString(name) {
+		handleError(w, r, validationError("team names are 2 to 30 letters, digits, _ or -"))
+		return
+	}
+	if _, ok := teams.GetByName(name); ok {
+		handleError(w, r, conflictError("that team already exists"))
+		return
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	result, err := execSQL(r.Context(), dbConn, "INSERT INTO teams (name, created_at) VALUES (?, now())", name)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	team := &Team{Id: int(id), Name: name}
+	teams.Put(team)
+	audit("admin "+r.RemoteAddr, "team.create", []string{name})
+	writeJSON(w, http.StatusCreated, teamInfo(team))
+}
+
+// teamMemberPostHandler adds the user named in the form to the team in
+// the route, or removes them with remove=1. Their memos stay posted to
+// the team.
+func teamMemberPostHandler(w http.ResponseWriter, r *http.Request) {
+	team, ok := teams.GetByName(mux.Vars(r)["name"])
+	if !ok {
+		handleError(w, r, notFoundError("no such team"))
+		return
+	}
+	user, ok := userCache.GetByName(r.FormValue("username"))
+	if !ok {
+		handleError(w, r, validationError("no such user"))
+		return
+	}
+	remove := r.FormValue("remove") == "1"
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	var err error
+	if remove {
+		_, err = execSQL(r.Context(), dbConn, "DELETE FROM team_members WHERE team_id=? AND user_id=?", team.Id, user.Id)
+	} else {
+		_, err = execSQL(r.Context(), dbConn, "INSERT IGNORE INTO team_members (team_id, user_id, created_at) VALUES (?, ?, now())", team.Id, user.Id)
+	}
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	action := "team.join"
+	if remove {
+		teams.RemoveMember(team.Id, user.Id)
+		action = "team.leave"
+	} else {
+		teams.AddMember(team.Id, user.Id)
+	}
+	audit("admin "+r.RemoteAddr, action, []string{team.Name, user.Username})
+	writeJSON(w, http.StatusOK, teamInfo(team))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTeamVisibility(t *testing.T) {
+	defer func(d *teamDirectory) { teams = d }(teams)
+	teams = newTeamDirectory()
+	teams.Put(&Team{Id: 1, Name: "Ops"})
+	teams.AddMember(1, 2)
+
+	memo := &Memo{Id: 10, User: 1, Visibility: visibilityTeam, Team: 1}
+	for _, c := range []struct {
+		user *User
+		want bool
+	}{
+		{nil, false},
+		{&User{Id: 1}, true},
+		{&User{Id: 2}, true},
+		{&User{Id: 3}, false},
+	} {
+		if got := canView(c.user, memo); got != c.want {
+			t.Errorf("canView(%+v) = %v, want %v", c.user, got, c.want)
+		}
+	}
+	if memo.Listed() || inFeeds(memo) {
+		t.Error("team memo shows in the public lists or timelines")
+	}
+	if team, ok := teams.GetByName("ops"); !ok || team.Id != 1 {
+		t.Errorf("GetByName(ops) = %v, %v", team, ok)
+	}
+	teams.RemoveMember(1, 2)
+	if canView(&User{Id: 2}, memo) {
+		t.Error("former member can still see the memo")
+	}
+}
+
+func TestIndexTeamMemo(t *testing.T) {
+	defer teamMemos.Reset()
+	teamMemos.Reset()
+
+	memo := &Memo{Id: 10, Visibility: visibilityTeam, Team: 1}
+	indexTeamMemo(nil, memo)
+	indexTeamMemo(nil, &Memo{Id: 11, Visibility: visibilityTeam, Team: 1})
+	if ids := teamMemos.Ids(1); len(ids) != 2 || ids[0] != 11 {
+		t.Fatalf("team 1 = %v, want [11 10]", ids)
+	}
+
+	moved := &Memo{Id: 10, Visibility: visibilityTeam, Team: 2}
+	indexTeamMemo(memo, moved)
+	if ids := teamMemos.Ids(1); len(ids) != 1 || ids[0] != 11 {
+		t.Errorf("team 1 after move = %v, want [11]", ids)
+	}
+	if ids := teamMemos.Ids(2); len(ids) != 1 || ids[0] != 10 {
+		t.Errorf("team 2 after move = %v, want [10]", ids)
+	}
+
+	indexTeamMemo(moved, &Memo{Id: 10, Visibility: visibilityPrivate})
+	if ids := teamMemos.Ids(2); len(ids) != 0 {
+		t.Errorf("team 2 after making the memo private = %v, want []", ids)
+	}
+}
+
+func TestTeamSelect(t *testing.T) {
+	v := &View{
+		Teams: []*Team{{Id: 1, Name: "dev"}, {Id: 2, Name: "ops"}},
+		Draft: &Memo{Team: 2},
+	}
+	var buf bytes.Buffer
+	if err := themeTemplates(defaultTheme).ExecuteTemplate(&buf, "team_select", v); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<option value="ops" selected>`) {
+		t.Errorf("team_select = %s", buf.String())
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const tenantPathPrefix = "/t/"
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// TenantConfig names one memo space. Every tenant runs in its own
+// process with its own database, caches and sessions; the process whose
+// Config.Tenant matches serves it, and the others proxy its requests to
+// Backend. A tenant is reached through Host, or through /t/<name>/ on
+// any host.
+//
+// One process never serves two tenants: the caches, indexes, connection
+// pools and job queue are all process-wide, so the process is the unit
+// of isolation.
+type TenantConfig struct {
+	Name    string `json:"name"`
+	Host    string `json:"host"`
+	Backend string `json:"backend"`
+}
+
+func validateTenants(local string, tenants []TenantConfig) error {
+	if local != "" && !tenantNamePattern.MatchString(local) {
+		return fmt.Errorf("config: bad tenant name %q", local)
+	}
+	seen := make(map[string]bool)
+	for _, t := range tenants {
+		if !tenantNamePattern.MatchString(t.Name) {
+			return fmt.Errorf("config: bad tenant name %q", t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("config: tenant %q listed twice", t.Name)
+		}
+		seen[t.Name] = true
+		if t.Name == local {
+			continue
+		}
+		if u, err := url.Parse(t.Backend); err != nil || u.Host == "" {
+			return fmt.Errorf("config: tenant %q needs a backend URL", t.Name)
+		}
+	}
+	return nil
+}
+
+// tenantKeyPrefix starts the keys this process keeps in services that
+// other tenants' processes may share, such as the rate limits' Redis.
+var tenantKeyPrefix string
+
+// setupTenant keeps this process's sessions, snapshot and shared keys
+// apart from those of the other tenants on the same machine.
+func setupTenant(c *Config) {
+	if c.Tenant == "" {
+		return
+	}
+	tenantKeyPrefix = "tenant:" + c.Tenant + ":"
+	sessionName = defaultSessionName + "_" + c.Tenant
+	sessionFile = defaultSessionFile + "_" + c.Tenant
+	if c.Snapshot.Path == "" {
+		c.Snapshot.Path = tmpDir + "isucon_cache_" + c.Tenant + ".gob"
+	}
+}
+
+// routedPath is path as the handlers behind tenantRouter see it, for the
+// filters in front of it: without its /t/<name> prefixes. Prefixes that
+// name no tenant are taken off too, which only makes a filter stricter.
+func routedPath(path string) string {
+	for strings.HasPrefix(path, tenantPathPrefix) {
+		rest := path[len(tenantPathPrefix):]
+		i := strings.IndexByte(rest, '/')
+		if i < 0 {
+			return "/"
+		}
+		path = rest[i:]
+	}
+	return path
+}
+
+type tenantPrefixKey struct{}
+
+// urlPrefix is the path the current tenant is mounted under, if any: set
+// by tenantRouter when it serves the tenant itself, or passed on by the
+// process that proxied the request.
+func urlPrefix(r *http.Request) string {
+	if prefix, ok := r.Context().Value(tenantPrefixKey{}).(string); ok {
+		return prefix
+	}
+	if fromTrustedProxy(r) {
+		if prefix := r.Header.Get("X-Forwarded-Prefix"); strings.HasPrefix(prefix, tenantPathPrefix) {
+			return strings.TrimSuffix(prefix, "/")
+		}
+	}
+	return ""
+}
+
+type tenantRouter struct {
+	local   string
+	tenants []TenantConfig
+	proxies map[string]*httputil.ReverseProxy
+	next    http.Handler
+}
+
+// newTenantRouter serves the local tenant, and requests that name no
+// tenant, with next.
+func newTenantRouter(local string, tenants []TenantConfig, next http.Handler) http.Handler {
+	if len(tenants) == 0 {
+		return next
+	}
+	t := &tenantRouter{
+		local:   local,
+		tenants: tenants,
+		proxies: make(map[string]*httputil.ReverseProxy),
+		next:    next,
+	}
+	for _, tenant := range tenants {
+		if tenant.Name == local {
+			continue
+		}
+		backend, _ := url.Parse(tenant.Backend)
+		t.proxies[tenant.Name] = tenantProxy(backend)
+	}
+	return t
+}
+
+// resolve returns the tenant a request is for and the path prefix that
+// named it.
+func (t *tenantRouter) resolve(r *http.Request) (name, prefix string) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, tenant := range t.tenants {
+		if tenant.Host != "" && strings.EqualFold(tenant.Host, host) {
+			return tenant.Name, ""
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, tenantPathPrefix) {
+		rest := r.URL.Path[len(tenantPathPrefix):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			rest = rest[:i]
+		}
+		for _, tenant := range t.tenants {
+			if tenant.Name == rest {
+				return tenant.Name, tenantPathPrefix + rest
+			}
+		}
+	}
+	return t.local, ""
+}
+
+func (t *tenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, prefix := t.resolve(r)
+	if prefix != "" {
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+		r2.URL = &u
+		r = r2
+	}
+	if proxy, ok := t.proxies[name]; ok {
+		r.Header.Set("X-Forwarded-Prefix", prefix)
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	if prefix != "" {
+		w = &prefixedWriter{ResponseWriter: w, prefix: prefix}
+	}
+	t.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantPrefixKey{}, prefix)))
+}
+
+// prefixedWriter mounts the handlers' redirects, which are all to
+// absolute paths, under the tenant's prefix.
+type prefixedWriter struct {
+	http.ResponseWriter
+	prefix string
+}
+
+func (w *prefixedWriter) WriteHeader(code int) {
+	if loc := w.Header().Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		w.Header().Set("Location", w.prefix+loc)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// tenantProxy passes requests on to another tenant's process with the
+// headers it needs to build its URLs; that process must list this one in
+// trusted_proxies. Its redirects are mounted under the prefix as for the
+// local tenant.
+func tenantProxy(backend *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.Header.Set("X-Forwarded-Host", requestHost(r))
+			r.Header.Set("X-Forwarded-Proto", requestScheme(r))
+			r.URL.Scheme = backend.Scheme
+			r.URL.Host = backend.Host
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			prefix := resp.Request.Header.Get("X-Forwarded-Prefix")
+			if loc := resp.Header.Get("Location"); prefix != "" && strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+				resp.Header.Set("Location", prefix+loc)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutedPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/admin/stats":             "/admin/stats",
+		"/t/staging/admin/stats":   "/admin/stats",
+		"/t/staging":               "/",
+		"/t/staging/t/other/reset": "/reset",
+		"/tags/t/x/admin":          "/tags/t/x/admin",
+	} {
+		if got := routedPath(path); got != want {
+			t.Errorf("routedPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestTenantRouter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Tenant", "staging")
+		w.Header().Set("X-Path", r.URL.Path)
+		http.Redirect(w, r, "/mypage", http.StatusFound)
+	}))
+	defer backend.Close()
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Tenant", "production")
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Prefix", urlPrefix(r))
+		http.Redirect(w, r, "/mypage", http.StatusFound)
+	})
+	tenants := []TenantConfig{
+		{Name: "production"},
+		{Name: "staging", Host: "staging.example.com", Backend: backend.URL},
+	}
+	if err := validateTenants("production", tenants); err != nil {
+		t.Fatal(err)
+	}
+	router := newTenantRouter("production", tenants, local)
+
+	cases := []struct {
+		host, path                  string
+		tenant, gotPath, prefix, to string
+	}{
+		{"example.com", "/memo/1", "production", "/memo/1", "", "/mypage"},
+		{"example.com", "/t/production/memo/1", "production", "/memo/1", "/t/production", "/t/production/mypage"},
+		{"example.com", "/t/production", "production", "/", "/t/production", "/t/production/mypage"},
+		{"example.com", "/t/unknown/memo/1", "production", "/t/unknown/memo/1", "", "/mypage"},
+		{"staging.example.com:5000", "/memo/1", "staging", "/memo/1", "", "/mypage"},
+		{"example.com", "/t/staging/memo/1", "staging", "/memo/1", "", "/t/staging/mypage"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.Host = c.host
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if got := w.Header().Get("X-Tenant"); got != c.tenant {
+			t.Errorf("%s%s: tenant %q, want %q", c.host, c.path, got, c.tenant)
+		}
+		if got := w.Header().Get("X-Path"); got != c.gotPath {
+			t.Errorf("%s%s: path %q, want %q", c.host, c.path, got, c.gotPath)
+		}
+		if got := w.Header().Get("X-Prefix"); got != c.prefix {
+			t.Errorf("%s%s: prefix %q, want %q", c.host, c.path, got, c.prefix)
+		}
+		if got := w.Header().Get("Location"); got != c.to {
+			t.Errorf("%s%s: redirect to %q, want %q", c.host, c.path, got, c.to)
+		}
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	for _, tenants := range [][]TenantConfig{
+		{{Name: "Staging", Backend: "http://127.0.0.1:5001"}},
+		{{Name: "staging"}},
+		{{Name: "a", Backend: "http://127.0.0.1:5001"}, {Name: "a", Backend: "http://127.0.0.1:5002"}},
+	} {
+		if err := validateTenants("production", tenants); err == nil {
+			t.Errorf("validateTenants(%+v) = nil, want an error", tenants)
+		}
+	}
+}
+
+func TestSetupTenant(t *testing.T) {
+	defer func(name, file, prefix string) {
+		sessionName, sessionFile, tenantKeyPrefix = name, file, prefix
+		setupRateLimits(RateLimitConfig{})
+	}(sessionName, sessionFile, tenantKeyPrefix)
+
+	c := &Config{Tenant: "staging"}
+	setupTenant(c)
+	if sessionName != defaultSessionName+"_staging" || !strings.HasSuffix(c.Snapshot.Path, "_staging.gob") {
+		t.Errorf("session %q, snapshot %q", sessionName, c.Snapshot.Path)
+	}
+	setupRateLimits(RateLimitConfig{Redis: "127.0.0.1:1"})
+	if l := memoUserLimiter.(*redisLimiter); l.prefix != "tenant:staging:memo:user" {
+		t.Errorf("redis keys start with %q", l.prefix)
+	}
+}
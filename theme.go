@@ -0,0 +1,164 @@
+package main
+
+import (
+	"container/list"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"./sessions"
+)
+
+const (
+	templateDir  = "templates"
+	defaultTheme = "default"
+	// maxBaseTemplateSets bounds the sets baseTemplates keeps; there is
+	// one per theme and base URL the site is reached by. The base comes
+	// from the Host header, so the least recently used set goes first.
+	maxBaseTemplateSets = 32
+)
+
+// themes maps a theme name to its parsed template set. Every set starts as
+// a clone of the default one, so a theme only has to provide the templates
+// it changes. themeMasters are the same sets, never executed so that
+// they can still be cloned.
+var themes, themeMasters = mustLoadThemes(templateDir)
+
+var baseSets = struct {
+	sync.Mutex
+	sets map[string]*list.Element
+	lru  *list.List
+}{sets: make(map[string]*list.Element), lru: list.New()}
+
+type baseSet struct {
+	key string
+	set *template.Template
+}
+
+func mustLoadThemes(dir string) (map[string]*template.Template, map[string]*template.Template) {
+	masters := mustParseThemes(dir)
+	sets := make(map[string]*template.Template, len(masters))
+	for name, master := range masters {
+		sets[name] = template.Must(master.Clone())
+	}
+	return sets, masters
+}
+
+func mustParseThemes(dir string) map[string]*template.Template {
+	base := template.Must(template.New("tmpl").Funcs(fmap).ParseGlob(filepath.Join(dir, defaultTheme, "*.html")))
+	sets := map[string]*template.Template{defaultTheme: base}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == defaultTheme {
+			continue
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, e.Name(), "*.html"))
+		if len(files) == 0 {
+			continue
+		}
+		set := template.Must(base.Clone())
+		sets[e.Name()] = template.Must(set.ParseFiles(files...))
+	}
+	return sets
+}
+
+func themeNames() []string {
+	names := make([]string, 0, len(themes))
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validTheme(name string) bool {
+	_, ok := themes[name]
+	return ok
+}
+
+// themeFor picks the signed-in user's preferred theme, then the session's,
+// then the configured one.
+func themeFor(session *sessions.Session) string {
+	if session != nil {
+		if userId, ok := sessionUserId(session); ok {
+			if user, ok := userCache.Get(userId); ok && validTheme(user.Prefs.Theme) {
+				return user.Prefs.Theme
+			}
+		}
+		if name, ok := session.Values["theme"].(string); ok && validTheme(name) {
+			return name
+		}
+	}
+	if config != nil && validTheme(config.Theme) {
+		return config.Theme
+	}
+	return defaultTheme
+}
+
+func themeTemplates(name string) *template.Template {
+	if set, ok := themes[name]; ok {
+		return set
+	}
+	return themes[defaultTheme]
+}
+
+// baseTemplates returns theme's templates with url_for bound to base
+// instead of the URL of whichever request set it last, for output that is
+// cached and served to other requests.
+func baseTemplates(theme, base string) *template.Template {
+	if _, ok := themeMasters[theme]; !ok {
+		theme = defaultTheme
+	}
+	key := theme + "#" + base
+	baseSets.Lock()
+	defer baseSets.Unlock()
+	if e, ok := baseSets.sets[key]; ok {
+		baseSets.lru.MoveToFront(e)
+		return e.Value.(*baseSet).set
+	}
+	set := template.Must(themeMasters[theme].Clone())
+	set.Funcs(template.FuncMap{"url_for": func(path string) string {
+		return base + path
+	}})
+	baseSets.sets[key] = baseSets.lru.PushFront(&baseSet{key: key, set: set})
+	for baseSets.lru.Len() > maxBaseTemplateSets {
+		oldest := baseSets.lru.Remove(baseSets.lru.Back()).(*baseSet)
+		delete(baseSets.sets, oldest.key)
+	}
+	return set
+}
+
+func themeHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(w, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if antiCSRF(w, r, session) {
+		return
+	}
+	name := r.FormValue("theme")
+	if name != "" && !validTheme(name) {
+		writeError(w, r, http.StatusBadRequest, "unknown theme", session)
+		return
+	}
+	if name == "" {
+		delete(session.Values, "theme")
+	} else {
+		session.Values["theme"] = name
+	}
+	addNotice(session, noticeSuccess, "The theme was changed.")
+	if err := session.Save(r, w); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/mypage", http.StatusFound)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"strings"
+)
+
+const (
+	updateAttachmentVariantsSQL = "UPDATE memo_attachments SET variants=? WHERE id=?"
+
+	// maxImagePixels keeps a small file that claims huge dimensions from
+	// being decoded.
+	maxImagePixels = 40 << 20
+	jpegQuality    = 85
+	// imageHeadBytes is how much of an image is read ahead for its EXIF
+	// orientation and dimensions.
+	imageHeadBytes = 128 << 10
+
+	// variantsNone marks an image that could not be decoded; it is
+	// served as a plain download.
+	variantsNone = "none"
+)
+
+// imageSizes are the sizes image attachments are kept in, each fitting a
+// square of Max pixels. Every size is encoded afresh, which drops the
+// EXIF data of the upload, such as where a photo was taken; until they
+// exist only the uploader can see the original.
+var imageSizes = []struct {
+	Name string
+	Max  int
+}{
+	{"inline", 480},
+	{"preview", 1024},
+	{"full", 2560},
+}
+
+type resizeJob struct {
+	AttachmentId int `json:"attachment_id"`
+}
+
+// resizable reports whether the sizes of an attachment of contentType can
+// be made; the standard library has no WebP decoder.
+func resizable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Sized reports whether the sizes of an image attachment are ready.
+func (a *Attachment) Sized() bool {
+	return resizable(a.ContentType) && a.Variants != "" && a.Variants != variantsNone
+}
+
+func (a *Attachment) SizePath(size string) string {
+	return a.Path() + "?size=" + size
+}
+
+func (a *Attachment) variantKey(size string) string {
+	return a.Key + "." + size
+}
+
+// variantType is the format the sizes are encoded in: JPEG for photos and
+// PNG, which keeps transparency, for the rest.
+func (a *Attachment) variantType() string {
+	if a.ContentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// blobKeys are the original and every size that may have been stored.
+func (a *Attachment) blobKeys() []string {
+	keys := []string{a.Key}
+	if resizable(a.ContentType) {
+		for _, s := range imageSizes {
+			keys = append(keys, a.variantKey(s.Name))
+		}
+	}
+	return keys
+}
+
+// blob picks what to serve user for ?size=: the size of a processed
+// image, "full" by default, or the file as uploaded. length is -1 when
+// not known.
+func (a *Attachment) blob(size string, user *User) (key, contentType string, length int, err error) {
+	if !resizable(a.ContentType) || a.Variants == variantsNone {
+		return a.Key, a.ContentType, a.Size, nil
+	}
+	if size == "" {
+		size = "full"
+	}
+	known := false
+	for _, s := range imageSizes {
+		known = known || s.Name == size
+	}
+	if !known {
+		return "", "", 0, notFoundError("")
+	}
+	if a.Sized() {
+		return a.variantKey(size), a.variantType(), -1, nil
+	}
+	if user == nil || user.Id != a.User {
+		return "", "", 0, notFoundError("the image is still being processed")
+	}
+	return a.Key, a.ContentType, a.Size, nil
+}
+
+// resizeAttachmentJob stores the sizes of an uploaded image and marks
+// them ready.
+func resizeAttachmentJob(payload json.RawMessage) error {
+	var job resizeJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	dbConn := <-dbConnPool
+	a, err := scanAttachment(dbConn.QueryRowContext(ctx, getAttachmentSQL, job.AttachmentId))
+	dbConnPool <- dbConn
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	variants, err := storeImageSizes(ctx, a)
+	if err != nil {
+		return err
+	}
+	dbConn = <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	_, err = execSQL(ctx, dbConn, updateAttachmentVariantsSQL, variants, a.Id)
+	return err
+}
+
+// storeImageSizes decodes a's file and puts each size in the blob store,
+// returning the attachment's new variants. Images that cannot be decoded
+// get variantsNone rather than an error, which would only be retried.
+func storeImageSizes(ctx context.Context, a *Attachment) (string, error) {
+	body, err := blobs.Get(ctx, a.Key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	br := bufio.NewReaderSize(body, imageHeadBytes)
+	head, _ := br.Peek(imageHeadBytes)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil || cfg.Width*cfg.Height > maxImagePixels {
+		log.Printf("attachment %d: not resizing: %dx%d %v", a.Id, cfg.Width, cfg.Height, err)
+		return variantsNone, nil
+	}
+	img, _, err := image.Decode(br)
+	if err != nil {
+		log.Printf("attachment %d: not resizing: %s", a.Id, err)
+		return variantsNone, nil
+	}
+	if a.ContentType == "image/jpeg" {
+		img = orient(img, jpegOrientation(head))
+	}
+
+	// Every size is scaled from one RGBA copy, 160 MB at maxImagePixels,
+	// and the decoded image can go once it is made.
+	rgba := toRGBA(img)
+	img = nil
+	names := make([]string, 0, len(imageSizes))
+	for _, s := range imageSizes {
+		var buf bytes.Buffer
+		fitted := fitImage(rgba, s.Max)
+		if a.variantType() == "image/jpeg" {
+			err = jpeg.Encode(&buf, fitted, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(&buf, fitted)
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := blobs.Put(ctx, a.variantKey(s.Name), &buf, int64(buf.Len()), a.variantType()); err != nil {
+			return "", err
+		}
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ","), nil
+}
+
+// toRGBA returns src as RGBA with its origin at 0,0, converting it only if
+// it isn't already. RGBA is premultiplied, so transparent pixels do not
+// darken their neighbours when fitImage averages them.
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	if rgba, ok := src.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	return rgba
+}
+
+// fitImage scales in down to fit a square of max pixels, averaging the
+// pixels each one covers. Smaller images are returned as they are.
+func fitImage(in *image.RGBA, max int) image.Image {
+	w, h := in.Bounds().Dx(), in.Bounds().Dy()
+	if w <= max && h <= max {
+		return in
+	}
+	dw, dh := max, h*max/w
+	if h > w {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			var sum [4]int
+			n := 0
+			for sy := y0; sy < y1; sy++ {
+				row := in.Pix[sy*in.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+					n++
+				}
+			}
+			p := out.Pix[y*out.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				p[c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return out
+}
+
+// orient turns src the way EXIF orientation o says it should be shown,
+// since the sizes carry no EXIF to tell the browser.
+func orient(src image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // turned a quarter clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // turned a quarter anticlockwise
+				dx, dy = y, w-1-x
+			}
+			out.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// jpegOrientation returns the EXIF orientation of the JPEG starting with
+// head, or 1 if it has none.
+func jpegOrientation(head []byte) int {
+	if len(head) < 4 || head[0] != 0xFF || head[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(head); {
+		if head[i] != 0xFF {
+			return 1
+		}
+		marker := head[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		n := int(binary.BigEndian.Uint16(head[i+2:]))
+		if n < 2 || i+2+n > len(head) {
+			return 1
+		}
+		if marker == 0xE1 {
+			if o := exifOrientation(head[i+4 : i+2+n]); o > 0 {
+				return o
+			}
+		}
+		i += 2 + n
+	}
+	return 1
+}
+
+// exifOrientation reads tag 0x0112 from the first IFD of an APP1 segment,
+// or returns 0.
+func exifOrientation(seg []byte) int {
+	if len(seg) < 14 || string(seg[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := seg[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// exifJPEG encodes a w×h JPEG with an APP1 segment holding orientation o
+// and some text standing in for private metadata.
+func exifJPEG(t *testing.T, w, h, o int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w/2; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = append(tiff, 0, 1) // one entry
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry, 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], uint16(o))
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "GPS 35.6812N 139.7671E"...)
+	seg := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(seg)+2))
+	app1 = append(app1, seg...)
+	b := buf.Bytes()
+	return append(append(append([]byte{}, b[:2]...), app1...), b[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	if o := jpegOrientation(exifJPEG(t, 8, 4, 6)); o != 6 {
+		t.Errorf("orientation = %d, want 6", o)
+	}
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil)
+	if o := jpegOrientation(plain.Bytes()); o != 1 {
+		t.Errorf("orientation without EXIF = %d, want 1", o)
+	}
+	if o := jpegOrientation([]byte("not a jpeg")); o != 1 {
+		t.Errorf("orientation of garbage = %d", o)
+	}
+}
+
+func TestFitImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	if b := fitImage(src, 480).Bounds(); b.Dx() != 480 || b.Dy() != 240 {
+		t.Errorf("fitted to %v, want 480x240", b)
+	}
+	if b := fitImage(src, 2560).Bounds(); b.Dx() != 1000 {
+		t.Errorf("small image scaled to %v", b)
+	}
+	if toRGBA(src) != src {
+		t.Errorf("an RGBA image was copied")
+	}
+	gray := image.NewGray(image.Rect(10, 10, 30, 20))
+	if rgba := toRGBA(gray); rgba.Bounds() != image.Rect(0, 0, 20, 10) {
+		t.Errorf("converted to %v, want 20x10 at the origin", rgba.Bounds())
+	}
+	// Turning a quarter swaps the sides.
+	turned := orient(src, 6)
+	if b := turned.Bounds(); b.Dx() != 500 || b.Dy() != 1000 {
+		t.Errorf("turned to %v, want 500x1000", b)
+	}
+}
+
+func TestStoreImageSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(b BlobStore) { blobs = b }(blobs)
+	blobs = &localBlobStore{dir: dir}
+
+	ctx := context.Background()
+	photo := exifJPEG(t, 1200, 600, 6)
+	a := &Attachment{Id: 1, Key: "memos/1/photo", ContentType: "image/jpeg"}
+	if err := blobs.Put(ctx, a.Key, bytes.NewReader(photo), int64(len(photo)), a.ContentType); err != nil {
+		t.Fatal(err)
+	}
+	variants, err := storeImageSizes(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants != "inline,preview,full" {
+		t.Fatalf("variants = %q", variants)
+	}
+	for _, s := range imageSizes {
+		r, err := blobs.Get(ctx, a.variantKey(s.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		if bytes.Contains(b, []byte("Exif")) || bytes.Contains(b, []byte("GPS")) {
+			t.Errorf("%s size kept the EXIF data", s.Name)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width > s.Max || cfg.Height > s.Max || cfg.Width > cfg.Height {
+			t.Errorf("%s size is %dx%d, want upright within %d", s.Name, cfg.Width, cfg.Height, s.Max)
+		}
+	}
+
+	junk := &Attachment{Id: 2, Key: "memos/1/junk", ContentType: "image/png"}
+	blobs.Put(ctx, junk.Key, strings.NewReader("\x89PNG\r\n\x1a\nnot really"), 18, junk.ContentType)
+	if variants, err := storeImageSizes(ctx, junk); err != nil || variants != variantsNone {
+		t.Errorf("undecodable image: %q, %v", variants, err)
+	}
+}
+
+func TestImageAttachment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(b BlobStore) { blobs = b }(blobs)
+	blobs = &localBlobStore{dir: dir}
+
+	app := startMemoryApp(t, memorySeed{Seed: 4, Users: 2, Memos: 5})
+	res := app.postMemo(t, url.Values{"content": {"# holiday\nthe view from the hotel"}, "visibility": {"public"}})
+	memoPage := res.Request.URL.Path
+	id := strings.SplitN(strings.TrimPrefix(memoPage, "/memo/"), "-", 2)[0]
+	app.upload(t, "/memo/"+id+"/attachments", "view.jpg", exifJPEG(t, 600, 300, 1))
+	link := regexp.MustCompile(`href="[^"]*(/attachments/([0-9]+))">view.jpg</a>`).FindStringSubmatch(app.get(t, memoPage))
+	if link == nil {
+		t.Fatalf("memo page does not list the image")
+	}
+
+	// Until the sizes are made, only the uploader sees the original.
+	res, err = http.Get(app.URL + link[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("unprocessed image served to others: %d", res.StatusCode)
+	}
+
+	attachmentId, _ := strconv.Atoi(link[2])
+	payload, _ := json.Marshal(&resizeJob{AttachmentId: attachmentId})
+	if err := resizeAttachmentJob(payload); err != nil {
+		t.Fatal(err)
+	}
+	if page := app.get(t, memoPage); !strings.Contains(page, link[1]+"?size=inline") {
+		t.Errorf("memo page does not show the inline size")
+	}
+	res, err = http.Get(app.URL + link[1] + "?size=inline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || bytes.Contains(b, []byte("GPS")) {
+		t.Errorf("inline size: %d, %d bytes", res.StatusCode, len(b))
+	}
+}
@@ -0,0 +1,269 @@
+// Command replay re-sends requests recorded by the app's record
+// middleware against a local instance and reports how the responses and
+// latencies compare with the recording.
+//
+//	go run ./tools/replay -target http://127.0.0.1:5000 /tmp/isucon_record.jsonl
+//
+// Each recorded client gets a cookie jar of its own, and CSRF tokens are
+// taken from the pages the replay gets back. Passwords are not recorded;
+// with -password-is-username a signin is replayed with the username as
+// the password, for datasets whose users were created that way.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorded mirrors the app's RecordedRequest.
+type recorded struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	URI         string    `json:"uri"`
+	Host        string    `json:"host"`
+	ContentType string    `json:"content_type"`
+	Body        string    `json:"body"`
+	BodySkipped bool      `json:"body_skipped"`
+	Client      string    `json:"client"`
+	SetsClient  string    `json:"sets_client"`
+	Status      int       `json:"status"`
+	DurationMs  float64   `json:"duration_ms"`
+}
+
+const redacted = "REDACTED"
+
+var sidPattern = regexp.MustCompile(`name="sid" value="([^"]*)"`)
+
+// client is one recorded browser: its cookies and latest CSRF token.
+type client struct {
+	sync.Mutex
+	http *http.Client
+	sid  string
+}
+
+func newClient() *client {
+	jar, _ := cookiejar.New(nil)
+	return &client{http: &http.Client{
+		Jar:     jar,
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+type result struct {
+	route    string
+	status   int
+	want     int
+	duration time.Duration
+	recorded time.Duration
+	err      error
+}
+
+func main() {
+	target := flag.String("target", "http://127.0.0.1:5000", "base URL of the instance to replay against")
+	speed := flag.Float64("speed", 0, "replay at this multiple of the recorded pace; 0 sends as fast as -concurrency allows")
+	concurrency := flag.Int("concurrency", 8, "requests in flight at once")
+	passwordIsUsername := flag.Bool("password-is-username", false, "sign in with the username as the password")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: replay [flags] recording.jsonl")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	base, err := url.Parse(*target)
+	if err != nil {
+		log.Fatal(err)
+	}
+	requests, err := readRecording(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		clients = make(map[string]*client)
+		results []result
+		wg      sync.WaitGroup
+		slots   = make(chan struct{}, *concurrency)
+	)
+	clientFor := func(key string) *client {
+		mu.Lock()
+		defer mu.Unlock()
+		if key == "" {
+			return newClient()
+		}
+		if clients[key] == nil {
+			clients[key] = newClient()
+		}
+		return clients[key]
+	}
+
+	start := time.Now()
+	for _, req := range requests {
+		if *speed > 0 {
+			offset := time.Duration(float64(req.Time.Sub(requests[0].Time)) / *speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+		if req.BodySkipped {
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(req *recorded) {
+			defer func() { <-slots; wg.Done() }()
+			c := clientFor(req.Client)
+			res := send(c, base, req, *passwordIsUsername)
+			if req.SetsClient != "" {
+				mu.Lock()
+				clients[req.SetsClient] = c
+				mu.Unlock()
+			}
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}(req)
+	}
+	wg.Wait()
+	report(results, time.Since(start))
+}
+
+func readRecording(path string) ([]*recorded, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var requests []*recorded
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<20), 1<<20)
+	for scanner.Scan() {
+		req := &recorded{}
+		if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].Time.Before(requests[j].Time) })
+	return requests, scanner.Err()
+}
+
+// send replays one request as c. Requests of one client are sent one at
+// a time so that its cookies and token follow the recorded order.
+func send(c *client, base *url.URL, req *recorded, passwordIsUsername bool) result {
+	c.Lock()
+	defer c.Unlock()
+	res := result{route: req.Method + " " + routeOf(req.URI), want: req.Status, recorded: time.Duration(req.DurationMs * float64(time.Millisecond))}
+
+	body := req.Body
+	if body != "" {
+		values, _ := url.ParseQuery(body)
+		if values.Get("sid") == redacted {
+			values.Set("sid", c.sid)
+		}
+		if values.Get("password") == redacted && passwordIsUsername {
+			values.Set("password", values.Get("username"))
+		}
+		body = values.Encode()
+	}
+	u, err := base.Parse(req.URI)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	r, err := http.NewRequest(req.Method, u.String(), strings.NewReader(body))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if req.ContentType != "" {
+		r.Header.Set("Content-Type", req.ContentType)
+	}
+	start := time.Now()
+	resp, err := c.http.Do(r)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	res.duration = time.Since(start)
+	res.status = resp.StatusCode
+	if m := sidPattern.FindSubmatch(page); m != nil {
+		c.sid = string(m[1])
+	}
+	return res
+}
+
+var idPattern = regexp.MustCompile(`/[0-9]+(/|$)`)
+
+// routeOf groups paths the way the app's routes do, well enough for a
+// report.
+func routeOf(uri string) string {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	if strings.HasPrefix(uri, "/css/") || strings.HasPrefix(uri, "/js/") || strings.HasPrefix(uri, "/img/") {
+		return "static"
+	}
+	for idPattern.MatchString(uri) {
+		uri = idPattern.ReplaceAllString(uri, "/{id}$1")
+	}
+	return uri
+}
+
+func report(results []result, elapsed time.Duration) {
+	byRoute := make(map[string][]result)
+	failed, mismatched := 0, 0
+	for _, res := range results {
+		if res.err != nil {
+			failed++
+			continue
+		}
+		if res.status != res.want {
+			mismatched++
+		}
+		byRoute[res.route] = append(byRoute[res.route], res)
+	}
+	routes := make([]string, 0, len(byRoute))
+	for route := range byRoute {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Printf("%d requests in %s: %d failed, %d with a different status\n\n", len(results), elapsed.Round(time.Millisecond), failed, mismatched)
+	fmt.Printf("%-40s %6s %10s %10s %10s %10s %6s\n", "route", "count", "p50", "p99", "rec p50", "rec p99", "status")
+	for _, route := range routes {
+		rs := byRoute[route]
+		got := make([]time.Duration, len(rs))
+		rec := make([]time.Duration, len(rs))
+		diff := 0
+		for i, res := range rs {
+			got[i], rec[i] = res.duration, res.recorded
+			if res.status != res.want {
+				diff++
+			}
+		}
+		fmt.Printf("%-40s %6d %10s %10s %10s %10s %6d\n", route, len(rs),
+			percentile(got, 50), percentile(got, 99), percentile(rec, 50), percentile(rec, 99), diff)
+	}
+}
+
+func percentile(ds []time.Duration, p int) time.Duration {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return ds[(len(ds)-1)*p/100].Round(10 * time.Microsecond)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultServiceName = "isucon3-go"
+
+type TracingConfig struct {
+	Endpoint    string  `json:"endpoint"`
+	Insecure    bool    `json:"insecure"`
+	ServiceName string  `json:"service_name"`
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+var tracer = otel.Tracer("github.com/nise-nabe/isucon2013-go")
+
+// initTracing installs an OTLP/HTTP exporter. Without an endpoint the
+// global no-op provider stays in place and spans cost next to nothing.
+func initTracing(c TracingConfig) error {
+	if c.Endpoint == "" {
+		return nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+	if c.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	name := c.ServiceName
+	if name == "" {
+		name = defaultServiceName
+	}
+	ratio := c.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", name))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	))
+	return nil
+}
+
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(r.Context(), r.Method+" "+routeName(r),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.RequestURI()),
+				attribute.String("http.scheme", requestScheme(r)),
+				attribute.String("http.client_ip", clientIP(r)),
+			),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", sw.Status()))
+		if sw.Status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.Status()))
+		}
+	})
+}
+
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, name)
+	if info := requestInfoFrom(ctx); info != nil && info.timings != nil {
+		if phase := spanPhase(name); phase >= 0 {
+			return ctx, &timedSpan{Span: span, timings: info.timings, phase: phase, start: time.Now()}
+		}
+	}
+	return ctx, span
+}
+
+// timedSpan also adds its duration to the request's phase timings.
+type timedSpan struct {
+	trace.Span
+	timings *phaseTimings
+	phase   int
+	start   time.Time
+}
+
+func (s *timedSpan) End(options ...trace.SpanEndOption) {
+	s.timings.add(s.phase, time.Since(s.start))
+	s.Span.End(options...)
+}
+
+// sqlSpan times a single statement for both tracing and the slow log.
+type sqlSpan struct {
+	trace.Span
+	ctx   context.Context
+	query string
+	args  []interface{}
+	start time.Time
+}
+
+func startSQLSpan(ctx context.Context, query string, args ...interface{}) (context.Context, *sqlSpan) {
+	ctx, span := tracer.Start(ctx, "sql",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mysql"),
+			attribute.String("db.statement", query),
+		),
+	)
+	return ctx, &sqlSpan{Span: span, ctx: ctx, query: query, args: args, start: time.Now()}
+}
+
+func (s *sqlSpan) Finish(err error) {
+	endSpan(s.Span, err)
+	d := time.Since(s.start)
+	if info := requestInfoFrom(s.ctx); info != nil && info.timings != nil {
+		info.timings.add(phaseDB, d)
+	}
+	recordSlowQuery(s.ctx, s.query, s.args, d)
+}
+
+// endSpan records err, if any, before ending the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
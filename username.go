@@ -0,0 +1,53 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	usernameMinLen = 3
+	usernameMaxLen = 20
+)
+
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// reservedUsernames can't be taken by anyone: they name routes and
+// static paths, or would pass for the site itself.
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "root": true, "isucon": true,
+	"api": true, "archive": true, "css": true, "emoji": true, "follow": true,
+	"img": true, "js": true, "memo": true, "mypage": true, "popular": true,
+	"recent": true, "reset": true, "signin": true, "signout": true,
+	"signup": true, "static": true, "theme": true, "timeline": true,
+	"unfollow": true, "user": true,
+}
+
+// validateUsername checks a username chosen at signup. Existing accounts
+// are not held to it. The message is meant to be shown next to the field.
+func validateUsername(name string) error {
+	switch n := utf8.RuneCountInString(name); {
+	case n < usernameMinLen:
+		return validationError("Usernames need at least 3 characters.")
+	case n > usernameMaxLen:
+		return validationError("Usernames can be at most 20 characters.")
+	}
+	if !usernameRe.MatchString(name) {
+		return validationError("Usernames may only contain letters, digits and underscores.")
+	}
+	if reservedUsernames[strings.ToLower(name)] {
+		return validationError("That username is reserved.")
+	}
+	if usernameTaken(name) {
+		return conflictError("That username is already taken.")
+	}
+	return nil
+}
+
+// usernameTaken checks the cached users. The unique index on
+// users.username catches signups that race each other or another process.
+func usernameTaken(name string) bool {
+	_, ok := userCache.GetByName(name)
+	return ok
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestValidateUsername(t *testing.T) {
+	userCache.Put(&User{Id: 901, Username: "Taken_Name"})
+	defer userCache.Remove(901)
+
+	tests := []struct {
+		name string
+		kind ErrorKind
+		ok   bool
+	}{
+		{"isucon_fan", 0, true},
+		{"ab", KindValidation, false},
+		{"abcdefghijklmnopqrstu", KindValidation, false},
+		{"no spaces", KindValidation, false},
+		{"ユーザー名", KindValidation, false},
+		{"Admin", KindValidation, false},
+		{"api", KindValidation, false},
+		{"taken_name", KindConflict, false},
+	}
+	for _, tt := range tests {
+		err := validateUsername(tt.name)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("validateUsername(%q) = %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || errorKind(err) != tt.kind {
+			t.Errorf("validateUsername(%q) = %v, want kind %d", tt.name, err, tt.kind)
+		}
+	}
+}
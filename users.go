@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const unknownUsername = "(unknown)"
+
+// UserCache is the in-memory copy of the users table. Entries are added or
+// updated as users sign in and the whole table is periodically reconciled
+// against the database (the user_reconcile task) so rows written by other
+// processes show up too. Users are indexed by id and by username, folded
+// to lower case as the column's collation compares them; both maps are
+// only touched under the lock.
+type UserCache struct {
+	hits   int64
+	misses int64
+	sync.RWMutex
+	users  map[int]*User
+	byName map[string]*User
+}
+
+func NewUserCache() *UserCache {
+	return &UserCache{users: make(map[int]*User), byName: make(map[string]*User)}
+}
+
+func usernameKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// GetByName finds a user by username, ignoring case.
+func (c *UserCache) GetByName(name string) (*User, bool) {
+	c.RLock()
+	user, ok := c.byName[usernameKey(name)]
+	c.RUnlock()
+	return user, ok
+}
+
+func (c *UserCache) Get(id int) (*User, bool) {
+	c.RLock()
+	user, ok := c.users[id]
+	c.RUnlock()
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return user, ok
+}
+
+func (c *UserCache) Stats() CacheStats {
+	return CacheStats{
+		Name:    "user",
+		Hits:    atomic.LoadInt64(&c.hits),
+		Misses:  atomic.LoadInt64(&c.misses),
+		Entries: c.Len(),
+	}
+}
+
+func (c *UserCache) Username(id int) string {
+	if user, ok := c.Get(id); ok {
+		return user.Username
+	}
+	return unknownUsername
+}
+
+func (c *UserCache) Put(user *User) {
+	c.Lock()
+	if old, ok := c.users[user.Id]; ok {
+		delete(c.byName, usernameKey(old.Username))
+	}
+	c.users[user.Id] = user
+	c.byName[usernameKey(user.Username)] = user
+	c.Unlock()
+}
+
+func (c *UserCache) Remove(id int) {
+	c.Lock()
+	if old, ok := c.users[id]; ok {
+		delete(c.byName, usernameKey(old.Username))
+	}
+	delete(c.users, id)
+	c.Unlock()
+}
+
+// All returns the cached users in no particular order.
+func (c *UserCache) All() []*User {
+	c.RLock()
+	defer c.RUnlock()
+	users := make([]*User, 0, len(c.users))
+	for _, user := range c.users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// Replace swaps in the contents of src.
+func (c *UserCache) Replace(src *UserCache) {
+	src.RLock()
+	users, byName := src.users, src.byName
+	src.RUnlock()
+	c.Lock()
+	c.users, c.byName = users, byName
+	c.Unlock()
+}
+
+func (c *UserCache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.users)
+}
+
+// Reload replaces the cached users with the current contents of the users
+// table, dropping entries whose rows no longer exist.
+func (c *UserCache) Reload(dbConn *sql.DB) error {
+	rows, err := dbConn.Query("SELECT id, username, password, salt, last_access FROM users")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	users := NewUserCache()
+	for rows.Next() {
+		user := &User{}
+		var lastAccess sql.NullString
+		if err := rows.Scan(&user.Id, &user.Username, &user.Password, &user.Salt, &lastAccess); err != nil {
+			return err
+		}
+		user.LastAccess = lastAccess.String
+		users.Put(user)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := loadPreferences(dbConn, users); err != nil {
+		return err
+	}
+	c.Replace(users)
+	return nil
+}
+
+type lastAccessJob struct {
+	UserId int `json:"user_id"`
+}
+
+// updateLastAccessJob records a sign-in outside the request so that the
+// redirect doesn't wait on the write.
+func updateLastAccessJob(payload json.RawMessage) error {
+	var job lastAccessJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return err
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	if _, err := execSQL(context.Background(), dbConn, "UPDATE users SET last_access=now() WHERE id=?", job.UserId); err != nil {
+		return err
+	}
+	// Cached users are shared by concurrent requests, so put a copy.
+	if user, ok := userCache.Get(job.UserId); ok {
+		updated := *user
+		updated.LastAccess = formatDBTime(time.Now())
+		userCache.Put(&updated)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUserCacheByName(t *testing.T) {
+	c := NewUserCache()
+	c.Put(&User{Id: 1, Username: "Isucon1"})
+	if user, ok := c.GetByName("isucon1"); !ok || user.Id != 1 {
+		t.Fatalf("GetByName(isucon1) = %v, %v", user, ok)
+	}
+
+	c.Put(&User{Id: 1, Username: "renamed"})
+	if _, ok := c.GetByName("isucon1"); ok {
+		t.Errorf("old username still resolves after a rename")
+	}
+	if user, ok := c.GetByName("RENAMED"); !ok || user.Id != 1 {
+		t.Errorf("GetByName(RENAMED) = %v, %v", user, ok)
+	}
+
+	c.Remove(1)
+	if _, ok := c.GetByName("renamed"); ok {
+		t.Errorf("removed user still resolves by name")
+	}
+
+	src := NewUserCache()
+	src.Put(&User{Id: 2, Username: "isucon2"})
+	c.Replace(src)
+	if user, ok := c.GetByName("isucon2"); !ok || user.Id != 2 {
+		t.Errorf("GetByName after Replace = %v, %v", user, ok)
+	}
+}
+
+// TestLastAccessJob checks that a sign-in's last access reaches the
+// cached user, not just the users table.
+func TestLastAccessJob(t *testing.T) {
+	startMemoryApp(t, memorySeed{Seed: 2, Users: 3, Memos: 1})
+	user, _ := userCache.Get(2)
+	stale := *user
+	stale.LastAccess = ""
+	userCache.Put(&stale)
+
+	if err := updateLastAccessJob(json.RawMessage(`{"user_id": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := userCache.Get(2); user.LastAccess == "" {
+		t.Errorf("cached user has no last access")
+	}
+	if stale.LastAccess != "" {
+		t.Errorf("the cached user was changed in place")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"./sessions"
+)
+
+// visitorCounter counts each visitor once per memo per day. Visitors are
+// only ever added to HyperLogLog sketches, so who viewed a memo is not
+// recorded anywhere. Only today's sketches are kept in memory; earlier
+// days are folded into per-memo totals.
+type visitorCounter struct {
+	sync.Mutex
+	day      string
+	today    map[int]*hyperLogLog
+	dirty    map[int]bool
+	totals   map[int]int
+	finished []visitorRow
+}
+
+// visitorRow is one memo's sketch for one day as stored in memo_visitors.
+type visitorRow struct {
+	memoId   int
+	day      string
+	sketch   hyperLogLog
+	visitors int
+}
+
+var memoVisitors = newVisitorCounter()
+
+func newVisitorCounter() *visitorCounter {
+	return &visitorCounter{
+		day:    visitorDay(time.Now()),
+		today:  make(map[int]*hyperLogLog),
+		dirty:  make(map[int]bool),
+		totals: make(map[int]int),
+	}
+}
+
+func visitorDay(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// visitorKey identifies the viewer of a request: the user when signed in,
+// otherwise the session, otherwise the client address.
+func visitorKey(r *http.Request, user *User, session *sessions.Session) string {
+	switch {
+	case user != nil:
+		return "u:" + strconv.Itoa(user.Id)
+	case session != nil && session.ID != "":
+		return "s:" + session.ID
+	}
+	return "ip:" + clientIP(r)
+}
+
+// rollover moves to day, keeping the previous day's unsaved sketches for
+// the next flush. The caller holds the lock.
+func (c *visitorCounter) rollover(day string) {
+	if day == c.day {
+		return
+	}
+	for id, h := range c.today {
+		n := h.Estimate()
+		c.totals[id] += n
+		if c.dirty[id] {
+			c.finished = append(c.finished, visitorRow{memoId: id, day: c.day, sketch: *h, visitors: n})
+		}
+	}
+	c.day = day
+	c.today = make(map[int]*hyperLogLog)
+	c.dirty = make(map[int]bool)
+}
+
+func (c *visitorCounter) Add(memoId int, visitor string) {
+	c.Lock()
+	defer c.Unlock()
+	c.rollover(visitorDay(time.Now()))
+	h, ok := c.today[memoId]
+	if !ok {
+		h = &hyperLogLog{}
+		c.today[memoId] = h
+	}
+	h.Add(hllHash(visitor))
+	c.dirty[memoId] = true
+}
+
+// Count returns the memo's views counting each visitor once per day.
+func (c *visitorCounter) Count(memoId int) int {
+	c.Lock()
+	defer c.Unlock()
+	c.rollover(visitorDay(time.Now()))
+	n := c.totals[memoId]
+	if h, ok := c.today[memoId]; ok {
+		n += h.Estimate()
+	}
+	return n
+}
+
+// take returns the rows changed since the last call.
+func (c *visitorCounter) take() []visitorRow {
+	c.Lock()
+	defer c.Unlock()
+	c.rollover(visitorDay(time.Now()))
+	rows := c.finished
+	c.finished = nil
+	for id := range c.dirty {
+		h := c.today[id]
+		rows = append(rows, visitorRow{memoId: id, day: c.day, sketch: *h, visitors: h.Estimate()})
+	}
+	c.dirty = make(map[int]bool)
+	return rows
+}
+
+// requeue marks rows that failed to save so the next flush retries them.
+func (c *visitorCounter) requeue(rows []visitorRow) {
+	c.Lock()
+	defer c.Unlock()
+	for _, row := range rows {
+		if row.day == c.day {
+			c.dirty[row.memoId] = true
+		} else {
+			c.finished = append(c.finished, row)
+		}
+	}
+}
+
+// Load replaces the counter's state with what was saved in memo_visitors.
+func (c *visitorCounter) Load(dbConn *sql.DB) error {
+	day := visitorDay(time.Now())
+	rows, err := dbConn.Query("SELECT memo_id, DATE_FORMAT(day, '%Y-%m-%d'), registers, visitors FROM memo_visitors")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	loaded := newVisitorCounter()
+	loaded.day = day
+	for rows.Next() {
+		var memoId, visitors int
+		var rowDay string
+		var registers []byte
+		if err := rows.Scan(&memoId, &rowDay, &registers, &visitors); err != nil {
+			return err
+		}
+		if rowDay != day {
+			loaded.totals[memoId] += visitors
+			continue
+		}
+		h := &hyperLogLog{}
+		copy(h[:], registers)
+		loaded.today[memoId] = h
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.day, c.today, c.dirty, c.totals, c.finished = loaded.day, loaded.today, loaded.dirty, loaded.totals, nil
+	c.Unlock()
+	return nil
+}
+
+func flushVisitorsTask() error {
+	rows := memoVisitors.take()
+	if len(rows) == 0 {
+		return nil
+	}
+	dbConn := <-dbConnPool
+	defer func() {
+		dbConnPool <- dbConn
+	}()
+	for i, row := range rows {
+		_, err := execSQL(context.Background(), dbConn,
+			"INSERT INTO memo_visitors (memo_id, day, registers, visitors) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE registers=VALUES(registers), visitors=VALUES(visitors)",
+			row.memoId, row.day, row.sketch[:], row.visitors,
+		)
+		if err != nil {
+			memoVisitors.requeue(rows[i:])
+			return err
+		}
+	}
+	return nil
+}